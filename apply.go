@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bspxmgr"
+	"github.com/spf13/cobra"
+)
+
+var applyCmd = &cobra.Command{
+	Use:   "apply <map> <manifest>",
+	Short: "Apply the operations of a JSON or YAML manifest to a map",
+	Long: `Apply the set, unset, rename and entity operations listed in a JSON
+manifest to a map in one rewrite, e.g.
+
+  {"operations": [
+    {"op": "set", "lump": "RGBLIGHTING", "path": "skull.lit2"},
+    {"op": "unset", "lump": "LMSHIFT"},
+    {"op": "rename", "lump": "MVDSV_PHYSICSNORMAL", "to": "MVDSV_PHYSICSNORMALS"},
+    {"op": "entity", "match": {"classname": "worldspawn"},
+     "set": {"message": "Skull"}, "delete": ["_wad"]}
+  ]}
+
+or in YAML for manifests named .yaml or .yml:
+
+  operations:
+    - op: set
+      lump: RGBLIGHTING
+      path: skull.lit2
+    - op: entity
+      match: {classname: worldspawn}
+      set: {message: Skull}
+
+Paths are relative to the manifest. Entity keys and values can't contain
+quotes or newlines. If any operation fails, e.g. an entity operation matching
+no entity, no map is written.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		manifest, err := bspxmgr.ReadManifest(args[1])
+		if err != nil {
+			return err
+		}
+
+		destName, err := bspxmgr.Apply(cmd.Context(), bspxmgr.ApplyOptions{Map: args[0], Manifest: manifest})
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		fmt.Printf("Applied %d operations from %s, wrote %s\n", len(manifest.Operations), args[1], destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
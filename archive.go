@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// MapFile is a map opened with OpenMapFile, either a plain file or a copy of
+// a map read from an archive.
+type MapFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// archivedMap is a map read from an archive into memory.
+type archivedMap struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (m archivedMap) Stat() (fs.FileInfo, error) { return m.info, nil }
+func (m archivedMap) Close() error               { return nil }
+
+// splitArchivePath splits a path going through a .pak, .pk3 or .zip archive,
+// like id1/pak0.pak/maps/e1m1.bsp, into the archive and the path inside it.
+// The archive is empty for other paths.
+func splitArchivePath(name string) (string, string) {
+	parts := strings.Split(filepath.ToSlash(name), "/")
+	for i := 0; i < len(parts)-1; i++ {
+		switch strings.ToLower(path.Ext(parts[i])) {
+		case ".pak", ".pk3", ".zip":
+			archive := filepath.FromSlash(strings.Join(parts[:i+1], "/"))
+			if info, err := os.Stat(archive); err == nil && info.Mode().IsRegular() {
+				return archive, strings.Join(parts[i+1:], "/")
+			}
+		}
+	}
+	return "", ""
+}
+
+// OpenMapFile opens a map file, or a map inside an archive when the path goes
+// through one.
+func OpenMapFile(name string) (MapFile, error) {
+	archive, member := splitArchivePath(name)
+	if archive == "" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var fsys fs.FS
+	if strings.EqualFold(filepath.Ext(archive), ".pak") {
+		fsys, err = bsp.OpenPak(f)
+	} else {
+		fsys, err = zip.NewReader(f, info.Size())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+
+	Debugf("reading %s from %s", member, archive)
+	data, err := fs.ReadFile(fsys, member)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	info, err = fs.Stat(fsys, member)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+	return archivedMap{bytes.NewReader(data), info}, nil
+}
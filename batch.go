@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var batchRecursive bool
+var batchOutput string
+
+// FindMaps expands the arguments of batch into map paths: glob patterns are
+// matched, directories are searched for .bsp files, recursively if set, and
+// anything else is taken as it is. Each map is listed once.
+func FindMaps(patterns []string, recursive bool) ([]string, error) {
+	var maps []string
+	seen := map[string]bool{}
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			maps = append(maps, path)
+		}
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil || !info.IsDir() {
+				add(match)
+				continue
+			}
+			var found []string
+			err = filepath.WalkDir(match, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if d.IsDir() && path != match && !recursive {
+					return filepath.SkipDir
+				}
+				if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".bsp") && !strings.HasSuffix(strings.ToLower(path), ".new.bsp") {
+					found = append(found, path)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			sort.Strings(found)
+			for _, path := range found {
+				add(path)
+			}
+		}
+	}
+	return maps, nil
+}
+
+// BatchOutputName expands an output template for a map: {dir} is the
+// directory of the map and {name} its name without extension.
+func BatchOutputName(template string, mapPath string) string {
+	name := strings.TrimSuffix(filepath.Base(mapPath), filepath.Ext(mapPath))
+	return strings.NewReplacer("{dir}", filepath.Dir(mapPath), "{name}", name).Replace(template)
+}
+
+// BatchResult is a line of the summary batch prints.
+type BatchResult struct {
+	Map      string
+	ExitCode int
+	Output   string
+	Duration time.Duration
+}
+
+// persistentFlagArgs returns the global flags set on the command line, such
+// as --timeout, --profile or -v, for passing them on to the commands run.
+func persistentFlagArgs(cmd *cobra.Command) []string {
+	var args []string
+	for _, name := range []string{"config", "profile", "timeout", "verbose", "quiet", "log-format"} {
+		if f := cmd.Flags().Lookup(name); f != nil && f.Changed {
+			args = append(args, "--"+name+"="+f.Value.String())
+		}
+	}
+	return args
+}
+
+// runBatchCommand runs bspxmgr with args for one map, {} in args standing for
+// the map and the map appended if there is none. A map written to
+// <map>.new.bsp is moved to the output template if one is given.
+func runBatchCommand(cmd *cobra.Command, executable string, args []string, mapPath string) (BatchResult, error) {
+	result := BatchResult{Map: mapPath}
+	var commandArgs []string
+	substituted := false
+	for _, arg := range args {
+		if strings.Contains(arg, "{}") {
+			substituted = true
+		}
+		commandArgs = append(commandArgs, strings.ReplaceAll(arg, "{}", mapPath))
+	}
+	if !substituted {
+		commandArgs = append(commandArgs, mapPath)
+	}
+	commandArgs = append(persistentFlagArgs(cmd), commandArgs...)
+
+	newName := strings.TrimSuffix(mapPath, filepath.Ext(mapPath)) + ".new.bsp"
+	before := stampFiles([]string{newName})
+	start := time.Now()
+	child := exec.CommandContext(cmd.Context(), executable, commandArgs...)
+	child.Stdin, child.Stdout, child.Stderr = nil, os.Stdout, os.Stderr
+	err := child.Run()
+	result.Duration = time.Since(start)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		result.ExitCode = exitErr.ExitCode()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+
+	after := stampFiles([]string{newName})
+	if after[0] == (fileStamp{}) || sameStamps(before, after) {
+		return result, nil
+	}
+	result.Output = newName
+	if batchOutput == "" {
+		return result, nil
+	}
+	result.Output = BatchOutputName(batchOutput, mapPath)
+	if err := os.MkdirAll(filepath.Dir(result.Output), 0755); err != nil {
+		return result, err
+	}
+	return result, os.Rename(newName, result.Output)
+}
+
+var batchCmd = &cobra.Command{
+	Use:   "batch <map|dir|glob>... -- <command> [args]",
+	Short: "Run a command for every map of directories or glob patterns",
+	Long: `Run a bspxmgr command once per map and print a summary of the results.
+Directories are searched for .bsp files, with --recursive also their
+subdirectories, skipping .new.bsp files. In the command arguments {} stands
+for the map, without {} the map is added as the last argument, e.g.
+
+  bspxmgr batch --recursive maps/ -- checksum
+  bspxmgr batch 'maps/ctf*.bsp' -- set {} LMSHIFT ctf.lms
+
+Maps the command writes to <map>.new.bsp are moved to --output, in which
+{dir} is the directory of the map and {name} its name without extension.
+Global flags such as --timeout, --profile and -v given to batch are passed on
+to the command. Exits non-zero if the command failed for any map.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		if dash < 1 || dash == len(args) {
+			return errors.New("expected maps, -- and a command")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dash := cmd.ArgsLenAtDash()
+		maps, err := FindMaps(args[:dash], batchRecursive)
+		if err != nil {
+			return err
+		}
+		if len(maps) == 0 {
+			return errors.New("no maps found")
+		}
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+
+		var results []BatchResult
+		failed := 0
+		for _, mapPath := range maps {
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+			fmt.Printf("==> %s <==\n", mapPath)
+			result, err := runBatchCommand(cmd, executable, args[dash:], mapPath)
+			if err != nil {
+				Warnf("%s: %s", mapPath, err)
+				if result.ExitCode == 0 {
+					result.ExitCode = ExitCode(err)
+				}
+			}
+			if result.ExitCode != 0 {
+				failed++
+			}
+			results = append(results, result)
+		}
+
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "MAP\tSTATUS\tOUTPUT\tTIME")
+		for _, result := range results {
+			status := "ok"
+			if result.ExitCode != 0 {
+				status = fmt.Sprintf("failed (%d)", result.ExitCode)
+			}
+			output := result.Output
+			if output == "" {
+				output = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", result.Map, status, output, result.Duration.Round(time.Millisecond))
+		}
+		w.Flush()
+
+		if failed > 0 {
+			return fmt.Errorf("command failed for %d of %d maps", failed, len(maps))
+		}
+		return nil
+	},
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+type BenchResult struct {
+	Name       string
+	Iterations int
+	Elapsed    time.Duration
+	Bytes      int64
+	Allocs     uint64
+	AllocBytes uint64
+}
+
+func (r BenchResult) String() string {
+	perOp := r.Elapsed / time.Duration(r.Iterations)
+	throughput := float64(r.Bytes) * float64(r.Iterations) / r.Elapsed.Seconds() / (1 << 20)
+	return fmt.Sprintf("%-10s %12s/op %9.1f MB/s %12d B/op %9d allocs/op", r.Name, perOp, throughput,
+		r.AllocBytes/uint64(r.Iterations), r.Allocs/uint64(r.Iterations))
+}
+
+// Bench runs fn the given number of times and measures the time taken and
+// the memory allocated, bytes being the amount of map data one run handles.
+func Bench(name string, iterations int, bytes int64, fn func() error) (BenchResult, error) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	for i := 0; i < iterations; i++ {
+		if err := fn(); err != nil {
+			return BenchResult{}, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	return BenchResult{
+		Name:       name,
+		Iterations: iterations,
+		Elapsed:    elapsed,
+		Bytes:      bytes,
+		Allocs:     after.Mallocs - before.Mallocs,
+		AllocBytes: after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+var benchIterations int
+
+var benchCmd = &cobra.Command{
+	Use:   "bench <map>",
+	Short: "Measure parse, validate and rewrite throughput",
+	Long: `Repeatedly parse, validate and rewrite a map and print the time, throughput
+and memory allocated per run of each step. The rewrite decodes and re-encodes
+all geometry and writes the map to a temporary file that is removed again.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if benchIterations < 1 {
+			return fmt.Errorf("iterations must be at least 1")
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		tmp, err := os.MkdirTemp("", "bspxmgr-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		destName := filepath.Join(tmp, filepath.Base(args[0]))
+
+		steps := []struct {
+			name string
+			fn   func() error
+		}{
+			{"parse", func() error {
+				bspFile, err := bsp.ReadBspFile(f)
+				if err != nil {
+					return err
+				}
+				_, err = readMapData(&bspFile, f)
+				return err
+			}},
+			{"validate", func() error {
+				bspFile, err := bsp.ReadBspFile(f)
+				if err != nil {
+					return err
+				}
+				_, err = ValidateMap(&bspFile, f, ValidateOptions{})
+				return err
+			}},
+			{"rewrite", func() error {
+				bspFile, err := bsp.ReadBspFile(f)
+				if err != nil {
+					return err
+				}
+				data, err := readMapData(&bspFile, f)
+				if err != nil {
+					return err
+				}
+				return bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+					data.encodeGeometry(lumps)
+					var err error
+					lumps[bsp.LumpEntities], err = bsp.FormatEntities(data.entities)
+					return err
+				})
+			}},
+		}
+
+		fmt.Printf("%s: %d bytes, %d iterations, %s %s/%s\n", args[0], info.Size(), benchIterations, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		for _, step := range steps {
+			result, err := Bench(step.name, benchIterations, info.Size(), step.fn)
+			if err != nil {
+				return err
+			}
+			fmt.Println(result)
+		}
+
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		fmt.Printf("heap reserved %.1f MB, %d GC cycles\n", float64(stats.HeapSys)/(1<<20), stats.NumGC)
+		return nil
+	},
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// browseLump is a standard or BSPX lump as listed by the browser. Standard
+// lumps come first, in header order, followed by the BSPX lumps.
+type browseLump struct {
+	Name     string
+	Standard bool
+	Type     bsp.LumpType
+	Offset   uint32
+	Length   uint32
+}
+
+type browser struct {
+	f        *os.File
+	bspFile  bsp.BspFile
+	lumps    []browseLump
+	out      io.Writer
+	pageSize int
+
+	current *browseLump
+	lines   []string
+	page    int
+}
+
+func newBrowser(f *os.File, out io.Writer, pageSize int) (*browser, error) {
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	b := &browser{f: f, bspFile: bspFile, out: out, pageSize: pageSize}
+	for i, lump := range b.bspFile.BspHeader.Lumps {
+		b.lumps = append(b.lumps, browseLump{bsp.LumpType(i).String(), true, bsp.LumpType(i), lump.Offset, lump.Length})
+	}
+	for _, xlump := range b.bspFile.BspXLumps {
+		b.lumps = append(b.lumps, browseLump{bsp.BytesToString(xlump.LumpName[:]), false, 0, xlump.Offset, xlump.Length})
+	}
+	return b, nil
+}
+
+func (b *browser) find(arg string) *browseLump {
+	if index, err := strconv.Atoi(arg); err == nil {
+		if index >= 0 && index < len(b.lumps) {
+			return &b.lumps[index]
+		}
+		return nil
+	}
+	for i := range b.lumps {
+		if strings.EqualFold(b.lumps[i].Name, arg) {
+			return &b.lumps[i]
+		}
+	}
+	return nil
+}
+
+func (b *browser) read(lump *browseLump) ([]byte, error) {
+	buffer := make([]byte, lump.Length)
+	_, err := b.f.ReadAt(buffer, int64(lump.Offset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+func (b *browser) listLumps() {
+	fmt.Fprintf(b.out, "%s, version %s\n", b.f.Name(), b.bspFile.BspHeader.Version)
+	for i, lump := range b.lumps {
+		kind := "bsp "
+		if !lump.Standard {
+			kind = "bspx"
+		}
+		fmt.Fprintf(b.out, "  %3d %s %-24s %10d bytes @ %8d\n", i, kind, lump.Name, lump.Length, lump.Offset)
+	}
+}
+
+// decode renders the lines shown for a lump: decoded records for the lumps
+// the browser understands, a hex dump for everything else.
+func (b *browser) decode(lump *browseLump) ([]string, error) {
+	data, err := b.read(lump)
+	if err != nil {
+		return nil, err
+	}
+	if !lump.Standard {
+		return HexDumpLines(data, 0), nil
+	}
+
+	switch lump.Type {
+	case bsp.LumpEntities:
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for i := range entities {
+			lines = append(lines, fmt.Sprintf("#%d {", i))
+			for _, kv := range entities[i].Pairs {
+				lines = append(lines, fmt.Sprintf("  %q %q", kv.Key, kv.Value))
+			}
+			lines = append(lines, "}")
+		}
+		return lines, nil
+	case bsp.LumpTextures:
+		textures, err := bsp.ParseTextureLump(data)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for i := range textures {
+			t := &textures[i]
+			if t.Missing() {
+				lines = append(lines, fmt.Sprintf("%4d <missing>", i))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%4d %-16s %4dx%-4d %6d bytes @ %d", i, t.Name(), t.MipTex.Width, t.MipTex.Height, len(t.Pixels), t.Offset))
+		}
+		return lines, nil
+	case bsp.LumpFaces:
+		faces, err := bsp.ReadFaces(&b.bspFile, b.f)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for i, face := range faces {
+			lines = append(lines, fmt.Sprintf("%6d plane %5d side %d edges %6d+%-3d texinfo %5d styles %3d %3d %3d %3d light %d",
+				i, face.PlaneId, face.Side, face.LedgeId, face.LedgeNum, face.TexinfoId,
+				face.TypeLight, face.BaseLight, face.Light[0], face.Light[1], face.Lightmap))
+		}
+		return lines, nil
+	case bsp.LumpModels:
+		models, err := bsp.ReadModels(&b.bspFile, b.f)
+		if err != nil {
+			return nil, err
+		}
+		var lines []string
+		for i, model := range models {
+			lines = append(lines, fmt.Sprintf("*%-4d mins %s maxs %s faces %d+%d", i, model.Mins, model.Maxs, model.FirstFace, model.NumFaces))
+		}
+		return lines, nil
+	}
+	return HexDumpLines(data, 0), nil
+}
+
+func (b *browser) showPage() {
+	if b.current == nil {
+		fmt.Fprintln(b.out, "no lump selected")
+		return
+	}
+	pages := (len(b.lines) + b.pageSize - 1) / b.pageSize
+	if pages == 0 {
+		pages = 1
+	}
+	if b.page >= pages {
+		b.page = pages - 1
+	}
+	if b.page < 0 {
+		b.page = 0
+	}
+	start := b.page * b.pageSize
+	end := start + b.pageSize
+	if end > len(b.lines) {
+		end = len(b.lines)
+	}
+	fmt.Fprintf(b.out, "-- %s, page %d/%d --\n", b.current.Name, b.page+1, pages)
+	for _, line := range b.lines[start:end] {
+		fmt.Fprintln(b.out, line)
+	}
+}
+
+func (b *browser) open(arg string) {
+	lump := b.find(arg)
+	if lump == nil {
+		fmt.Fprintf(b.out, "no lump %q\n", arg)
+		return
+	}
+	lines, err := b.decode(lump)
+	if err != nil {
+		fmt.Fprintf(b.out, "%s: %s\n", lump.Name, err)
+		return
+	}
+	b.current, b.lines, b.page = lump, lines, 0
+	b.showPage()
+}
+
+func (b *browser) hexdump(args []string) {
+	if b.current == nil || len(args) == 0 {
+		fmt.Fprintln(b.out, "usage: x <offset> [length] (after selecting a lump)")
+		return
+	}
+	offset, err := strconv.ParseInt(args[0], 0, 64)
+	if err != nil || offset < 0 || offset >= int64(b.current.Length) {
+		fmt.Fprintf(b.out, "invalid offset %q\n", args[0])
+		return
+	}
+	length := int64(256)
+	if len(args) > 1 {
+		length, err = strconv.ParseInt(args[1], 0, 64)
+		if err != nil || length <= 0 {
+			fmt.Fprintf(b.out, "invalid length %q\n", args[1])
+			return
+		}
+	}
+	if offset+length > int64(b.current.Length) {
+		length = int64(b.current.Length) - offset
+	}
+	buffer := make([]byte, length)
+	_, err = b.f.ReadAt(buffer, int64(b.current.Offset)+offset)
+	if err != nil && err != io.EOF {
+		fmt.Fprintln(b.out, err)
+		return
+	}
+	for _, line := range HexDumpLines(buffer, offset) {
+		fmt.Fprintln(b.out, line)
+	}
+}
+
+const browseHelp = `commands:
+  l              list lumps
+  o <n|name>     open a lump by index or name
+  n, p           next / previous page
+  g <page>       go to page
+  x <ofs> [len]  hex dump a range of the open lump (offsets relative to the lump)
+  h              this help
+  q              quit`
+
+func (b *browser) run(in io.Reader) {
+	b.listLumps()
+	fmt.Fprintln(b.out, browseHelp)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(b.out, "> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(b.out, "")
+			return
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			if b.current != nil {
+				b.page++
+				b.showPage()
+			}
+			continue
+		}
+
+		switch fields[0] {
+		case "l", "lumps":
+			b.listLumps()
+		case "o", "open":
+			if len(fields) < 2 {
+				fmt.Fprintln(b.out, "usage: o <n|name>")
+				continue
+			}
+			b.open(fields[1])
+		case "n", "next":
+			b.page++
+			b.showPage()
+		case "p", "prev":
+			b.page--
+			b.showPage()
+		case "g", "goto":
+			page, err := strconv.Atoi(strings.Join(fields[1:], ""))
+			if err != nil {
+				fmt.Fprintln(b.out, "usage: g <page>")
+				continue
+			}
+			b.page = page - 1
+			b.showPage()
+		case "x", "hex":
+			b.hexdump(fields[1:])
+		case "h", "help", "?":
+			fmt.Fprintln(b.out, browseHelp)
+		case "q", "quit", "exit":
+			return
+		default:
+			if b.find(fields[0]) != nil {
+				b.open(fields[0])
+			} else {
+				fmt.Fprintf(b.out, "unknown command %q, h for help\n", fields[0])
+			}
+		}
+	}
+}
+
+var browsePageSize int
+
+var browseCmd = &cobra.Command{
+	Use:   "browse <map>",
+	Short: "Interactively browse lumps",
+	Long: `Open an interactive prompt to navigate the lumps of a map, page through
+decoded entities, faces, textures and models, and hex dump selected ranges.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		b, err := newBrowser(f, os.Stdout, browsePageSize)
+		if err != nil {
+			return err
+		}
+		b.run(os.Stdin)
+		return nil
+	},
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// BspXHandler decodes, prints and checks the contents of one BSPX lump.
+type BspXHandler struct {
+	Name string
+	// FaceRecordSize is the size of the records of lumps holding one record
+	// per face, 0 for other lumps. Such lumps are compacted along with the
+	// faces lump and their size is checked by validate.
+	FaceRecordSize int
+	// Print writes the decoded lump to w, nil if the lump can't be printed.
+	Print func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error
+	// Validate returns problems with the contents of the lump.
+	Validate func(bspFile *bsp.BspFile, lump []byte) []string
+	// Diff writes the decoded differences between two versions of the lump
+	// to w, nil to compare the lumps byte by byte.
+	Diff func(w io.Writer, a, b []byte) error
+}
+
+var bspxHandlers = map[string]*BspXHandler{}
+
+// RegisterBspXHandler makes handler the handler of the BSPX lumps named like
+// it, replacing any handler registered before.
+func RegisterBspXHandler(handler *BspXHandler) {
+	bspxHandlers[handler.Name] = handler
+}
+
+// BspXHandlerFor returns the handler registered for a BSPX lump, or nil.
+func BspXHandlerFor(name string) *BspXHandler {
+	return bspxHandlers[name]
+}
+
+// BspXHandlerNames returns the names of all lumps with a handler, sorted.
+func BspXHandlerNames() []string {
+	var names []string
+	for name := range bspxHandlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateBspXLump checks a lump with its handler, including the record
+// count of per face lumps.
+func ValidateBspXLump(handler *BspXHandler, bspFile *bsp.BspFile, lump []byte) []string {
+	if handler.FaceRecordSize > 0 {
+		faces := bspFile.NumRecords(bsp.LumpFaces)
+		if len(lump) != handler.FaceRecordSize*faces {
+			return []string{fmt.Sprintf("%d bytes, expected %d byte records for all %d faces", len(lump), handler.FaceRecordSize, faces)}
+		}
+	}
+	if handler.Validate == nil {
+		return nil
+	}
+	return handler.Validate(bspFile, lump)
+}
+
+// validateLightingSize checks a lump holding three bytes for every byte of
+// the lighting lump.
+func validateLightingSize(bspFile *bsp.BspFile, lump []byte) []string {
+	lighting := int(bspFile.BspHeader.Lumps[bsp.LumpLighting].Length)
+	if len(lump) != 3*lighting {
+		return []string{fmt.Sprintf("%d bytes, expected %d for %d lighting samples", len(lump), 3*lighting, lighting)}
+	}
+	return nil
+}
+
+func printLightingSize(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+	_, err := fmt.Fprintf(w, "%d bytes, %d samples\n", len(lump), len(lump)/3)
+	return err
+}
+
+// brushListModel is the header of the brushes of one model in a BRUSHLIST
+// lump, followed by the brushes and their planes.
+type brushListModel struct {
+	Version    uint32
+	Model      uint32
+	NumBrushes uint32
+	NumPlanes  uint32
+}
+
+type brushListBrush struct {
+	Mins      bsp.Vec3
+	Maxs      bsp.Vec3
+	Contents  int16
+	NumPlanes uint16
+}
+
+// parseBrushList returns the model headers of a BRUSHLIST lump.
+func parseBrushList(lump []byte) ([]brushListModel, error) {
+	var models []brushListModel
+	r := bytes.NewReader(lump)
+	planeSize := int64(binary.Size(bsp.Vec4{}))
+	for r.Len() > 0 {
+		var model brushListModel
+		if err := binary.Read(r, binary.LittleEndian, &model); err != nil {
+			return nil, fmt.Errorf("model %d: truncated header", len(models))
+		}
+		if model.Version != 1 {
+			return nil, fmt.Errorf("model %d: unsupported version %d", model.Model, model.Version)
+		}
+		planes := uint32(0)
+		for i := uint32(0); i < model.NumBrushes; i++ {
+			var brush brushListBrush
+			if err := binary.Read(r, binary.LittleEndian, &brush); err != nil {
+				return nil, fmt.Errorf("model %d: brush %d truncated", model.Model, i)
+			}
+			if int64(brush.NumPlanes)*planeSize > int64(r.Len()) {
+				return nil, fmt.Errorf("model %d: planes of brush %d truncated", model.Model, i)
+			}
+			r.Seek(int64(brush.NumPlanes)*planeSize, io.SeekCurrent)
+			planes += uint32(brush.NumPlanes)
+		}
+		if planes != model.NumPlanes {
+			return nil, fmt.Errorf("model %d: %d planes, header says %d", model.Model, planes, model.NumPlanes)
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
+
+// diffDecoupledLM lists the fields of the DECOUPLED_LM records that differ,
+// face by face.
+func diffDecoupledLM(w io.Writer, a, b []byte) error {
+	lightmapsA, err := bsp.ParseDecoupledLM(a)
+	if err != nil {
+		return err
+	}
+	lightmapsB, err := bsp.ParseDecoupledLM(b)
+	if err != nil {
+		return err
+	}
+	if len(lightmapsA) != len(lightmapsB) {
+		fmt.Fprintf(w, "%d / %d faces\n", len(lightmapsA), len(lightmapsB))
+	}
+
+	differing := 0
+	for i := 0; i < len(lightmapsA) && i < len(lightmapsB); i++ {
+		lmA, lmB := lightmapsA[i], lightmapsB[i]
+		var fields []string
+		if lmA.LmWidth != lmB.LmWidth || lmA.LmHeight != lmB.LmHeight {
+			fields = append(fields, fmt.Sprintf("size %dx%d => %dx%d", lmA.LmWidth, lmA.LmHeight, lmB.LmWidth, lmB.LmHeight))
+		}
+		if lmA.Offset != lmB.Offset {
+			fields = append(fields, fmt.Sprintf("offset %d => %d", lmA.Offset, lmB.Offset))
+		}
+		for axis, name := range []string{"s", "t"} {
+			if lmA.WorldToLmSpace[axis] != lmB.WorldToLmSpace[axis] {
+				fields = append(fields, fmt.Sprintf("%s %s => %s", name, lmA.WorldToLmSpace[axis], lmB.WorldToLmSpace[axis]))
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		differing++
+		if differing <= diffMaxRecords {
+			fmt.Fprintf(w, "face %5d: %s\n", i, strings.Join(fields, ", "))
+		}
+	}
+	if differing > diffMaxRecords {
+		fmt.Fprintf(w, "... %d more faces differ\n", differing-diffMaxRecords)
+	}
+	return nil
+}
+
+func init() {
+	RegisterBspXHandler(&BspXHandler{
+		Name:           "DECOUPLED_LM",
+		FaceRecordSize: binary.Size(bsp.DecoupledLM{}),
+		Print: func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+			lightmaps, err := bsp.ParseDecoupledLM(lump)
+			if err != nil {
+				return err
+			}
+			for _, lightmap := range lightmaps {
+				fmt.Fprintf(w, "%s\n", lightmap)
+			}
+			return nil
+		},
+		Diff: diffDecoupledLM,
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name:           "LMSHIFT",
+		FaceRecordSize: 1,
+		Print: func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+			for i, shift := range lump {
+				fmt.Fprintf(w, "face %5d: shift %d (%d units per luxel)\n", i, shift, 1<<shift)
+			}
+			return nil
+		},
+		Validate: func(bspFile *bsp.BspFile, lump []byte) []string {
+			var problems []string
+			for i, shift := range lump {
+				if shift > 8 {
+					problems = append(problems, fmt.Sprintf("face %d has shift %d, engines support up to 8", i, shift))
+				}
+			}
+			return problems
+		},
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name:           "LMOFFSET",
+		FaceRecordSize: 4,
+		Print: func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+			for i := 0; i+4 <= len(lump); i += 4 {
+				fmt.Fprintf(w, "face %5d: lightmap offset %d\n", i/4, int32(binary.LittleEndian.Uint32(lump[i:])))
+			}
+			return nil
+		},
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name:           "LMSTYLE",
+		FaceRecordSize: 4,
+		Print: func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+			for i := 0; i+4 <= len(lump); i += 4 {
+				fmt.Fprintf(w, "face %5d: styles %d %d %d %d\n", i/4, lump[i], lump[i+1], lump[i+2], lump[i+3])
+			}
+			return nil
+		},
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name:     "RGBLIGHTING",
+		Print:    printLightingSize,
+		Validate: validateLightingSize,
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name:     "LIGHTINGDIR",
+		Print:    printLightingSize,
+		Validate: validateLightingSize,
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name: "BRUSHLIST",
+		Print: func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+			models, err := parseBrushList(lump)
+			if err != nil {
+				return &bsp.FormatError{Err: fmt.Errorf("BRUSHLIST %w", err)}
+			}
+			for _, model := range models {
+				fmt.Fprintf(w, "model %3d: %d brushes, %d planes\n", model.Model, model.NumBrushes, model.NumPlanes)
+			}
+			return nil
+		},
+		Validate: func(bspFile *bsp.BspFile, lump []byte) []string {
+			models, err := parseBrushList(lump)
+			if err != nil {
+				return []string{err.Error()}
+			}
+			numModels := bspFile.NumRecords(bsp.LumpModels)
+			var problems []string
+			for _, model := range models {
+				if int(model.Model) >= numModels {
+					problems = append(problems, fmt.Sprintf("brushes for model %d, map has %d models", model.Model, numModels))
+				}
+			}
+			return problems
+		},
+	})
+	RegisterBspXHandler(&BspXHandler{
+		Name: MetaLump,
+		Print: func(w io.Writer, bspFile *bsp.BspFile, lump []byte) error {
+			entries, err := ParseMeta(lump)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(EncodeMeta(entries))
+			return err
+		},
+		Validate: func(bspFile *bsp.BspFile, lump []byte) []string {
+			if _, err := ParseMeta(lump); err != nil {
+				return []string{err.Error()}
+			}
+			return nil
+		},
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// BuildDocument assembles a map from a directory written by split. Lumps
+// with fixed size records must hold whole records.
+func BuildDocument(dir string) (*bsp.Document, error) {
+	header, err := ReadSplitHeader(dir)
+	if err != nil {
+		return nil, err
+	}
+	version, err := bsp.ParseBspVersion(header.Version)
+	if err != nil {
+		return nil, err
+	}
+	order, err := ParseByteOrder(header.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := bsp.NewDocument(version)
+	doc.ByteOrder = order
+	var found [bsp.LumpTotal]bool
+	for _, lump := range header.Lumps {
+		buffer, err := os.ReadFile(filepath.Join(dir, filepath.Base(lump.File)))
+		if err != nil {
+			return nil, err
+		}
+		if lump.BspX {
+			doc.SetBspXLump(lump.Name, buffer)
+			continue
+		}
+
+		lumpType, err := bsp.ParseLumpType(lump.Name)
+		if err != nil {
+			return nil, err
+		}
+		if lumpType == bsp.LumpEntities && strings.HasSuffix(lump.File, ".ent") {
+			buffer = append(bytes.TrimRight(buffer, "\x00"), 0)
+		}
+		if size := bsp.LumpRecordSize(version, lumpType); size != 0 && len(buffer)%size != 0 {
+			return nil, fmt.Errorf("%s: %d bytes are no whole number of %d byte records", lump.File, len(buffer), size)
+		}
+		doc.SetLump(lumpType, buffer)
+		found[lumpType] = true
+	}
+	for i, ok := range found {
+		if !ok {
+			return nil, fmt.Errorf("%s lists no %s lump", filepath.Join(dir, splitHeaderFile), bsp.LumpType(i))
+		}
+	}
+	return doc, nil
+}
+
+var buildCmd = &cobra.Command{
+	Use:   "build <dir> <map>",
+	Short: "Reassemble a map split with split",
+	Long: `Read header.json and the lump files of a directory written by split and
+write them as a map with recomputed lump offsets, standard lumps in order
+followed by the BSPX lumps in the order header.json lists them. Lump files
+may be edited, added to or removed from header.json in between.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		doc, err := BuildDocument(args[0])
+		if err != nil {
+			return err
+		}
+		err = doc.WriteFileContext(cmd.Context(), args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Built %s from %s\n", args[1], args[0])
+
+		return RunUploadHooks(cmd.Context(), args[1], cmd.Name())
+	},
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var checksumLumps bool
+var checksumJSON bool
+
+// LumpChecksum holds the hashes of one lump.
+type LumpChecksum struct {
+	Name   string `json:"name"`
+	BspX   bool   `json:"bspx,omitempty"`
+	Length int    `json:"length"`
+	CRC32  string `json:"crc32"`
+	MD4    string `json:"md4"`
+	SHA256 string `json:"sha256"`
+}
+
+func newLumpChecksum(name string, bspx bool, data []byte) LumpChecksum {
+	return LumpChecksum{
+		Name:   name,
+		BspX:   bspx,
+		Length: len(data),
+		CRC32:  fmt.Sprintf("%08x", crc32.ChecksumIEEE(data)),
+		MD4:    fmt.Sprintf("%x", bsp.MD4(data)),
+		SHA256: fmt.Sprintf("%x", sha256.Sum256(data)),
+	}
+}
+
+// MapChecksum holds the hashes of a map file and the QuakeWorld map
+// checksums, which engines print as signed numbers.
+type MapChecksum struct {
+	Filename  string         `json:"filename"`
+	Size      int            `json:"size"`
+	CRC32     string         `json:"crc32"`
+	MD4       string         `json:"md4"`
+	SHA256    string         `json:"sha256"`
+	Checksum  int32          `json:"checksum"`
+	Checksum2 int32          `json:"checksum2"`
+	Lumps     []LumpChecksum `json:"lumps,omitempty"`
+}
+
+// NewMapChecksum hashes the named map, with lumps set also every standard
+// and BSPX lump.
+func NewMapChecksum(name string, lumps bool) (*MapChecksum, error) {
+	f, err := OpenMapFile(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	bspFile, err := bsp.ReadBspFile(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	checksum, checksum2, err := bsp.MapChecksums(&bspFile, r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	file := newLumpChecksum(name, false, data)
+	sums := &MapChecksum{
+		Filename:  path.Base(name),
+		Size:      len(data),
+		CRC32:     file.CRC32,
+		MD4:       file.MD4,
+		SHA256:    file.SHA256,
+		Checksum:  int32(checksum),
+		Checksum2: int32(checksum2),
+	}
+	if !lumps {
+		return sums, nil
+	}
+
+	for i := 0; i < bsp.LumpTotal; i++ {
+		lumpType := bsp.LumpType(i)
+		buffer, err := bsp.ReadLump(&bspFile, r, lumpType)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		sums.Lumps = append(sums.Lumps, newLumpChecksum(lumpType.String(), false, buffer))
+	}
+	for _, xlump := range bspFile.BspXLumps {
+		xname := bsp.BytesToString(xlump.LumpName[:])
+		if int64(xlump.Offset)+int64(xlump.Length) > int64(len(data)) {
+			return nil, fmt.Errorf("%s: BSPX lump %s extends past the end of the file", name, xname)
+		}
+		sums.Lumps = append(sums.Lumps, newLumpChecksum(xname, true, data[xlump.Offset:xlump.Offset+xlump.Length]))
+	}
+	return sums, nil
+}
+
+var checksumCmd = &cobra.Command{
+	Use:   "checksum <map>...",
+	Short: "Print CRC32, MD4, SHA256 and QuakeWorld map checksums",
+	Long: `Print the CRC32, MD4 and SHA256 of each map file together with the
+QuakeWorld map checksums: checksum covers all lumps but the entities,
+checksum2, which servers compare against the checksum sent by clients, also
+leaves out visibility, leafs and nodes. With --lumps every standard and BSPX
+lump is hashed as well.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var all []*MapChecksum
+		for _, arg := range args {
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+			sums, err := NewMapChecksum(arg, checksumLumps)
+			if err != nil {
+				return err
+			}
+			if checksumJSON {
+				all = append(all, sums)
+				continue
+			}
+
+			fmt.Println(arg)
+			fmt.Printf("  %-10s %s\n", "crc32", sums.CRC32)
+			fmt.Printf("  %-10s %s\n", "md4", sums.MD4)
+			fmt.Printf("  %-10s %s\n", "sha256", sums.SHA256)
+			fmt.Printf("  %-10s %d\n", "checksum", sums.Checksum)
+			fmt.Printf("  %-10s %d\n", "checksum2", sums.Checksum2)
+			for _, lump := range sums.Lumps {
+				name := lump.Name
+				if lump.BspX {
+					name = "BSPX " + name
+				}
+				fmt.Printf("  %-24s %8d  %s  %s\n", name, lump.Length, lump.CRC32, lump.SHA256)
+			}
+		}
+
+		if checksumJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(all)
+		}
+		return nil
+	},
+}
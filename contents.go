@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// contentsTextures are the texture name fragments liquid surfaces are
+// recognised by, for warning about surfaces that no longer look like what
+// they contain.
+var contentsTextures = map[bsp.Contents]string{
+	bsp.ContentsWater: "water",
+	bsp.ContentsSlime: "slime",
+	bsp.ContentsLava:  "lava",
+}
+
+// ChangeContents sets the contents of every world leaf and clipping hull leaf
+// with contents from to to. It returns the number of changed leafs and
+// clipnode children.
+func ChangeContents(data *mapData, from, to bsp.Contents) (int, int) {
+	leafs := 0
+	for i := range data.leafs {
+		if data.leafs[i].Contents == from {
+			data.leafs[i].Contents = to
+			leafs++
+		}
+	}
+	children := 0
+	for i := range data.clipNodes {
+		for j, child := range data.clipNodes[i].Children {
+			if bsp.Contents(child) == from {
+				data.clipNodes[i].Children[j] = int32(to)
+				children++
+			}
+		}
+	}
+	return leafs, children
+}
+
+// mismatchedLiquidTextures counts the liquid textures of faces in leafs with
+// the given contents that are named after a different liquid.
+func mismatchedLiquidTextures(data *mapData, textures []bsp.TextureEntry, contents bsp.Contents) map[string]int {
+	mismatched := map[string]int{}
+	for i := range data.leafs {
+		leaf := &data.leafs[i]
+		if leaf.Contents != contents {
+			continue
+		}
+		for j := leaf.FirstMarkSurface; j < leaf.FirstMarkSurface+leaf.NumMarkSurfaces && int(j) < len(data.marksurfs); j++ {
+			face := data.marksurfs[j]
+			if int(face) >= len(data.faces) {
+				continue
+			}
+			name := strings.ToLower(FaceTextureName(data, textures, &data.faces[face]))
+			if bsp.TextureClass(name) != "*" {
+				continue
+			}
+			for other, fragment := range contentsTextures {
+				if other != contents && strings.Contains(name, fragment) {
+					mismatched[name]++
+				}
+			}
+		}
+	}
+	return mismatched
+}
+
+var contentsFrom string
+var contentsTo string
+
+var contentsCmd = &cobra.Command{
+	Use:   "contents <map>",
+	Short: "Change leaf contents in bulk",
+	Long: `Change the contents of all leafs and clipping hull leafs from one type to
+another, e.g. --from lava --to water for practice servers. Textures are not
+changed, a warning lists liquid surfaces whose texture name no longer
+matches their contents.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := bsp.ParseContents(contentsFrom)
+		if err != nil {
+			return err
+		}
+		to, err := bsp.ParseContents(contentsTo)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		buffer, err := bsp.ReadLump(&bspFile, f, bsp.LumpTextures)
+		if err != nil {
+			return err
+		}
+		textures, err := bsp.ParseTextureLump(buffer)
+		if err != nil {
+			return err
+		}
+
+		leafs, children := ChangeContents(data, from, to)
+		if leafs == 0 && children == 0 {
+			fmt.Printf("%s: no %s leafs\n", args[0], from)
+			return nil
+		}
+
+		mismatched := mismatchedLiquidTextures(data, textures, to)
+		var names []string
+		for name := range mismatched {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			Warnf("%d faces in %s leafs use texture %s", mismatched[name], to, name)
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			data.encodeGeometry(lumps)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Changed %d leafs and %d clipnode children from %s to %s, wrote %s\n", leafs, children, from, to, destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var convertEndian string
+
+// ParseByteOrder parses the --endian flag values big and little.
+func ParseByteOrder(s string) (binary.ByteOrder, error) {
+	switch strings.ToLower(s) {
+	case "big":
+		return binary.BigEndian, nil
+	case "little":
+		return binary.LittleEndian, nil
+	}
+	return nil, fmt.Errorf("unknown byte order %q, expected big or little", s)
+}
+
+// byteOrderName returns the --endian name of order.
+func byteOrderName(order binary.ByteOrder) string {
+	if order == binary.BigEndian {
+		return "big"
+	}
+	return "little"
+}
+
+var convertCmd = &cobra.Command{
+	Use:   "convert --endian <big|little> <map>",
+	Short: "Convert a map between little-endian and big-endian byte order",
+	Long: `Write a copy of the map with all standard lumps and the lump directories in
+the given byte order, for maps of big-endian console ports. BSPX lump
+payloads are copied as they are.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		order, err := ParseByteOrder(convertEndian)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		doc, err := bsp.OpenDocument(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		if doc.ByteOrder == order {
+			fmt.Printf("%s: already %s-endian\n", args[0], byteOrderName(order))
+			return nil
+		}
+		from := doc.ByteOrder
+		doc.ByteOrder = order
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = doc.WriteFileContext(cmd.Context(), destName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Converted %s from %s-endian to %s-endian, wrote %s\n", args[0], byteOrderName(from), byteOrderName(order), destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
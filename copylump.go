@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var copyLumpCmd = &cobra.Command{
+	Use:   "copy-lump <src> <dst> <lump-name>",
+	Short: "Copy a standard or BSPX lump from one map into another",
+	Long: `Write a copy of dst with one lump replaced by the same lump of src, e.g. to
+restore the original lighting into an obfuscated copy of a map. Standard
+lumps are given by name or index, anything else names a BSPX lump. Standard
+lumps with fixed size records can only be copied between maps of the same
+version.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		src, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		srcFile, err := bsp.ReadBspFile(src)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		dst, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		defer dst.Close()
+
+		dstFile, err := bsp.ReadBspFile(dst)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+
+		basename := strings.TrimSuffix(args[1], filepath.Ext(args[1]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+
+		lumpType, err := bsp.ParseLumpType(args[2])
+		if err != nil {
+			buffer, err := bsp.ReadBspXLump(&srcFile, src, args[2])
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[0], err)
+			}
+			if buffer == nil {
+				return fmt.Errorf("%s has no standard or BSPX lump %s", args[0], args[2])
+			}
+			err = bsp.StreamBSPXContext(cmd.Context(), &dstFile, dst, destName, func(doc *bsp.Document) error {
+				doc.SetBspXLump(args[2], buffer)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Copied BSPX lump %s (%d bytes) from %s, wrote %s\n", args[2], len(buffer), args[0], destName)
+			return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+		}
+
+		srcVersion, dstVersion := srcFile.BspHeader.Version, dstFile.BspHeader.Version
+		if srcVersion != dstVersion && bsp.LumpRecordSize(srcVersion, lumpType) != 0 {
+			return fmt.Errorf("can't copy the %s lump from a %s map into a %s map", lumpType, srcVersion, dstVersion)
+		}
+		buffer, err := bsp.ReadLump(&srcFile, src, lumpType)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		if length := dstFile.BspHeader.Lumps[lumpType].Length; int(length) != len(buffer) {
+			Warnf("%s lump is %d bytes in %s but %d bytes in %s", lumpType, len(buffer), args[0], length, args[1])
+		}
+
+		doc, err := bsp.OpenDocument(dst)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		doc.SetLump(lumpType, buffer)
+		err = doc.WriteFileContext(cmd.Context(), destName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Copied %s lump (%d bytes) from %s, wrote %s\n", lumpType, len(buffer), args[0], destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// CTFEntity is how a convention spells a flag or team spawn: the classname
+// and the keys it sets. Match lists the keys that tell the red and blue
+// entity apart when they share a classname.
+type CTFEntity struct {
+	Classname string            `json:"classname"`
+	Keys      map[string]string `json:"keys,omitempty"`
+	Match     []string          `json:"match,omitempty"`
+}
+
+// CTFConvention is the way a CTF mod expects flags, team spawns and team
+// restricted entities. TeamKey is the key restricting doors, walls and
+// triggers to a team, Teams its values for red and blue.
+type CTFConvention struct {
+	Flags   [2]CTFEntity `json:"flags"`
+	Spawns  [2]CTFEntity `json:"spawns"`
+	TeamKey string       `json:"teamKey"`
+	Teams   [2]string    `json:"teams"`
+}
+
+// ctfTeamNames are the teams of the red, blue pairs of a CTFConvention.
+var ctfTeamNames = [2]string{"red", "blue"}
+
+var threewaveConvention = CTFConvention{
+	Flags:   [2]CTFEntity{{Classname: "item_flag_team1"}, {Classname: "item_flag_team2"}},
+	Spawns:  [2]CTFEntity{{Classname: "info_player_team1"}, {Classname: "info_player_team2"}},
+	TeamKey: "team",
+	Teams:   [2]string{"1", "2"},
+}
+
+// BuiltinCTFConventions are the conventions convert-ctf knows: Threewave CTF,
+// KTX and the other current QuakeWorld CTF mods reading the Threewave
+// entities, and Fortress One, whose flags are goal items owned by one team
+// and carried by the other.
+var BuiltinCTFConventions = map[string]CTFConvention{
+	"threewave": threewaveConvention,
+	"ktx":       threewaveConvention,
+	"fo": {
+		Flags: [2]CTFEntity{
+			{Classname: "item_tfgoal", Keys: map[string]string{"goal_no": "1", "owned_by": "2", "team_no": "1", "mdl": "progs/tf_flag.mdl", "skin": "1"}, Match: []string{"owned_by"}},
+			{Classname: "item_tfgoal", Keys: map[string]string{"goal_no": "2", "owned_by": "1", "team_no": "2", "mdl": "progs/tf_flag.mdl", "skin": "0"}, Match: []string{"owned_by"}},
+		},
+		Spawns: [2]CTFEntity{
+			{Classname: "info_player_teamspawn", Keys: map[string]string{"team_no": "2"}, Match: []string{"team_no"}},
+			{Classname: "info_player_teamspawn", Keys: map[string]string{"team_no": "1"}, Match: []string{"team_no"}},
+		},
+		TeamKey: "team_no",
+		Teams:   [2]string{"2", "1"},
+	},
+}
+
+// matches reports whether the entity is spelled as c.
+func (c *CTFEntity) matches(entity *bsp.Entity) bool {
+	if entity.Classname() != c.Classname {
+		return false
+	}
+	for _, key := range c.Match {
+		if entity.Get(key) != c.Keys[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// convert respells the entity from c to target, dropping the keys of c.
+func (c *CTFEntity) convert(entity *bsp.Entity, target *CTFEntity) {
+	for key := range c.Keys {
+		entity.Delete(key)
+	}
+	entity.Set("classname", target.Classname)
+	keys := make([]string, 0, len(target.Keys))
+	for key := range target.Keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entity.Set(key, target.Keys[key])
+	}
+}
+
+// CTFConversion counts the entities ConvertCTF changed.
+type CTFConversion struct {
+	Flags     [2]int
+	Spawns    [2]int
+	TeamKeyed int
+}
+
+// ConvertCTF respells flags, team spawns and team keys of the entities from
+// one convention to another.
+func ConvertCTF(entities []bsp.Entity, from *CTFConvention, to *CTFConvention) CTFConversion {
+	var conversion CTFConversion
+	for i := range entities {
+		e := &entities[i]
+		converted := false
+		for team := range ctfTeamNames {
+			if from.Flags[team].matches(e) {
+				from.Flags[team].convert(e, &to.Flags[team])
+				conversion.Flags[team]++
+				converted = true
+				break
+			}
+			if from.Spawns[team].matches(e) {
+				from.Spawns[team].convert(e, &to.Spawns[team])
+				conversion.Spawns[team]++
+				converted = true
+				break
+			}
+		}
+		if converted || !e.Has(from.TeamKey) {
+			continue
+		}
+		for team := range ctfTeamNames {
+			if e.Get(from.TeamKey) == from.Teams[team] {
+				e.Delete(from.TeamKey)
+				e.Set(to.TeamKey, to.Teams[team])
+				conversion.TeamKeyed++
+				break
+			}
+		}
+	}
+	return conversion
+}
+
+// ReadCTFConventions adds the conventions of a JSON file to conventions,
+// replacing built-in ones of the same name.
+func ReadCTFConventions(conventions map[string]CTFConvention, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var extra map[string]CTFConvention
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, convention := range extra {
+		conventions[name] = convention
+	}
+	return nil
+}
+
+var convertCTFFrom string
+var convertCTFTo string
+var convertCTFConventions string
+
+var entitiesConvertCTFCmd = &cobra.Command{
+	Use:   "convert-ctf --from <convention> --to <convention> <map>",
+	Short: "Convert flags, team spawns and team keys between CTF mods",
+	Long: `Write a copy of the map with its CTF entities respelled for another mod, so
+one compiled map can be shipped for several rule sets. The conventions are
+
+  threewave  item_flag_team1/2, info_player_team1/2, team 1 red, 2 blue
+  ktx        the same entities as threewave, read by KTX and most current
+             QuakeWorld CTF mods
+  fo         Fortress One: item_tfgoal flags owned by one team and carried by
+             the other, info_player_teamspawn, team_no 1 blue, 2 red
+
+Entities with the team key of the source convention, such as team only doors
+and walls, get the key and team number of the target. --conventions reads
+more conventions, or replacements for the built-in ones, from a JSON file
+mapping names to objects with flags, spawns, teamKey and teams.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conventions := map[string]CTFConvention{}
+		for name, convention := range BuiltinCTFConventions {
+			conventions[name] = convention
+		}
+		if convertCTFConventions != "" {
+			if err := ReadCTFConventions(conventions, convertCTFConventions); err != nil {
+				return err
+			}
+		}
+		names := make([]string, 0, len(conventions))
+		for name := range conventions {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		from, ok := conventions[convertCTFFrom]
+		if !ok {
+			return fmt.Errorf("unknown convention %q, expected one of %s", convertCTFFrom, strings.Join(names, ", "))
+		}
+		to, ok := conventions[convertCTFTo]
+		if !ok {
+			return fmt.Errorf("unknown convention %q, expected one of %s", convertCTFTo, strings.Join(names, ", "))
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		conversion := ConvertCTF(entities, &from, &to)
+		if conversion == (CTFConversion{}) {
+			return fmt.Errorf("%s: no CTF entities of the %s convention", args[0], convertCTFFrom)
+		}
+		for team, name := range ctfTeamNames {
+			if conversion.Flags[team] == 0 {
+				Warnf("%s: no %s flag in %s convention", args[0], name, convertCTFFrom)
+			}
+			if conversion.Spawns[team] == 0 {
+				Warnf("%s: no %s team spawns in %s convention", args[0], name, convertCTFFrom)
+			}
+		}
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Converted %d flags, %d team spawns and %d team keyed entities from %s to %s, wrote %s\n",
+			conversion.Flags[0]+conversion.Flags[1], conversion.Spawns[0]+conversion.Spawns[1], conversion.TeamKeyed,
+			convertCTFFrom, convertCTFTo, destName)
+		return nil
+	},
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var diffDeep bool
+
+// diffMaxRecords and diffMaxRanges limit how many differing records and byte
+// ranges are shown per lump with --deep.
+const (
+	diffMaxRecords = 20
+	diffMaxRanges  = 8
+)
+
+// DiffRange is a range of differing bytes within a lump.
+type DiffRange struct {
+	Offset int
+	Length int
+}
+
+// DiffRanges returns the ranges in which a and b differ, merging ranges less
+// than gap bytes apart. Bytes past the end of the shorter slice differ.
+func DiffRanges(a, b []byte, gap int) []DiffRange {
+	length := len(a)
+	if len(b) > length {
+		length = len(b)
+	}
+	var ranges []DiffRange
+	for i := 0; i < length; i++ {
+		if i < len(a) && i < len(b) && a[i] == b[i] {
+			continue
+		}
+		if n := len(ranges); n > 0 && i-(ranges[n-1].Offset+ranges[n-1].Length) < gap {
+			ranges[n-1].Length = i + 1 - ranges[n-1].Offset
+		} else {
+			ranges = append(ranges, DiffRange{i, 1})
+		}
+	}
+	return ranges
+}
+
+// hexRows returns the hex dump lines of data covering [start, end), clipped
+// to the length of data.
+func hexRows(data []byte, start int, end int) []string {
+	if end > len(data) {
+		end = len(data)
+	}
+	if start >= end {
+		return nil
+	}
+	return HexDumpLines(data[start:end], int64(start))
+}
+
+// writeByteDiff writes the differing ranges of a and b as hex dumps of the
+// surrounding 16 byte rows, a prefixed with - and b with +.
+func writeByteDiff(w io.Writer, a, b []byte) {
+	ranges := DiffRanges(a, b, 16)
+	for i, r := range ranges {
+		if i == diffMaxRanges {
+			fmt.Fprintf(w, "  ... %d more ranges differ\n", len(ranges)-diffMaxRanges)
+			break
+		}
+		fmt.Fprintf(w, "  @ 0x%x, %d bytes\n", r.Offset, r.Length)
+		start := r.Offset &^ 15
+		end := (r.Offset + r.Length + 15) &^ 15
+		for _, line := range hexRows(a, start, end) {
+			fmt.Fprintf(w, "  - %s\n", line)
+		}
+		for _, line := range hexRows(b, start, end) {
+			fmt.Fprintf(w, "  + %s\n", line)
+		}
+	}
+}
+
+// shortHash returns the first bytes of the sha256 of data in hex.
+func shortHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%x", sum[:4])
+}
+
+// DiffMaps writes the lumps in which the maps differ to w and returns the
+// number of differing lumps. With deep set the differences within BSPX lumps
+// are shown, decoded for lumps whose handler can diff them.
+func DiffMaps(w io.Writer, a, b *openMap, deep bool) (int, error) {
+	differing := 0
+	versionA, versionB := a.bspFile.BspHeader.Version, b.bspFile.BspHeader.Version
+	if versionA != versionB {
+		differing++
+		fmt.Fprintf(w, "Version: %s / %s\n", versionA, versionB)
+	}
+	if orderA, orderB := byteOrderName(a.bspFile.ByteOrder), byteOrderName(b.bspFile.ByteOrder); orderA != orderB {
+		differing++
+		fmt.Fprintf(w, "Byte order: %s / %s\n", orderA, orderB)
+	}
+	for i := 0; i < bsp.LumpTotal; i++ {
+		lumpType := bsp.LumpType(i)
+		bufferA, err := bsp.ReadLump(&a.bspFile, a.f, lumpType)
+		if err != nil {
+			return 0, err
+		}
+		bufferB, err := bsp.ReadLump(&b.bspFile, b.f, lumpType)
+		if err != nil {
+			return 0, err
+		}
+		if !bytes.Equal(bufferA, bufferB) {
+			differing++
+			fmt.Fprintf(w, "%s: %d / %d bytes, sha256 %s / %s\n", lumpType, len(bufferA), len(bufferB), shortHash(bufferA), shortHash(bufferB))
+		}
+	}
+
+	var names []string
+	seen := map[string]bool{}
+	for _, bspFile := range []*bsp.BspFile{&a.bspFile, &b.bspFile} {
+		for _, xlump := range bspFile.BspXLumps {
+			name := bsp.BytesToString(xlump.LumpName[:])
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		bufferA, err := bsp.ReadBspXLump(&a.bspFile, a.f, name)
+		if err != nil {
+			return 0, err
+		}
+		bufferB, err := bsp.ReadBspXLump(&b.bspFile, b.f, name)
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case bufferA == nil:
+			fmt.Fprintf(w, "BSPX %s: only in second map, %d bytes\n", name, len(bufferB))
+		case bufferB == nil:
+			fmt.Fprintf(w, "BSPX %s: only in first map, %d bytes\n", name, len(bufferA))
+		case bytes.Equal(bufferA, bufferB):
+			continue
+		default:
+			fmt.Fprintf(w, "BSPX %s: %d / %d bytes, sha256 %s / %s\n", name, len(bufferA), len(bufferB), shortHash(bufferA), shortHash(bufferB))
+			if !deep {
+				break
+			}
+			if handler := BspXHandlerFor(name); handler != nil && handler.Diff != nil {
+				var decoded bytes.Buffer
+				err := handler.Diff(&decoded, bufferA, bufferB)
+				if err == nil {
+					for _, line := range bytes.SplitAfter(decoded.Bytes(), []byte("\n")) {
+						if len(line) > 0 {
+							fmt.Fprintf(w, "  %s", line)
+						}
+					}
+					break
+				}
+				Warnf("BSPX %s can't be decoded, comparing bytes: %s", name, err)
+			}
+			writeByteDiff(w, bufferA, bufferB)
+		}
+		differing++
+	}
+	return differing, nil
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff <a> <b>",
+	Short: "Show the standard and BSPX lumps two maps differ in",
+	Long: `List the lumps in which two maps differ with their sizes and hashes. With
+--deep the differing byte ranges within BSPX lumps present in both maps are
+shown as hex dumps, and known lumps such as DECOUPLED_LM are compared field by
+field per face. Exits non-zero if the maps differ.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var maps [2]openMap
+		for i, arg := range args {
+			f, err := OpenMapFile(arg)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			bspFile, err := bsp.ReadBspFile(f)
+			if err != nil {
+				return fmt.Errorf("%s: %w", arg, err)
+			}
+			maps[i] = openMap{f: f, bspFile: bspFile}
+		}
+
+		differing, err := DiffMaps(os.Stdout, &maps[0], &maps[1], diffDeep)
+		if err != nil {
+			return err
+		}
+		if differing > 0 {
+			return &ExitError{ExitFailure}
+		}
+		fmt.Println("Maps are identical")
+		return nil
+	},
+}
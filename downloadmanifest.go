@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+type DownloadEntry struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+func NewDownloadEntry(filename string, root string) (DownloadEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return DownloadEntry{}, err
+	}
+	defer f.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return DownloadEntry{}, err
+	}
+
+	rel, err := filepath.Rel(root, filename)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filename
+	}
+
+	return DownloadEntry{
+		Path:  filepath.ToSlash(rel),
+		Size:  size,
+		CRC32: hash.Sum32(),
+	}, nil
+}
+
+// WriteDownloadManifest writes entries as a plain "path size crc" list, as
+// JSON, or as FTE manifest package lines.
+func WriteDownloadManifest(w io.Writer, format string, mirror string, entries []DownloadEntry) error {
+	switch format {
+	case "list":
+		for _, entry := range entries {
+			_, err := fmt.Fprintf(w, "%s %d %08x\n", entry.Path, entry.Size, entry.CRC32)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	case "fmf":
+		_, err := fmt.Fprintln(w, "FTEMANIFEST 1")
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			line := fmt.Sprintf("package \"%s\" crc 0x%08x size %d", entry.Path, entry.CRC32, entry.Size)
+			if mirror != "" {
+				line += fmt.Sprintf(" mirror \"%s/%s\"", strings.TrimSuffix(mirror, "/"), entry.Path)
+			}
+			_, err = fmt.Fprintln(w, line)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown manifest format %q (want list, json or fmf)", format)
+	}
+}
+
+var downloadManifestRoot string
+var downloadManifestFormat string
+var downloadManifestMirror string
+
+var downloadManifestCmd = &cobra.Command{
+	Use:   "download-manifest <map>...",
+	Short: "Generate client download checksum manifests",
+	Long: `Generate a manifest listing size and CRC32 of each map and all of its
+sidecars (.lit, .lux, .ent, .loc, .way) with paths relative to --root, for
+keeping HTTP download trees consistent with what servers load.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var entries []DownloadEntry
+		for _, arg := range args {
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+			files := append([]string{arg}, FindSidecars(arg)...)
+			for _, file := range files {
+				entry, err := NewDownloadEntry(file, downloadManifestRoot)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, entry)
+			}
+		}
+
+		err := WriteDownloadManifest(os.Stdout, downloadManifestFormat, downloadManifestMirror, entries)
+		if err != nil {
+			return err
+		}
+		return nil
+	},
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// WaypointsLump holds a frogbot waypoint file embedded into the map.
+const WaypointsLump = "FROGBOT_WAYPOINTS"
+
+// LocationsLump holds a QuakeWorld .loc file embedded into the map.
+const LocationsLump = "LOCATIONS"
+
+// embedFile stores the contents of path in the named BSPX lump, writing the
+// result to <map>.new.bsp.
+func embedFile(mapPath string, lumpName string, path string, cmd *cobra.Command) error {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if len(buffer) == 0 {
+		return fmt.Errorf("%s is empty", path)
+	}
+
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	basename := strings.TrimSuffix(mapPath, filepath.Ext(mapPath))
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", mapPath, err)
+	}
+	destName := fmt.Sprintf("%s.new.bsp", basename)
+	err = bsp.StreamBSPXContext(cmd.Context(), &bspFile, f, destName, func(doc *bsp.Document) error {
+		doc.SetBspXLump(lumpName, buffer)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Embedded %s as %s, wrote %s\n", path, lumpName, destName)
+
+	return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+}
+
+// extractFile writes the named BSPX lump to path, defaulting to the map name
+// with ext.
+func extractFile(mapPath string, lumpName string, path string, ext string) error {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", mapPath, err)
+	}
+	buffer, err := bsp.ReadBspXLump(&bspFile, f, lumpName)
+	if err != nil {
+		return err
+	}
+	if buffer == nil {
+		return fmt.Errorf("%s has no %s lump", mapPath, lumpName)
+	}
+
+	if path == "" {
+		path = strings.TrimSuffix(mapPath, filepath.Ext(mapPath)) + ext
+	}
+	err = os.WriteFile(path, buffer, 0644)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Extracted %s to %s\n", lumpName, path)
+	return nil
+}
+
+var waypointsCmd = &cobra.Command{
+	Use:   "waypoints",
+	Short: "Embed or extract frogbot waypoints",
+}
+
+var waypointsEmbedCmd = &cobra.Command{
+	Use:   "embed <map> <file.way>",
+	Short: "Store a frogbot waypoint file in the " + WaypointsLump + " BSPX lump",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return embedFile(args[0], WaypointsLump, args[1], cmd)
+	},
+}
+
+var waypointsExtractCmd = &cobra.Command{
+	Use:   "extract <map> [file.way]",
+	Short: "Write the embedded frogbot waypoints back to a file",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := ""
+		if len(args) > 1 {
+			path = args[1]
+		}
+		return extractFile(args[0], WaypointsLump, path, ".way")
+	},
+}
+
+// CheckLocFile reports lines of a .loc file that are not "x y z name" with
+// integer coordinates in 1/8 units.
+func CheckLocFile(data []byte) []string {
+	var problems []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "//") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 4 {
+			problems = append(problems, fmt.Sprintf("line %d: expected x y z name", line))
+			continue
+		}
+		for _, field := range fields[:3] {
+			if _, err := strconv.Atoi(field); err != nil {
+				problems = append(problems, fmt.Sprintf("line %d: coordinate %q is not an integer", line, field))
+				break
+			}
+		}
+	}
+	return problems
+}
+
+var locsCmd = &cobra.Command{
+	Use:   "locs",
+	Short: "Embed or extract QuakeWorld .loc team locations",
+}
+
+var locsEmbedCmd = &cobra.Command{
+	Use:   "embed <map> <file.loc>",
+	Short: "Store a .loc file in the " + LocationsLump + " BSPX lump",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		buffer, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		for _, problem := range CheckLocFile(buffer) {
+			Warnf("%s: %s", args[1], problem)
+		}
+		return embedFile(args[0], LocationsLump, args[1], cmd)
+	},
+}
+
+var locsExtractCmd = &cobra.Command{
+	Use:   "extract <map> [file.loc]",
+	Short: "Write the embedded locations back to a .loc file",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := ""
+		if len(args) > 1 {
+			path = args[1]
+		}
+		return extractFile(args[0], LocationsLump, path, ".loc")
+	},
+}
+
+var embedSidecarsLoc bool
+var embedSidecarsWay bool
+
+var embedSidecarsCmd = &cobra.Command{
+	Use:   "embed-sidecars <map>",
+	Short: "Embed the .lit, .lux and .ent files found next to the map",
+	Long: `Look for <map>.lit, <map>.lux and <map>.ent beside the map and embed them in
+one pass: .lit and .lux become the RGBLIGHTING and LIGHTINGDIR BSPX lumps,
+.ent replaces the entities lump. With --loc and --way, .loc files (also from
+the gamedir's locs directory) and frogbot .way files are embedded as well.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		lighting := bspFile.BspHeader.Lumps[bsp.LumpLighting].Length
+
+		type sidecar struct {
+			path    string
+			ext     string
+			payload []byte
+		}
+		var sidecars []sidecar
+		seen := map[string]bool{}
+		for _, path := range FindSidecars(args[0]) {
+			ext := filepath.Ext(path)
+			if seen[ext] || (ext == ".loc" && !embedSidecarsLoc) || (ext == ".way" && !embedSidecarsWay) {
+				continue
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			payload, err := SidecarPayload(ext, data)
+			if err != nil {
+				Warnf("%s: %s, skipped", path, err)
+				continue
+			}
+			if (ext == ".lit" || ext == ".lux") && len(payload) != 3*int(lighting) {
+				Warnf("%s: %d bytes of light data for %d lightmap samples, skipped", path, len(payload), lighting)
+				continue
+			}
+			seen[ext] = true
+			sidecars = append(sidecars, sidecar{path, ext, payload})
+		}
+		if len(sidecars) == 0 {
+			fmt.Printf("No sidecar files found for %s\n", args[0])
+			return nil
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			for _, s := range sidecars {
+				if s.ext == ".ent" {
+					lumps[bsp.LumpEntities] = s.payload
+				} else {
+					bspx.Set(SidecarLumps[s.ext], s.payload)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, s := range sidecars {
+			target := SidecarLumps[s.ext]
+			if s.ext == ".ent" {
+				target = bsp.LumpType(bsp.LumpEntities).String()
+			}
+			fmt.Printf("Embedded %s as %s\n", s.path, target)
+		}
+		fmt.Printf("Wrote %s\n", destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
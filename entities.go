@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var entitiesPretty bool
+var entitiesNumber bool
+var entitiesJSON bool
+var entitiesExportGamedir string
+var entitiesExportExclude []string
+var entitiesExportForce bool
+var entitiesQueryCount bool
+var entitiesEditRemove []string
+var entitiesEditSet []string
+var entitiesEditUnset []string
+var entitiesEditAdd []string
+
+// EntityJSON encodes an entity as a JSON object with the keys in file order.
+// Duplicate keys are kept, which JSON allows though most decoders keep only
+// the last.
+type EntityJSON bsp.Entity
+
+func (e EntityJSON) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, kv := range e.Pairs {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, err := json.Marshal(kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// readEntitiesLump returns the entities lump of a map, which may be inside an
+// archive.
+func readEntitiesLump(mapPath string) ([]byte, error) {
+	f, err := OpenMapFile(mapPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapPath, err)
+	}
+	data, err := bsp.ReadLump(&bspFile, f, bsp.LumpEntities)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapPath, err)
+	}
+	return data, nil
+}
+
+// WriteEntities writes entities in the .ent format. With pretty set pairs are
+// indented and values aligned per entity, with number set each entity is
+// preceded by a comment with its index.
+func WriteEntities(w io.Writer, entities []bsp.Entity, pretty bool, number bool) error {
+	for i := range entities {
+		index := -1
+		if number {
+			index = i
+		}
+		if err := writeEntity(w, index, &entities[i], pretty); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEntity writes one entity, preceded by a comment with its index unless
+// index is negative.
+func writeEntity(w io.Writer, index int, entity *bsp.Entity, pretty bool) error {
+	if index >= 0 {
+		fmt.Fprintf(w, "// entity %d\n", index)
+	}
+	fmt.Fprintln(w, "{")
+	width := 0
+	for _, kv := range entity.Pairs {
+		if pretty && len(kv.Key)+2 > width {
+			width = len(kv.Key) + 2
+		}
+	}
+	for _, kv := range entity.Pairs {
+		if pretty {
+			fmt.Fprintf(w, "  %-*s \"%s\"\n", width, "\""+kv.Key+"\"", kv.Value)
+		} else {
+			fmt.Fprintf(w, "\"%s\" \"%s\"\n", kv.Key, kv.Value)
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// printEntities prints the entities lump of a map as it is, reformatted with
+// --pretty or --number, or as JSON.
+func printEntities(cmd *cobra.Command, args []string) error {
+	data, err := readEntitiesLump(args[0])
+	if err != nil {
+		return err
+	}
+	if entitiesJSON {
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		out := make([]EntityJSON, len(entities))
+		for i := range entities {
+			out[i] = EntityJSON(entities[i])
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(out)
+	}
+	if !entitiesPretty && !entitiesNumber {
+		_, err = os.Stdout.Write(bytes.TrimRight(data, "\x00"))
+		return err
+	}
+
+	entities, err := bsp.ParseEntities(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	return WriteEntities(os.Stdout, entities, entitiesPretty, entitiesNumber)
+}
+
+var entitiesCmd = &cobra.Command{
+	Use:   "entities <map>",
+	Short: "Print or edit the entities lump",
+	Long: `Print the entities lump of a map as text, like entities print. The
+subcommands edit it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: printEntities,
+}
+
+var entitiesPrintCmd = &cobra.Command{
+	Use:   "print <map>",
+	Short: "Print the entities lump",
+	Long: `Print the entities lump of a map as text. --pretty indents the key/value
+pairs and aligns the values, --number precedes every entity with a comment
+giving its index, the number validate and grep refer to entities by. --json
+prints an array with an object per entity, keys in file order and duplicate
+keys kept, e.g. for jq.`,
+	Args: cobra.ExactArgs(1),
+	RunE: printEntities,
+}
+
+// writeEntitiesLump writes a copy of the map with the entities lump replaced
+// by data, moving the lumps after it as needed.
+func writeEntitiesLump(cmd *cobra.Command, mapPath string, data []byte) (string, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	doc, err := bsp.OpenDocument(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", mapPath, err)
+	}
+	doc.SetLump(bsp.LumpEntities, data)
+
+	basename := strings.TrimSuffix(mapPath, filepath.Ext(mapPath))
+	destName := fmt.Sprintf("%s.new.bsp", basename)
+	err = doc.WriteFileContext(cmd.Context(), destName)
+	if err != nil {
+		return "", err
+	}
+	return destName, RunUploadHooks(cmd.Context(), destName, cmd.Name())
+}
+
+var entitiesSetCmd = &cobra.Command{
+	Use:   "set <map> <file.ent>",
+	Short: "Replace the entities lump with the contents of a .ent file",
+	Long: `Write a copy of the map with the entities lump replaced by a .ent file, the
+usual way to fix entities on a server without recompiling the map. The file
+is checked to parse and stored as it is, with the trailing NUL engines
+expect.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		if len(entities) == 0 || entities[0].Classname() != "worldspawn" {
+			Warnf("%s: first entity is not worldspawn", args[1])
+		}
+
+		data = append(bytes.TrimRight(data, "\x00"), 0)
+		destName, err := writeEntitiesLump(cmd, args[0], data)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Replaced entities with %d entities from %s, wrote %s\n", len(entities), args[1], destName)
+		return nil
+	},
+}
+
+// removeEntities drops the entities matching any of the filters and returns
+// the rest together with the number removed.
+func removeEntities(entities []bsp.Entity, filters []EntityFilter) ([]bsp.Entity, int) {
+	kept := entities[:0]
+	for i := range entities {
+		removed := false
+		for _, filter := range filters {
+			if filter.Match(&entities[i]) {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			kept = append(kept, entities[i])
+		}
+	}
+	return kept, len(entities) - len(kept)
+}
+
+// EntFileName returns where engines look for the .ent file of a map: next to
+// the map, or in the maps directory of gamedir if set.
+func EntFileName(mapPath string, gamedir string) (string, error) {
+	archive, member := splitArchivePath(mapPath)
+	if gamedir != "" {
+		name := filepath.Base(filepath.FromSlash(mapPath))
+		return filepath.Join(gamedir, "maps", strings.TrimSuffix(name, filepath.Ext(name))+".ent"), nil
+	}
+	if archive != "" {
+		return "", fmt.Errorf("%s is inside %s, give --gamedir to write its .ent file to", member, archive)
+	}
+	return strings.TrimSuffix(mapPath, filepath.Ext(mapPath)) + ".ent", nil
+}
+
+var entitiesExportCmd = &cobra.Command{
+	Use:   "export <map>",
+	Short: "Write the entities lump to the .ent file engines load instead",
+	Long: `Write the entities lump to <map>.ent next to the map, or to maps/<map>.ent
+in --gamedir, where servers and engines supporting external entity files
+pick it up instead of the lump. Entities matching an --exclude filter such as
+classname=trigger_changelevel are left out. An existing .ent file is only
+replaced with --force.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filters, err := ParseEntityFilters(entitiesExportExclude)
+		if err != nil {
+			return err
+		}
+		entName, err := EntFileName(args[0], entitiesExportGamedir)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(entName); err == nil && !entitiesExportForce {
+			return fmt.Errorf("%s exists already, use --force to replace it", entName)
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		if len(filters) > 0 {
+			var excluded int
+			entities, excluded = removeEntities(entities, filters)
+			Infof("excluded %d entities", excluded)
+			data, err = bsp.FormatEntities(entities)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = os.MkdirAll(filepath.Dir(entName), 0755)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(entName, bytes.TrimRight(data, "\x00"), 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d entities to %s\n", len(entities), entName)
+		return nil
+	},
+}
+
+var entitiesQueryCmd = &cobra.Command{
+	Use:   "query <map> [filter]...",
+	Short: "Print the entities matching key/value filters",
+	Long: `Print the entities matching all filters with their index. A filter is
+key=pattern for entities with a matching pair, key!=pattern for those
+without, or a bare key for those having it; keys and values are glob
+patterns, e.g.
+
+  bspxmgr entities query ctf1.bsp 'classname=item_armor*'
+  bspxmgr entities query ctf1.bsp 'classname=weapon_*' 'spawnflags'
+
+--count prints the number of matches per classname instead, --json the
+matching entities as JSON.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filters, err := ParseEntityFilters(args[1:])
+		if err != nil {
+			return err
+		}
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		var matches []int
+		for i := range entities {
+			if MatchAll(filters, &entities[i]) {
+				matches = append(matches, i)
+			}
+		}
+
+		switch {
+		case entitiesQueryCount:
+			counts := map[string]int{}
+			for _, i := range matches {
+				counts[entities[i].Classname()]++
+			}
+			var classnames []string
+			for classname := range counts {
+				classnames = append(classnames, classname)
+			}
+			sort.Strings(classnames)
+			for _, classname := range classnames {
+				fmt.Printf("  %-24s %8d\n", classname, counts[classname])
+			}
+			fmt.Printf("  %-24s %8d\n", "Total", len(matches))
+		case entitiesJSON:
+			out := make([]EntityJSON, len(matches))
+			for j, i := range matches {
+				out[j] = EntityJSON(entities[i])
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.SetEscapeHTML(false)
+			return encoder.Encode(out)
+		default:
+			for _, i := range matches {
+				if err := writeEntity(os.Stdout, i, &entities[i], entitiesPretty); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// EntityKeyEdit is a --set or --unset of entities edit: the key of every
+// entity whose classname matches the Classname glob pattern is set to Value,
+// or removed if Unset.
+type EntityKeyEdit struct {
+	Classname string
+	Key       string
+	Value     string
+	Unset     bool
+}
+
+// ParseEntityKeyEdit parses "classname:key=value", or "classname:key" if
+// unset.
+func ParseEntityKeyEdit(s string, unset bool) (EntityKeyEdit, error) {
+	classname, pair, found := strings.Cut(s, ":")
+	edit := EntityKeyEdit{Classname: classname, Key: pair, Unset: unset}
+	if !unset {
+		edit.Key, edit.Value, found = strings.Cut(pair, "=")
+	}
+	if !found || edit.Classname == "" || edit.Key == "" {
+		if unset {
+			return edit, fmt.Errorf("invalid --unset %q, expected classname:key", s)
+		}
+		return edit, fmt.Errorf("invalid --set %q, expected classname:key=value", s)
+	}
+	if _, err := path.Match(edit.Classname, ""); err != nil {
+		return edit, fmt.Errorf("invalid classname pattern %q: %w", edit.Classname, err)
+	}
+	if err := bsp.CheckKeyValue(edit.Key, edit.Value); err != nil {
+		return edit, err
+	}
+	return edit, nil
+}
+
+// Apply edits the matching entities and returns how many there were.
+func (e EntityKeyEdit) Apply(entities []bsp.Entity) int {
+	matched := 0
+	for i := range entities {
+		if ok, _ := path.Match(e.Classname, entities[i].Classname()); !ok {
+			continue
+		}
+		matched++
+		if e.Unset {
+			entities[i].Delete(e.Key)
+		} else {
+			entities[i].Set(e.Key, e.Value)
+		}
+	}
+	return matched
+}
+
+var entitiesEditCmd = &cobra.Command{
+	Use:   "edit <map>",
+	Short: "Remove, modify and add entities in a single rewrite",
+	Long: `Write a copy of the map with its entities edited, e.g.
+
+  bspxmgr entities edit ctf1.bsp --remove classname=trigger_changelevel \
+      --set 'worldspawn:message=Night CTF' \
+      --add '{classname item_flag_team1 origin "0 0 64"}'
+
+--remove drops the entities matching a filter as accepted by entities query,
+--set classname:key=value sets a key and --unset classname:key removes it
+from every entity whose classname matches the glob pattern, and --add
+appends entities written as in a .ent file. All flags may be repeated and
+are applied in this order. Nothing is written if a --set or --unset matches
+no entity. Keys and values can't contain quotes or newlines, the entities
+lump has no way to escape them.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filters, err := ParseEntityFilters(entitiesEditRemove)
+		if err != nil {
+			return err
+		}
+		var edits []EntityKeyEdit
+		for _, value := range entitiesEditSet {
+			edit, err := ParseEntityKeyEdit(value, false)
+			if err != nil {
+				return err
+			}
+			edits = append(edits, edit)
+		}
+		for _, value := range entitiesEditUnset {
+			edit, err := ParseEntityKeyEdit(value, true)
+			if err != nil {
+				return err
+			}
+			edits = append(edits, edit)
+		}
+		var added []bsp.Entity
+		for _, value := range entitiesEditAdd {
+			entities, err := bsp.ParseEntities([]byte(value))
+			if err != nil {
+				return fmt.Errorf("invalid --add %q: %w", value, err)
+			}
+			if len(entities) == 0 {
+				return fmt.Errorf("invalid --add %q: no entity", value)
+			}
+			added = append(added, entities...)
+		}
+		if len(filters) == 0 && len(edits) == 0 && len(added) == 0 {
+			return fmt.Errorf("nothing to do, give --remove, --set, --unset or --add")
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		entities, removed := removeEntities(entities, filters)
+		if len(entities) == 0 || entities[0].Classname() != "worldspawn" {
+			Warnf("%s: first entity is no longer worldspawn", args[0])
+		}
+		for _, edit := range edits {
+			if edit.Apply(entities) == 0 {
+				return fmt.Errorf("no entity with classname %s", edit.Classname)
+			}
+		}
+		entities = append(entities, added...)
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d entities, applied %d key edits, added %d entities, wrote %s\n", removed, len(edits), len(added), destName)
+		return nil
+	},
+}
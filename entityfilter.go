@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// EntityFilter selects entities by a key/value condition: "key=pattern"
+// matches entities with a pair whose key and value match the glob patterns,
+// "key!=pattern" those without such a pair and a bare "key" those having the
+// key at all.
+type EntityFilter struct {
+	Key    string
+	Value  string
+	Negate bool
+	HasKey bool
+}
+
+// ParseEntityFilter parses a filter given on the command line.
+func ParseEntityFilter(s string) (EntityFilter, error) {
+	var filter EntityFilter
+	if key, value, found := strings.Cut(s, "!="); found {
+		filter = EntityFilter{Key: key, Value: value, Negate: true}
+	} else if key, value, found := strings.Cut(s, "="); found {
+		filter = EntityFilter{Key: key, Value: value}
+	} else {
+		filter = EntityFilter{Key: s, HasKey: true}
+	}
+	if filter.Key == "" {
+		return filter, fmt.Errorf("invalid filter %q, expected key=pattern, key!=pattern or key", s)
+	}
+	for _, pattern := range []string{filter.Key, filter.Value} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return filter, fmt.Errorf("invalid filter %q: %w", s, err)
+		}
+	}
+	return filter, nil
+}
+
+// ParseEntityFilters parses every filter of a repeated flag.
+func ParseEntityFilters(values []string) ([]EntityFilter, error) {
+	filters := make([]EntityFilter, len(values))
+	for i, value := range values {
+		var err error
+		filters[i], err = ParseEntityFilter(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
+
+// Match reports whether the entity passes the filter.
+func (f EntityFilter) Match(entity *bsp.Entity) bool {
+	for _, kv := range entity.Pairs {
+		if keyMatched, _ := path.Match(f.Key, kv.Key); !keyMatched {
+			continue
+		}
+		if f.HasKey {
+			return true
+		}
+		if valueMatched, _ := path.Match(f.Value, kv.Value); valueMatched {
+			return !f.Negate
+		}
+	}
+	return f.Negate
+}
+
+// MatchAll reports whether the entity passes all filters.
+func MatchAll(filters []EntityFilter, entity *bsp.Entity) bool {
+	for _, filter := range filters {
+		if !filter.Match(entity) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f EntityFilter) String() string {
+	switch {
+	case f.HasKey:
+		return f.Key
+	case f.Negate:
+		return f.Key + "!=" + f.Value
+	}
+	return f.Key + "=" + f.Value
+}
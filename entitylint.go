@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// EntityClass describes a classname known to the game code: the keys an
+// entity of the class needs for the game to spawn it properly.
+type EntityClass struct {
+	Required []string `json:"required"`
+}
+
+// EntityClasses maps classnames to their descriptions.
+type EntityClasses map[string]EntityClass
+
+// Point entities of id1 and the QuakeWorld and CTF mods, placed by origin.
+var builtinPointClasses = []string{
+	"info_player_start", "info_player_start2", "info_player_deathmatch", "info_player_coop",
+	"info_player_team1", "info_player_team2", "info_intermission", "info_teleport_destination",
+	"testplayerstart",
+	"light", "light_fluoro", "light_fluorospark", "light_globe", "light_torch_small_walltorch",
+	"light_flame_large_yellow", "light_flame_small_yellow", "light_flame_small_white",
+	"item_health", "item_armor1", "item_armor2", "item_armorInv",
+	"item_shells", "item_spikes", "item_rockets", "item_cells",
+	"item_artifact_invulnerability", "item_artifact_envirosuit", "item_artifact_invisibility",
+	"item_artifact_super_damage", "item_key1", "item_key2", "item_sigil",
+	"item_flag_team1", "item_flag_team2", "item_tfgoal", "info_tfgoal", "info_player_teamspawn",
+	"weapon_supershotgun", "weapon_nailgun", "weapon_supernailgun",
+	"weapon_grenadelauncher", "weapon_rocketlauncher", "weapon_lightning",
+	"monster_army", "monster_dog", "monster_ogre", "monster_ogre_marksman", "monster_knight",
+	"monster_hell_knight", "monster_wizard", "monster_demon1", "monster_shambler",
+	"monster_zombie", "monster_enforcer", "monster_shalrath", "monster_tarbaby",
+	"monster_fish", "monster_oldone", "monster_boss",
+	"misc_fireball", "misc_explobox", "misc_explobox2", "misc_teleporttrain", "misc_noisemaker",
+	"misc_model", "air_bubbles", "viewthing", "trap_spikeshooter", "trap_shooter",
+	"path_corner",
+	"ambient_suck_wind", "ambient_drone", "ambient_flouro_buzz", "ambient_drip",
+	"ambient_comp_hum", "ambient_thunder", "ambient_light_buzz", "ambient_swamp1", "ambient_swamp2",
+}
+
+// Brush entities of id1 and the QuakeWorld and CTF mods, built from a model.
+var builtinBrushClasses = []string{
+	"func_door", "func_door_secret", "func_plat", "func_train", "func_button", "func_wall",
+	"func_illusionary", "func_episodegate", "func_bossgate", "func_dm_only", "func_ctf_wall",
+	"trigger_multiple", "trigger_once", "trigger_secret", "trigger_teleport",
+	"trigger_changelevel", "trigger_setskill", "trigger_onlyregistered", "trigger_hurt",
+	"trigger_push", "trigger_monsterjump",
+}
+
+// Entities without origin or model and keys the game code can't do without.
+var builtinOtherClasses = []string{"worldspawn", "info_null", "info_notnull", "trigger_relay", "trigger_counter", "event_lightning"}
+
+var builtinRequiredKeys = map[string][]string{
+	"info_teleport_destination": {"targetname"},
+	"path_corner":               {"targetname"},
+	"trigger_teleport":          {"target"},
+	"trigger_changelevel":       {"map"},
+	"func_train":                {"target"},
+	"misc_teleporttrain":        {"target"},
+}
+
+// BuiltinEntityClasses returns the classnames bspxmgr knows, from id1 and the
+// QuakeWorld and CTF mods.
+func BuiltinEntityClasses() EntityClasses {
+	classes := EntityClasses{}
+	add := func(names []string, key string) {
+		for _, name := range names {
+			var required []string
+			if key != "" {
+				required = append(required, key)
+			}
+			classes[name] = EntityClass{Required: append(required, builtinRequiredKeys[name]...)}
+		}
+	}
+	add(builtinPointClasses, "origin")
+	add(builtinBrushClasses, "model")
+	add(builtinOtherClasses, "")
+	return classes
+}
+
+// ReadEntityClasses adds the classnames of a JSON file such as
+//
+//	{"item_tech1": {"required": ["origin"]}}
+//
+// to classes, replacing the description of known ones.
+func ReadEntityClasses(classes EntityClasses, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var extra EntityClasses
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, class := range extra {
+		classes[name] = class
+	}
+	return nil
+}
+
+// editDistance returns the Levenshtein distance of two strings.
+func editDistance(a, b string) int {
+	row := make([]int, len(b)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		diagonal := row[0]
+		row[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			next := diagonal + cost
+			if row[j]+1 < next {
+				next = row[j] + 1
+			}
+			if row[j-1]+1 < next {
+				next = row[j-1] + 1
+			}
+			diagonal, row[j] = row[j], next
+		}
+	}
+	return row[len(b)]
+}
+
+// SuggestClassname returns the known classname closest to an unknown one, or
+// "" if none is close enough to be a likely typo.
+func (classes EntityClasses) SuggestClassname(classname string) string {
+	names := make([]string, 0, len(classes))
+	for name := range classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	best, bestDistance := "", 3
+	for _, name := range names {
+		if distance := editDistance(classname, name); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+// LintEntities checks every entity has a known classname and the keys its
+// class requires. Unknown classnames close to a known one are errors, as the
+// entity silently fails to spawn; others are warnings, they may belong to a
+// mod.
+func LintEntities(entities []bsp.Entity, classes EntityClasses) []Finding {
+	var findings []Finding
+	add := func(severity Severity, check string, entity int, format string, a ...interface{}) {
+		findings = append(findings, Finding{severity, check, fmt.Sprintf(format, a...), entity})
+	}
+
+	for i := range entities {
+		e := &entities[i]
+		if !e.Has("classname") {
+			add(SeverityError, "entities.classname", i, "%s has no classname", entityRef(entities, i))
+			continue
+		}
+		class, known := classes[e.Classname()]
+		if !known {
+			if suggestion := classes.SuggestClassname(e.Classname()); suggestion != "" {
+				add(SeverityError, "entities.classname", i, "unknown classname in %s, did you mean %s?", entityRef(entities, i), suggestion)
+			} else {
+				add(SeverityWarning, "entities.classname", i, "unknown classname in %s", entityRef(entities, i))
+			}
+			continue
+		}
+		for _, key := range class.Required {
+			if !e.Has(key) {
+				add(SeverityError, "entities.keys", i, "%s has no %s", entityRef(entities, i), key)
+			}
+		}
+	}
+	return findings
+}
+
+// loadEntityClasses returns the built-in classnames extended by the files of
+// --classes.
+func loadEntityClasses(paths []string) (EntityClasses, error) {
+	classes := BuiltinEntityClasses()
+	for _, path := range paths {
+		if err := ReadEntityClasses(classes, path); err != nil {
+			return nil, err
+		}
+	}
+	return classes, nil
+}
+
+var entitiesLintClasses []string
+var entitiesLintFailOn string
+
+var entitiesLintCmd = &cobra.Command{
+	Use:   "lint <map>",
+	Short: "Check entities against the known classnames and their required keys",
+	Long: `Check every entity has a classname known to id1, QuakeWorld or the CTF mods
+and the keys its class needs, such as origin for items or target for
+teleporters. A classname close to a known one, like
+item_artifact_invulnerabilty, is an error since the entity never spawns; other
+unknown classnames are warnings as they may belong to a mod.
+
+--classes adds the classnames of a JSON file mapping classnames to their
+required keys, e.g. {"item_tech1": {"required": ["origin"]}}. Exits with
+status 3 when any finding is at or above the --fail-on severity.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		threshold, err := ParseSeverity(entitiesLintFailOn)
+		if err != nil {
+			return err
+		}
+		classes, err := loadEntityClasses(entitiesLintClasses)
+		if err != nil {
+			return err
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		findings := LintEntities(entities, classes)
+		if len(findings) == 0 {
+			fmt.Printf("%s: no problems found\n", args[0])
+		}
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+		if FailsAt(findings, threshold) {
+			return ErrCheckFailed
+		}
+		return nil
+	},
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var entitiesReplaceKey string
+var entitiesReplaceWhere []string
+var entitiesReplaceRegex bool
+var entitiesReplacePreview bool
+
+// EntityReplacement is a value changed by entities replace.
+type EntityReplacement struct {
+	Entity   int
+	Key      string
+	OldValue string
+	NewValue string
+}
+
+// ReplaceEntityValues replaces pattern with replacement in the values of the
+// pairs whose key matches the key glob pattern, in the entities passing all
+// filters. With re set the pattern is a regular expression and $1 in the
+// replacement expands to its first group, otherwise it is replaced literally.
+// Values that would contain quotes or newlines, which the entities lump can't
+// hold, are left as they are and returned as warnings.
+func ReplaceEntityValues(entities []bsp.Entity, key string, filters []EntityFilter, pattern string, replacement string, re *regexp.Regexp) ([]EntityReplacement, []string) {
+	var replacements []EntityReplacement
+	var warnings []string
+	for i := range entities {
+		if !MatchAll(filters, &entities[i]) {
+			continue
+		}
+		for j, kv := range entities[i].Pairs {
+			if matched, _ := path.Match(key, kv.Key); !matched {
+				continue
+			}
+			value := kv.Value
+			if re != nil {
+				value = re.ReplaceAllString(value, replacement)
+			} else if pattern != "" {
+				value = strings.ReplaceAll(value, pattern, replacement)
+			}
+			if value == kv.Value {
+				continue
+			}
+			if err := bsp.CheckKeyValue(kv.Key, value); err != nil {
+				warnings = append(warnings, fmt.Sprintf("entity %d (%s): skipped, %s", i, entities[i].Classname(), err))
+				continue
+			}
+			replacements = append(replacements, EntityReplacement{i, kv.Key, kv.Value, value})
+			entities[i].Pairs[j].Value = value
+		}
+	}
+	return replacements, warnings
+}
+
+var entitiesReplaceCmd = &cobra.Command{
+	Use:   "replace <map> <pattern> <replacement>",
+	Short: "Search and replace in the values of entity keys",
+	Long: `Write a copy of the map with pattern replaced in entity values, limited to
+keys matching the --key glob pattern and entities passing every --where
+filter as accepted by entities query, e.g.
+
+  bspxmgr entities replace --key sounds --regex dm4.bsp '^.*$' 4
+  bspxmgr entities replace --key model --where classname=misc_model dm4.bsp progs/tree.mdl progs/tree2.mdl
+
+With --regex the pattern is a regular expression and $1 in the replacement
+stands for its first group. Replacements that would put quotes or newlines
+in a value are skipped with a warning, the entities lump can't hold them.
+--preview prints the changes without writing a map.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filters, err := ParseEntityFilters(entitiesReplaceWhere)
+		if err != nil {
+			return err
+		}
+		if _, err := path.Match(entitiesReplaceKey, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %q: %w", entitiesReplaceKey, err)
+		}
+		var re *regexp.Regexp
+		if entitiesReplaceRegex {
+			re, err = regexp.Compile(args[1])
+			if err != nil {
+				return err
+			}
+		} else if args[1] == "" {
+			return fmt.Errorf("empty pattern")
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		replacements, warnings := ReplaceEntityValues(entities, entitiesReplaceKey, filters, args[1], args[2], re)
+		for _, warning := range warnings {
+			Warnf("%s: %s", args[0], warning)
+		}
+		for _, r := range replacements {
+			line := fmt.Sprintf("entity %d (%s): \"%s\" \"%s\" -> \"%s\"", r.Entity, entities[r.Entity].Classname(), r.Key, r.OldValue, r.NewValue)
+			if entitiesReplacePreview {
+				fmt.Println(line)
+			} else {
+				Infof("%s", line)
+			}
+		}
+		if len(replacements) == 0 && len(warnings) > 0 {
+			return fmt.Errorf("%s: every replacement of %s was skipped", args[0], args[1])
+		}
+		if len(replacements) == 0 {
+			return fmt.Errorf("%s: no value matches %s", args[0], args[1])
+		}
+		if entitiesReplacePreview {
+			fmt.Printf("%d values would be replaced\n", len(replacements))
+			return nil
+		}
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Replaced %d values, wrote %s\n", len(replacements), destName)
+		return nil
+	},
+}
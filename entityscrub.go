@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var entitiesScrubKeys []string
+var entitiesScrubCheck bool
+
+// defaultScrubKeys are the keys map editors and compilers leave in entities
+// that engines never read.
+var defaultScrubKeys = []string{"_compiler*", "_generator", "_tb_*", "_jack*"}
+
+// localPath matches values that contain an absolute path of the machine the
+// map was made on.
+var localPath = regexp.MustCompile(`(^|[^A-Za-z])[A-Za-z]:[\\/]|^[\\/]|/home/|/Users/`)
+
+// ScrubChange is a key removed or a value changed by ScrubEntities. NewValue
+// is empty for removed keys.
+type ScrubChange struct {
+	Entity   int
+	Key      string
+	OldValue string
+	NewValue string
+}
+
+// scrubWad reduces the wad paths of a worldspawn wad value to their file
+// names, which is all engines loading wads look up.
+func scrubWad(value string) string {
+	wads := strings.Split(value, ";")
+	for i, wad := range wads {
+		wads[i] = wad[strings.LastIndexAny(wad, `/\`)+1:]
+	}
+	return strings.Join(wads, ";")
+}
+
+// ScrubEntities removes the keys matching any of the glob patterns and strips
+// the directories of worldspawn wad paths. It returns the changes and the
+// remaining pairs that still contain a local path, which are left to the
+// user as there is no telling what they should be.
+func ScrubEntities(entities []bsp.Entity, keys []string) ([]ScrubChange, []ScrubChange) {
+	var changes, remaining []ScrubChange
+	for i := range entities {
+		pairs := entities[i].Pairs[:0]
+		for _, kv := range entities[i].Pairs {
+			removed := false
+			for _, pattern := range keys {
+				if matched, _ := path.Match(pattern, kv.Key); matched {
+					removed = true
+					break
+				}
+			}
+			if removed {
+				changes = append(changes, ScrubChange{i, kv.Key, kv.Value, ""})
+				continue
+			}
+			if kv.Key == "wad" && entities[i].Classname() == "worldspawn" {
+				if wad := scrubWad(kv.Value); wad != kv.Value {
+					changes = append(changes, ScrubChange{i, kv.Key, kv.Value, wad})
+					kv.Value = wad
+				}
+			}
+			if localPath.MatchString(kv.Value) {
+				remaining = append(remaining, ScrubChange{i, kv.Key, kv.Value, kv.Value})
+			}
+			pairs = append(pairs, kv)
+		}
+		entities[i].Pairs = pairs
+	}
+	return changes, remaining
+}
+
+var entitiesScrubCmd = &cobra.Command{
+	Use:   "scrub <map>",
+	Short: "Remove wad paths and editor metadata from the entities before release",
+	Long: `Write a copy of the map without the local file system details editors and
+compilers leave in the entities: directories of the worldspawn wad paths are
+stripped, leaving the wad names, and keys such as _compiler, _generator and
+the _tb_ keys of TrenchBroom are removed. --key replaces the keys removed by
+glob patterns of its own. Other values that still contain an absolute path
+are reported for fixing by hand, e.g. with entities replace.
+
+--check only prints what would change and exits with status 3 if anything
+would.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		keys := entitiesScrubKeys
+		if !cmd.Flags().Changed("key") {
+			keys = defaultScrubKeys
+		}
+		for _, pattern := range keys {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+			}
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		changes, remaining := ScrubEntities(entities, keys)
+		for _, change := range changes {
+			line := fmt.Sprintf("entity %d (%s): removed \"%s\" \"%s\"", change.Entity, entities[change.Entity].Classname(), change.Key, change.OldValue)
+			if change.NewValue != "" {
+				line = fmt.Sprintf("entity %d (%s): \"%s\" \"%s\" -> \"%s\"", change.Entity, entities[change.Entity].Classname(), change.Key, change.OldValue, change.NewValue)
+			}
+			if entitiesScrubCheck {
+				fmt.Println(line)
+			} else {
+				Infof("%s", line)
+			}
+		}
+		for _, r := range remaining {
+			Warnf("%s: entity %d (%s): \"%s\" \"%s\" contains a local path", args[0], r.Entity, entities[r.Entity].Classname(), r.Key, r.OldValue)
+		}
+
+		if entitiesScrubCheck {
+			if len(changes) > 0 || len(remaining) > 0 {
+				return ErrCheckFailed
+			}
+			fmt.Printf("%s: nothing to scrub\n", args[0])
+			return nil
+		}
+		if len(changes) == 0 {
+			fmt.Printf("%s: nothing to scrub\n", args[0])
+			return nil
+		}
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Scrubbed %d keys, wrote %s\n", len(changes), destName)
+		return nil
+	},
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var entitiesTransformTranslate string
+var entitiesTransformRotate float64
+
+// EntityRotationZ returns a rotation around the z axis by any angle. Entities
+// have no clipping hulls, so unlike RotationZ any angle is accepted; multiples
+// of 90 degrees are exact.
+func EntityRotationZ(degrees float64) [3][3]float64 {
+	if rotation, err := RotationZ(degrees); err == nil {
+		return rotation
+	}
+	rad := degrees * math.Pi / 180
+	c, s := math.Cos(rad), math.Sin(rad)
+	return [3][3]float64{{c, -s, 0}, {s, c, 0}, {0, 0, 1}}
+}
+
+var entitiesTransformCmd = &cobra.Command{
+	Use:   "transform <map>",
+	Short: "Translate and rotate the entities only",
+	Long: `Write a copy of the map with the origin, angle, angles and mangle keys of
+every entity rotated around the z axis by --rotate-z degrees, then moved by
+--translate x,y,z. The geometry is left as it is, for grafting an entity
+set onto a rotated or shifted version of the map, e.g.
+
+  bspxmgr entities set ctf1-shifted.bsp ctf1.ent
+  bspxmgr entities transform --translate 512,0,0 ctf1-shifted.new.bsp
+
+Use transform to move the whole map.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t := IdentityTransform()
+		t.Rotation = EntityRotationZ(entitiesTransformRotate)
+		if entitiesTransformTranslate != "" {
+			var err error
+			t.Translation, err = parseVectorFlag(entitiesTransformTranslate)
+			if err != nil {
+				return err
+			}
+		}
+		if t == IdentityTransform() {
+			return fmt.Errorf("nothing to do, give --translate or --rotate-z")
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		for i := range entities {
+			t.transformEntity(&entities[i])
+		}
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Transformed %d entities, wrote %s\n", len(entities), destName)
+		return nil
+	},
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/qw-ctf/bspxmgr/pkg/bspxmgr"
+	"github.com/spf13/cobra"
+)
+
+type EquivalenceCheck struct {
+	Name   string
+	Passed bool
+	Detail string
+}
+
+func (c EquivalenceCheck) String() string {
+	status := "PASS"
+	if !c.Passed {
+		status = "FAIL"
+	}
+	return fmt.Sprintf("%s %-14s %s", status, c.Name, c.Detail)
+}
+
+// targetKeys are entity keys holding names that obfuscation may rewrite, as
+// long as every reference is rewritten consistently.
+var targetKeys = map[string]bool{
+	"target":     true,
+	"targetname": true,
+	"killtarget": true,
+}
+
+type openMap struct {
+	f       MapFile
+	bspFile bsp.BspFile
+}
+
+func compareLumps(a, b *openMap, lumps []bsp.LumpType) (bool, string, error) {
+	var differing []string
+	for _, lumpType := range lumps {
+		bufferA, err := bsp.ReadLump(&a.bspFile, a.f, lumpType)
+		if err != nil {
+			return false, "", err
+		}
+		bufferB, err := bsp.ReadLump(&b.bspFile, b.f, lumpType)
+		if err != nil {
+			return false, "", err
+		}
+		if !bytes.Equal(bufferA, bufferB) {
+			differing = append(differing, lumpType.String())
+		}
+	}
+	if len(differing) > 0 {
+		return false, "differs in " + strings.Join(differing, ", "), nil
+	}
+	return true, "identical", nil
+}
+
+// shadeShifted reports whether the texels of b differ from a only where
+// obfuscate --scramble-pixels moves them to the neighbouring shade of their
+// palette ramp, and how many do.
+func shadeShifted(a, b []byte) (int, bool) {
+	if len(a) != len(b) {
+		return 0, false
+	}
+	shifted := 0
+	for i := range a {
+		if a[i] == b[i] {
+			continue
+		}
+		if a[i]^b[i] != 1 || a[i] >= bsp.FullbrightStart {
+			return 0, false
+		}
+		shifted++
+	}
+	return shifted, true
+}
+
+func compareTextures(a, b *openMap) (bool, string, error) {
+	bufferA, err := bsp.ReadLump(&a.bspFile, a.f, bsp.LumpTextures)
+	if err != nil {
+		return false, "", err
+	}
+	bufferB, err := bsp.ReadLump(&b.bspFile, b.f, bsp.LumpTextures)
+	if err != nil {
+		return false, "", err
+	}
+	texturesA, err := bsp.ParseTextureLump(bufferA)
+	if err != nil {
+		return false, "", err
+	}
+	texturesB, err := bsp.ParseTextureLump(bufferB)
+	if err != nil {
+		return false, "", err
+	}
+
+	if len(texturesA) != len(texturesB) {
+		return false, fmt.Sprintf("texture count %d != %d", len(texturesA), len(texturesB)), nil
+	}
+
+	renamed, scrambled := 0, 0
+	for i := range texturesA {
+		ta, tb := &texturesA[i], &texturesB[i]
+		if ta.Missing() != tb.Missing() {
+			return false, fmt.Sprintf("texture %d missing in only one map", i), nil
+		}
+		if ta.Missing() {
+			continue
+		}
+		if ta.MipTex.Width != tb.MipTex.Width || ta.MipTex.Height != tb.MipTex.Height || ta.MipTex.Offsets != tb.MipTex.Offsets {
+			return false, fmt.Sprintf("texture %d (%s) header differs", i, ta.Name()), nil
+		}
+		if shifted, ok := shadeShifted(ta.Pixels, tb.Pixels); !ok {
+			return false, fmt.Sprintf("texture %d (%s) pixels differ", i, ta.Name()), nil
+		} else if shifted > 0 {
+			scrambled++
+		}
+		if bsp.TextureClass(ta.Name()) != bsp.TextureClass(tb.Name()) {
+			return false, fmt.Sprintf("texture %d renamed %s => %s changes its behaviour", i, ta.Name(), tb.Name()), nil
+		}
+		if ta.Name() != tb.Name() {
+			renamed++
+		}
+	}
+	return true, fmt.Sprintf("%d textures, %d renamed, %d scrambled", len(texturesA), renamed, scrambled), nil
+}
+
+func compareEntities(a, b *openMap) (bool, string, error) {
+	entitiesA, err := bsp.ReadEntities(&a.bspFile, a.f)
+	if err != nil {
+		return false, "", err
+	}
+	entitiesB, err := bsp.ReadEntities(&b.bspFile, b.f)
+	if err != nil {
+		return false, "", err
+	}
+
+	if len(entitiesA) != len(entitiesB) {
+		return false, fmt.Sprintf("entity count %d != %d", len(entitiesA), len(entitiesB)), nil
+	}
+
+	forward := map[string]string{}
+	backward := map[string]string{}
+	for i := range entitiesA {
+		pairsA, pairsB := entitiesA[i].Pairs, entitiesB[i].Pairs
+		if len(pairsA) != len(pairsB) {
+			return false, fmt.Sprintf("%s has different keys", entityRef(entitiesA, i)), nil
+		}
+		for j := range pairsA {
+			if pairsA[j].Key != pairsB[j].Key {
+				return false, fmt.Sprintf("%s has different keys", entityRef(entitiesA, i)), nil
+			}
+			if !targetKeys[pairsA[j].Key] {
+				if pairsA[j].Value != pairsB[j].Value {
+					return false, fmt.Sprintf("%s differs in %q", entityRef(entitiesA, i), pairsA[j].Key), nil
+				}
+				continue
+			}
+			from, to := pairsA[j].Value, pairsB[j].Value
+			if mapped, found := forward[from]; found && mapped != to {
+				return false, fmt.Sprintf("target name %q renamed inconsistently", from), nil
+			}
+			if mapped, found := backward[to]; found && mapped != from {
+				return false, fmt.Sprintf("target names %q and %q merged", mapped, from), nil
+			}
+			forward[from] = to
+			backward[to] = from
+		}
+	}
+
+	renamed := 0
+	for from, to := range forward {
+		if from != to {
+			renamed++
+		}
+	}
+	return true, fmt.Sprintf("%d entities, %d target names renamed", len(entitiesA), renamed), nil
+}
+
+func readBspXLumps(m *openMap) (map[string][]byte, error) {
+	lumps := map[string][]byte{}
+	for _, xlump := range m.bspFile.BspXLumps {
+		name := bsp.BytesToString(xlump.LumpName[:])
+		if name == bspxmgr.ObfuscationMarkerLump {
+			continue
+		}
+		buffer := make([]byte, xlump.Length)
+		_, err := m.f.ReadAt(buffer, int64(xlump.Offset))
+		if err != nil {
+			return nil, err
+		}
+		lumps[name] = buffer
+	}
+	return lumps, nil
+}
+
+func compareBspX(a, b *openMap) (bool, string, error) {
+	lumpsA, err := readBspXLumps(a)
+	if err != nil {
+		return false, "", err
+	}
+	lumpsB, err := readBspXLumps(b)
+	if err != nil {
+		return false, "", err
+	}
+
+	var problems []string
+	for name, bufferA := range lumpsA {
+		bufferB, found := lumpsB[name]
+		if !found {
+			problems = append(problems, name+" missing")
+		} else if !bytes.Equal(bufferA, bufferB) {
+			problems = append(problems, name+" differs")
+		}
+	}
+	for name := range lumpsB {
+		if _, found := lumpsA[name]; !found {
+			problems = append(problems, name+" added")
+		}
+	}
+	if len(problems) > 0 {
+		return false, strings.Join(problems, ", "), nil
+	}
+	return true, fmt.Sprintf("%d lumps identical", len(lumpsA)), nil
+}
+
+// CheckEquivalence verifies that b plays identically to a: geometry,
+// lighting, vis, BSPX data and entity logic must match, only texture names
+// (keeping their engine prefixes) and target names may differ.
+func CheckEquivalence(a, b *openMap) ([]EquivalenceCheck, error) {
+	var checks []EquivalenceCheck
+
+	versionA, versionB := a.bspFile.BspHeader.Version, b.bspFile.BspHeader.Version
+	checks = append(checks, EquivalenceCheck{"version", versionA == versionB, fmt.Sprintf("%s / %s", versionA, versionB)})
+
+	type comparison struct {
+		name    string
+		compare func(a, b *openMap) (bool, string, error)
+	}
+	comparisons := []comparison{
+		{"geometry", func(a, b *openMap) (bool, string, error) {
+			return compareLumps(a, b, []bsp.LumpType{bsp.LumpPlanes, bsp.LumpVertexes, bsp.LumpNodes, bsp.LumpTexinfo, bsp.LumpFaces,
+				bsp.LumpClipnodes, bsp.LumpLeafs, bsp.LumpMarksurfaces, bsp.LumpEdges, bsp.LumpSurfedges, bsp.LumpModels})
+		}},
+		{"lighting", func(a, b *openMap) (bool, string, error) {
+			return compareLumps(a, b, []bsp.LumpType{bsp.LumpLighting})
+		}},
+		{"vis", func(a, b *openMap) (bool, string, error) {
+			return compareLumps(a, b, []bsp.LumpType{bsp.LumpVisibility})
+		}},
+		{"textures", compareTextures},
+		{"entities", compareEntities},
+		{"bspx", compareBspX},
+	}
+	for _, c := range comparisons {
+		passed, detail, err := c.compare(a, b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", c.name, err)
+		}
+		checks = append(checks, EquivalenceCheck{c.name, passed, detail})
+	}
+	return checks, nil
+}
+
+var equivalentCmd = &cobra.Command{
+	Use:   "equivalent <original> <obfuscated>",
+	Short: "Verify an obfuscated map plays identically to its original",
+	Long: `Compare an obfuscated map against its original and report whether both are
+gameplay identical: same geometry, lighting, vis, BSPX data and entity logic,
+differing only in texture and target names and in texels obfuscate
+--scramble-pixels moved to the neighbouring shade. Exits non-zero on any
+other difference.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var maps [2]openMap
+		for i, arg := range args {
+			f, err := OpenMapFile(arg)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			bspFile, err := bsp.ReadBspFile(f)
+			if err != nil {
+				return fmt.Errorf("%s: %w", arg, err)
+			}
+			maps[i] = openMap{f: f, bspFile: bspFile}
+		}
+
+		checks, err := CheckEquivalence(&maps[0], &maps[1])
+		if err != nil {
+			return err
+		}
+
+		passed := true
+		for _, check := range checks {
+			fmt.Println(check)
+			passed = passed && check.Passed
+		}
+		if !passed {
+			fmt.Println("Result: FAIL")
+			return ErrCheckFailed
+		}
+		fmt.Println("Result: PASS")
+		return nil
+	},
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestShadeShifted(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		a, b    []byte
+		shifted int
+		ok      bool
+	}{
+		{"identical", []byte{1, 2, 3}, []byte{1, 2, 3}, 0, true},
+		{"neighbouring shades", []byte{16, 17, 100}, []byte{17, 16, 100}, 2, true},
+		{"two shades apart", []byte{16}, []byte{18}, 0, false},
+		{"across ramps", []byte{15}, []byte{16}, 0, false},
+		{"fullbright", []byte{224}, []byte{225}, 0, false},
+		{"transparent", []byte{255}, []byte{254}, 0, false},
+		{"different size", []byte{1, 2}, []byte{1}, 0, false},
+	} {
+		shifted, ok := shadeShifted(test.a, test.b)
+		if shifted != test.shifted || ok != test.ok {
+			t.Errorf("%s: got %d, %v, expected %d, %v", test.name, shifted, ok, test.shifted, test.ok)
+		}
+	}
+}
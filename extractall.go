@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// ExtractedLump is an entry of the manifest written by extract-all.
+type ExtractedLump struct {
+	Name   string `json:"name"`
+	BspX   bool   `json:"bspx,omitempty"`
+	Offset uint32 `json:"offset"`
+	Length uint32 `json:"length"`
+	File   string `json:"file"`
+}
+
+// ExtractManifest describes the map a directory was extracted from.
+type ExtractManifest struct {
+	Map       string          `json:"map"`
+	Version   string          `json:"version"`
+	ByteOrder string          `json:"byteOrder"`
+	Lumps     []ExtractedLump `json:"lumps"`
+}
+
+// lumpFileName turns a lump name into a file name, replacing characters that
+// are not safe in paths.
+func lumpFileName(prefix string, name string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+	return prefix + safe + ".lmp"
+}
+
+// extractLumps writes every standard and BSPX lump of the map to its own file
+// in dir and returns the manifest describing them. With entitiesText the
+// entities are written as text without the trailing NUL.
+func extractLumps(ctx context.Context, name string, bspFile *bsp.BspFile, r io.ReaderAt, dir string, entitiesText bool) (*ExtractManifest, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ExtractManifest{
+		Map:       filepath.Base(name),
+		Version:   bspFile.BspHeader.Version.String(),
+		ByteOrder: byteOrderName(bspFile.ByteOrder),
+	}
+	write := func(lump ExtractedLump, buffer []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		manifest.Lumps = append(manifest.Lumps, lump)
+		return os.WriteFile(filepath.Join(dir, lump.File), buffer, 0644)
+	}
+
+	for i, lump := range bspFile.BspHeader.Lumps {
+		lumpType := bsp.LumpType(i)
+		buffer, err := bsp.ReadLump(bspFile, r, lumpType)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		file := lumpFileName(fmt.Sprintf("%02d-", i), strings.ToLower(lumpType.String()))
+		if lumpType == bsp.LumpEntities && entitiesText {
+			file = strings.TrimSuffix(file, ".lmp") + ".ent"
+			buffer = bytes.TrimRight(buffer, "\x00")
+		}
+		err = write(ExtractedLump{lumpType.String(), false, lump.Offset, lump.Length, file}, buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	written := map[string]int{}
+	for _, xlump := range bspFile.BspXLumps {
+		xname := bsp.BytesToString(xlump.LumpName[:])
+		buffer := make([]byte, xlump.Length)
+		n, err := r.ReadAt(buffer, int64(xlump.Offset))
+		if n < len(buffer) {
+			if err == io.EOF {
+				return nil, fmt.Errorf("%s: BSPX lump %s extends past the end of the file", name, xname)
+			}
+			return nil, err
+		}
+
+		file := lumpFileName("bspx-", xname)
+		if n := written[file]; n > 0 {
+			file = lumpFileName("bspx-", fmt.Sprintf("%s-%d", xname, n))
+		}
+		written[lumpFileName("bspx-", xname)]++
+		err = write(ExtractedLump{xname, true, xlump.Offset, xlump.Length, file}, buffer)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// writeJSONFile writes v as indented JSON to the named file.
+func writeJSONFile(name string, v interface{}) error {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(v)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+var extractAllCmd = &cobra.Command{
+	Use:   "extract-all <map> <dir>",
+	Short: "Write every standard and BSPX lump to a file in a directory",
+	Long: `Write each of the 15 standard lumps and every BSPX lump of the map to its own
+file in dir, together with a manifest.json listing the name, offset and length
+of every lump. Standard lumps of big-endian maps are written in
+little-endian, BSPX lumps as they are.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		manifest, err := extractLumps(cmd.Context(), args[0], &bspFile, f, args[1], false)
+		if err != nil {
+			return err
+		}
+		err = writeJSONFile(filepath.Join(args[1], "manifest.json"), manifest)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Extracted %d lumps of %s to %s\n", len(manifest.Lumps), args[0], args[1])
+		return nil
+	},
+}
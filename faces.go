@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// RemoveFaces drops the faces not flagged in keepFaces and their surfedges,
+// and renumbers the face ranges of nodes and models, the marksurfaces and the
+// per face BSPX lumps. Lightmap data of removed faces stays in place.
+func RemoveFaces(data *mapData, bspx *bsp.BspXLumps, keepFaces []bool) []string {
+	var warnings []string
+	faceMap := compactIndex(keepFaces)
+
+	var faces []bsp.FaceV2
+	var surfedges []int32
+	for i := range data.faces {
+		if !keepFaces[i] {
+			continue
+		}
+		face := data.faces[i]
+		first := uint32(len(surfedges))
+		for j := face.LedgeId; j < face.LedgeId+face.LedgeNum && int(j) < len(data.surfedges); j++ {
+			surfedges = append(surfedges, data.surfedges[j])
+		}
+		face.LedgeId = first
+		faces = append(faces, face)
+	}
+
+	remapFaceRange := func(first, num uint32) (uint32, uint32) {
+		newFirst := int32(-1)
+		newNum := uint32(0)
+		for face := first; face < first+num && int(face) < len(faceMap); face++ {
+			if faceMap[face] < 0 {
+				continue
+			}
+			if newFirst < 0 {
+				newFirst = faceMap[face]
+			}
+			newNum++
+		}
+		if newFirst < 0 {
+			return 0, 0
+		}
+		return uint32(newFirst), newNum
+	}
+
+	for i := range data.nodes {
+		node := &data.nodes[i]
+		node.FirstFace, node.NumFaces = remapFaceRange(node.FirstFace, node.NumFaces)
+	}
+	for i := range data.models {
+		model := &data.models[i]
+		first, num := remapFaceRange(uint32(model.FirstFace), uint32(model.NumFaces))
+		model.FirstFace, model.NumFaces = int32(first), int32(num)
+	}
+
+	var marksurfs []uint32
+	for i := range data.leafs {
+		leaf := &data.leafs[i]
+		first := uint32(len(marksurfs))
+		for j := leaf.FirstMarkSurface; j < leaf.FirstMarkSurface+leaf.NumMarkSurfaces && int(j) < len(data.marksurfs); j++ {
+			face := data.marksurfs[j]
+			if int(face) < len(faceMap) && faceMap[face] >= 0 {
+				marksurfs = append(marksurfs, uint32(faceMap[face]))
+			}
+		}
+		leaf.FirstMarkSurface = first
+		leaf.NumMarkSurfaces = uint32(len(marksurfs)) - first
+	}
+
+	bspx.Range(func(lumpName string, buffer []byte) {
+		handler := BspXHandlerFor(lumpName)
+		if handler == nil || handler.FaceRecordSize == 0 {
+			return
+		}
+		size := handler.FaceRecordSize
+		if len(buffer) != size*len(data.faces) {
+			warnings = append(warnings, fmt.Sprintf("BSPX lump %s does not hold %d byte records for all %d faces, left unchanged", lumpName, size, len(data.faces)))
+			return
+		}
+		var compacted []byte
+		for i := range data.faces {
+			if keepFaces[i] {
+				compacted = append(compacted, buffer[i*size:(i+1)*size]...)
+			}
+		}
+		bspx.Set(lumpName, compacted)
+	})
+
+	data.faces, data.surfedges, data.marksurfs = faces, surfedges, marksurfs
+	return warnings
+}
+
+// FaceTextureName returns the name of the texture a face uses, or "" if the
+// texinfo or texture is missing.
+func FaceTextureName(data *mapData, textures []bsp.TextureEntry, face *bsp.FaceV2) string {
+	if int(face.TexinfoId) >= len(data.texinfo) {
+		return ""
+	}
+	miptex := data.texinfo[face.TexinfoId].MipTex
+	if miptex < 0 || int(miptex) >= len(textures) || textures[miptex].Missing() {
+		return ""
+	}
+	return textures[miptex].Name()
+}
+
+var facesCmd = &cobra.Command{
+	Use:   "faces",
+	Short: "Operate on the faces of a map",
+}
+
+var facesRemoveTexture string
+
+var facesRemoveCmd = &cobra.Command{
+	Use:   "remove <map>",
+	Short: "Remove faces by texture name",
+	Long: `Remove every face whose texture matches the --texture glob pattern, e.g.
+'skip*', case insensitively. Marksurfaces, node and model face ranges,
+surfedges and per face BSPX lumps are renumbered. Only the drawn faces are
+removed, collision is unchanged.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		pattern := strings.ToLower(facesRemoveTexture)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		buffer, err := bsp.ReadLump(&bspFile, f, bsp.LumpTextures)
+		if err != nil {
+			return err
+		}
+		textures, err := bsp.ParseTextureLump(buffer)
+		if err != nil {
+			return err
+		}
+
+		keepFaces := make([]bool, len(data.faces))
+		removed := 0
+		for i := range data.faces {
+			name := strings.ToLower(FaceTextureName(data, textures, &data.faces[i]))
+			matched, _ := path.Match(pattern, name)
+			keepFaces[i] = !matched
+			if matched {
+				removed++
+			}
+		}
+		if removed == 0 {
+			fmt.Printf("No faces use a texture matching %q\n", facesRemoveTexture)
+			return nil
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			for _, warning := range RemoveFaces(data, bspx, keepFaces) {
+				Warnf("%s", warning)
+			}
+			data.encodeGeometry(lumps)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %d faces, wrote %s\n", removed, destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
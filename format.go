@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"text/template"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// MapSummary is the data exposed to --format templates. Lumps and XLumps are
+// keyed by name, e.g. {{.Lumps.Entities.Length}} or {{.XLumps.LMSHIFT.Offset}}.
+type MapSummary struct {
+	Filename   string
+	Path       string
+	Version    bsp.BspVersion
+	Lumps      map[string]bsp.Lump
+	XLumps     map[string]bsp.Lump
+	XLumpNames []string
+	BspXOffset int64
+}
+
+func NewMapSummary(path string, bspFile *bsp.BspFile) MapSummary {
+	summary := MapSummary{
+		Filename:   filepath.Base(path),
+		Path:       path,
+		Version:    bspFile.BspHeader.Version,
+		Lumps:      map[string]bsp.Lump{},
+		XLumps:     map[string]bsp.Lump{},
+		BspXOffset: bspFile.BspXOffset,
+	}
+	for i, lump := range bspFile.BspHeader.Lumps {
+		summary.Lumps[bsp.LumpType(i).String()] = lump
+	}
+	for _, xlump := range bspFile.BspXLumps {
+		name := bsp.BytesToString(xlump.LumpName[:])
+		summary.XLumps[name] = bsp.Lump{Offset: xlump.Offset, Length: xlump.Length}
+		summary.XLumpNames = append(summary.XLumpNames, name)
+	}
+	return summary
+}
+
+// RenderFormat executes a user supplied Go template against data and
+// terminates the output with a newline.
+func RenderFormat(w io.Writer, format string, data interface{}) error {
+	tmpl, err := template.New("format").Option("missingkey=zero").Parse(format)
+	if err != nil {
+		return err
+	}
+	err = tmpl.Execute(w, data)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
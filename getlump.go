@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var getLumpCmd = &cobra.Command{
+	Use:   "get-lump <map> <lump> [out]",
+	Short: "Write the contents of a standard lump to a file",
+	Long: `Write the raw contents of one of the 15 standard lumps, given by name
+(Entities, Lighting, Visibility, ...) or index, to a file or to stdout if no
+file is given. Lumps of big-endian maps are written in little-endian.`,
+	Args: cobra.RangeArgs(2, 3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		lumpType, err := bsp.ParseLumpType(args[1])
+		if err != nil {
+			return err
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		buffer, err := bsp.ReadLump(&bspFile, f, lumpType)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		if len(args) < 3 {
+			_, err = os.Stdout.Write(buffer)
+			return err
+		}
+		err = os.WriteFile(args[2], buffer, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Extracted %s (%d bytes) to %s\n", lumpType, len(buffer), args[2])
+		return nil
+	},
+}
@@ -1,9 +1,13 @@
-module bspxmgr
+module github.com/qw-ctf/bspxmgr
 
 go 1.19
 
+require (
+	github.com/spf13/cobra v1.6.1
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
-	github.com/spf13/cobra v1.6.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 )
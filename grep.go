@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+type GrepMatch struct {
+	Lump   string
+	Offset int64
+	File   int64
+	Detail string
+}
+
+func (m GrepMatch) String() string {
+	return fmt.Sprintf("%-24s @ %8d (file %8d)  %s", m.Lump, m.Offset, m.File, m.Detail)
+}
+
+// grepEntities matches the pattern against each line of the entity lump and
+// reports the entity the line belongs to.
+func grepEntities(data []byte, base int64, re *regexp.Regexp) []GrepMatch {
+	var matches []GrepMatch
+	entity := -1
+	offset := 0
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		trimmed := strings.TrimRight(line, "\r\n\x00")
+		if strings.HasPrefix(strings.TrimSpace(trimmed), "{") {
+			entity++
+		}
+		if loc := re.FindStringIndex(trimmed); loc != nil {
+			matches = append(matches, GrepMatch{
+				Lump:   bsp.LumpType(bsp.LumpEntities).String(),
+				Offset: int64(offset + loc[0]),
+				File:   base + int64(offset+loc[0]),
+				Detail: fmt.Sprintf("entity #%d: %s", entity, strings.TrimSpace(trimmed)),
+			})
+		}
+		offset += len(line)
+	}
+	return matches
+}
+
+func grepTextures(data []byte, base int64, re *regexp.Regexp) ([]GrepMatch, error) {
+	textures, err := bsp.ParseTextureLump(data)
+	if err != nil {
+		return nil, err
+	}
+	var matches []GrepMatch
+	for i := range textures {
+		if textures[i].Missing() || !re.MatchString(textures[i].Name()) {
+			continue
+		}
+		matches = append(matches, GrepMatch{
+			Lump:   bsp.LumpType(bsp.LumpTextures).String(),
+			Offset: int64(textures[i].Offset),
+			File:   base + int64(textures[i].Offset),
+			Detail: fmt.Sprintf("texture #%d: %s", i, textures[i].Name()),
+		})
+	}
+	return matches, nil
+}
+
+// FileRegion is a named byte range of a map file.
+type FileRegion struct {
+	Name   string
+	Offset int64
+	Length int64
+}
+
+// MapRegions returns the header, the standard lumps, the BSPX directory and
+// the BSPX lumps of a map as regions of the file.
+func MapRegions(bspFile *bsp.BspFile) []FileRegion {
+	regions := []FileRegion{{"header", 0, int64(binary.Size(bspFile.BspHeader))}}
+	for i, lump := range bspFile.BspHeader.Lumps {
+		regions = append(regions, FileRegion{bsp.LumpType(i).String(), int64(lump.Offset), int64(lump.Length)})
+	}
+	if n := len(bspFile.BspXLumps); n > 0 {
+		regions = append(regions, FileRegion{"BSPX directory", bspFile.BspXOffset, int64(8 + bsp.BspXLumpHeaderSize*n)})
+	}
+	for _, xlump := range bspFile.BspXLumps {
+		regions = append(regions, FileRegion{bsp.BytesToString(xlump.LumpName[:]), int64(xlump.Offset), int64(xlump.Length)})
+	}
+	return regions
+}
+
+// regionAt returns the first region containing offset, or a region named
+// "unused" for bytes outside of all regions.
+func regionAt(regions []FileRegion, offset int64) FileRegion {
+	for _, region := range regions {
+		if offset >= region.Offset && offset < region.Offset+region.Length {
+			return region
+		}
+	}
+	return FileRegion{Name: "unused"}
+}
+
+// asciiLower returns a copy of data with ASCII letters lowered, leaving all
+// other bytes as they are.
+func asciiLower(data []byte) []byte {
+	lower := make([]byte, len(data))
+	for i, c := range data {
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[i] = c
+	}
+	return lower
+}
+
+// grepFile searches the whole map file for needle and reports the region
+// each match starts in.
+func grepFile(data []byte, regions []FileRegion, needle []byte, ignoreCase bool) []GrepMatch {
+	var matches []GrepMatch
+	if len(needle) == 0 {
+		return nil
+	}
+	haystack := data
+	if ignoreCase {
+		haystack, needle = asciiLower(data), asciiLower(needle)
+	}
+	for start := 0; ; {
+		index := bytes.Index(haystack[start:], needle)
+		if index < 0 {
+			return matches
+		}
+		offset := start + index
+		context := data[offset:]
+		if len(context) > 16 {
+			context = context[:16]
+		}
+		region := regionAt(regions, int64(offset))
+		matches = append(matches, GrepMatch{
+			Lump:   region.Name,
+			Offset: int64(offset) - region.Offset,
+			File:   int64(offset),
+			Detail: fmt.Sprintf("% x", context),
+		})
+		start = offset + 1
+	}
+}
+
+var grepRaw bool
+var grepHex bool
+var grepIgnoreCase bool
+
+var grepCmd = &cobra.Command{
+	Use:   "grep <map> <pattern>",
+	Short: "Search entities, texture names and lump contents",
+	Long: `Search the entity text and texture names for a regular expression, reporting
+the lump and offset of every match. With --raw, the pattern is also searched
+for as a literal byte string in the whole file, reporting the standard or BSPX
+lump each match lies in, or the header, the BSPX directory or unused bytes
+between lumps; --hex takes the pattern as hex bytes (e.g. "de ad be ef") and
+implies --raw.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		var matches []GrepMatch
+
+		if grepHex {
+			grepRaw = true
+		} else {
+			pattern := args[1]
+			if grepIgnoreCase {
+				pattern = "(?i)" + pattern
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return err
+			}
+
+			data, err := bsp.ReadLump(&bspFile, f, bsp.LumpEntities)
+			if err != nil {
+				return err
+			}
+			matches = append(matches, grepEntities(data, int64(bspFile.BspHeader.Lumps[bsp.LumpEntities].Offset), re)...)
+
+			data, err = bsp.ReadLump(&bspFile, f, bsp.LumpTextures)
+			if err != nil {
+				return err
+			}
+			textureMatches, err := grepTextures(data, int64(bspFile.BspHeader.Lumps[bsp.LumpTextures].Offset), re)
+			if err != nil {
+				return err
+			}
+			matches = append(matches, textureMatches...)
+		}
+
+		if grepRaw {
+			needle := []byte(args[1])
+			if grepHex {
+				needle, err = hex.DecodeString(strings.Join(strings.Fields(args[1]), ""))
+				if err != nil {
+					return err
+				}
+			}
+			data, err := io.ReadAll(io.NewSectionReader(f, 0, math.MaxInt64))
+			if err != nil {
+				return err
+			}
+			matches = append(matches, grepFile(data, MapRegions(&bspFile), needle, grepIgnoreCase)...)
+		}
+
+		for _, match := range matches {
+			fmt.Println(match)
+		}
+		if len(matches) == 0 {
+			return &ExitError{ExitFailure}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// HexDumpLines formats data like hexdump -C, 16 bytes per line, with offsets
+// starting at base.
+func HexDumpLines(data []byte, base int64) []string {
+	var lines []string
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		row := data[i:end]
+
+		var hex strings.Builder
+		for j := 0; j < 16; j++ {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			if j < len(row) {
+				fmt.Fprintf(&hex, "%02x ", row[j])
+			} else {
+				hex.WriteString("   ")
+			}
+		}
+
+		ascii := make([]byte, len(row))
+		for j, c := range row {
+			if c >= 0x20 && c < 0x7f {
+				ascii[j] = c
+			} else {
+				ascii[j] = '.'
+			}
+		}
+
+		lines = append(lines, fmt.Sprintf("%08x  %s |%s|", base+int64(i), hex.String(), ascii))
+	}
+	return lines
+}
+
+var hexdumpOffset int64
+var hexdumpLength int64
+
+// FindLump returns the position in the file of a standard lump given by name
+// or index, or of the named BSPX lump.
+func FindLump(bspFile *bsp.BspFile, name string) (bsp.Lump, error) {
+	if lumpType, err := bsp.ParseLumpType(name); err == nil {
+		return bspFile.BspHeader.Lumps[lumpType], nil
+	}
+	if xlump := bsp.FindBspXLump(bspFile, name); xlump != nil {
+		return bsp.Lump{Offset: xlump.Offset, Length: xlump.Length}, nil
+	}
+	return bsp.Lump{}, fmt.Errorf("no standard or BSPX lump %s", name)
+}
+
+var hexdumpCmd = &cobra.Command{
+	Use:   "hexdump <map> <lump-name>",
+	Short: "Print a hex dump of a standard or BSPX lump",
+	Long: `Print the raw bytes of a lump like hexdump -C, with offsets relative to the
+start of the lump. Standard lumps are given by name or index, anything else
+names a BSPX lump.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		lump, err := FindLump(&bspFile, args[1])
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		if hexdumpOffset < 0 || hexdumpOffset > int64(lump.Length) {
+			return fmt.Errorf("offset %d outside the %d bytes of %s", hexdumpOffset, lump.Length, args[1])
+		}
+		length := int64(lump.Length) - hexdumpOffset
+		if hexdumpLength > 0 && hexdumpLength < length {
+			length = hexdumpLength
+		}
+
+		buffer := make([]byte, length)
+		n, err := f.ReadAt(buffer, int64(lump.Offset)+hexdumpOffset)
+		if n < len(buffer) {
+			if err == io.EOF {
+				return fmt.Errorf("%s: %s extends past the end of the file", args[0], args[1])
+			}
+			return err
+		}
+		for _, line := range HexDumpLines(buffer, hexdumpOffset) {
+			fmt.Println(line)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var intermissionCameras []string
+var intermissionFrom string
+var intermissionReplace bool
+
+// formatVectorFlag formats a vector parsed by parseVectorFlag as an entity
+// value.
+func formatVectorFlag(v [3]float64) string {
+	return fmt.Sprintf("%s %s %s", formatAngle(v[0]), formatAngle(v[1]), formatAngle(v[2]))
+}
+
+// ParseIntermissionCamera parses a --camera flag, x,y,z optionally followed
+// by :pitch,yaw,roll, into an info_intermission entity.
+func ParseIntermissionCamera(s string) (bsp.Entity, error) {
+	entity := bsp.Entity{Pairs: []bsp.KeyValue{{Key: "classname", Value: "info_intermission"}}}
+	originFlag, mangleFlag, hasMangle := strings.Cut(s, ":")
+	origin, err := parseVectorFlag(originFlag)
+	if err != nil {
+		return entity, fmt.Errorf("invalid camera %q: %w", s, err)
+	}
+	entity.Set("origin", formatVectorFlag(origin))
+	if hasMangle {
+		mangle, err := parseVectorFlag(mangleFlag)
+		if err != nil {
+			return entity, fmt.Errorf("invalid camera %q: %w", s, err)
+		}
+		entity.Set("mangle", formatVectorFlag(mangle))
+	}
+	return entity, nil
+}
+
+var entitiesIntermissionCmd = &cobra.Command{
+	Use:   "intermission <map>",
+	Short: "Add intermission cameras at given positions or from another map",
+	Long: `Write a copy of the map with info_intermission entities added, for maps
+shipped without intermission cameras. --camera places one at x,y,z,
+optionally looking along :pitch,yaw,roll, e.g.
+
+  bspxmgr entities intermission --camera 512,0,128:20,90,0 ctf1.bsp
+
+--from copies the cameras of another version of the map. With --replace the
+existing cameras are removed first.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var cameras []bsp.Entity
+		for _, value := range intermissionCameras {
+			camera, err := ParseIntermissionCamera(value)
+			if err != nil {
+				return err
+			}
+			cameras = append(cameras, camera)
+		}
+		if intermissionFrom != "" {
+			data, err := readEntitiesLump(intermissionFrom)
+			if err != nil {
+				return err
+			}
+			entities, err := bsp.ParseEntities(data)
+			if err != nil {
+				return fmt.Errorf("%s: %w", intermissionFrom, err)
+			}
+			found := 0
+			for _, entity := range entities {
+				if entity.Classname() == "info_intermission" {
+					cameras = append(cameras, entity)
+					found++
+				}
+			}
+			if found == 0 {
+				return fmt.Errorf("%s has no info_intermission", intermissionFrom)
+			}
+		}
+		if len(cameras) == 0 {
+			return fmt.Errorf("nothing to add, give --camera or --from")
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		removed := 0
+		if intermissionReplace {
+			filter := EntityFilter{Key: "classname", Value: "info_intermission"}
+			entities, removed = removeEntities(entities, []EntityFilter{filter})
+		} else {
+			for i := range entities {
+				if entities[i].Classname() == "info_intermission" {
+					Infof("%s already has intermission cameras, --replace removes them", args[0])
+					break
+				}
+			}
+		}
+		entities = append(entities, cameras...)
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %d and removed %d intermission cameras, wrote %s\n", len(cameras), removed, destName)
+		return nil
+	},
+}
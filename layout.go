@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+type layoutIcon struct {
+	Shape string
+	Color color.RGBA
+}
+
+var (
+	colorTeam1 = color.RGBA{220, 40, 40, 255}
+	colorTeam2 = color.RGBA{40, 90, 230, 255}
+)
+
+// layoutIconFor picks the marker drawn for an entity, or false for entities
+// not shown on the layout.
+func layoutIconFor(classname string) (layoutIcon, string, bool) {
+	switch {
+	case classname == "item_flag_team1":
+		return layoutIcon{"triangle", colorTeam1}, "team1 flag", true
+	case classname == "item_flag_team2":
+		return layoutIcon{"triangle", colorTeam2}, "team2 flag", true
+	case classname == "info_player_team1":
+		return layoutIcon{"circle", colorTeam1}, "team1 spawn", true
+	case classname == "info_player_team2":
+		return layoutIcon{"circle", colorTeam2}, "team2 spawn", true
+	case classname == "info_player_deathmatch" || classname == "info_player_start":
+		return layoutIcon{"circle", color.RGBA{240, 240, 240, 255}}, "spawn", true
+	case strings.HasPrefix(classname, "weapon_"):
+		return layoutIcon{"square", color.RGBA{255, 140, 0, 255}}, "weapon", true
+	case strings.HasPrefix(classname, "item_armor"):
+		return layoutIcon{"diamond", color.RGBA{255, 220, 0, 255}}, "armor", true
+	case classname == "item_health":
+		return layoutIcon{"plus", color.RGBA{40, 200, 60, 255}}, "health", true
+	case strings.HasPrefix(classname, "item_artifact_"):
+		return layoutIcon{"diamond", color.RGBA{200, 60, 220, 255}}, "powerup", true
+	case strings.HasPrefix(classname, "item_key"):
+		return layoutIcon{"diamond", color.RGBA{60, 220, 220, 255}}, "key", true
+	case classname == "item_shells" || classname == "item_spikes" || classname == "item_rockets" || classname == "item_cells":
+		return layoutIcon{"dot", color.RGBA{170, 140, 100, 255}}, "ammo", true
+	}
+	return layoutIcon{}, "", false
+}
+
+type layoutCanvas struct {
+	img    *image.RGBA
+	mins   bsp.Vec3
+	scale  float64
+	margin int
+}
+
+func (c *layoutCanvas) project(v bsp.Vec3) (int, int) {
+	x := c.margin + int(float64(v[0]-c.mins[0])*c.scale)
+	y := c.img.Bounds().Dy() - c.margin - int(float64(v[1]-c.mins[1])*c.scale)
+	return x, y
+}
+
+func (c *layoutCanvas) set(x, y int, col color.RGBA) {
+	if image.Pt(x, y).In(c.img.Bounds()) {
+		c.img.SetRGBA(x, y, col)
+	}
+}
+
+func (c *layoutCanvas) line(x0, y0, x1, y1 int, col color.RGBA) {
+	dx := x1 - x0
+	if dx < 0 {
+		dx = -dx
+	}
+	dy := y1 - y0
+	if dy > 0 {
+		dy = -dy
+	}
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		c.set(x0, y0, col)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+func (c *layoutCanvas) icon(x, y int, icon layoutIcon) {
+	const r = 5
+	black := color.RGBA{0, 0, 0, 255}
+	for dy := -r - 1; dy <= r+1; dy++ {
+		for dx := -r - 1; dx <= r+1; dx++ {
+			inside := false
+			outline := false
+			switch icon.Shape {
+			case "circle":
+				d := dx*dx + dy*dy
+				inside = d <= r*r
+				outline = !inside && d <= (r+1)*(r+1)
+			case "square":
+				inside = abs(dx) <= r-1 && abs(dy) <= r-1
+				outline = !inside && abs(dx) <= r && abs(dy) <= r
+			case "diamond":
+				inside = abs(dx)+abs(dy) <= r
+				outline = !inside && abs(dx)+abs(dy) <= r+1
+			case "plus":
+				inside = (abs(dx) <= 1 && abs(dy) <= r) || (abs(dy) <= 1 && abs(dx) <= r)
+			case "triangle":
+				inside = dy >= -r && dy <= r && 2*abs(dx) <= dy+r
+				outline = !inside && dy >= -r-1 && dy <= r+1 && 2*abs(dx) <= dy+r+2
+			case "dot":
+				inside = dx*dx+dy*dy <= 4
+			}
+			if inside {
+				c.set(x+dx, y+dy, icon.Color)
+			} else if outline {
+				c.set(x+dx, y+dy, black)
+			}
+		}
+	}
+}
+
+// newLayoutCanvas creates a canvas showing the world model from above, with
+// the longest side size pixels wide.
+func newLayoutCanvas(world bsp.Model, size int) *layoutCanvas {
+	extent := math.Max(float64(world.Maxs[0]-world.Mins[0]), float64(world.Maxs[1]-world.Mins[1]))
+	if extent <= 0 {
+		extent = 1
+	}
+
+	const margin = 16
+	scale := float64(size-2*margin) / extent
+	width := int(float64(world.Maxs[0]-world.Mins[0])*scale) + 2*margin
+	height := int(float64(world.Maxs[1]-world.Mins[1])*scale) + 2*margin
+
+	canvas := &layoutCanvas{
+		img:    image.NewRGBA(image.Rect(0, 0, width, height)),
+		mins:   world.Mins,
+		scale:  scale,
+		margin: margin,
+	}
+	background := color.RGBA{24, 24, 28, 255}
+	for i := 0; i < len(canvas.img.Pix); i += 4 {
+		canvas.img.Pix[i], canvas.img.Pix[i+1], canvas.img.Pix[i+2], canvas.img.Pix[i+3] = background.R, background.G, background.B, background.A
+	}
+	return canvas
+}
+
+// polygon fills the projection of a convex winding.
+func (c *layoutCanvas) polygon(winding []bsp.Vec3, col color.RGBA) {
+	if len(winding) < 3 {
+		return
+	}
+	points := make([][2]int, len(winding))
+	minY, maxY := math.MaxInt32, math.MinInt32
+	for i, v := range winding {
+		x, y := c.project(v)
+		points[i] = [2]int{x, y}
+		if y < minY {
+			minY = y
+		}
+		if y > maxY {
+			maxY = y
+		}
+	}
+	for y := minY; y <= maxY; y++ {
+		minX, maxX := math.MaxInt32, math.MinInt32
+		span := func(x int) {
+			if x < minX {
+				minX = x
+			}
+			if x > maxX {
+				maxX = x
+			}
+		}
+		for i := range points {
+			p, q := points[i], points[(i+1)%len(points)]
+			switch {
+			case p[1] == q[1]:
+				if p[1] == y {
+					span(p[0])
+					span(q[0])
+				}
+			case (y-p[1])*(y-q[1]) <= 0:
+				span(p[0] + (y-p[1])*(q[0]-p[0])/(q[1]-p[1]))
+			}
+		}
+		for x := minX; x <= maxX; x++ {
+			c.set(x, y, col)
+		}
+	}
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// RenderLayout draws the world geometry from above, shaded by height, with a
+// marker for every item, weapon and spawn point.
+func RenderLayout(data *mapData, size int) (*image.RGBA, map[string]layoutIcon) {
+	world := data.models[0]
+	canvas := newLayoutCanvas(world, size)
+
+	zRange := world.Maxs[2] - world.Mins[2]
+	if zRange <= 0 {
+		zRange = 1
+	}
+
+	// Draw lower faces first so upper floors stay visible.
+	type shadedFace struct {
+		winding []bsp.Vec3
+		z       float32
+	}
+	var shaded []shadedFace
+	for i := world.FirstFace; i < world.FirstFace+world.NumFaces && int(i) < len(data.faces); i++ {
+		winding := bsp.FaceWinding(&data.faces[i], data.edges, data.surfedges, data.vertexes)
+		if len(winding) == 0 {
+			continue
+		}
+		var z float32
+		for _, v := range winding {
+			z += v[2]
+		}
+		shaded = append(shaded, shadedFace{winding, z / float32(len(winding))})
+	}
+	sort.SliceStable(shaded, func(i, j int) bool { return shaded[i].z < shaded[j].z })
+
+	for _, face := range shaded {
+		level := uint8(60 + 140*(face.z-world.Mins[2])/zRange)
+		col := color.RGBA{level, level, level, 255}
+		for i := range face.winding {
+			x0, y0 := canvas.project(face.winding[i])
+			x1, y1 := canvas.project(face.winding[(i+1)%len(face.winding)])
+			canvas.line(x0, y0, x1, y1, col)
+		}
+	}
+
+	legend := map[string]layoutIcon{}
+	for i := range data.entities {
+		icon, label, ok := layoutIconFor(data.entities[i].Classname())
+		if !ok {
+			continue
+		}
+		origin, ok := data.entities[i].Origin()
+		if !ok {
+			continue
+		}
+		x, y := canvas.project(origin)
+		canvas.icon(x, y, icon)
+		legend[label] = icon
+	}
+
+	return canvas.img, legend
+}
+
+var layoutSize int
+
+var layoutCmd = &cobra.Command{
+	Use:   "layout <map> <out.png>",
+	Short: "Render a top-down item layout image",
+	Long: `Render a top-down PNG of the map geometry with markers for items, weapons,
+flags and spawn points, suitable for map documentation pages.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		if len(data.models) == 0 {
+			return fmt.Errorf("map has no world model")
+		}
+
+		img, legend := RenderLayout(data, layoutSize)
+
+		out, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		err = png.Encode(out, img)
+		if err != nil {
+			return err
+		}
+
+		var labels []string
+		for label := range legend {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		fmt.Println("Legend:")
+		for _, label := range labels {
+			icon := legend[label]
+			fmt.Printf("  %-8s #%02x%02x%02x  %s\n", icon.Shape, icon.Color.R, icon.Color.G, icon.Color.B, label)
+		}
+		return nil
+	},
+}
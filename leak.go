@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// leakOpen reports whether the hull 0 leaf at p can be flooded, like qbsp
+// both solid and sky stop the outside fill.
+func leakOpen(data *mapData, head int32, p bsp.Vec3) (int, bool) {
+	leaf := bsp.PointLeaf(data.nodes, data.planes, head, p)
+	if leaf <= 0 || leaf >= len(data.leafs) {
+		return leaf, false
+	}
+	contents := data.leafs[leaf].Contents
+	return leaf, contents != bsp.ContentsSolid && contents != bsp.ContentsSky
+}
+
+// segmentOpen reports whether the segment from a to b crosses no solid or sky
+// leaf of the hull 0 tree below num.
+func segmentOpen(data *mapData, num int32, a, b bsp.Vec3) bool {
+	for num >= 0 {
+		if int(num) >= len(data.nodes) {
+			return false
+		}
+		node := &data.nodes[num]
+		if int(node.PlaneId) >= len(data.planes) {
+			return false
+		}
+		plane := data.planes[node.PlaneId]
+		da, db := plane.Distance(a), plane.Distance(b)
+		switch {
+		case da >= 0 && db >= 0:
+			num = node.Children[0]
+		case da < 0 && db < 0:
+			num = node.Children[1]
+		default:
+			// Split at the plane and check the part on each side.
+			frac := da / (da - db)
+			var mid bsp.Vec3
+			for axis := 0; axis < 3; axis++ {
+				mid[axis] = a[axis] + frac*(b[axis]-a[axis])
+			}
+			near, far := node.Children[0], node.Children[1]
+			if da < 0 {
+				near, far = far, near
+			}
+			if !segmentOpen(data, near, a, mid) {
+				return false
+			}
+			num, a = far, mid
+		}
+	}
+	leaf := int(-1 - num)
+	if leaf <= 0 || leaf >= len(data.leafs) {
+		return false
+	}
+	contents := data.leafs[leaf].Contents
+	return contents != bsp.ContentsSolid && contents != bsp.ContentsSky
+}
+
+type Leak struct {
+	Entity int
+	// Path runs from the entity to the outside of the map.
+	Path []bsp.Vec3
+}
+
+// FindLeaks floods the hull 0 tree from a grid of points around the world
+// bounds, stepping between neighbouring grid points where the line between
+// them stays out of solid and sky, and reports every point entity in a leaf
+// the flood reaches. qbsp fills the outside of a sealed map with solid, so
+// in a sealed map the flood never starts. Holes smaller than the grid may be
+// missed.
+func FindLeaks(data *mapData, grid float32) ([]Leak, error) {
+	if len(data.models) == 0 {
+		return nil, fmt.Errorf("map has no world model")
+	}
+	world := data.models[0]
+	head := world.HeadNode[0]
+
+	var origin bsp.Vec3
+	var size [3]int
+	for axis := 0; axis < 3; axis++ {
+		origin[axis] = world.Mins[axis] - grid
+		size[axis] = int(math.Ceil(float64((world.Maxs[axis]-world.Mins[axis])/grid))) + 3
+	}
+	cells := size[0] * size[1] * size[2]
+	if cells > 1<<25 {
+		return nil, fmt.Errorf("%d grid points, use a coarser grid", cells)
+	}
+	point := func(index int) bsp.Vec3 {
+		k := index % size[2]
+		j := index / size[2] % size[1]
+		i := index / size[2] / size[1]
+		return bsp.Vec3{origin[0] + float32(i)*grid, origin[1] + float32(j)*grid, origin[2] + float32(k)*grid}
+	}
+
+	parent := make([]int32, cells)
+	for i := range parent {
+		parent[i] = -2
+	}
+	var queue []int
+	for i := 0; i < size[0]; i++ {
+		for j := 0; j < size[1]; j++ {
+			for k := 0; k < size[2]; k++ {
+				if i != 0 && j != 0 && k != 0 && i != size[0]-1 && j != size[1]-1 && k != size[2]-1 {
+					continue
+				}
+				index := (i*size[1]+j)*size[2] + k
+				if _, open := leakOpen(data, head, point(index)); open {
+					parent[index] = -1
+					queue = append(queue, index)
+				}
+			}
+		}
+	}
+
+	// The first grid point reached in each leaf, to trace the leak back.
+	reached := map[int]int{}
+	strides := []int{size[1] * size[2], size[2], 1}
+	for len(queue) > 0 {
+		index := queue[0]
+		queue = queue[1:]
+		p := point(index)
+		if leaf, _ := leakOpen(data, head, p); leaf > 0 {
+			if _, found := reached[leaf]; !found {
+				reached[leaf] = index
+			}
+		}
+
+		coords := [3]int{index / strides[0], index / strides[1] % size[1], index % size[2]}
+		for axis, stride := range strides {
+			for _, step := range []int{-1, 1} {
+				c := coords[axis] + step
+				if c < 0 || c >= size[axis] {
+					continue
+				}
+				next := index + step*stride
+				if parent[next] != -2 || !segmentOpen(data, head, p, point(next)) {
+					continue
+				}
+				parent[next] = int32(index)
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	var leaks []Leak
+	for i := range data.entities {
+		entity := &data.entities[i]
+		if _, ok := ModelRef(entity.Get("model")); ok {
+			continue
+		}
+		origin, ok := entity.Origin()
+		if !ok {
+			continue
+		}
+		index, found := reached[bsp.PointLeaf(data.nodes, data.planes, head, origin)]
+		if !found {
+			continue
+		}
+		leak := Leak{Entity: i, Path: []bsp.Vec3{origin}}
+		for ; index >= 0; index = int(parent[index]) {
+			leak.Path = append(leak.Path, point(index))
+		}
+		leaks = append(leaks, leak)
+	}
+	return leaks, nil
+}
+
+// WritePointFile writes path as a qbsp style pointfile, with a point every
+// few units so engines loading it draw a continuous line.
+func WritePointFile(filename string, path []bsp.Vec3) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for i := 0; i+1 < len(path); i++ {
+		a, b := path[i], path[i+1]
+		length := vertexDistance(a, b)
+		for d := 0.0; d < length; d += 8 {
+			t := float32(d / length)
+			_, err = fmt.Fprintf(out, "%g %g %g\n", a[0]+t*(b[0]-a[0]), a[1]+t*(b[1]-a[1]), a[2]+t*(b[2]-a[2]))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if len(path) > 0 {
+		last := path[len(path)-1]
+		_, err = fmt.Fprintf(out, "%g %g %g\n", last[0], last[1], last[2])
+	}
+	return err
+}
+
+var leakGrid float32
+var leakPointFile string
+
+var leakCmd = &cobra.Command{
+	Use:   "leak <map>",
+	Short: "Check whether point entities can reach the outside of the map",
+	Long: `Flood the world from outside its bounds on a grid, the way qbsp's outside
+fill works, and report every point entity the flood reaches. A compiled map
+leaks when such a path exists, and leaked maps come without vis data.
+
+With --pointfile the path from the first leaking entity to the outside is
+written as a .pts file, which engines show with the pointfile command.
+
+Exits with status 3 when the map leaks.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if leakGrid < 4 {
+			return fmt.Errorf("grid size %g too small", leakGrid)
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		vis, err := bsp.ReadLump(&bspFile, f, bsp.LumpVisibility)
+		if err != nil {
+			return err
+		}
+
+		leaks, err := FindLeaks(data, leakGrid)
+		if err != nil {
+			return err
+		}
+		if len(leaks) == 0 {
+			if len(vis) == 0 {
+				fmt.Printf("%s: no leak found, but the map has no vis data\n", args[0])
+			} else {
+				fmt.Printf("%s: no leak found\n", args[0])
+			}
+			return nil
+		}
+
+		for _, leak := range leaks {
+			fmt.Printf("leak: %s reaches the outside\n", entityRef(data.entities, leak.Entity))
+		}
+		if leakPointFile != "" {
+			err = WritePointFile(leakPointFile, leaks[0].Path)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Wrote leak path of %s to %s\n", entityRef(data.entities, leaks[0].Entity), leakPointFile)
+		}
+		return ErrCheckFailed
+	},
+}
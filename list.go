@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+type MapListing struct {
+	MapSummary
+	Size     int64
+	Entities int
+	CRC32    uint32
+}
+
+func NewMapListing(path string) (MapListing, error) {
+	f, err := OpenMapFile(path)
+	if err != nil {
+		return MapListing{}, err
+	}
+	defer f.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return MapListing{}, err
+	}
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return MapListing{}, fmt.Errorf("%s: %w", path, err)
+	}
+	entities, err := bsp.ReadEntities(&bspFile, f)
+	if err != nil {
+		return MapListing{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return MapListing{
+		MapSummary: NewMapSummary(path, &bspFile),
+		Size:       size,
+		Entities:   len(entities),
+		CRC32:      hash.Sum32(),
+	}, nil
+}
+
+var listFormat string
+
+var listCmd = &cobra.Command{
+	Use:   "list <map>...",
+	Short: "Print a one line summary per map",
+	Long: `Print a table with one line per map: name, version, size, entity count,
+BSPX lumps and CRC32, for auditing a whole map directory at once.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		if listFormat == "" {
+			fmt.Fprintln(w, "MAP\tVERSION\tSIZE\tENTITIES\tBSPX\tCRC32")
+		}
+
+		for _, arg := range args {
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+			listing, err := NewMapListing(arg)
+			if err != nil {
+				Warnf("%s: %s", arg, err)
+				continue
+			}
+
+			if listFormat != "" {
+				err = RenderFormat(os.Stdout, listFormat, listing)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			bspx := strings.Join(listing.XLumpNames, ",")
+			if bspx == "" {
+				bspx = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%.1f kB\t%d\t%s\t%08x\n", listing.Filename, listing.Version, float64(listing.Size)/1024, listing.Entities, bspx, listing.CRC32)
+		}
+
+		w.Flush()
+		return nil
+	},
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// LogLevel is the severity of a diagnostic message. Warnings are always
+// shown, -v adds info and -vv debug messages.
+type LogLevel int
+
+const (
+	LogError LogLevel = iota - 1
+	LogWarning
+	LogInfo
+	LogDebug
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogError:
+		return "error"
+	case LogWarning:
+		return "warning"
+	case LogInfo:
+		return "info"
+	case LogDebug:
+		return "debug"
+	}
+	return fmt.Sprintf("level %d", int(l))
+}
+
+var (
+	logVerbosity int
+	logFormat    string
+	logOutput    io.Writer = os.Stderr
+	logCommand   string
+)
+
+// logEntry is a message in the json log format, one object per line.
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Command string `json:"command,omitempty"`
+	Message string `json:"msg"`
+}
+
+// Logf writes a diagnostic message to stderr if the verbosity includes
+// level, as "level: message" lines or with --log-format json as one JSON
+// object per line.
+func Logf(level LogLevel, format string, a ...interface{}) {
+	if int(level) > logVerbosity {
+		return
+	}
+	message := fmt.Sprintf(format, a...)
+	if logFormat == "json" {
+		encoder := json.NewEncoder(logOutput)
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(logEntry{time.Now().UTC().Format(time.RFC3339Nano), level.String(), logCommand, message})
+		return
+	}
+	fmt.Fprintf(logOutput, "%s: %s\n", level, message)
+}
+
+func Warnf(format string, a ...interface{}) {
+	Logf(LogWarning, format, a...)
+}
+
+func Infof(format string, a ...interface{}) {
+	Logf(LogInfo, format, a...)
+}
+
+func Debugf(format string, a ...interface{}) {
+	Logf(LogDebug, format, a...)
+}
+
+// checkLogFormat validates the --log-format flag.
+func checkLogFormat() error {
+	switch logFormat {
+	case "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown log format %q, expected text or json", logFormat)
+}
@@ -1,567 +1,592 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
-	"io"
-	"math"
-	"math/rand"
+	"io/fs"
 	"os"
-	"path"
-	"path/filepath"
+	"os/signal"
 	"strings"
 	"time"
-	"unsafe"
 
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/qw-ctf/bspxmgr/pkg/bspxmgr"
 	"github.com/spf13/cobra"
 )
 
-type BspVersion int32
-type LumpType int32
+var printFormat string
 
-const (
-	LumpEntities     LumpType = 0
-	LumpPlanes                = 1
-	LumpTextures              = 2
-	LumpVertexes              = 3
-	LumpVisibility            = 4
-	LumpNodes                 = 5
-	LumpTexinfo               = 6
-	LumpFaces                 = 7
-	LumpLighting              = 8
-	LumpClipnodes             = 9
-	LumpLeafs                 = 10
-	LumpMarksurfaces          = 11
-	LumpEdges                 = 12
-	LumpSurfedges             = 13
-	LumpModels                = 14
-	LumpTotal                 = 15
-
-	BspVersionStd      BspVersion = 29
-	BspVersionHalfLife            = 30
-	BspVersion2PSB                = (('2') + ('P' << 8) + ('S' << 16) + ('B' << 24))
-	BspVersionBSP2                = (('B') + ('S' << 8) + ('P' << 16) + ('2' << 24))
-)
-
-func (b BspVersion) String() string {
-	switch b {
-	case BspVersionStd:
-		return "29"
-	case BspVersionHalfLife:
-		return "HalfLife"
-	case BspVersion2PSB:
-		return "2PSB"
-	case BspVersionBSP2:
-		return "BSP2"
-	default:
-		return fmt.Sprintf("Unknown version (%d)", int(b))
-	}
-}
-
-func (l LumpType) String() string {
-	switch l {
-	case LumpEntities:
-		return "Entities"
-	case LumpPlanes:
-		return "Planes"
-	case LumpTextures:
-		return "Textures"
-	case LumpVertexes:
-		return "Vertexes"
-	case LumpVisibility:
-		return "Visibility"
-	case LumpNodes:
-		return "Nodes"
-	case LumpTexinfo:
-		return "Texinfo"
-	case LumpFaces:
-		return "Faces"
-	case LumpLighting:
-		return "Lighting"
-	case LumpClipnodes:
-		return "Clipnodes"
-	case LumpLeafs:
-		return "Leafs"
-	case LumpMarksurfaces:
-		return "Marksurfaces"
-	case LumpEdges:
-		return "Edges"
-	case LumpSurfedges:
-		return "Surfedges"
-	case LumpModels:
-		return "Models"
-	default:
-		return fmt.Sprintf("Unknown lump (%d)", int(l))
-	}
-}
-
-type Lump struct {
-	Offset uint32
-	Length uint32
-}
-
-type BspHeader struct {
-	Version BspVersion
-	Lumps   [LumpTotal]Lump
-}
-
-type BspXHeader struct {
-	Id       [4]byte
-	NumLumps int32
-}
-
-type BspXLump struct {
-	LumpName [24]byte
-	Offset   uint32
-	Length   uint32
-}
-
-type Face struct {
-	PlaneId   uint16
-	Side      uint16
-	LedgeId   uint32
-	LedgeNum  uint16
-	TexinfoId uint16
-	TypeLight uint8
-	BaseLight uint8
-	Light     [2]uint8
-	Lightmap  int32
-}
-
-type FaceV2 struct {
-	PlaneId   uint32
-	Side      uint32
-	LedgeId   uint32
-	LedgeNum  uint32
-	TexinfoId uint32
-	TypeLight uint8
-	BaseLight uint8
-	Light     [2]uint8
-	Lightmap  int32
-}
-
-type Vec4 [4]float32
-
-func (v Vec4) String() string {
-	return fmt.Sprintf("{x: %.3f, y: %.3f, z: %.3f, w: %.3f}", v[0], v[1], v[2], v[3])
-}
-
-type DecoupledLM struct {
-	LmWidth        uint16
-	LmHeight       uint16
-	Offset         int32
-	WorldToLmSpace [2]Vec4
-}
-
-func (d DecoupledLM) String() string {
-	return fmt.Sprintf("LM[w: %2d, h: %2d, off: %6d, [%s, %s]", d.LmWidth, d.LmHeight, d.Offset, d.WorldToLmSpace[0], d.WorldToLmSpace[1])
-}
-
-const BspXLumpHeaderSize = 24 + 4 + 4
-
-type BspFile struct {
-	BspHeader  BspHeader
-	BspXOffset int64
-	BspXHeader BspXHeader
-	BspXLumps  []BspXLump
-}
-
-func BytesToString(buffer []byte) string {
-	return fmt.Sprintf("%s", bytes.Trim(buffer, "\x00"))
-}
-
-func ReadBspFile(f *os.File) BspFile {
-	var bspFile BspFile
-
-	err := binary.Read(f, binary.LittleEndian, &bspFile.BspHeader)
-	if err != nil {
-		panic(err)
-	}
-
-	for i := 0; i < LumpTotal; i++ {
-		var lump = &bspFile.BspHeader.Lumps[i]
-		var end = int64(lump.Offset + lump.Length)
-		if end > bspFile.BspXOffset {
-			bspFile.BspXOffset = end
+var printCmd = &cobra.Command{
+	Use:   "print [<bspx-lump>] <map>",
+	Short: "Print BSP structure",
+	Long: `Print the full list of both BSP and BSPX lumps, or the decoded contents of
+a single BSPX lump.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[len(args)-1])
+		if err != nil {
+			return err
 		}
-	}
-
-	_, err = f.Seek(bspFile.BspXOffset, os.SEEK_SET)
-	if err != nil {
-		return bspFile
-	}
+		defer f.Close()
 
-	err = binary.Read(f, binary.LittleEndian, &bspFile.BspXHeader)
-	if err != nil {
-		return bspFile
-	}
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[len(args)-1], err)
+		}
+		if printFormat != "" {
+			return RenderFormat(os.Stdout, printFormat, NewMapSummary(args[len(args)-1], &bspFile))
+		}
 
-	bspFile.BspXLumps = make([]BspXLump, bspFile.BspXHeader.NumLumps)
-	for i := 0; i < len(bspFile.BspXLumps); i++ {
-		err = binary.Read(f, binary.LittleEndian, &bspFile.BspXLumps[i])
-	}
+		fmt.Println(args[len(args)-1])
 
-	return bspFile
+		if len(args) > 1 {
+			handler := BspXHandlerFor(args[0])
+			if handler == nil || handler.Print == nil {
+				fmt.Printf("Detailed print of %s not supported, supported lumps: %s\n", args[0], strings.Join(BspXHandlerNames(), ", "))
+				return nil
+			}
+			lump, err := bspFile.BspXLump(args[0])
+			if err != nil {
+				return err
+			}
+			if lump == nil {
+				return fmt.Errorf("%s has no %s lump", args[1], args[0])
+			}
+			return handler.Print(os.Stdout, &bspFile, lump)
+		}
+		return bspxmgr.PrintListing(os.Stdout, args[0], &bspFile)
+	},
 }
 
-func WriteBSPX(bspFile *BspFile, f *os.File, destName string, handler func(lumps map[[24]byte][]byte)) {
-
-	out, err := os.Create(destName)
-	if err != nil {
-		panic(err)
+var lumpSets []string
+var lumpUnsets []string
+var lumpWatch bool
+var lumpWatchInterval time.Duration
+
+// LumpEdits collects the edits of the set and unset commands from the lumps to
+// remove, the name and path pairs given as arguments and the NAME=path values
+// of --set. Each lump may only be edited once.
+func LumpEdits(args []string, sets []string, unsets []string) ([]bspxmgr.LumpEdit, error) {
+	var edits []bspxmgr.LumpEdit
+	for _, name := range unsets {
+		edits = append(edits, bspxmgr.LumpEdit{Lump: name, Unset: true})
 	}
-	f.Seek(0, os.SEEK_SET)
-
-	written, err := io.CopyN(out, f, bspFile.BspXOffset)
-	if err != nil {
-		panic(err)
-	}
-
-	if written != bspFile.BspXOffset {
-		panic("Could not write new map")
-	}
-
-	bspx := map[[24]byte][]byte{}
-	for _, xlump := range bspFile.BspXLumps {
-		var buffer = make([]byte, xlump.Length)
-		f.Seek(int64(xlump.Offset), os.SEEK_SET)
-		f.Read(buffer)
-		bspx[xlump.LumpName] = buffer
+	for _, set := range sets {
+		name, dataPath, found := strings.Cut(set, "=")
+		if !found || name == "" || dataPath == "" {
+			return nil, fmt.Errorf("invalid --set %q, expected NAME=path", set)
+		}
+		args = append(args, name, dataPath)
 	}
-
-	handler(bspx)
-
-	binary.Write(out, binary.LittleEndian, bspFile.BspXHeader.Id)
-	binary.Write(out, binary.LittleEndian, int32(len(bspx)))
-
-	offset, err := out.Seek(0, os.SEEK_CUR)
-	if err != nil {
-		panic(err)
+	for i := 0; i+1 < len(args); i += 2 {
+		buffer, err := os.ReadFile(args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, bspxmgr.LumpEdit{Lump: args[i], Data: buffer})
 	}
 
-	offset += int64(BspXLumpHeaderSize * len(bspx))
-
-	for lumpName, buffer := range bspx {
-		xlump := BspXLump{
-			LumpName: lumpName,
-			Offset:   uint32(offset),
-			Length:   uint32(len(buffer)),
+	edited := map[string]bool{}
+	for _, edit := range edits {
+		if edited[edit.Lump] {
+			return nil, fmt.Errorf("BSPX lump %s is edited more than once", edit.Lump)
 		}
-		offset += int64(xlump.Length)
-		binary.Write(out, binary.LittleEndian, xlump)
+		edited[edit.Lump] = true
 	}
-
-	for _, buffer := range bspx {
-		out.Write(buffer)
+	if len(edits) == 0 {
+		return nil, errors.New("no BSPX lump to set or unset")
 	}
+	return edits, nil
+}
 
-	err = out.Sync()
+// runLumpEdits applies the edits to the map in one rewrite.
+func runLumpEdits(cmd *cobra.Command, mapPath string, edits []bspxmgr.LumpEdit) error {
+	destName, err := bspxmgr.EditLumps(cmd.Context(), bspxmgr.EditLumpsOptions{Map: mapPath, Edits: edits})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = out.Close()
-	if err != nil {
-		panic(err)
-	}
+	return RunUploadHooks(cmd.Context(), destName, cmd.Name())
 }
 
-func PrintDecoupledLM(bspFile *BspFile, f *os.File) error {
-	var numFaces int
-	switch bspFile.BspHeader.Version {
-	case BspVersionStd:
-		numFaces = int(bspFile.BspHeader.Lumps[LumpFaces].Length / uint32(unsafe.Sizeof(Face{})))
-		break
-	case BspVersionBSP2:
-		numFaces = int(bspFile.BspHeader.Lumps[LumpFaces].Length / uint32(unsafe.Sizeof(FaceV2{})))
-		break
-	default:
-		fmt.Printf("Detailed print of BSP version %s not supported\n", bspFile.BspHeader.Version)
-		break
-	}
-	for i := 0; i < len(bspFile.BspXLumps); i++ {
-		if BytesToString(bspFile.BspXLumps[i].LumpName[:]) != "DECOUPLED_LM" {
-			continue
+var setLumpCmd = &cobra.Command{
+	Use:   "set <map> [<lump-name> <path-to-data>]",
+	Short: "Add or update content of a BSPX lump",
+	Long: `Add or update content of a BSPX lump. Further lumps can be set with
+--set NAME=path and removed with --unset NAME, both may be repeated, and the
+map is written only once. With --watch the map is written again whenever one
+of the data files changes, e.g. while iterating on the lighting of a map.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 && len(args) != 3 {
+			return fmt.Errorf("accepts 1 or 3 arg(s), received %d", len(args))
 		}
-		_, err := f.Seek(int64(bspFile.BspXLumps[i].Offset), io.SeekStart)
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if lumpWatch {
+			return watchLumpEdits(cmd, args)
+		}
+		edits, err := LumpEdits(args[1:], lumpSets, lumpUnsets)
 		if err != nil {
 			return err
 		}
-		for j := 0; j < numFaces; j++ {
-			var Lightmap DecoupledLM
-			err := binary.Read(f, binary.LittleEndian, &Lightmap)
-			if err != nil {
-				return err
-			}
-			fmt.Printf("%s\n", Lightmap)
-		}
-	}
-	return nil
+		return runLumpEdits(cmd, args[0], edits)
+	},
 }
 
-var printCmd = &cobra.Command{
-	Use:   "print <map>",
-	Short: "Print BSP structure",
-	Long:  `Print the full list of both BSP and BSPX lumps`,
-	Args:  cobra.RangeArgs(1, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		f, err := os.Open(args[len(args)-1])
-		if err != nil {
-			panic(err)
-		}
-		defer f.Close()
-
-		fmt.Println(args[len(args)-1])
-
-		bspFile := ReadBspFile(f)
-		if len(args) > 1 {
-			if args[0] == "DECOUPLED_LM" {
-				PrintDecoupledLM(&bspFile, f)
-			} else {
-				fmt.Printf("Detailed print of %s not supported\n", args[1])
-			}
-		} else {
-			fmt.Println("Filename:", path.Base(args[0]))
-			fmt.Println(" Version:", bspFile.BspHeader.Version)
-			fmt.Println("   Lumps:")
-
-			for i, lump := range bspFile.BspHeader.Lumps {
-				fmt.Printf("     %-24s %8.1f kB @ %8d ofs\n", LumpType(i), float64(lump.Length)/1024.0, lump.Offset)
-			}
-
-			if len(bspFile.BspXLumps) > 0 {
-				fmt.Printf("  XLumps:                                 @ %8d ofs\n", bspFile.BspXOffset)
-
-				for _, xlump := range bspFile.BspXLumps {
-					fmt.Printf("     %-24s %8.1f kB @ %8d ofs\n", BytesToString(xlump.LumpName[:]), float64(xlump.Length)/1024, xlump.Offset)
-				}
-			}
-
-			fmt.Println("")
+// watchLumpEdits rewrites the map whenever one of the data files of set
+// changes, until interrupted.
+func watchLumpEdits(cmd *cobra.Command, args []string) error {
+	var paths []string
+	if len(args) == 3 {
+		paths = append(paths, args[2])
+	}
+	for _, set := range lumpSets {
+		if _, dataPath, found := strings.Cut(set, "="); found {
+			paths = append(paths, dataPath)
 		}
-	},
-}
+	}
+	if len(paths) == 0 {
+		return errors.New("--watch needs a lump to set")
+	}
 
-var setLumpCmd = &cobra.Command{
-	Use:   "set <map> <lump-name> <path-to-data>",
-	Short: "Add or update content of a BSPX lump",
-	Args:  cobra.ExactArgs(3),
-	Run: func(cmd *cobra.Command, args []string) {
-		f, err := os.Open(args[0])
+	fmt.Printf("Watching %s, press Ctrl-C to stop\n", strings.Join(paths, ", "))
+	return WatchFiles(cmd.Context(), paths, lumpWatchInterval, func() error {
+		edits, err := LumpEdits(args[1:], lumpSets, lumpUnsets)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		defer f.Close()
-
-		var lumpNameRaw [24]byte
-		copy(lumpNameRaw[:], []byte(args[1]))
-
-		buffer, err := os.ReadFile(args[2])
+		err = runLumpEdits(cmd, args[0], edits)
 		if err != nil {
-			panic(err)
+			return err
 		}
-
-		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
-		bspFile := ReadBspFile(f)
-		WriteBSPX(&bspFile, f, fmt.Sprintf("%s.new.bsp", basename), func(lumps map[[24]byte][]byte) {
-			lumps[lumpNameRaw] = buffer
-		})
-	},
+		fmt.Printf("%s Wrote %s\n", time.Now().Format("15:04:05"), bspxmgr.DefaultOutput(args[0]))
+		return nil
+	})
 }
 
 var unsetLumpCmd = &cobra.Command{
-	Use:   "unset <map> <lump-name>",
+	Use:   "unset <map> [<lump-name>]",
 	Short: "Removes a BSPX lump",
-	Args:  cobra.ExactArgs(2),
-	Run: func(cmd *cobra.Command, args []string) {
-		f, err := os.Open(args[0])
+	Long: `Removes a BSPX lump. Further lumps can be removed with --unset NAME and set
+with --set NAME=path, both may be repeated, and the map is written only once.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		unsets := append(append([]string(nil), args[1:]...), lumpUnsets...)
+		edits, err := LumpEdits(nil, lumpSets, unsets)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		defer f.Close()
-
-		var lumpNameRaw [24]byte
-		copy(lumpNameRaw[:], []byte(args[1]))
-
-		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
-		bspFile := ReadBspFile(f)
-		WriteBSPX(&bspFile, f, fmt.Sprintf("%s.new.bsp", basename), func(lumps map[[24]byte][]byte) {
-			delete(lumps, lumpNameRaw)
-		})
+		return runLumpEdits(cmd, args[0], edits)
 	},
 }
 
-var animSuffixCache = map[string]string{}
-
-func randomLetters(n int) string {
-	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
-	}
-	return string(b)
-}
-
-func obfuscateTextureName(original string) string {
-	trimmed := strings.TrimRight(original, "\x00 ")
-
-	const totalLen = 15
-
-	//----------------------------------------------------------------
-	// 1) Animated textures: +0foo, +1foo, +2foo, +afoo, etc.
-	//----------------------------------------------------------------
-	if strings.HasPrefix(trimmed, "+") && len(trimmed) > 1 {
-		prefix := trimmed[:2]
-		suffix := trimmed[2:]
-
-		prefixLen := len(prefix)
-		suffixLen := totalLen - prefixLen
-
-		if suffixLen < 0 {
-			return prefix[:totalLen]
-		}
-
-		scrambledSuffix, found := animSuffixCache[suffix]
-		if !found {
-			scrambledSuffix = randomLetters(suffixLen)
-			animSuffixCache[suffix] = scrambledSuffix
-		} else {
-			if len(scrambledSuffix) != suffixLen {
-				scrambledSuffix = randomLetters(suffixLen)
-				animSuffixCache[suffix] = scrambledSuffix
-			}
-		}
-
-		return prefix + scrambledSuffix
-	}
-
-	liquidPrefixes := []string{"*water", "*lava", "*slime", "*tele"}
-	for _, lp := range liquidPrefixes {
-		if strings.HasPrefix(trimmed, lp) {
-			return preserveAndScrambleFixed(lp, trimmed, totalLen)
-		}
-	}
-
-	if strings.HasPrefix(trimmed, "*") {
-		return preserveAndScrambleFixed("*", trimmed, totalLen)
-	}
-
-	if strings.HasPrefix(trimmed, "{") {
-		return preserveAndScrambleFixed("{", trimmed, totalLen)
-	}
-
-	if strings.HasPrefix(trimmed, "sky") {
-		return preserveAndScrambleFixed("sky", trimmed, totalLen)
-	}
-
-	return randomLetters(totalLen)
-}
-
-func preserveAndScrambleFixed(prefix, original string, totalLen int) string {
-	prefixLen := len(prefix)
-	if prefixLen >= totalLen {
-		return prefix[:totalLen]
-	}
-	scrambleLen := totalLen - prefixLen
-	return prefix + randomLetters(scrambleLen)
-}
+var obfuscateSeed int64
 
 var obfuscateTextureNamesCmd = &cobra.Command{
 	Use:   "obfuscate <map>",
 	Short: "Randomizes texture names",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		f, err := os.Open(args[0])
+	Long: `Randomizes texture names. The seed and a hash of the name mapping are stored
+in a BSPXMGR_OBFUSCATED lump, and maps carrying it are refused since scrambling
+them again would make the mapping unrecoverable.
+
+Texels can be scrambled to defeat texture hashes and entity target names can
+be randomized as well. The whole policy can be stored in a profile, see the
+obfuscation section of the profile config.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		policy, err := ResolveObfuscationPolicy(cmd, args[0])
 		if err != nil {
-			panic(err)
+			return err
 		}
-		defer f.Close()
-
-		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
-		destname := fmt.Sprintf("%s.new.bsp", basename)
 
-		destFile, err := os.Create(destname)
-		if err != nil {
-			panic(err)
+		destName, err := bspxmgr.Obfuscate(cmd.Context(), bspxmgr.ObfuscateOptions{Map: args[0], Policy: *policy, Log: Infof})
+		var obfuscated *bspxmgr.AlreadyObfuscatedError
+		if errors.As(err, &obfuscated) {
+			fmt.Fprintf(os.Stderr, "%s is already obfuscated:\n%s", args[0], obfuscated.Marker)
 		}
-		defer destFile.Close()
-
-		if _, err := io.Copy(destFile, f); err != nil {
-			panic(err)
+		if err != nil {
+			return err
 		}
 
-		if err := destFile.Sync(); err != nil {
-			panic(err)
+		if policy.Mapping != "" {
+			fmt.Printf("Wrote name mapping to %s\n", policy.Mapping)
 		}
 
-		rand.Seed(time.Now().UnixNano())
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
 
-		destFile.Seek(0, io.SeekStart)
-		bspFile := ReadBspFile(destFile)
+var (
+	timeout       time.Duration
+	cancelTimeout context.CancelFunc = func() {}
+	quiet         bool
+)
 
-		destFile.Seek(int64(bspFile.BspHeader.Lumps[LumpTextures].Offset), io.SeekStart)
-		var numMips uint32
-		err = binary.Read(destFile, binary.LittleEndian, &numMips)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Println(numMips)
-		var offsets = make([]uint32, numMips)
-		err = binary.Read(destFile, binary.LittleEndian, &offsets)
-		if err != nil {
-			panic(err)
+var rootCmd = &cobra.Command{
+	Use:   "bspxmgr",
+	Short: `bspxmgr manages BPS stuff.`,
+	Long: `bspxmgr handles adding, removing, and updating BSPX assets, and obfuscates texture names.
+
+Exits with status 1 when a command fails, 2 when a map can't be parsed, 3
+when a check such as validate finds problems, 4 when a file can't be read or
+written and 130 when interrupted. diff and grep exit with 1 when the maps
+differ or nothing matches. Interrupted commands don't leave partial output
+files behind.`,
+	SilenceErrors: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		// Arguments are valid at this point, errors from here on are not
+		// usage errors.
+		cmd.SilenceUsage = true
+		logCommand = cmd.Name()
+		if timeout > 0 {
+			var ctx context.Context
+			ctx, cancelTimeout = context.WithTimeout(cmd.Context(), timeout)
+			cmd.SetContext(ctx)
 		}
-
-		for _, offset := range offsets {
-			if offset == math.MaxUint32 {
-				continue
-			}
-			destFile.Seek(int64(bspFile.BspHeader.Lumps[LumpTextures].Offset+offset), io.SeekStart)
-			var rawName [16]byte
-			err = binary.Read(destFile, binary.LittleEndian, &rawName)
+		if quiet {
+			// Everything but errors goes, including output meant for stdout.
+			logVerbosity = int(LogError)
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
 			if err != nil {
-				panic(err)
+				return err
 			}
+			os.Stdout = devNull
+		}
+		return checkLogFormat()
+	},
+}
 
-			name := string(rawName[:])
-			obf := obfuscateTextureName(name)
-
-			fmt.Println(name + " => " + obf)
-
-			var name16 [15]byte
-			copy(name16[:], obf) // copies up to 15 bytes
+const (
+	ExitFailure     = 1
+	ExitParseError  = 2
+	ExitCheckFailed = 3
+	ExitIOError     = 4
+	ExitInterrupted = 130
+)
 
-			destFile.Seek(int64(bspFile.BspHeader.Lumps[LumpTextures].Offset+offset), io.SeekStart)
-			err = binary.Write(destFile, binary.LittleEndian, name16)
-			if err != nil {
-				panic(err)
-			}
-		}
+// ExitError ends a command with Status without an error message, for
+// commands whose findings have been printed already.
+type ExitError struct {
+	Status int
+}
 
-		err = destFile.Sync()
-		if err != nil {
-			panic(err)
-		}
-	},
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Status)
 }
 
-var rootCmd = &cobra.Command{
-	Use:   "bspxmgr",
-	Short: `bspxmgr manages BPS stuff.`,
-	Long:  `bspxmgr handles adding, removing, and updating BSPX assets, and obfuscates texture names.`,
+// ErrCheckFailed is returned by checks such as validate that found problems.
+var ErrCheckFailed = &ExitError{ExitCheckFailed}
+
+// ExitCode returns the exit status for an error returned by a command.
+func ExitCode(err error) int {
+	var exitErr *ExitError
+	var formatErr *bsp.FormatError
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	switch {
+	case errors.As(err, &exitErr):
+		return exitErr.Status
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	case errors.As(err, &formatErr):
+		return ExitParseError
+	case errors.As(err, &pathErr), errors.As(err, &linkErr):
+		return ExitIOError
+	}
+	return ExitFailure
 }
 
 func main() {
-	err := rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	go func() {
+		// A second interrupt kills the process right away.
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := rootCmd.ExecuteContext(ctx)
+	cancelTimeout()
+	var exitErr *ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		if logFormat == "json" {
+			Logf(LogError, "%s", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "bspxmgr:", err)
+		}
+	}
 	if err != nil {
-		os.Exit(1)
+		os.Exit(ExitCode(err))
 	}
 }
 
 func init() {
+	rootCmd.PersistentFlags().StringVar(&profileName, "profile", "", "name of the profile to apply")
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", DefaultConfigPath(), "path to the profile configuration file")
+	rootCmd.PersistentFlags().DurationVar(&timeout, "timeout", 0, "abort the command after this long, e.g. 30s")
+	rootCmd.PersistentFlags().CountVarP(&logVerbosity, "verbose", "v", "log info messages, -vv also debug messages")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "print nothing but errors, for scripts going by the exit status")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "format of log messages on stderr: text or json")
+
 	rootCmd.AddCommand(printCmd)
 	rootCmd.AddCommand(setLumpCmd)
 	rootCmd.AddCommand(unsetLumpCmd)
 	rootCmd.AddCommand(obfuscateTextureNamesCmd)
+	rootCmd.AddCommand(serverConfigCmd)
+	rootCmd.AddCommand(validateCmd)
+	rootCmd.AddCommand(layoutCmd)
+	rootCmd.AddCommand(downloadManifestCmd)
+	rootCmd.AddCommand(equivalentCmd)
+	rootCmd.AddCommand(browseCmd)
+	rootCmd.AddCommand(grepCmd)
+	rootCmd.AddCommand(versionCmd)
+	rootCmd.AddCommand(listCmd)
+	rootCmd.AddCommand(transformCmd)
+	rootCmd.AddCommand(scaleCmd)
+	rootCmd.AddCommand(mirrorCmd)
+	rootCmd.AddCommand(extractModelCmd)
+	rootCmd.AddCommand(pruneModelsCmd)
+	rootCmd.AddCommand(facesCmd)
+	facesCmd.AddCommand(facesRemoveCmd)
+	rootCmd.AddCommand(texturesCmd)
+	texturesCmd.AddCommand(texturesListCmd)
+	texturesCmd.AddCommand(texturesExportWadCmd)
+	texturesCmd.AddCommand(texturesEmbedCmd)
+	texturesCmd.AddCommand(texturesExportCmd)
+	texturesCmd.AddCommand(texturesReplaceCmd)
+	texturesCmd.AddCommand(texturesStripCmd)
+	texturesCmd.AddCommand(texturesRenameCmd)
+	texturesCmd.AddCommand(texturesDedupeCmd)
+	rootCmd.AddCommand(rspeedsCmd)
+	rootCmd.AddCommand(zfightCmd)
+	rootCmd.AddCommand(waypointsCmd)
+	waypointsCmd.AddCommand(waypointsEmbedCmd)
+	waypointsCmd.AddCommand(waypointsExtractCmd)
+	rootCmd.AddCommand(locsCmd)
+	locsCmd.AddCommand(locsEmbedCmd)
+	locsCmd.AddCommand(locsExtractCmd)
+	rootCmd.AddCommand(embedSidecarsCmd)
+	rootCmd.AddCommand(sidecarsCmd)
+	rootCmd.AddCommand(shuffleCmd)
+	rootCmd.AddCommand(contentsCmd)
+	rootCmd.AddCommand(navCmd)
+	rootCmd.AddCommand(texmapCmd)
+	rootCmd.AddCommand(optimizeCmd)
+	rootCmd.AddCommand(convertCmd)
+	rootCmd.AddCommand(tjuncCmd)
+	rootCmd.AddCommand(renameMapCmd)
+	rootCmd.AddCommand(leakCmd)
+	rootCmd.AddCommand(benchCmd)
+	rootCmd.AddCommand(verifyManifestCmd)
+	rootCmd.AddCommand(entitiesCmd)
+	entitiesCmd.AddCommand(entitiesPrintCmd)
+	entitiesCmd.AddCommand(entitiesSetCmd)
+	entitiesCmd.AddCommand(entitiesExportCmd)
+	entitiesCmd.AddCommand(entitiesQueryCmd)
+	entitiesCmd.AddCommand(entitiesEditCmd)
+	entitiesCmd.AddCommand(entitiesReplaceCmd)
+	entitiesCmd.AddCommand(entitiesWorldspawnCmd)
+	entitiesCmd.AddCommand(entitiesScrubCmd)
+	entitiesCmd.AddCommand(entitiesLintCmd)
+	entitiesCmd.AddCommand(entitiesConvertCTFCmd)
+	entitiesCmd.AddCommand(entitiesSpawnsCmd)
+	entitiesCmd.AddCommand(entitiesMinifyCmd)
+	entitiesCmd.AddCommand(entitiesIntermissionCmd)
+	entitiesCmd.AddCommand(entitiesTargetsCmd)
+	entitiesCmd.AddCommand(entitiesSpawnFilterCmd)
+	entitiesCmd.AddCommand(entitiesTemplateCmd)
+	entitiesCmd.AddCommand(entitiesTransformCmd)
+	entitiesCmd.AddCommand(entitiesStripSPCmd)
+	rootCmd.AddCommand(metaCmd)
+	metaCmd.AddCommand(metaListCmd)
+	metaCmd.AddCommand(metaGetCmd)
+	metaCmd.AddCommand(metaSetCmd)
+	metaCmd.AddCommand(metaDeleteCmd)
+	rootCmd.AddCommand(getLumpCmd)
+	rootCmd.AddCommand(extractAllCmd)
+	rootCmd.AddCommand(copyLumpCmd)
+	rootCmd.AddCommand(diffCmd)
+	rootCmd.AddCommand(hexdumpCmd)
+	rootCmd.AddCommand(statCmd)
+	rootCmd.AddCommand(checksumCmd)
+	rootCmd.AddCommand(renameLumpCmd)
+	rootCmd.AddCommand(reorderCmd)
+	rootCmd.AddCommand(stripBspXCmd)
+	rootCmd.AddCommand(repackCmd)
+	rootCmd.AddCommand(applyCmd)
+	rootCmd.AddCommand(mergeBspXCmd)
+	rootCmd.AddCommand(trimCmd)
+	rootCmd.AddCommand(splitCmd)
+	rootCmd.AddCommand(buildCmd)
+	rootCmd.AddCommand(batchCmd)
+
+	for _, cmd := range []*cobra.Command{setLumpCmd, unsetLumpCmd} {
+		cmd.Flags().StringArrayVar(&lumpSets, "set", nil, "also set a BSPX lump as NAME=path, may be repeated")
+		cmd.Flags().StringArrayVar(&lumpUnsets, "unset", nil, "also remove a BSPX lump, may be repeated")
+	}
+
+	setLumpCmd.Flags().BoolVar(&lumpWatch, "watch", false, "write the map again whenever a data file changes, until interrupted")
+	setLumpCmd.Flags().DurationVar(&lumpWatchInterval, "watch-interval", 500*time.Millisecond, "how often --watch checks the data files")
+
+	diffCmd.Flags().BoolVar(&diffDeep, "deep", false, "show differing byte ranges and decoded fields within BSPX lumps")
+
+	hexdumpCmd.Flags().Int64Var(&hexdumpOffset, "offset", 0, "offset within the lump to start at")
+	hexdumpCmd.Flags().Int64Var(&hexdumpLength, "length", 0, "number of bytes to dump, 0 for the rest of the lump")
+
+	statCmd.Flags().BoolVar(&statJSON, "json", false, "print as JSON")
+	statCmd.Flags().StringVar(&statFormat, "format", "", "Go template to format the output with, e.g. '{{.Version}} {{.Faces}}'")
+	statCmd.Flags().StringVar(&statReport, "report", "", "write the counts as json, junit or sarif findings")
+	statCmd.Flags().StringVar(&statFailOn, "fail-on", "error", "lowest severity (info, warning, error) that causes a non-zero exit with --report")
+
+	checksumCmd.Flags().BoolVar(&checksumLumps, "lumps", false, "also hash every standard and BSPX lump")
+	checksumCmd.Flags().BoolVar(&checksumJSON, "json", false, "print as JSON")
+
+	reorderCmd.Flags().StringSliceVar(&reorderOrder, "order", nil, "BSPX lump names to put first, in this order, instead of sorting by name")
+
+	repackCmd.Flags().IntVar(&repackAlignment, "align", 4, "start every BSPX lump at a multiple of this many bytes")
+
+	mergeBspXCmd.Flags().StringSliceVar(&mergeBspXOnly, "only", nil, "BSPX lumps to copy, all by default")
+
+	trimCmd.Flags().BoolVar(&trimCheck, "check", false, "only report the bytes after the last lump")
+
+	batchCmd.Flags().BoolVarP(&batchRecursive, "recursive", "r", false, "also search subdirectories for maps")
+	batchCmd.Flags().StringVar(&batchOutput, "output", "", "where to move written maps, e.g. 'out/{name}.bsp'")
+
+	for _, cmd := range []*cobra.Command{entitiesCmd, entitiesPrintCmd} {
+		cmd.Flags().BoolVar(&entitiesPretty, "pretty", false, "indent pairs and align values")
+		cmd.Flags().BoolVar(&entitiesNumber, "number", false, "precede every entity with a comment giving its index")
+		cmd.Flags().BoolVar(&entitiesJSON, "json", false, "print as a JSON array of objects")
+	}
+
+	entitiesQueryCmd.Flags().BoolVar(&entitiesQueryCount, "count", false, "print the number of matches per classname")
+	entitiesQueryCmd.Flags().BoolVar(&entitiesJSON, "json", false, "print the matching entities as a JSON array")
+	entitiesQueryCmd.Flags().BoolVar(&entitiesPretty, "pretty", false, "indent pairs and align values")
+	entitiesEditCmd.Flags().StringArrayVar(&entitiesEditRemove, "remove", nil, "remove the entities matching key=pattern, key!=pattern or key, may be repeated")
+	entitiesEditCmd.Flags().StringArrayVar(&entitiesEditSet, "set", nil, "set a key of the entities with a classname as classname:key=value, may be repeated")
+	entitiesEditCmd.Flags().StringArrayVar(&entitiesEditUnset, "unset", nil, "remove a key of the entities with a classname as classname:key, may be repeated")
+	entitiesEditCmd.Flags().StringArrayVar(&entitiesEditAdd, "add", nil, "append entities written as in a .ent file, may be repeated")
+	entitiesReplaceCmd.Flags().StringVar(&entitiesReplaceKey, "key", "*", "only replace in the values of keys matching this glob pattern")
+	entitiesReplaceCmd.Flags().StringArrayVar(&entitiesReplaceWhere, "where", nil, "only replace in entities matching key=pattern, key!=pattern or key, may be repeated")
+	entitiesReplaceCmd.Flags().BoolVar(&entitiesReplaceRegex, "regex", false, "the pattern is a regular expression")
+	entitiesReplaceCmd.Flags().BoolVar(&entitiesReplacePreview, "preview", false, "print the changes without writing a map")
+	entitiesWorldspawnCmd.Flags().StringVar(&worldspawnMessage, "message", "", "set the map title shown by clients")
+	entitiesWorldspawnCmd.Flags().StringVar(&worldspawnWad, "wad", "", "set the texture wads, separated by semicolons")
+	entitiesWorldspawnCmd.Flags().StringVar(&worldspawnSky, "sky", "", "set the skybox name")
+	entitiesWorldspawnCmd.Flags().StringVar(&worldspawnFog, "fog", "", "set the fog as density or density red green blue")
+	entitiesWorldspawnCmd.Flags().StringVar(&worldspawnWorldtype, "worldtype", "", "set the worldtype, 0/medieval, 1/metal or 2/base")
+	entitiesScrubCmd.Flags().StringArrayVar(&entitiesScrubKeys, "key", nil, "remove keys matching this glob pattern instead of the editor and compiler keys, may be repeated")
+	entitiesScrubCmd.Flags().BoolVar(&entitiesScrubCheck, "check", false, "only print what would be scrubbed")
+	entitiesLintCmd.Flags().StringArrayVar(&entitiesLintClasses, "classes", nil, "JSON file of additional classnames and their required keys, may be repeated")
+	entitiesLintCmd.Flags().StringVar(&entitiesLintFailOn, "fail-on", "error", "lowest severity (info, warning, error) that causes a non-zero exit")
+	entitiesConvertCTFCmd.Flags().StringVar(&convertCTFFrom, "from", "", "convention of the map: threewave, ktx or fo")
+	entitiesConvertCTFCmd.Flags().StringVar(&convertCTFTo, "to", "", "convention to convert to: threewave, ktx or fo")
+	entitiesConvertCTFCmd.Flags().StringVar(&convertCTFConventions, "conventions", "", "JSON file with additional conventions")
+	entitiesConvertCTFCmd.MarkFlagRequired("from")
+	entitiesConvertCTFCmd.MarkFlagRequired("to")
+	entitiesSpawnsCmd.Flags().IntVar(&spawnsMin, "min", 2, "fewest deathmatch spawns, and team spawns per team, accepted")
+	entitiesSpawnsCmd.Flags().IntVar(&spawnsTolerance, "tolerance", 1, "allowed difference between team spawn counts")
+	entitiesMinifyCmd.Flags().StringArrayVar(&minifyDrop, "drop", nil, "also drop keys matching this glob pattern, may be repeated")
+	entitiesMinifyCmd.Flags().StringArrayVar(&minifyKeep, "keep", nil, "keep keys matching this glob pattern, may be repeated")
+	entitiesIntermissionCmd.Flags().StringArrayVar(&intermissionCameras, "camera", nil, "add a camera at x,y,z, optionally followed by :pitch,yaw,roll, may be repeated")
+	entitiesIntermissionCmd.Flags().StringVar(&intermissionFrom, "from", "", "copy the cameras of this map")
+	entitiesIntermissionCmd.Flags().BoolVar(&intermissionReplace, "replace", false, "remove the existing cameras")
+	entitiesTargetsCmd.Flags().StringVar(&targetsDot, "dot", "", "write the graph in DOT format to this file, - for stdout")
+	entitiesSpawnFilterCmd.Flags().BoolVar(&spawnFilterDeathmatch, "deathmatch", false, "remove entities flagged not in deathmatch")
+	entitiesSpawnFilterCmd.Flags().IntVar(&spawnFilterSkill, "skill", 0, "remove entities flagged not in this skill level, 0 to 3")
+	entitiesTemplateCmd.Flags().StringArrayVar(&templateParams, "param", nil, "value of a template parameter as name=value, may be repeated")
+	entitiesTemplateCmd.Flags().StringVar(&templateInstances, "instances", "", "JSON array of parameter objects, expanding the template once for each")
+	entitiesTransformCmd.Flags().StringVar(&entitiesTransformTranslate, "translate", "", "offset to move the entities by, as x,y,z")
+	entitiesTransformCmd.Flags().Float64Var(&entitiesTransformRotate, "rotate-z", 0, "degrees to rotate the entities around the z axis")
+	entitiesStripSPCmd.Flags().StringArrayVar(&stripSPKeep, "keep", nil, "keep entities with classnames matching this glob pattern, may be repeated")
+	entitiesExportCmd.Flags().StringVar(&entitiesExportGamedir, "gamedir", "", "write to the maps directory of this game directory instead of next to the map")
+	entitiesExportCmd.Flags().StringArrayVar(&entitiesExportExclude, "exclude", nil, "leave out entities matching key=pattern, key!=pattern or key, may be repeated")
+	entitiesExportCmd.Flags().BoolVar(&entitiesExportForce, "force", false, "replace an existing .ent file")
+
+	printCmd.Flags().StringVar(&printFormat, "format", "", "Go template to format the output with, e.g. '{{.Version}} {{.Lumps.Entities.Length}}'")
+
+	validateCmd.Flags().BoolVar(&validateOpts.CTF, "ctf", false, "check CTF/teamplay requirements")
+	validateCmd.Flags().IntVar(&validateOpts.TeamSpawnTolerance, "team-spawn-tolerance", 1, "allowed difference between team spawn counts")
+	validateCmd.Flags().StringVar(&validateReport, "report", "", "write findings as json, junit or sarif")
+	validateCmd.Flags().StringArrayVar(&validateClasses, "classes", nil, "JSON file of additional classnames and their required keys, may be repeated")
+	validateCmd.Flags().StringVar(&validateFailOn, "fail-on", "error", "lowest severity (info, warning, error) that causes a non-zero exit")
+
+	layoutCmd.Flags().IntVar(&layoutSize, "size", 1024, "size in pixels of the longest image side")
+
+	downloadManifestCmd.Flags().StringVar(&downloadManifestRoot, "root", ".", "directory manifest paths are relative to")
+	downloadManifestCmd.Flags().StringVar(&downloadManifestFormat, "format", "list", "manifest format: list, json or fmf")
+	obfuscateTextureNamesCmd.Flags().Int64Var(&obfuscateSeed, "seed", 0, "random seed, 0 picks one from the current time")
+	obfuscateTextureNamesCmd.Flags().StringVar(&obfuscateSeedFrom, "seed-from", "time", "seed source: time, map to derive it from the map contents, or a number")
+	obfuscateTextureNamesCmd.Flags().BoolVar(&obfuscateTextures, "textures", true, "randomize texture names")
+	obfuscateTextureNamesCmd.Flags().BoolVar(&obfuscateScramblePixels, "scramble-pixels", false, "shift some texels to a neighbouring shade so texture hashes change")
+	obfuscateTextureNamesCmd.Flags().BoolVar(&obfuscateTargetnames, "targetnames", false, "randomize entity target and targetname values")
+	obfuscateTextureNamesCmd.Flags().StringArrayVar(&obfuscateExclude, "exclude", nil, "glob pattern of texture names to leave untouched, may be repeated")
+	obfuscateTextureNamesCmd.Flags().StringVar(&obfuscateMapping, "mapping", "", "write the name mapping to this file, {map} is replaced with the map name")
+
+	downloadManifestCmd.Flags().StringVar(&downloadManifestMirror, "mirror", "", "base URL added as mirror to fmf packages")
+
+	browseCmd.Flags().IntVar(&browsePageSize, "page-size", 20, "lines shown per page")
+
+	grepCmd.Flags().BoolVar(&grepRaw, "raw", false, "also search raw bytes of every lump")
+	grepCmd.Flags().BoolVar(&grepHex, "hex", false, "pattern is a hex byte string, implies --raw")
+	grepCmd.Flags().BoolVarP(&grepIgnoreCase, "ignore-case", "i", false, "case insensitive search, for raw bytes ASCII letters only")
+
+	versionCmd.Flags().BoolVar(&versionJSON, "json", false, "print as JSON")
+
+	listCmd.Flags().StringVar(&listFormat, "format", "", "Go template to format each line with, e.g. '{{.Filename}} {{.CRC32}}'")
+
+	transformCmd.Flags().StringVar(&transformTranslate, "translate", "", "offset to move the map by, as x,y,z")
+	transformCmd.Flags().Float64Var(&transformRotate, "rotate", 0, "degrees to rotate around the z axis, a multiple of 90")
+	transformCmd.Flags().BoolVar(&transformAllowBigCoords, "allow-bigcoords", false, "allow results beyond +-4096 for servers with float coords")
+	scaleCmd.Flags().BoolVar(&transformAllowBigCoords, "allow-bigcoords", false, "allow results beyond +-4096 for servers with float coords")
+	mirrorCmd.Flags().StringVar(&mirrorAxis, "axis", "x", "axis to mirror along, x or y")
+
+	facesRemoveCmd.Flags().StringVar(&facesRemoveTexture, "texture", "", "glob pattern of texture names to remove, e.g. 'skip*'")
+	facesRemoveCmd.MarkFlagRequired("texture")
+	texturesEmbedCmd.Flags().BoolVar(&texturesEmbedReplace, "replace", false, "also replace textures that are embedded already")
+	texturesExportCmd.Flags().StringVar(&texturesExportFormat, "format", "png", "image format: png or tga")
+	texturesExportCmd.Flags().StringVar(&texturesExportPalette, "palette", "", "palette.lmp to use instead of the Quake palette")
+	texturesExportCmd.Flags().BoolVar(&texturesExportLuma, "luma", false, "also write the fullbright colours of each texture to <name>_luma images")
+	texturesReplaceCmd.Flags().StringVar(&texturesReplacePalette, "palette", "", "palette.lmp to use instead of the Quake palette")
+	texturesReplaceCmd.Flags().BoolVar(&texturesReplaceFullbrights, "fullbrights", false, "allow fullbright colours in the quantized texture")
+	texturesStripCmd.Flags().BoolVar(&texturesStripZero, "zero", false, "set the pixels to 0 instead of removing them")
+	texturesStripCmd.Flags().StringArrayVar(&texturesStripKeep, "keep", nil, "keep the pixels of textures matching this glob pattern")
+	texturesDedupeCmd.Flags().BoolVar(&texturesDedupeSameName, "same-name", false, "only collapse textures of the same name")
+
+	rspeedsCmd.Flags().StringArrayVar(&rspeedsPoints, "point", nil, "viewpoint as x,y,z, may be repeated")
+	rspeedsCmd.Flags().IntVar(&rspeedsTop, "top", 10, "number of worst viewpoints to show, 0 for all")
+
+	embedSidecarsCmd.Flags().BoolVar(&embedSidecarsLoc, "loc", false, "also embed .loc files")
+	embedSidecarsCmd.Flags().BoolVar(&embedSidecarsWay, "way", false, "also embed frogbot .way files")
+
+	shuffleCmd.Flags().Int64Var(&shuffleSeed, "seed", 0, "random seed, 0 picks one from the current time")
+	shuffleCmd.Flags().StringSliceVar(&shufflePrefixes, "classes", []string{"item_", "weapon_"}, "classname prefixes of the entities to shuffle")
+
+	contentsCmd.Flags().StringVar(&contentsFrom, "from", "", "contents to replace: empty, solid, water, slime, lava or sky")
+	contentsCmd.Flags().StringVar(&contentsTo, "to", "", "new contents")
+	contentsCmd.MarkFlagRequired("from")
+	contentsCmd.MarkFlagRequired("to")
+
+	navCmd.Flags().Float32Var(&navGrid, "grid", 32, "sample spacing in units")
+	navCmd.Flags().StringVarP(&navOutput, "output", "o", "", "write the JSON to a file instead of stdout")
+
+	texmapCmd.Flags().IntVar(&texmapSize, "size", 1024, "size in pixels of the longest image side")
+	texmapCmd.Flags().StringVar(&texmapBy, "by", "texture", "attribute to colour faces by: texture or lmshift")
+	texmapCmd.Flags().StringVar(&texmapHighlight, "highlight", "", "only colour faces whose texture matches this glob pattern")
+
+	tjuncCmd.Flags().Float64Var(&tjuncEpsilon, "epsilon", 0.1, "distance within which vertexes count as on an edge or coincident")
+	tjuncCmd.Flags().IntVar(&tjuncTop, "top", 10, "number of worst offenders to list, 0 for all")
+
+	renameMapCmd.Flags().StringVar(&renameMessage, "message", "", "replace the worldspawn message")
+	renameMapCmd.Flags().BoolVar(&renameKeep, "keep", false, "copy instead of rename, keeping the original files")
+
+	leakCmd.Flags().Float32Var(&leakGrid, "grid", 32, "spacing of the flood fill grid")
+	leakCmd.Flags().StringVar(&leakPointFile, "pointfile", "", "write the path of the first leak to this .pts file")
+
+	convertCmd.Flags().StringVar(&convertEndian, "endian", "", "byte order to write: big or little")
+	convertCmd.MarkFlagRequired("endian")
+
+	benchCmd.Flags().IntVarP(&benchIterations, "iterations", "n", 20, "number of runs of each step")
+
+	verifyManifestCmd.Flags().BoolVar(&verifyManifestStrict, "strict", false, "also report maps and sidecars missing from the manifest")
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// mapData holds the decoded lumps commands work on.
+type mapData struct {
+	bspFile   *bsp.BspFile
+	entities  []bsp.Entity
+	models    []bsp.Model
+	planes    []bsp.Plane
+	nodes     []bsp.Node
+	leafs     []bsp.Leaf
+	clipNodes []bsp.ClipNode
+	vertexes  []bsp.Vec3
+	edges     [][2]uint32
+	surfedges []int32
+	faces     []bsp.FaceV2
+	texinfo   []bsp.Texinfo
+	marksurfs []uint32
+}
+
+func readMapGeometry(bspFile *bsp.BspFile, r io.ReaderAt, data *mapData) error {
+	var err error
+	if data.models, err = bsp.ReadModels(bspFile, r); err != nil {
+		return err
+	}
+	if data.planes, err = bsp.ReadPlanes(bspFile, r); err != nil {
+		return err
+	}
+	if data.nodes, err = bsp.ReadNodes(bspFile, r); err != nil {
+		return err
+	}
+	if data.leafs, err = bsp.ReadLeafs(bspFile, r); err != nil {
+		return err
+	}
+	if data.clipNodes, err = bsp.ReadClipNodes(bspFile, r); err != nil {
+		return err
+	}
+	if data.vertexes, err = bsp.ReadVertexes(bspFile, r); err != nil {
+		return err
+	}
+	if data.edges, err = bsp.ReadEdges(bspFile, r); err != nil {
+		return err
+	}
+	if data.surfedges, err = bsp.ReadSurfedges(bspFile, r); err != nil {
+		return err
+	}
+	if data.faces, err = bsp.ReadFaces(bspFile, r); err != nil {
+		return err
+	}
+	if data.texinfo, err = bsp.ReadTexinfo(bspFile, r); err != nil {
+		return err
+	}
+	if data.marksurfs, err = bsp.ReadMarksurfaces(bspFile, r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readMapData decodes the entities and all geometry lumps of a map.
+func readMapData(bspFile *bsp.BspFile, r io.ReaderAt) (*mapData, error) {
+	data := &mapData{bspFile: bspFile}
+	var err error
+	if data.entities, err = bsp.ReadEntities(bspFile, r); err != nil {
+		return nil, err
+	}
+	if err = readMapGeometry(bspFile, r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// encodeGeometry serializes the decoded geometry lumps back into lumps,
+// using the record layouts of the map's version.
+func (data *mapData) encodeGeometry(lumps *[bsp.LumpTotal][]byte) {
+	version := data.bspFile.BspHeader.Version
+	lumps[bsp.LumpModels] = bsp.EncodeModels(data.models)
+	lumps[bsp.LumpPlanes] = bsp.EncodePlanes(data.planes)
+	lumps[bsp.LumpNodes] = bsp.EncodeNodes(version, data.nodes)
+	lumps[bsp.LumpLeafs] = bsp.EncodeLeafs(version, data.leafs)
+	lumps[bsp.LumpClipnodes] = bsp.EncodeClipNodes(version, data.clipNodes)
+	lumps[bsp.LumpVertexes] = bsp.EncodeVertexes(data.vertexes)
+	lumps[bsp.LumpEdges] = bsp.EncodeEdges(version, data.edges)
+	lumps[bsp.LumpSurfedges] = bsp.EncodeSurfedges(data.surfedges)
+	lumps[bsp.LumpFaces] = bsp.EncodeFaces(version, data.faces)
+	lumps[bsp.LumpTexinfo] = bsp.EncodeTexinfo(data.texinfo)
+	lumps[bsp.LumpMarksurfaces] = bsp.EncodeMarksurfaces(version, data.marksurfs)
+}
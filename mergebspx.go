@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var mergeBspXOnly []string
+
+// faceCount returns the number of records of the faces lump.
+func faceCount(bspFile *bsp.BspFile) int {
+	size := bsp.LumpRecordSize(bspFile.BspHeader.Version, bsp.LumpFaces)
+	return int(bspFile.BspHeader.Lumps[bsp.LumpFaces].Length) / size
+}
+
+var mergeBspXCmd = &cobra.Command{
+	Use:   "merge-bspx <target> <donor>",
+	Short: "Copy all BSPX lumps of a donor map into another map",
+	Long: `Write a copy of target with every BSPX lump of donor added or replaced, e.g.
+to graft the DECOUPLED_LM and RGBLIGHTING lumps of a relit build onto the
+distributed map. BSPX lumps only in target are kept. --only limits the
+lumps copied.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		donor, err := OpenMapFile(args[1])
+		if err != nil {
+			return err
+		}
+		defer donor.Close()
+
+		donorFile, err := bsp.ReadBspFile(donor)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+
+		target, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		targetFile, err := bsp.ReadBspFile(target)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		names := mergeBspXOnly
+		if len(names) == 0 {
+			for _, xlump := range donorFile.BspXLumps {
+				names = append(names, bsp.BytesToString(xlump.LumpName[:]))
+			}
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("%s has no BSPX lumps", args[1])
+		}
+		lumps := make([][]byte, len(names))
+		for i, name := range names {
+			lumps[i], err = bsp.ReadBspXLump(&donorFile, donor, name)
+			if err != nil {
+				return fmt.Errorf("%s: %w", args[1], err)
+			}
+			if lumps[i] == nil {
+				return fmt.Errorf("%s has no BSPX lump %s", args[1], name)
+			}
+		}
+		if donorFaces, targetFaces := faceCount(&donorFile), faceCount(&targetFile); donorFaces != targetFaces {
+			Warnf("%s has %d faces but %s has %d, per face lumps won't match", args[1], donorFaces, args[0], targetFaces)
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.StreamBSPXContext(cmd.Context(), &targetFile, target, destName, func(doc *bsp.Document) error {
+			for i, name := range names {
+				doc.SetBspXLump(name, lumps[i])
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, name := range names {
+			fmt.Printf("  %-24s %8d\n", name, len(lumps[i]))
+		}
+		fmt.Printf("Merged %d BSPX lumps from %s, wrote %s\n", len(names), args[1], destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
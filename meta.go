@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// MetaLump holds distribution metadata such as author, license or release
+// tag as "key=value" lines.
+const MetaLump = "BSPXMGR_META"
+
+type MetaEntry struct {
+	Key   string
+	Value string
+}
+
+// ParseMeta decodes the contents of a metadata lump.
+func ParseMeta(data []byte) ([]MetaEntry, error) {
+	var entries []MetaEntry
+	scanner := bufio.NewScanner(bytes.NewReader(bytes.TrimRight(data, "\x00")))
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		key, value, found := strings.Cut(scanner.Text(), "=")
+		if !found || key == "" {
+			return nil, &bsp.FormatError{Err: fmt.Errorf("%s line %d: expected key=value", MetaLump, line)}
+		}
+		entries = append(entries, MetaEntry{key, value})
+	}
+	return entries, scanner.Err()
+}
+
+// EncodeMeta encodes metadata entries in the lump format.
+func EncodeMeta(entries []MetaEntry) []byte {
+	var buffer bytes.Buffer
+	for _, entry := range entries {
+		fmt.Fprintf(&buffer, "%s=%s\n", entry.Key, entry.Value)
+	}
+	return buffer.Bytes()
+}
+
+// ValidateMetaEntry checks that a key and value survive the lump format.
+func ValidateMetaEntry(key, value string) error {
+	if key == "" || strings.ContainsAny(key, "=\n\x00") {
+		return fmt.Errorf("invalid key %q, keys must be non-empty and not contain '=' or newlines", key)
+	}
+	if strings.ContainsAny(value, "\n\x00") {
+		return fmt.Errorf("invalid value for %s, values must not contain newlines", key)
+	}
+	return nil
+}
+
+// readMeta returns the metadata entries stored in a map.
+func readMeta(mapPath string) ([]MetaEntry, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapPath, err)
+	}
+	buffer, err := bsp.ReadBspXLump(&bspFile, f, MetaLump)
+	if err != nil {
+		return nil, err
+	}
+	return ParseMeta(buffer)
+}
+
+// updateMeta rewrites the metadata of a map with update, writing the result
+// to <map>.new.bsp. The lump is removed when no entries are left.
+func updateMeta(mapPath string, cmd *cobra.Command, update func(entries []MetaEntry) ([]MetaEntry, error)) (string, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", mapPath, err)
+	}
+	buffer, err := bsp.ReadBspXLump(&bspFile, f, MetaLump)
+	if err != nil {
+		return "", err
+	}
+	entries, err := ParseMeta(buffer)
+	if err != nil {
+		return "", err
+	}
+	entries, err = update(entries)
+	if err != nil {
+		return "", err
+	}
+
+	basename := strings.TrimSuffix(mapPath, filepath.Ext(mapPath))
+	destName := fmt.Sprintf("%s.new.bsp", basename)
+	err = bsp.StreamBSPXContext(cmd.Context(), &bspFile, f, destName, func(doc *bsp.Document) error {
+		if len(entries) == 0 {
+			doc.DeleteBspXLump(MetaLump)
+		} else {
+			doc.SetBspXLump(MetaLump, EncodeMeta(entries))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return destName, RunUploadHooks(cmd.Context(), destName, cmd.Name())
+}
+
+var metaCmd = &cobra.Command{
+	Use:   "meta",
+	Short: "Manage key/value metadata stored in the " + MetaLump + " BSPX lump",
+	Long: `Store distribution metadata such as author, license, release tag or source
+URL inside the map, so it travels with the file.`,
+}
+
+var metaListCmd = &cobra.Command{
+	Use:   "list <map>",
+	Short: "Print all metadata as key=value lines",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := readMeta(args[0])
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(EncodeMeta(entries))
+		return nil
+	},
+}
+
+var metaGetCmd = &cobra.Command{
+	Use:   "get <map> <key>",
+	Short: "Print the value of a metadata key",
+	Long: `Print the value of a metadata key. Exits with status 1 when the key is not
+set.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		entries, err := readMeta(args[0])
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.Key == args[1] {
+				fmt.Println(entry.Value)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s: %s is not set", args[0], args[1])
+	},
+}
+
+var metaSetCmd = &cobra.Command{
+	Use:   "set <map> <key> <value>",
+	Short: "Set a metadata key",
+	Args:  cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, value := args[1], args[2]
+		if err := ValidateMetaEntry(key, value); err != nil {
+			return err
+		}
+		destName, err := updateMeta(args[0], cmd, func(entries []MetaEntry) ([]MetaEntry, error) {
+			for i := range entries {
+				if entries[i].Key == key {
+					entries[i].Value = value
+					return entries, nil
+				}
+			}
+			return append(entries, MetaEntry{key, value}), nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Set %s, wrote %s\n", key, destName)
+		return nil
+	},
+}
+
+var metaDeleteCmd = &cobra.Command{
+	Use:   "delete <map> <key>",
+	Short: "Remove a metadata key",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key := args[1]
+		destName, err := updateMeta(args[0], cmd, func(entries []MetaEntry) ([]MetaEntry, error) {
+			for i := range entries {
+				if entries[i].Key == key {
+					return append(entries[:i], entries[i+1:]...), nil
+				}
+			}
+			return nil, fmt.Errorf("%s: %s is not set", args[0], key)
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted %s, wrote %s\n", key, destName)
+		return nil
+	},
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var minifyDrop []string
+var minifyKeep []string
+
+// defaultMinifyDrop are keys engines never read: Quake discards keys with a
+// leading underscore, which compilers and editors use for their settings, and
+// phong is read by qbsp only.
+var defaultMinifyDrop = []string{"_*", "phong", "phong_angle"}
+
+// MinifyEntities removes the keys matching a drop pattern but no keep pattern
+// and returns how many were removed.
+func MinifyEntities(entities []bsp.Entity, drop []string, keep []string) int {
+	matchAny := func(patterns []string, key string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, key); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	removed := 0
+	for i := range entities {
+		pairs := entities[i].Pairs[:0]
+		for _, kv := range entities[i].Pairs {
+			if matchAny(drop, kv.Key) && !matchAny(keep, kv.Key) {
+				removed++
+				continue
+			}
+			pairs = append(pairs, kv)
+		}
+		entities[i].Pairs = pairs
+	}
+	return removed
+}
+
+// FormatEntitiesMinified serializes entities with one entity per line and a
+// single space between tokens, the least whitespace every entity parser
+// accepts, followed by the trailing NUL.
+func FormatEntitiesMinified(entities []bsp.Entity) []byte {
+	var buffer bytes.Buffer
+	for _, entity := range entities {
+		buffer.WriteByte('{')
+		for i, kv := range entity.Pairs {
+			if i > 0 {
+				buffer.WriteByte(' ')
+			}
+			fmt.Fprintf(&buffer, "\"%s\" \"%s\"", kv.Key, kv.Value)
+		}
+		buffer.WriteString("}\n")
+	}
+	buffer.WriteByte(0)
+	return buffer.Bytes()
+}
+
+var entitiesMinifyCmd = &cobra.Command{
+	Use:   "minify <map>",
+	Short: "Shrink the entities lump for distribution",
+	Long: `Write a copy of the map with the entities lump rewritten without comments
+and with as little whitespace as possible, one entity per line. Keys engines
+never read are dropped: those starting with an underscore, such as the _tb_
+keys of TrenchBroom and the light settings of the compilers, and phong.
+--drop adds glob patterns of keys to drop, --keep preserves keys matching a
+pattern even if a drop pattern matches, e.g. --keep _fog for mods reading
+it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		drop := append(append([]string{}, defaultMinifyDrop...), minifyDrop...)
+		for _, pattern := range append(append([]string{}, drop...), minifyKeep...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid key pattern %q: %w", pattern, err)
+			}
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		removed := MinifyEntities(entities, drop, minifyKeep)
+		minified := FormatEntitiesMinified(entities)
+		if len(minified) >= len(data) {
+			fmt.Printf("%s: entities lump is already minified\n", args[0])
+			return nil
+		}
+
+		destName, err := writeEntitiesLump(cmd, args[0], minified)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dropped %d keys, entities lump %d -> %d bytes, wrote %s\n", removed, len(data), len(minified), destName)
+		return nil
+	},
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// HullLeaf walks a clipping hull like HullPointContents, and also returns an
+// id of the leaf p ends up in: the last clipnode times two plus the side.
+func HullLeaf(clipNodes []bsp.ClipNode, planes []bsp.Plane, headNode int32, p bsp.Vec3) (int, bsp.Contents) {
+	num := headNode
+	id := -1
+	for num >= 0 {
+		if int(num) >= len(clipNodes) {
+			return -1, bsp.ContentsSolid
+		}
+		node := &clipNodes[num]
+		if node.PlaneId < 0 || int(node.PlaneId) >= len(planes) {
+			return -1, bsp.ContentsSolid
+		}
+		if planes[node.PlaneId].Distance(p) < 0 {
+			id = int(num)*2 + 1
+			num = node.Children[1]
+		} else {
+			id = int(num) * 2
+			num = node.Children[0]
+		}
+	}
+	return id, bsp.Contents(num)
+}
+
+// Players can walk up steps of this height.
+const navStepHeight = 18
+
+type NavNode struct {
+	Id      int        `json:"id"`
+	Leaf    int        `json:"leaf"`
+	Medium  string     `json:"contents"`
+	Samples int        `json:"samples"`
+	Center  [3]float32 `json:"center"`
+	Mins    [3]float32 `json:"mins"`
+	Maxs    [3]float32 `json:"maxs"`
+}
+
+type NavEdge struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+type NavEntity struct {
+	Entity    int    `json:"entity"`
+	Classname string `json:"classname"`
+	Node      int    `json:"node"`
+	Reachable bool   `json:"reachable"`
+}
+
+type NavGraph struct {
+	Grid   float32     `json:"grid"`
+	Nodes  []NavNode   `json:"nodes"`
+	Edges  []NavEdge   `json:"edges"`
+	Spawns []NavEntity `json:"spawns"`
+	Items  []NavEntity `json:"items"`
+}
+
+type navSample struct {
+	origin bsp.Vec3
+	node   int
+}
+
+// navFloors returns the player origins standing on every floor in the column
+// at x, y, found by scanning the player hull downwards.
+func navFloors(data *mapData, x, y float32, step float32) []bsp.Vec3 {
+	world := data.models[0]
+	head := world.HeadNode[1]
+	var floors []bsp.Vec3
+	above := bsp.ContentsSolid
+	for z := world.Maxs[2] + step; z >= world.Mins[2]-step; z -= step {
+		_, contents := HullLeaf(data.clipNodes, data.planes, head, bsp.Vec3{x, y, z})
+		if contents == bsp.ContentsSolid && above != bsp.ContentsSolid && above != bsp.ContentsSky {
+			// Narrow down the floor between z and z + step.
+			low, high := z, z+step
+			for high-low > 0.5 {
+				mid := (low + high) / 2
+				if _, c := HullLeaf(data.clipNodes, data.planes, head, bsp.Vec3{x, y, mid}); c == bsp.ContentsSolid {
+					low = mid
+				} else {
+					high = mid
+				}
+			}
+			floors = append(floors, bsp.Vec3{x, y, high + 0.5})
+		}
+		above = contents
+	}
+	return floors
+}
+
+// BuildNavGraph samples the player hull on a grid, groups the standing
+// positions by the hull 1 leaf they are in and connects leafs that have
+// samples next to each other within a step height. Spawns and items are
+// attached to the graph and items not reachable from any spawn flagged.
+func BuildNavGraph(data *mapData, grid float32) (*NavGraph, error) {
+	if len(data.models) == 0 {
+		return nil, fmt.Errorf("map has no world model")
+	}
+	world := data.models[0]
+	graph := &NavGraph{Grid: grid}
+
+	nodeOfLeaf := map[int]int{}
+	columns := map[[2]int][]navSample{}
+	nx := int((world.Maxs[0] - world.Mins[0]) / grid)
+	ny := int((world.Maxs[1] - world.Mins[1]) / grid)
+	for i := 0; i <= nx; i++ {
+		for j := 0; j <= ny; j++ {
+			x := world.Mins[0] + float32(i)*grid
+			y := world.Mins[1] + float32(j)*grid
+			for _, floor := range navFloors(data, x, y, 8) {
+				leaf, contents := HullLeaf(data.clipNodes, data.planes, world.HeadNode[1], floor)
+				node, found := nodeOfLeaf[leaf]
+				if !found {
+					node = len(graph.Nodes)
+					nodeOfLeaf[leaf] = node
+					graph.Nodes = append(graph.Nodes, NavNode{Id: node, Leaf: leaf, Medium: contents.String(), Mins: floor, Maxs: floor})
+				}
+				n := &graph.Nodes[node]
+				n.Samples++
+				for axis := 0; axis < 3; axis++ {
+					n.Center[axis] += floor[axis]
+					n.Mins[axis] = float32(math.Min(float64(n.Mins[axis]), float64(floor[axis])))
+					n.Maxs[axis] = float32(math.Max(float64(n.Maxs[axis]), float64(floor[axis])))
+				}
+				columns[[2]int{i, j}] = append(columns[[2]int{i, j}], navSample{floor, node})
+			}
+		}
+	}
+	for i := range graph.Nodes {
+		for axis := 0; axis < 3; axis++ {
+			graph.Nodes[i].Center[axis] /= float32(graph.Nodes[i].Samples)
+		}
+	}
+
+	// Connect samples of neighbouring columns a player can step between.
+	adjacent := map[NavEdge]bool{}
+	for column, samples := range columns {
+		for _, offset := range [][2]int{{1, 0}, {0, 1}} {
+			neighbours := columns[[2]int{column[0] + offset[0], column[1] + offset[1]}]
+			for _, a := range samples {
+				for _, b := range neighbours {
+					if a.node == b.node || float32(math.Abs(float64(a.origin[2]-b.origin[2]))) > navStepHeight {
+						continue
+					}
+					high := a.origin[2]
+					if b.origin[2] > high {
+						high = b.origin[2]
+					}
+					mid := bsp.Vec3{(a.origin[0] + b.origin[0]) / 2, (a.origin[1] + b.origin[1]) / 2, high + 1}
+					if bsp.HullPointContents(data.clipNodes, data.planes, world.HeadNode[1], mid) == bsp.ContentsSolid {
+						continue
+					}
+					adjacent[NavEdge{a.node, b.node}] = true
+					adjacent[NavEdge{b.node, a.node}] = true
+				}
+			}
+		}
+	}
+	for edge := range adjacent {
+		graph.Edges = append(graph.Edges, edge)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i].From != graph.Edges[j].From {
+			return graph.Edges[i].From < graph.Edges[j].From
+		}
+		return graph.Edges[i].To < graph.Edges[j].To
+	})
+
+	nodeAt := func(origin bsp.Vec3) int {
+		leaf, _ := HullLeaf(data.clipNodes, data.planes, world.HeadNode[1], origin)
+		if node, found := nodeOfLeaf[leaf]; found {
+			return node
+		}
+		return -1
+	}
+	for i := range data.entities {
+		entity := &data.entities[i]
+		origin, ok := entity.Origin()
+		if !ok {
+			continue
+		}
+		classname := entity.Classname()
+		switch {
+		case strings.HasPrefix(classname, "info_player_"):
+			graph.Spawns = append(graph.Spawns, NavEntity{i, classname, nodeAt(origin), true})
+		case strings.HasPrefix(classname, "item_") || strings.HasPrefix(classname, "weapon_"):
+			// Items rest on the floor, a player picking them up stands 24
+			// units higher.
+			origin[2] += 24
+			graph.Items = append(graph.Items, NavEntity{i, classname, nodeAt(origin), false})
+		}
+	}
+
+	reached := make([]bool, len(graph.Nodes))
+	var queue []int
+	for _, spawn := range graph.Spawns {
+		if spawn.Node >= 0 && !reached[spawn.Node] {
+			reached[spawn.Node] = true
+			queue = append(queue, spawn.Node)
+		}
+	}
+	neighbours := map[int][]int{}
+	for _, edge := range graph.Edges {
+		neighbours[edge.From] = append(neighbours[edge.From], edge.To)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for _, next := range neighbours[node] {
+			if !reached[next] {
+				reached[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	for i := range graph.Items {
+		if node := graph.Items[i].Node; node >= 0 {
+			graph.Items[i].Reachable = reached[node]
+		}
+	}
+
+	return graph, nil
+}
+
+var navGrid float32
+var navOutput string
+
+var navCmd = &cobra.Command{
+	Use:   "nav <map>",
+	Short: "Export a coarse walkable area graph as JSON",
+	Long: `Sample the player clipping hull on a grid, group the positions players can
+stand at by hull 1 leaf and connect leafs with samples within step height of
+each other. The graph, spawns and items are written as JSON, and items that
+can't be walked to from any spawn are listed on stderr.
+
+Jumps, lifts and teleporters are not followed, so items only reachable that
+way are reported as well.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if navGrid < 4 {
+			return fmt.Errorf("grid size %g too small", navGrid)
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+
+		graph, err := BuildNavGraph(data, navGrid)
+		if err != nil {
+			return err
+		}
+
+		out := os.Stdout
+		if navOutput != "" {
+			out, err = os.Create(navOutput)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(graph)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "%d nodes, %d edges\n", len(graph.Nodes), len(graph.Edges)/2)
+		for _, item := range graph.Items {
+			if !item.Reachable {
+				fmt.Fprintf(os.Stderr, "unreachable: %s\n", entityRef(data.entities, item.Entity))
+			}
+		}
+		return nil
+	},
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bspxmgr"
+	"github.com/spf13/cobra"
+)
+
+var obfuscateTextures bool
+var obfuscateScramblePixels bool
+var obfuscateTargetnames bool
+var obfuscateSeedFrom string
+var obfuscateExclude []string
+var obfuscateMapping string
+
+// ResolveObfuscationPolicy merges the obfuscation settings of the active
+// profile with the flags given on the command line, flags taking precedence.
+func ResolveObfuscationPolicy(cmd *cobra.Command, mapPath string) (*bspxmgr.ObfuscationPolicy, error) {
+	policy := &bspxmgr.ObfuscationPolicy{Textures: true}
+	seedSource := "time"
+
+	profile, err := ActiveProfile()
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil && profile.Obfuscation != nil {
+		config := profile.Obfuscation
+		if config.Textures != nil {
+			policy.Textures = *config.Textures
+		}
+		policy.ScramblePixels = config.ScramblePixels
+		policy.Targetnames = config.Targetnames
+		policy.Exclude = config.Exclude
+		policy.Mapping = config.Mapping
+		if config.Seed != "" {
+			seedSource = config.Seed
+		}
+	}
+
+	flags := cmd.Flags()
+	if flags.Changed("textures") {
+		policy.Textures = obfuscateTextures
+	}
+	if flags.Changed("scramble-pixels") {
+		policy.ScramblePixels = obfuscateScramblePixels
+	}
+	if flags.Changed("targetnames") {
+		policy.Targetnames = obfuscateTargetnames
+	}
+	if flags.Changed("exclude") {
+		policy.Exclude = obfuscateExclude
+	}
+	if flags.Changed("mapping") {
+		policy.Mapping = obfuscateMapping
+	}
+	if flags.Changed("seed-from") {
+		seedSource = obfuscateSeedFrom
+	}
+	if flags.Changed("seed") && obfuscateSeed != 0 {
+		seedSource = strconv.FormatInt(obfuscateSeed, 10)
+	}
+
+	for i, pattern := range policy.Exclude {
+		policy.Exclude[i] = strings.ToLower(pattern)
+		if _, err := path.Match(policy.Exclude[i], ""); err != nil {
+			return nil, fmt.Errorf("exclusion %q: %w", pattern, err)
+		}
+	}
+	if policy.Mapping != "" {
+		name := strings.TrimSuffix(filepath.Base(mapPath), filepath.Ext(mapPath))
+		policy.Mapping = strings.ReplaceAll(policy.Mapping, "{map}", name)
+	}
+	if !policy.Textures && !policy.ScramblePixels && !policy.Targetnames {
+		return nil, fmt.Errorf("obfuscation policy changes nothing")
+	}
+
+	policy.Seed, err = bspxmgr.ResolveSeed(seedSource, mapPath)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// checkSurfedges returns a FormatError for the first surfedge referring to an
+// edge the map doesn't have.
+func checkSurfedges(data *mapData) error {
+	for i, surfedge := range data.surfedges {
+		if _, ok := bsp.SurfedgeEdge(surfedge, len(data.edges)); !ok {
+			return &bsp.FormatError{Err: fmt.Errorf("surfedge %d references edge %d out of range", i, surfedge)}
+		}
+	}
+	return nil
+}
+
+// WeldVertexes merges vertexes with identical coordinates, drops vertexes no
+// face uses and renumbers the edges to match. It returns the number of
+// vertexes removed, or an error without changing anything if a surfedge is
+// out of range.
+func WeldVertexes(data *mapData) (int, error) {
+	if err := checkSurfedges(data); err != nil {
+		return 0, err
+	}
+	canonical := make([]uint32, len(data.vertexes))
+	first := map[bsp.Vec3]uint32{}
+	for i, v := range data.vertexes {
+		if index, found := first[v]; found {
+			canonical[i] = index
+		} else {
+			first[v] = uint32(i)
+			canonical[i] = uint32(i)
+		}
+	}
+
+	for i := range data.edges {
+		for j, v := range data.edges[i] {
+			if int(v) < len(canonical) {
+				data.edges[i][j] = canonical[v]
+			}
+		}
+	}
+
+	// Only keep vertexes of edge 0 and the edges surfedges refer to.
+	used := make([]bool, len(data.vertexes))
+	markEdge := func(index int) {
+		for _, v := range data.edges[index] {
+			if int(v) < len(used) {
+				used[v] = true
+			}
+		}
+	}
+	if len(data.edges) > 0 {
+		markEdge(0)
+	}
+	for _, surfedge := range data.surfedges {
+		edge, _ := bsp.SurfedgeEdge(surfedge, len(data.edges))
+		markEdge(edge)
+	}
+
+	mapping := compactIndex(used)
+	var vertexes []bsp.Vec3
+	for i, v := range data.vertexes {
+		if used[i] {
+			vertexes = append(vertexes, v)
+		}
+	}
+	for i := range data.edges {
+		for j, v := range data.edges[i] {
+			if int(v) < len(mapping) {
+				data.edges[i][j] = uint32(mapping[v])
+			}
+		}
+	}
+
+	removed := len(data.vertexes) - len(vertexes)
+	data.vertexes = vertexes
+	return removed, nil
+}
+
+// MergeEdges stores edges between the same two vertexes once, drops edges no
+// surfedge uses and rewrites the surfedges. Like qbsp, edges are only merged
+// while every face walking the result in one direction is alone in doing so,
+// as the software renderer caches edges per direction. It returns the number
+// of edges removed, or an error without changing anything if a surfedge is
+// out of range.
+func MergeEdges(data *mapData) (int, error) {
+	if err := checkSurfedges(data); err != nil {
+		return 0, err
+	}
+	// How often faces walk each edge from its first to its second vertex,
+	// and the other way around.
+	uses := make([][2]int, len(data.edges))
+	for _, surfedge := range data.surfedges {
+		switch {
+		case surfedge > 0:
+			uses[surfedge][0]++
+		case surfedge < 0:
+			uses[-surfedge][1]++
+		}
+	}
+
+	type mergedEdge struct {
+		index int32
+		uses  [2]int
+	}
+	merged := map[[2]uint32][]mergedEdge{}
+	mapping := make([]int32, len(data.edges))
+	edges := [][2]uint32{{0, 0}}
+	if len(data.edges) > 0 {
+		edges[0] = data.edges[0]
+	}
+	for i := 1; i < len(data.edges); i++ {
+		if uses[i][0] == 0 && uses[i][1] == 0 {
+			continue
+		}
+		key, edgeUses, sign := data.edges[i], uses[i], int32(1)
+		if key[0] > key[1] {
+			key = [2]uint32{key[1], key[0]}
+			edgeUses = [2]int{edgeUses[1], edgeUses[0]}
+			sign = -1
+		}
+
+		candidates := merged[key]
+		found := -1
+		for j := range candidates {
+			if candidates[j].uses[0]+edgeUses[0] <= 1 && candidates[j].uses[1]+edgeUses[1] <= 1 {
+				found = j
+				break
+			}
+		}
+		if found < 0 {
+			candidates = append(candidates, mergedEdge{index: int32(len(edges))})
+			edges = append(edges, key)
+			found = len(candidates) - 1
+		}
+		candidates[found].uses[0] += edgeUses[0]
+		candidates[found].uses[1] += edgeUses[1]
+		merged[key] = candidates
+		mapping[i] = sign * candidates[found].index
+	}
+
+	for i, surfedge := range data.surfedges {
+		switch {
+		case surfedge > 0:
+			data.surfedges[i] = mapping[surfedge]
+		case surfedge < 0:
+			data.surfedges[i] = -mapping[-surfedge]
+		}
+	}
+
+	removed := len(data.edges) - len(edges)
+	data.edges = edges
+	return removed, nil
+}
+
+var optimizeCmd = &cobra.Command{
+	Use:   "optimize <map>",
+	Short: "Weld duplicate vertexes and merge duplicate edges",
+	Long: `Merge vertexes with identical coordinates and edges between the same two
+vertexes, drop vertexes and edges nothing references and rewrite the
+surfedges to match. Maps written by converters that emit every face with
+its own edges shrink noticeably, face windings are unchanged.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		version := bspFile.BspHeader.Version
+		numVertexes, numEdges := len(data.vertexes), len(data.edges)
+		vertexesSize := len(bsp.EncodeVertexes(data.vertexes))
+		edgesSize := len(bsp.EncodeEdges(version, data.edges))
+
+		welded, err := WeldVertexes(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		merged, err := MergeEdges(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		if welded == 0 && merged == 0 {
+			fmt.Printf("%s: no duplicate vertexes or edges\n", args[0])
+			return nil
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			lumps[bsp.LumpVertexes] = bsp.EncodeVertexes(data.vertexes)
+			lumps[bsp.LumpEdges] = bsp.EncodeEdges(version, data.edges)
+			lumps[bsp.LumpSurfedges] = bsp.EncodeSurfedges(data.surfedges)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		written, err := os.Stat(destName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("vertexes: %6d -> %6d (%d -> %d bytes)\n", numVertexes, len(data.vertexes), vertexesSize, len(bsp.EncodeVertexes(data.vertexes)))
+		fmt.Printf("edges:    %6d -> %6d (%d -> %d bytes)\n", numEdges, len(data.edges), edgesSize, len(bsp.EncodeEdges(version, data.edges)))
+		fmt.Printf("file:     %d -> %d bytes, wrote %s\n", info.Size(), written.Size(), destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
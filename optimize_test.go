@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+func TestWeldVertexes(t *testing.T) {
+	a, b, c, d := bsp.Vec3{0, 0, 0}, bsp.Vec3{64, 0, 0}, bsp.Vec3{64, 64, 0}, bsp.Vec3{0, 64, 0}
+	for _, test := range []struct {
+		name      string
+		data      mapData
+		removed   int
+		vertexes  []bsp.Vec3
+		edges     [][2]uint32
+		surfedges []int32
+	}{
+		{
+			name:      "identical vertexes",
+			data:      mapData{vertexes: []bsp.Vec3{a, b, a, c}, edges: [][2]uint32{{0, 0}, {0, 1}, {2, 3}}, surfedges: []int32{1, -2}},
+			removed:   1,
+			vertexes:  []bsp.Vec3{a, b, c},
+			edges:     [][2]uint32{{0, 0}, {0, 1}, {0, 2}},
+			surfedges: []int32{1, -2},
+		},
+		{
+			name:      "unused vertexes",
+			data:      mapData{vertexes: []bsp.Vec3{a, b, c, d}, edges: [][2]uint32{{0, 0}, {0, 2}}, surfedges: []int32{1}},
+			removed:   2,
+			vertexes:  []bsp.Vec3{a, c},
+			edges:     [][2]uint32{{0, 0}, {0, 1}},
+			surfedges: []int32{1},
+		},
+		{
+			name:      "edge 0 keeps its vertexes",
+			data:      mapData{vertexes: []bsp.Vec3{a, b, c, d}, edges: [][2]uint32{{3, 2}, {0, 1}}, surfedges: []int32{1}},
+			removed:   0,
+			vertexes:  []bsp.Vec3{a, b, c, d},
+			edges:     [][2]uint32{{3, 2}, {0, 1}},
+			surfedges: []int32{1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			removed, err := WeldVertexes(&test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != test.removed {
+				t.Errorf("removed %d vertexes, expected %d", removed, test.removed)
+			}
+			if !reflect.DeepEqual(test.data.vertexes, test.vertexes) {
+				t.Errorf("vertexes %v, expected %v", test.data.vertexes, test.vertexes)
+			}
+			if !reflect.DeepEqual(test.data.edges, test.edges) {
+				t.Errorf("edges %v, expected %v", test.data.edges, test.edges)
+			}
+			if !reflect.DeepEqual(test.data.surfedges, test.surfedges) {
+				t.Errorf("surfedges %v, expected %v", test.data.surfedges, test.surfedges)
+			}
+		})
+	}
+}
+
+func TestMergeEdges(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		data      mapData
+		removed   int
+		edges     [][2]uint32
+		surfedges []int32
+	}{
+		{
+			name:      "reversed edge",
+			data:      mapData{edges: [][2]uint32{{0, 0}, {0, 1}, {1, 0}}, surfedges: []int32{1, 2}},
+			removed:   1,
+			edges:     [][2]uint32{{0, 0}, {0, 1}},
+			surfedges: []int32{1, -1},
+		},
+		{
+			name:      "same direction stays apart",
+			data:      mapData{edges: [][2]uint32{{0, 0}, {0, 1}, {0, 1}}, surfedges: []int32{1, 2}},
+			removed:   0,
+			edges:     [][2]uint32{{0, 0}, {0, 1}, {0, 1}},
+			surfedges: []int32{1, 2},
+		},
+		{
+			name:      "unused edges",
+			data:      mapData{edges: [][2]uint32{{0, 0}, {0, 1}, {1, 2}}, surfedges: []int32{-2}},
+			removed:   1,
+			edges:     [][2]uint32{{0, 0}, {1, 2}},
+			surfedges: []int32{-1},
+		},
+		{
+			name:      "edge 0 is kept",
+			data:      mapData{edges: [][2]uint32{{5, 6}, {0, 1}}, surfedges: []int32{1}},
+			removed:   0,
+			edges:     [][2]uint32{{5, 6}, {0, 1}},
+			surfedges: []int32{1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			removed, err := MergeEdges(&test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != test.removed {
+				t.Errorf("removed %d edges, expected %d", removed, test.removed)
+			}
+			if !reflect.DeepEqual(test.data.edges, test.edges) {
+				t.Errorf("edges %v, expected %v", test.data.edges, test.edges)
+			}
+			if !reflect.DeepEqual(test.data.surfedges, test.surfedges) {
+				t.Errorf("surfedges %v, expected %v", test.data.surfedges, test.surfedges)
+			}
+		})
+	}
+}
+
+func TestOptimizeInvalidSurfedge(t *testing.T) {
+	for _, surfedge := range []int32{math.MinInt32, 2, -2} {
+		data := mapData{vertexes: []bsp.Vec3{{}, {1, 0, 0}}, edges: [][2]uint32{{0, 0}, {0, 1}}, surfedges: []int32{1, surfedge}}
+		var formatErr *bsp.FormatError
+		if _, err := WeldVertexes(&data); !errors.As(err, &formatErr) {
+			t.Errorf("WeldVertexes with surfedge %d: got %v, expected a FormatError", surfedge, err)
+		}
+		if _, err := MergeEdges(&data); !errors.As(err, &formatErr) {
+			t.Errorf("MergeEdges with surfedge %d: got %v, expected a FormatError", surfedge, err)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// The methods below decode the lumps of a map returned by ReadBspFile from
+// the reader it was read from. Records of BSP29, BSP2 and 2PSB maps are
+// converted to the same types.
+
+func (b *BspFile) checkReader() error {
+	if b.r == nil {
+		return fmt.Errorf("map was not read with ReadBspFile")
+	}
+	return nil
+}
+
+// NumRecords returns the number of records in a standard lump, or 0 for
+// lumps without fixed size records.
+func (b *BspFile) NumRecords(lumpType LumpType) int {
+	size := LumpRecordSize(b.BspHeader.Version, lumpType)
+	if size == 0 {
+		return 0
+	}
+	return int(b.BspHeader.Lumps[lumpType].Length) / size
+}
+
+// Lump returns the raw contents of a standard lump.
+func (b *BspFile) Lump(lumpType LumpType) ([]byte, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadLump(b, b.r, lumpType)
+}
+
+// BspXLump returns the contents of the named BSPX lump, or nil if the map
+// does not have it.
+func (b *BspFile) BspXLump(name string) ([]byte, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadBspXLump(b, b.r, name)
+}
+
+// Entities decodes the entities lump.
+func (b *BspFile) Entities() ([]Entity, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadEntities(b, b.r)
+}
+
+// Planes decodes the planes lump.
+func (b *BspFile) Planes() ([]Plane, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadPlanes(b, b.r)
+}
+
+// Textures decodes the textures lump.
+func (b *BspFile) Textures() ([]TextureEntry, error) {
+	data, err := b.Lump(LumpTextures)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTextureLump(data)
+}
+
+// Vertexes decodes the vertexes lump.
+func (b *BspFile) Vertexes() ([]Vec3, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadVertexes(b, b.r)
+}
+
+// Nodes decodes the nodes lump.
+func (b *BspFile) Nodes() ([]Node, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadNodes(b, b.r)
+}
+
+// Texinfo decodes the texinfo lump.
+func (b *BspFile) Texinfo() ([]Texinfo, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadTexinfo(b, b.r)
+}
+
+// Faces decodes the faces lump.
+func (b *BspFile) Faces() ([]FaceV2, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadFaces(b, b.r)
+}
+
+// ClipNodes decodes the clipnodes lump.
+func (b *BspFile) ClipNodes() ([]ClipNode, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadClipNodes(b, b.r)
+}
+
+// Leafs decodes the leafs lump.
+func (b *BspFile) Leafs() ([]Leaf, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadLeafs(b, b.r)
+}
+
+// Marksurfaces decodes the marksurfaces lump.
+func (b *BspFile) Marksurfaces() ([]uint32, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadMarksurfaces(b, b.r)
+}
+
+// Edges decodes the edges lump.
+func (b *BspFile) Edges() ([][2]uint32, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadEdges(b, b.r)
+}
+
+// Surfedges decodes the surfedges lump.
+func (b *BspFile) Surfedges() ([]int32, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadSurfedges(b, b.r)
+}
+
+// Models decodes the models lump.
+func (b *BspFile) Models() ([]Model, error) {
+	if err := b.checkReader(); err != nil {
+		return nil, err
+	}
+	return ReadModels(b, b.r)
+}
+
+// DecoupledLightmaps decodes the DECOUPLED_LM BSPX lump, nil if the map does
+// not have it.
+func (b *BspFile) DecoupledLightmaps() ([]DecoupledLM, error) {
+	data, err := b.BspXLump("DECOUPLED_LM")
+	if err != nil || data == nil {
+		return nil, err
+	}
+	return ParseDecoupledLM(data)
+}
+
+// ParseDecoupledLM decodes the contents of a DECOUPLED_LM lump.
+func ParseDecoupledLM(data []byte) ([]DecoupledLM, error) {
+	size := binary.Size(DecoupledLM{})
+	if len(data)%size != 0 {
+		return nil, formatErrorf("DECOUPLED_LM lump size %d is not a multiple of %d", len(data), size)
+	}
+	lightmaps := make([]DecoupledLM, len(data)/size)
+	err := binary.Read(bytes.NewReader(data), binary.LittleEndian, lightmaps)
+	if err != nil {
+		return nil, err
+	}
+	return lightmaps, nil
+}
+
+// EncodeDecoupledLM encodes the contents of a DECOUPLED_LM lump.
+func EncodeDecoupledLM(lightmaps []DecoupledLM) []byte {
+	return encodeRecords(lightmaps)
+}
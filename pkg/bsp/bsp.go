@@ -0,0 +1,372 @@
+// Package bsp reads and writes Quake BSP files (BSP29, BSP2, 2PSB and Half-Life
+// BSP30) including the BSPX lump extension.
+//
+// ReadBspFile reads the header and lump directories, ReadLump and the typed
+// readers decode individual lumps, and WriteBSPX and RewriteBsp write a
+// modified copy of a map.
+//
+// The package is covered by the compatibility promise of the module's v1
+// releases, see package bspxmgr.
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// BspVersion is the version number at the start of a BSP file.
+type BspVersion int32
+
+// LumpType indexes the standard lumps of the header.
+type LumpType int32
+
+const (
+	LumpEntities     LumpType = 0
+	LumpPlanes                = 1
+	LumpTextures              = 2
+	LumpVertexes              = 3
+	LumpVisibility            = 4
+	LumpNodes                 = 5
+	LumpTexinfo               = 6
+	LumpFaces                 = 7
+	LumpLighting              = 8
+	LumpClipnodes             = 9
+	LumpLeafs                 = 10
+	LumpMarksurfaces          = 11
+	LumpEdges                 = 12
+	LumpSurfedges             = 13
+	LumpModels                = 14
+	LumpTotal                 = 15
+
+	BspVersionStd      BspVersion = 29
+	BspVersionHalfLife            = 30
+	BspVersion2PSB                = (('2') + ('P' << 8) + ('S' << 16) + ('B' << 24))
+	BspVersionBSP2                = (('B') + ('S' << 8) + ('P' << 16) + ('2' << 24))
+)
+
+func (b BspVersion) String() string {
+	switch b {
+	case BspVersionStd:
+		return "29"
+	case BspVersionHalfLife:
+		return "HalfLife"
+	case BspVersion2PSB:
+		return "2PSB"
+	case BspVersionBSP2:
+		return "BSP2"
+	default:
+		return fmt.Sprintf("Unknown version (%d)", int(b))
+	}
+}
+
+func (l LumpType) String() string {
+	switch l {
+	case LumpEntities:
+		return "Entities"
+	case LumpPlanes:
+		return "Planes"
+	case LumpTextures:
+		return "Textures"
+	case LumpVertexes:
+		return "Vertexes"
+	case LumpVisibility:
+		return "Visibility"
+	case LumpNodes:
+		return "Nodes"
+	case LumpTexinfo:
+		return "Texinfo"
+	case LumpFaces:
+		return "Faces"
+	case LumpLighting:
+		return "Lighting"
+	case LumpClipnodes:
+		return "Clipnodes"
+	case LumpLeafs:
+		return "Leafs"
+	case LumpMarksurfaces:
+		return "Marksurfaces"
+	case LumpEdges:
+		return "Edges"
+	case LumpSurfedges:
+		return "Surfedges"
+	case LumpModels:
+		return "Models"
+	default:
+		return fmt.Sprintf("Unknown lump (%d)", int(l))
+	}
+}
+
+// ParseLumpType accepts the names printed by LumpType.String, case
+// insensitively, or a lump index from 0 to 14.
+func ParseLumpType(s string) (LumpType, error) {
+	if index, err := strconv.Atoi(s); err == nil {
+		if index >= 0 && index < LumpTotal {
+			return LumpType(index), nil
+		}
+		return 0, fmt.Errorf("lump index %d out of range 0-%d", index, LumpTotal-1)
+	}
+	for l := LumpType(0); l < LumpTotal; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown lump %q, expected a standard lump name or index", s)
+}
+
+// ParseBspVersion accepts the names printed by BspVersion.String.
+func ParseBspVersion(s string) (BspVersion, error) {
+	for _, version := range []BspVersion{BspVersionStd, BspVersionHalfLife, BspVersion2PSB, BspVersionBSP2} {
+		if strings.EqualFold(s, version.String()) {
+			return version, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown BSP version %q", s)
+}
+
+// Lump is an entry of the standard lump directory.
+type Lump struct {
+	Offset uint32
+	Length uint32
+}
+
+// BspHeader is the version and standard lump directory at the start of a map.
+type BspHeader struct {
+	Version BspVersion
+	Lumps   [LumpTotal]Lump
+}
+
+// BspXHeader starts the BSPX extension following the standard lumps.
+type BspXHeader struct {
+	Id       [4]byte
+	NumLumps int32
+}
+
+// BspXLump is an entry of the BSPX lump directory.
+type BspXLump struct {
+	LumpName [24]byte
+	Offset   uint32
+	Length   uint32
+}
+
+// Face is the BSP29 face record.
+type Face struct {
+	PlaneId   uint16
+	Side      uint16
+	LedgeId   uint32
+	LedgeNum  uint16
+	TexinfoId uint16
+	TypeLight uint8
+	BaseLight uint8
+	Light     [2]uint8
+	Lightmap  int32
+}
+
+// FaceV2 is the BSP2 face record, faces of all versions are decoded to it.
+type FaceV2 struct {
+	PlaneId   uint32
+	Side      uint32
+	LedgeId   uint32
+	LedgeNum  uint32
+	TexinfoId uint32
+	TypeLight uint8
+	BaseLight uint8
+	Light     [2]uint8
+	Lightmap  int32
+}
+
+// Vec3 is a point or direction in map units.
+type Vec3 [3]float32
+
+func (v Vec3) String() string {
+	return fmt.Sprintf("%g %g %g", v[0], v[1], v[2])
+}
+
+func (v Vec3) Dot(o Vec3) float32 {
+	return v[0]*o[0] + v[1]*o[1] + v[2]*o[2]
+}
+
+// Vec4 is a texture or lightmap projection vector, xyz and offset.
+type Vec4 [4]float32
+
+func (v Vec4) String() string {
+	return fmt.Sprintf("{x: %.3f, y: %.3f, z: %.3f, w: %.3f}", v[0], v[1], v[2], v[3])
+}
+
+// DecoupledLM is the per face record of the DECOUPLED_LM lump.
+type DecoupledLM struct {
+	LmWidth        uint16
+	LmHeight       uint16
+	Offset         int32
+	WorldToLmSpace [2]Vec4
+}
+
+func (d DecoupledLM) String() string {
+	return fmt.Sprintf("LM[w: %2d, h: %2d, off: %6d, [%s, %s]", d.LmWidth, d.LmHeight, d.Offset, d.WorldToLmSpace[0], d.WorldToLmSpace[1])
+}
+
+// BspXLumpHeaderSize is the size of a BSPX lump directory entry.
+const BspXLumpHeaderSize = 24 + 4 + 4
+
+// BspFile holds the header and both lump directories of a map, lump data is
+// read from the file on demand.
+type BspFile struct {
+	BspHeader  BspHeader
+	BspXOffset int64
+	BspXHeader BspXHeader
+	BspXLumps  []BspXLump
+	// ByteOrder is binary.BigEndian for maps of big-endian console ports
+	// and binary.LittleEndian for all others.
+	ByteOrder binary.ByteOrder
+
+	r io.ReaderAt
+}
+
+// FormatError is returned for data that is not a BSP file, or is truncated or
+// malformed, as opposed to errors reading the data.
+type FormatError struct {
+	Err error
+}
+
+func (e *FormatError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+func formatErrorf(format string, a ...interface{}) error {
+	return &FormatError{fmt.Errorf(format, a...)}
+}
+
+// truncated turns the errors binary.Read and ReadAt return for data ending
+// early into a FormatError.
+func truncated(err error, format string, a ...interface{}) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return formatErrorf(format, a...)
+	}
+	return err
+}
+
+// BytesToString converts a NUL padded name to a string.
+func BytesToString(buffer []byte) string {
+	return fmt.Sprintf("%s", bytes.Trim(buffer, "\x00"))
+}
+
+// LumpName converts a BSPX lump name to its NUL padded directory form.
+func LumpName(name string) [24]byte {
+	var lumpName [24]byte
+	copy(lumpName[:], name)
+	return lumpName
+}
+
+// FindBspXLump returns the directory entry of the named BSPX lump, or nil.
+func FindBspXLump(bspFile *BspFile, name string) *BspXLump {
+	for i := range bspFile.BspXLumps {
+		if BytesToString(bspFile.BspXLumps[i].LumpName[:]) == name {
+			return &bspFile.BspXLumps[i]
+		}
+	}
+	return nil
+}
+
+// ReadBspFile reads the header and lump directories of the map in r. The
+// BSPX header is looked for at the end of the last standard lump, padded to
+// 4 bytes; anything else there, or nothing, means the map has no BSPX lumps
+// and is left to callers as trailing bytes. A directory claiming more lumps
+// than the file holds is cut to the entries that fit.
+func ReadBspFile(r io.ReaderAt) (BspFile, error) {
+	bspFile := BspFile{r: r}
+
+	data := make([]byte, binary.Size(bspFile.BspHeader))
+	_, err := r.ReadAt(data, 0)
+	if err != nil {
+		return bspFile, truncated(err, "file too short for a BSP header")
+	}
+	bspFile.BspHeader, bspFile.ByteOrder = detectByteOrder(data, r)
+	switch bspFile.BspHeader.Version {
+	case BspVersionStd, BspVersionHalfLife, BspVersion2PSB, BspVersionBSP2:
+	default:
+		return bspFile, formatErrorf("not a BSP file, unknown version %d", int32(bspFile.BspHeader.Version))
+	}
+
+	for i := 0; i < LumpTotal; i++ {
+		var lump = &bspFile.BspHeader.Lumps[i]
+		var end = int64(lump.Offset + lump.Length)
+		if end > bspFile.BspXOffset {
+			bspFile.BspXOffset = end
+		}
+	}
+
+	// Writers pad the standard lumps to 4 bytes before the BSPX header.
+	offset := (bspFile.BspXOffset + 3) &^ 3
+	var header BspXHeader
+	bspx := io.NewSectionReader(r, offset, math.MaxInt64-offset)
+	if binary.Read(bspx, bspFile.ByteOrder, &header) != nil || string(header.Id[:]) != "BSPX" {
+		return bspFile, nil
+	}
+	if header.NumLumps < 0 {
+		return bspFile, formatErrorf("BSPX directory with %d lumps", header.NumLumps)
+	}
+	bspFile.BspXOffset = offset
+	bspFile.BspXHeader = header
+	if fit := directoryEntriesFit(r, offset+8, int64(header.NumLumps)); fit < int64(header.NumLumps) {
+		bspFile.BspXHeader.NumLumps = int32(fit)
+	}
+
+	bspFile.BspXLumps = make([]BspXLump, bspFile.BspXHeader.NumLumps)
+	for i := 0; i < len(bspFile.BspXLumps); i++ {
+		err = binary.Read(bspx, bspFile.ByteOrder, &bspFile.BspXLumps[i])
+		if err != nil {
+			return bspFile, truncated(err, "BSPX directory truncated after %d of %d lumps", i, header.NumLumps)
+		}
+	}
+
+	return bspFile, nil
+}
+
+// directoryEntriesFit returns how many of n BSPX directory entries starting
+// at offset fit in r, at most n, probing the last byte of each candidate
+// count so bogus counts don't allocate huge directories.
+func directoryEntriesFit(r io.ReaderAt, offset int64, n int64) int64 {
+	fits := func(count int64) bool {
+		if count == 0 {
+			return true
+		}
+		_, err := r.ReadAt(make([]byte, 1), offset+count*BspXLumpHeaderSize-1)
+		return err == nil
+	}
+	if fits(n) {
+		return n
+	}
+	low, high := int64(0), n
+	for low+1 < high {
+		mid := low + (high-low)/2
+		if fits(mid) {
+			low = mid
+		} else {
+			high = mid
+		}
+	}
+	return low
+}
+
+// ReadBspXLump returns the contents of the named BSPX lump, or nil if the map
+// does not have it.
+func ReadBspXLump(bspFile *BspFile, r io.ReaderAt, name string) ([]byte, error) {
+	xlump := FindBspXLump(bspFile, name)
+	if xlump == nil {
+		return nil, nil
+	}
+	buffer := make([]byte, xlump.Length)
+	_, err := r.ReadAt(buffer, int64(xlump.Offset))
+	if err != nil {
+		return nil, truncated(err, "BSPX lump %s extends past the end of the file", name)
+	}
+	return buffer, nil
+}
@@ -0,0 +1,56 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testMap returns a BSP29 map whose only lump is an entities lump of an
+// unaligned length, ending the standard lumps at an unaligned offset.
+func testMap(t *testing.T) []byte {
+	t.Helper()
+	entities := []byte("{\n\"classname\" \"worldspawn\"\n}\n\x00")
+	var header BspHeader
+	header.Version = BspVersionStd
+	headerSize := uint32(binary.Size(header))
+	for i := range header.Lumps {
+		header.Lumps[i].Offset = headerSize
+	}
+	header.Lumps[LumpEntities].Length = uint32(len(entities))
+
+	var buffer bytes.Buffer
+	if err := binary.Write(&buffer, binary.LittleEndian, header); err != nil {
+		t.Fatal(err)
+	}
+	buffer.Write(entities)
+	if buffer.Len()%4 == 0 {
+		t.Fatal("test map should end unaligned")
+	}
+	return buffer.Bytes()
+}
+
+func TestReadBspFileTrailingJunk(t *testing.T) {
+	data := append(testMap(t), "GARBAGEGARBAGEjunk"...)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bspFile.BspXLumps) != 0 {
+		t.Errorf("junk read as %d BSPX lumps", len(bspFile.BspXLumps))
+	}
+}
+
+func TestReadBspFileBspXCountCapped(t *testing.T) {
+	data := testMap(t)
+	data = append(data, make([]byte, (4-len(data)%4)%4)...)
+	data = append(data, 'B', 'S', 'P', 'X', 0xff, 0xff, 0xff, 0x3f)
+	data = append(data, make([]byte, 2*BspXLumpHeaderSize+5)...)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bspFile.BspXLumps) != 2 {
+		t.Errorf("got %d BSPX lumps, expected the 2 that fit", len(bspFile.BspXLumps))
+	}
+}
@@ -0,0 +1,118 @@
+package bsp
+
+// BspXLumps holds BSPX lumps in the order they are written. Lumps read from
+// a map keep their order, Set replaces a lump in place or appends a new one at
+// the end, so rewriting a map is deterministic. The zero value is empty and
+// ready to use.
+type BspXLumps struct {
+	names [][24]byte
+	data  map[[24]byte][]byte
+}
+
+// Len returns the number of lumps.
+func (l *BspXLumps) Len() int {
+	return len(l.names)
+}
+
+// Names returns the lump names in order.
+func (l *BspXLumps) Names() []string {
+	names := make([]string, len(l.names))
+	for i, lumpName := range l.names {
+		names[i] = BytesToString(lumpName[:])
+	}
+	return names
+}
+
+// Get returns the contents of the named lump and whether it exists.
+func (l *BspXLumps) Get(name string) ([]byte, bool) {
+	data, found := l.data[LumpName(name)]
+	return data, found
+}
+
+// Has reports whether the named lump exists.
+func (l *BspXLumps) Has(name string) bool {
+	_, found := l.data[LumpName(name)]
+	return found
+}
+
+// Set replaces the contents of the named lump, or appends it if it does not
+// exist yet.
+func (l *BspXLumps) Set(name string, data []byte) {
+	l.set(LumpName(name), data)
+}
+
+func (l *BspXLumps) set(lumpName [24]byte, data []byte) {
+	if l.data == nil {
+		l.data = map[[24]byte][]byte{}
+	}
+	if _, found := l.data[lumpName]; !found {
+		l.names = append(l.names, lumpName)
+	}
+	l.data[lumpName] = data
+}
+
+// Delete removes the named lump.
+func (l *BspXLumps) Delete(name string) {
+	lumpName := LumpName(name)
+	if _, found := l.data[lumpName]; !found {
+		return
+	}
+	delete(l.data, lumpName)
+	for i := range l.names {
+		if l.names[i] == lumpName {
+			l.names = append(l.names[:i], l.names[i+1:]...)
+			break
+		}
+	}
+}
+
+// Clear removes all lumps.
+func (l *BspXLumps) Clear() {
+	l.names, l.data = nil, nil
+}
+
+// Range calls fn for each lump in order. Lumps may be replaced with Set while
+// ranging, but not added or removed.
+func (l *BspXLumps) Range(fn func(name string, data []byte)) {
+	for _, lumpName := range l.names {
+		fn(BytesToString(lumpName[:]), l.data[lumpName])
+	}
+}
+
+// Reorder moves the named lumps to the front in the given order, the others
+// follow in their current order. Names of missing lumps are ignored.
+func (l *BspXLumps) Reorder(names []string) {
+	l.names = reorderNames(l.names, names)
+}
+
+// reorderNames returns current with the named entries moved to the front.
+func reorderNames(current [][24]byte, names []string) [][24]byte {
+	present := map[[24]byte]bool{}
+	for _, lumpName := range current {
+		present[lumpName] = true
+	}
+	var ordered [][24]byte
+	moved := map[[24]byte]bool{}
+	for _, name := range names {
+		lumpName := LumpName(name)
+		if present[lumpName] && !moved[lumpName] {
+			moved[lumpName] = true
+			ordered = append(ordered, lumpName)
+		}
+	}
+	for _, lumpName := range current {
+		if !moved[lumpName] {
+			ordered = append(ordered, lumpName)
+		}
+	}
+	return ordered
+}
+
+// payloads returns the lumps to write in order.
+func (l *BspXLumps) payloads() []bspxPayload {
+	payloads := make([]bspxPayload, 0, len(l.names))
+	for _, lumpName := range l.names {
+		payloads = append(payloads, bspxPayload{name: lumpName, data: l.data[lumpName]})
+	}
+	return payloads
+}
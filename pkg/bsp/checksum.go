@@ -0,0 +1,93 @@
+package bsp
+
+import (
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// MD4 returns the MD4 digest of data (RFC 1320), which the Quake engines use
+// for map checksums.
+func MD4(data []byte) [16]byte {
+	length := len(data)
+	message := append([]byte(nil), data...)
+	message = append(message, 0x80)
+	for len(message)%64 != 56 {
+		message = append(message, 0)
+	}
+	message = binary.LittleEndian.AppendUint64(message, uint64(length)<<3)
+
+	a, b, c, d := uint32(0x67452301), uint32(0xefcdab89), uint32(0x98badcfe), uint32(0x10325476)
+	var x [16]uint32
+	for block := 0; block < len(message); block += 64 {
+		for i := range x {
+			x[i] = binary.LittleEndian.Uint32(message[block+4*i:])
+		}
+		aa, bb, cc, dd := a, b, c, d
+
+		f := func(x, y, z uint32) uint32 { return x&y | ^x&z }
+		g := func(x, y, z uint32) uint32 { return x&y | x&z | y&z }
+		h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+
+		for _, i := range []int{0, 4, 8, 12} {
+			a = bits.RotateLeft32(a+f(b, c, d)+x[i], 3)
+			d = bits.RotateLeft32(d+f(a, b, c)+x[i+1], 7)
+			c = bits.RotateLeft32(c+f(d, a, b)+x[i+2], 11)
+			b = bits.RotateLeft32(b+f(c, d, a)+x[i+3], 19)
+		}
+		for _, i := range []int{0, 1, 2, 3} {
+			a = bits.RotateLeft32(a+g(b, c, d)+x[i]+0x5a827999, 3)
+			d = bits.RotateLeft32(d+g(a, b, c)+x[i+4]+0x5a827999, 5)
+			c = bits.RotateLeft32(c+g(d, a, b)+x[i+8]+0x5a827999, 9)
+			b = bits.RotateLeft32(b+g(c, d, a)+x[i+12]+0x5a827999, 13)
+		}
+		for _, i := range []int{0, 2, 1, 3} {
+			a = bits.RotateLeft32(a+h(b, c, d)+x[i]+0x6ed9eba1, 3)
+			d = bits.RotateLeft32(d+h(a, b, c)+x[i+8]+0x6ed9eba1, 9)
+			c = bits.RotateLeft32(c+h(d, a, b)+x[i+4]+0x6ed9eba1, 11)
+			b = bits.RotateLeft32(b+h(c, d, a)+x[i+12]+0x6ed9eba1, 15)
+		}
+
+		a, b, c, d = a+aa, b+bb, c+cc, d+dd
+	}
+
+	var digest [16]byte
+	binary.LittleEndian.PutUint32(digest[0:], a)
+	binary.LittleEndian.PutUint32(digest[4:], b)
+	binary.LittleEndian.PutUint32(digest[8:], c)
+	binary.LittleEndian.PutUint32(digest[12:], d)
+	return digest
+}
+
+// BlockChecksum is Com_BlockChecksum of the Quake engines, the MD4 digest of
+// data folded to 32 bits.
+func BlockChecksum(data []byte) uint32 {
+	digest := MD4(data)
+	return binary.LittleEndian.Uint32(digest[0:]) ^ binary.LittleEndian.Uint32(digest[4:]) ^
+		binary.LittleEndian.Uint32(digest[8:]) ^ binary.LittleEndian.Uint32(digest[12:])
+}
+
+// MapChecksums returns the checksums QuakeWorld computes when loading a map.
+// checksum covers every lump but the entities, checksum2, which servers
+// compare against the client's, also skips the visibility, leafs and nodes
+// lumps so maps differing only in vis data still match. Big-endian maps are
+// checksummed as their little-endian form.
+func MapChecksums(bspFile *BspFile, r io.ReaderAt) (checksum uint32, checksum2 uint32, err error) {
+	for i := 0; i < LumpTotal; i++ {
+		lumpType := LumpType(i)
+		if lumpType == LumpEntities {
+			continue
+		}
+		buffer, err := ReadLump(bspFile, r, lumpType)
+		if err != nil {
+			return 0, 0, err
+		}
+		sum := BlockChecksum(buffer)
+		checksum ^= sum
+		if lumpType == LumpVisibility || lumpType == LumpLeafs || lumpType == LumpNodes {
+			continue
+		}
+		checksum2 ^= sum
+	}
+	return checksum, checksum2, nil
+}
@@ -0,0 +1,386 @@
+package bsp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Document is a map held in memory, LoadDocument reads every standard and
+// BSPX lump up front. Lumps can be replaced, resized, added or removed freely, the lump
+// directories are recomputed when the document is written.
+//
+// A document opened with OpenDocument reads lumps only when they are first
+// accessed through Lump, BspXLump or Entities. Until Materialize is called
+// Lumps and BspX hold only what has been loaded or set so far, so lumps must
+// be changed through SetLump, SetBspXLump and DeleteBspXLump. Writing such a
+// document copies the lumps not loaded straight from the source.
+//
+// Standard lumps are held in little-endian, ByteOrder is the byte order the
+// document is written in.
+type Document struct {
+	Version   BspVersion
+	ByteOrder binary.ByteOrder
+	Lumps     [LumpTotal][]byte
+	BspX      BspXLumps
+	// BspXAlignment starts every BSPX lump payload at a multiple of this
+	// many bytes, 0 or 1 writes them back to back.
+	BspXAlignment int
+
+	// source is the map a lazily opened document reads from, nil once all
+	// lumps are loaded.
+	source      *BspFile
+	loaded      [LumpTotal]bool
+	changed     [LumpTotal]bool
+	bspxDeleted map[[24]byte]bool
+	bspxOrder   []string
+}
+
+// NewDocument returns an empty document of the given version.
+func NewDocument(version BspVersion) *Document {
+	return &Document{Version: version, ByteOrder: binary.LittleEndian}
+}
+
+// LoadDocument reads all lumps of the map in r into memory.
+func LoadDocument(r io.ReaderAt) (*Document, error) {
+	bspFile, err := ReadBspFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return loadDocument(&bspFile, r)
+}
+
+// OpenDocument reads the lump directories of the map in r, lump payloads are
+// read on demand.
+func OpenDocument(r io.ReaderAt) (*Document, error) {
+	bspFile, err := ReadBspFile(r)
+	if err != nil {
+		return nil, err
+	}
+	return openDocument(&bspFile), nil
+}
+
+func openDocument(bspFile *BspFile) *Document {
+	return &Document{
+		Version:     bspFile.BspHeader.Version,
+		ByteOrder:   bspFile.order(),
+		source:      bspFile,
+		bspxDeleted: map[[24]byte]bool{},
+	}
+}
+
+func loadDocument(bspFile *BspFile, r io.ReaderAt) (*Document, error) {
+	doc := &Document{Version: bspFile.BspHeader.Version, ByteOrder: bspFile.order()}
+	for i := range doc.Lumps {
+		buffer, err := ReadLump(bspFile, r, LumpType(i))
+		if err != nil {
+			return nil, err
+		}
+		doc.Lumps[i] = buffer
+	}
+
+	bspx, err := readBspXLumps(bspFile, r)
+	if err != nil {
+		return nil, err
+	}
+	doc.BspX = *bspx
+	return doc, nil
+}
+
+// Lazy reports whether the document still reads lumps on demand.
+func (d *Document) Lazy() bool {
+	return d.source != nil
+}
+
+// Lump returns the contents of a standard lump, reading it first if needed.
+func (d *Document) Lump(lumpType LumpType) ([]byte, error) {
+	if d.source != nil && !d.loaded[lumpType] {
+		buffer, err := ReadLump(d.source, d.source.r, lumpType)
+		if err != nil {
+			return nil, err
+		}
+		d.Lumps[lumpType] = buffer
+		d.loaded[lumpType] = true
+	}
+	return d.Lumps[lumpType], nil
+}
+
+// SetLump replaces the contents of a standard lump.
+func (d *Document) SetLump(lumpType LumpType, data []byte) {
+	d.Lumps[lumpType] = data
+	d.loaded[lumpType] = true
+	d.changed[lumpType] = true
+}
+
+// Entities decodes the entities lump.
+func (d *Document) Entities() ([]Entity, error) {
+	data, err := d.Lump(LumpEntities)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEntities(data)
+}
+
+// SetEntities replaces the entities lump. It fails, leaving the lump as it
+// is, for pairs that can't be written, see CheckKeyValue.
+func (d *Document) SetEntities(entities []Entity) error {
+	data, err := FormatEntities(entities)
+	if err != nil {
+		return err
+	}
+	d.SetLump(LumpEntities, data)
+	return nil
+}
+
+// BspXLump returns the contents of the named BSPX lump, or nil if the
+// document does not have it.
+func (d *Document) BspXLump(name string) ([]byte, error) {
+	if data, found := d.BspX.Get(name); found || d.source == nil || d.bspxDeleted[LumpName(name)] {
+		return data, nil
+	}
+	data, err := ReadBspXLump(d.source, d.source.r, name)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	d.BspX.Set(name, data)
+	return data, nil
+}
+
+// SetBspXLump adds or replaces the named BSPX lump.
+func (d *Document) SetBspXLump(name string, data []byte) {
+	d.BspX.Set(name, data)
+}
+
+// DeleteBspXLump removes the named BSPX lump.
+func (d *Document) DeleteBspXLump(name string) {
+	d.BspX.Delete(name)
+	if d.source != nil {
+		d.bspxDeleted[LumpName(name)] = true
+	}
+}
+
+// BspXLumpNames returns the names of the BSPX lumps in the order they are
+// written.
+func (d *Document) BspXLumpNames() []string {
+	var names []string
+	for _, payload := range d.bspxPayloads() {
+		names = append(names, BytesToString(payload.name[:]))
+	}
+	return names
+}
+
+// RenameBspXLump renames a BSPX lump, keeping its position and contents.
+func (d *Document) RenameBspXLump(from string, to string) error {
+	if to == "" || len(to) > len(BspXLump{}.LumpName) {
+		return fmt.Errorf("BSPX lump name %q must be 1 to %d bytes long", to, len(BspXLump{}.LumpName))
+	}
+	names := d.BspXLumpNames()
+	index := -1
+	for i, name := range names {
+		if name == from {
+			index = i
+		} else if name == to {
+			return fmt.Errorf("BSPX lump %s exists already", to)
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("no BSPX lump %s", from)
+	}
+
+	data, err := d.BspXLump(from)
+	if err != nil {
+		return err
+	}
+	d.DeleteBspXLump(from)
+	d.SetBspXLump(to, data)
+	names[index] = to
+	d.ReorderBspX(names)
+	return nil
+}
+
+// ReorderBspX moves the named BSPX lumps to the front in the given order, the
+// others follow in their current order.
+func (d *Document) ReorderBspX(names []string) {
+	if d.source == nil {
+		d.BspX.Reorder(names)
+		return
+	}
+	d.bspxOrder = append([]string(nil), names...)
+}
+
+// Materialize reads all lumps not loaded yet, after which the document no
+// longer uses the reader it was opened from.
+func (d *Document) Materialize() error {
+	if d.source == nil {
+		return nil
+	}
+	for i := range d.Lumps {
+		if _, err := d.Lump(LumpType(i)); err != nil {
+			return err
+		}
+	}
+	for _, xlump := range d.source.BspXLumps {
+		if _, err := d.BspXLump(BytesToString(xlump.LumpName[:])); err != nil {
+			return err
+		}
+	}
+	var bspx BspXLumps
+	for _, payload := range d.bspxPayloads() {
+		bspx.set(payload.name, payload.data)
+	}
+	d.BspX = bspx
+	d.source, d.bspxDeleted, d.bspxOrder = nil, nil, nil
+	return nil
+}
+
+// Header returns the header the document is written with. Standard lumps
+// follow the header in order, each padded to 4 bytes. Lumps of a lazy
+// document that are not loaded yet keep their size.
+func (d *Document) Header() BspHeader {
+	header := BspHeader{Version: d.Version}
+	offset := uint32(binary.Size(header))
+	for i, buffer := range d.Lumps {
+		length := uint32(len(buffer))
+		if d.source != nil && !d.loaded[i] {
+			length = d.source.BspHeader.Lumps[i].Length
+		}
+		header.Lumps[i] = Lump{Offset: offset, Length: length}
+		offset += (length + 3) &^ 3
+	}
+	return header
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bspxPayloads returns the BSPX lumps to write. Lumps of the source keep
+// their order, lumps not loaded are copied from it, and added lumps follow in
+// the order they were set.
+func (d *Document) bspxPayloads() []bspxPayload {
+	if d.source == nil {
+		return d.BspX.payloads()
+	}
+
+	var payloads []bspxPayload
+	written := map[[24]byte]bool{}
+	for i, xlump := range d.source.BspXLumps {
+		if written[xlump.LumpName] || d.bspxDeleted[xlump.LumpName] {
+			continue
+		}
+		written[xlump.LumpName] = true
+		if data, found := d.BspX.data[xlump.LumpName]; found {
+			payloads = append(payloads, bspxPayload{name: xlump.LumpName, data: data})
+		} else {
+			payloads = append(payloads, bspxPayload{name: xlump.LumpName, source: &d.source.BspXLumps[i]})
+		}
+	}
+	for _, payload := range d.BspX.payloads() {
+		if !written[payload.name] {
+			payloads = append(payloads, payload)
+		}
+	}
+	if d.bspxOrder == nil {
+		return payloads
+	}
+
+	current := make([][24]byte, len(payloads))
+	byName := map[[24]byte]bspxPayload{}
+	for i, payload := range payloads {
+		current[i] = payload.name
+		byName[payload.name] = payload
+	}
+	for i, lumpName := range reorderNames(current, d.bspxOrder) {
+		payloads[i] = byName[lumpName]
+	}
+	return payloads
+}
+
+// order returns the byte order the document is written in, little-endian if
+// unset.
+func (d *Document) order() binary.ByteOrder {
+	if d.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return d.ByteOrder
+}
+
+// writeLump writes a standard lump in the byte order of the document,
+// copying lumps a lazy document has not loaded from the source.
+func (d *Document) writeLump(w io.Writer, lumpType LumpType) error {
+	buffer := d.Lumps[lumpType]
+	if d.source != nil && !d.loaded[lumpType] {
+		if d.source.order() == d.order() {
+			lump := d.source.BspHeader.Lumps[lumpType]
+			return copyRange(w, d.source.r, int64(lump.Offset), int64(lump.Length), lumpType.String()+" lump")
+		}
+		var err error
+		buffer, err = ReadLump(d.source, d.source.r, lumpType)
+		if err != nil {
+			return err
+		}
+	}
+	if d.order() == binary.BigEndian {
+		buffer = swapLump(d.Version, lumpType, buffer, binary.LittleEndian)
+	}
+	_, err := w.Write(buffer)
+	return err
+}
+
+// WriteTo writes the document as a BSP file with recomputed lump
+// directories.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	out := &countingWriter{w: w}
+	header := d.Header()
+	err := binary.Write(out, d.order(), header)
+	if err != nil {
+		return out.n, err
+	}
+	for i, lump := range header.Lumps {
+		err = d.writeLump(out, LumpType(i))
+		if err != nil {
+			return out.n, err
+		}
+		_, err = out.Write(make([]byte, (4-lump.Length%4)%4))
+		if err != nil {
+			return out.n, err
+		}
+	}
+	var r io.ReaderAt
+	if d.source != nil {
+		r = d.source.r
+	}
+	err = writeBspXPayloads(out, out.n, d.order(), d.BspXAlignment, r, d.bspxPayloads())
+	return out.n, err
+}
+
+// Bytes returns the document encoded as a BSP file.
+func (d *Document) Bytes() ([]byte, error) {
+	var buffer bytes.Buffer
+	_, err := d.WriteTo(&buffer)
+	return buffer.Bytes(), err
+}
+
+// WriteFile writes the document to the named file.
+func (d *Document) WriteFile(name string) error {
+	return d.WriteFileContext(context.Background(), name)
+}
+
+// WriteFileContext is WriteFile stopping with ctx.Err() once ctx is done,
+// in which case the file is left untouched.
+func (d *Document) WriteFileContext(ctx context.Context, name string) error {
+	return writeFile(ctx, name, func(w io.Writer) error {
+		_, err := d.WriteTo(w)
+		return err
+	})
+}
@@ -0,0 +1,85 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestDocumentRoundTrip(t *testing.T) {
+	entities := []byte("{\n\"classname\" \"worldspawn\"\n}\n\x00")
+	planes := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		doc := NewDocument(BspVersionStd)
+		doc.ByteOrder = order
+		doc.SetLump(LumpEntities, entities)
+		doc.SetLump(LumpPlanes, planes)
+		doc.SetBspXLump("RGBLIGHTING", []byte("rgb"))
+		doc.SetBspXLump("LMSHIFT", []byte{4})
+		data, err := doc.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		loaded, err := LoadDocument(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.ByteOrder != order {
+			t.Errorf("byte order %v read back as %v", order, loaded.ByteOrder)
+		}
+		if !bytes.Equal(loaded.Lumps[LumpEntities], entities) || !bytes.Equal(loaded.Lumps[LumpPlanes], planes) {
+			t.Errorf("%v: standard lumps changed on the round trip", order)
+		}
+		if names := loaded.BspX.Names(); len(names) != 2 || names[0] != "RGBLIGHTING" || names[1] != "LMSHIFT" {
+			t.Errorf("%v: BSPX lumps read back as %v", order, names)
+		}
+		if lump, _ := loaded.BspX.Get("RGBLIGHTING"); string(lump) != "rgb" {
+			t.Errorf("%v: RGBLIGHTING read back as %q", order, lump)
+		}
+
+		again, err := loaded.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(again, data) {
+			t.Errorf("%v: writing a loaded document changed it", order)
+		}
+	}
+}
+
+func TestOpenDocumentCopiesUnloadedLumps(t *testing.T) {
+	source := NewDocument(BspVersionStd)
+	source.SetLump(LumpEntities, []byte("{\n}\n\x00"))
+	source.SetBspXLump("ONE", []byte("1"))
+	source.SetBspXLump("TWO", []byte("22"))
+	data, err := source.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := OpenDocument(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc.DeleteBspXLump("ONE")
+	doc.SetBspXLump("THREE", []byte("333"))
+	written, err := doc.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadDocument(bytes.NewReader(written))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(loaded.Lumps[LumpEntities]) != "{\n}\n\x00" {
+		t.Errorf("entities read back as %q", loaded.Lumps[LumpEntities])
+	}
+	if names := loaded.BspX.Names(); len(names) != 2 || names[0] != "TWO" || names[1] != "THREE" {
+		t.Errorf("BSPX lumps read back as %v", names)
+	}
+	if lump, _ := loaded.BspX.Get("TWO"); string(lump) != "22" {
+		t.Errorf("TWO read back as %q", lump)
+	}
+}
@@ -0,0 +1,170 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// Maps of some console ports store all numbers big-endian. ReadBspFile
+// detects the byte order, the readers decode either, and ReadLump and
+// documents hold standard lumps in little-endian so the rest of the code only
+// deals with one byte order. BSPX lump payloads are kept as they are.
+
+// order returns the byte order of the map, little-endian if unset.
+func (b *BspFile) order() binary.ByteOrder {
+	if b.ByteOrder == nil {
+		return binary.LittleEndian
+	}
+	return b.ByteOrder
+}
+
+// headerPlausible reports whether the header decoded with one byte order
+// describes lumps that fit in r, which a header decoded with the wrong byte
+// order doesn't.
+func headerPlausible(header *BspHeader, r io.ReaderAt) bool {
+	switch header.Version {
+	case BspVersionStd, BspVersionHalfLife, BspVersion2PSB, BspVersionBSP2:
+	default:
+		return false
+	}
+	headerSize := uint32(binary.Size(*header))
+	end := int64(0)
+	for _, lump := range header.Lumps {
+		if lump.Length == 0 {
+			continue
+		}
+		if lump.Offset < headerSize || lump.Offset > math.MaxUint32-lump.Length {
+			return false
+		}
+		if lumpEnd := int64(lump.Offset) + int64(lump.Length); lumpEnd > end {
+			end = lumpEnd
+		}
+	}
+	if end == 0 {
+		return true
+	}
+	_, err := r.ReadAt(make([]byte, 1), end-1)
+	return err == nil
+}
+
+// detectByteOrder decodes the header in data, preferring little-endian.
+func detectByteOrder(data []byte, r io.ReaderAt) (BspHeader, binary.ByteOrder) {
+	var header BspHeader
+	binary.Read(bytes.NewReader(data), binary.LittleEndian, &header)
+	if headerPlausible(&header, r) {
+		return header, binary.LittleEndian
+	}
+	var swapped BspHeader
+	binary.Read(bytes.NewReader(data), binary.BigEndian, &swapped)
+	if headerPlausible(&swapped, r) {
+		return swapped, binary.BigEndian
+	}
+	return header, binary.LittleEndian
+}
+
+// lumpRecords returns a slice for n on-disk records of a standard lump, nil
+// for lumps without fixed size records.
+func lumpRecords(version BspVersion, lumpType LumpType, n int) interface{} {
+	long := version.IsLongFormat()
+	switch lumpType {
+	case LumpPlanes:
+		return make([]Plane, n)
+	case LumpVertexes:
+		return make([]Vec3, n)
+	case LumpNodes:
+		switch version {
+		case BspVersionBSP2:
+			return make([]nodeV2, n)
+		case BspVersion2PSB:
+			return make([]node2PSB, n)
+		}
+		return make([]node29, n)
+	case LumpTexinfo:
+		return make([]Texinfo, n)
+	case LumpFaces:
+		if long {
+			return make([]FaceV2, n)
+		}
+		return make([]Face, n)
+	case LumpClipnodes:
+		if long {
+			return make([]clipNodeV2, n)
+		}
+		return make([]clipNode29, n)
+	case LumpLeafs:
+		switch version {
+		case BspVersionBSP2:
+			return make([]leafV2, n)
+		case BspVersion2PSB:
+			return make([]leaf2PSB, n)
+		}
+		return make([]leaf29, n)
+	case LumpMarksurfaces:
+		if long {
+			return make([]uint32, n)
+		}
+		return make([]uint16, n)
+	case LumpEdges:
+		if long {
+			return make([][2]uint32, n)
+		}
+		return make([][2]uint16, n)
+	case LumpSurfedges:
+		return make([]int32, n)
+	case LumpModels:
+		return make([]Model, n)
+	}
+	return nil
+}
+
+// swapLump converts the contents of a standard lump stored in byte order
+// from to the other byte order. Text and byte lumps are returned as they are.
+func swapLump(version BspVersion, lumpType LumpType, data []byte, from binary.ByteOrder) []byte {
+	if lumpType == LumpTextures {
+		return swapTextureLump(data, from)
+	}
+	size := LumpRecordSize(version, lumpType)
+	if size == 0 {
+		return data
+	}
+
+	// Reversing the bytes of every field is the same in both directions.
+	n := len(data) / size
+	records := lumpRecords(version, lumpType, n)
+	binary.Read(bytes.NewReader(data[:n*size]), binary.LittleEndian, records)
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.BigEndian, records)
+	buffer.Write(data[n*size:])
+	return buffer.Bytes()
+}
+
+// swapTextureLump converts the miptex directory and headers of a textures
+// lump, the names and pixels stay as they are.
+func swapTextureLump(data []byte, from binary.ByteOrder) []byte {
+	out := append([]byte(nil), data...)
+	swap32 := func(pos int) {
+		out[pos], out[pos+1], out[pos+2], out[pos+3] = out[pos+3], out[pos+2], out[pos+1], out[pos]
+	}
+	if len(data) < 4 {
+		return out
+	}
+	count := int64(from.Uint32(data))
+	swap32(0)
+
+	swapped := map[uint32]bool{}
+	for i := int64(0); i < count && 8+4*i <= int64(len(data)); i++ {
+		swap32(int(4 + 4*i))
+		offset := from.Uint32(data[4+4*i:])
+		if offset == math.MaxUint32 || int64(offset)+MipTexHeaderSize > int64(len(data)) || swapped[offset] {
+			continue
+		}
+		swapped[offset] = true
+		// Width, height and the four mip offsets follow the name.
+		for field := 0; field < 6; field++ {
+			swap32(int(offset) + 16 + 4*field)
+		}
+	}
+	return out
+}
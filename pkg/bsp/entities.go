@@ -0,0 +1,240 @@
+package bsp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Entity is a single { ... } block of the entity lump. Pairs are kept in
+// file order and duplicate keys are preserved.
+type Entity struct {
+	Pairs []KeyValue
+}
+
+func (e *Entity) Get(key string) string {
+	for _, kv := range e.Pairs {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return ""
+}
+
+func (e *Entity) Has(key string) bool {
+	for _, kv := range e.Pairs {
+		if kv.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Set updates the first pair with the given key, or appends a new one.
+func (e *Entity) Set(key, value string) {
+	for i := range e.Pairs {
+		if e.Pairs[i].Key == key {
+			e.Pairs[i].Value = value
+			return
+		}
+	}
+	e.Pairs = append(e.Pairs, KeyValue{Key: key, Value: value})
+}
+
+// Delete removes every pair with the given key.
+func (e *Entity) Delete(key string) {
+	pairs := e.Pairs[:0]
+	for _, kv := range e.Pairs {
+		if kv.Key != key {
+			pairs = append(pairs, kv)
+		}
+	}
+	e.Pairs = pairs
+}
+
+func (e *Entity) Classname() string {
+	return e.Get("classname")
+}
+
+func (e *Entity) Origin() (Vec3, bool) {
+	return ParseVec3(e.Get("origin"))
+}
+
+func ParseVec3(s string) (Vec3, bool) {
+	var v Vec3
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return v, false
+	}
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(field, 32)
+		if err != nil {
+			return v, false
+		}
+		v[i] = float32(f)
+	}
+	return v, true
+}
+
+type entityTokenizer struct {
+	data []byte
+	pos  int
+	line int
+}
+
+// next mimics COM_Parse: skips whitespace and // comments, and returns either
+// a quoted string, a brace, or a bare word.
+func (t *entityTokenizer) next() (string, bool, error) {
+	for t.pos < len(t.data) {
+		c := t.data[t.pos]
+		if c == '\n' {
+			t.line++
+		}
+		if c == 0 {
+			t.pos = len(t.data)
+			break
+		}
+		if c <= ' ' {
+			t.pos++
+			continue
+		}
+		if c == '/' && t.pos+1 < len(t.data) && t.data[t.pos+1] == '/' {
+			for t.pos < len(t.data) && t.data[t.pos] != '\n' {
+				t.pos++
+			}
+			continue
+		}
+		break
+	}
+	if t.pos >= len(t.data) {
+		return "", false, nil
+	}
+
+	c := t.data[t.pos]
+	if c == '{' || c == '}' {
+		t.pos++
+		return string(c), true, nil
+	}
+
+	if c == '"' {
+		t.pos++
+		start := t.pos
+		for t.pos < len(t.data) && t.data[t.pos] != '"' {
+			if t.data[t.pos] == '\n' {
+				t.line++
+			}
+			t.pos++
+		}
+		if t.pos >= len(t.data) {
+			return "", false, formatErrorf("line %d: unterminated string", t.line+1)
+		}
+		token := string(t.data[start:t.pos])
+		t.pos++
+		return token, true, nil
+	}
+
+	start := t.pos
+	for t.pos < len(t.data) && t.data[t.pos] > ' ' && t.data[t.pos] != '{' && t.data[t.pos] != '}' && t.data[t.pos] != '"' {
+		t.pos++
+	}
+	return string(t.data[start:t.pos]), true, nil
+}
+
+// ParseEntities parses an entities lump or .ent file.
+func ParseEntities(data []byte) ([]Entity, error) {
+	t := &entityTokenizer{data: data}
+	var entities []Entity
+
+	for {
+		token, ok, err := t.next()
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return entities, nil
+		}
+		if token != "{" {
+			return nil, formatErrorf("line %d: expected '{', got %q", t.line+1, token)
+		}
+
+		var entity Entity
+		for {
+			key, ok, err := t.next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, formatErrorf("line %d: unexpected end of entity data", t.line+1)
+			}
+			if key == "}" {
+				break
+			}
+			value, ok, err := t.next()
+			if err != nil {
+				return nil, err
+			}
+			if !ok || value == "}" || value == "{" {
+				return nil, formatErrorf("line %d: missing value for key %q", t.line+1, key)
+			}
+			entity.Pairs = append(entity.Pairs, KeyValue{Key: key, Value: value})
+		}
+		entities = append(entities, entity)
+	}
+}
+
+// CheckKeyValue returns an error if a key or value can't be written to an
+// entities lump. Engines parse quoted strings without escapes, so a quote
+// ends the string early, and a newline or NUL breaks the lump as well.
+func CheckKeyValue(key, value string) error {
+	if strings.ContainsAny(key, "\"\n\x00") {
+		return fmt.Errorf("invalid key %q, keys must not contain quotes or newlines", key)
+	}
+	if strings.ContainsAny(value, "\"\n\x00") {
+		return fmt.Errorf("invalid value %q for %s, values must not contain quotes or newlines", value, key)
+	}
+	return nil
+}
+
+// FormatEntities serializes entities the way qbsp writes them, including the
+// trailing NUL expected by engines. It fails for pairs CheckKeyValue rejects.
+func FormatEntities(entities []Entity) ([]byte, error) {
+	var buffer bytes.Buffer
+	for _, entity := range entities {
+		buffer.WriteString("{\n")
+		for _, kv := range entity.Pairs {
+			if err := CheckKeyValue(kv.Key, kv.Value); err != nil {
+				return nil, err
+			}
+			fmt.Fprintf(&buffer, "\"%s\" \"%s\"\n", kv.Key, kv.Value)
+		}
+		buffer.WriteString("}\n")
+	}
+	buffer.WriteByte(0)
+	return buffer.Bytes(), nil
+}
+
+// ReadEntities parses the entities lump of a map.
+func ReadEntities(bspFile *BspFile, r io.ReaderAt) ([]Entity, error) {
+	data, err := ReadLump(bspFile, r, LumpEntities)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEntities(data)
+}
+
+// FormatVec3 formats a vector the way entity values are written, without
+// exponents or trailing zeros.
+func FormatVec3(v Vec3) string {
+	return fmt.Sprintf("%s %s %s", formatFloat(v[0]), formatFloat(v[1]), formatFloat(v[2]))
+}
+
+func formatFloat(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 32)
+}
@@ -0,0 +1,35 @@
+package bsp
+
+import "testing"
+
+func TestFormatEntitiesRoundTrip(t *testing.T) {
+	entities := []Entity{
+		{Pairs: []KeyValue{{"classname", "worldspawn"}, {"message", "Night CTF"}}},
+		{Pairs: []KeyValue{{"classname", "info_player_start"}, {"origin", "0 0 24"}}},
+	}
+	data, err := FormatEntities(entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseEntities(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed[0].Get("message") != "Night CTF" || parsed[1].Get("origin") != "0 0 24" {
+		t.Errorf("entities read back as %v", parsed)
+	}
+}
+
+func TestFormatEntitiesRejectsUnwritablePairs(t *testing.T) {
+	for _, kv := range []KeyValue{
+		{"message", `Say "hi" now`},
+		{"message", "two\nlines"},
+		{`"key`, "value"},
+		{"message", "nul\x00"},
+	} {
+		_, err := FormatEntities([]Entity{{Pairs: []KeyValue{kv}}})
+		if err == nil {
+			t.Errorf("%q %q written", kv.Key, kv.Value)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package bsp
+
+import (
+	"bytes"
+	"io/fs"
+)
+
+// ReadBspFileFS reads the map name from fsys, like an embed.FS, a zip.Reader
+// for .pk3 archives or a Pak. The file is read into memory, so the returned
+// map does not keep it open.
+func ReadBspFileFS(fsys fs.FS, name string) (BspFile, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return BspFile{}, err
+	}
+	return ReadBspFile(bytes.NewReader(data))
+}
@@ -0,0 +1,788 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+// Model is a brush model, model 0 is the world.
+type Model struct {
+	Mins      Vec3
+	Maxs      Vec3
+	Origin    Vec3
+	HeadNode  [4]int32
+	VisLeafs  int32
+	FirstFace int32
+	NumFaces  int32
+}
+
+// ReadLump returns the contents of a standard lump, converted to
+// little-endian for big-endian maps. A lump extending past the end of the
+// file is a FormatError.
+func ReadLump(bspFile *BspFile, r io.ReaderAt, lumpType LumpType) ([]byte, error) {
+	lump := bspFile.BspHeader.Lumps[lumpType]
+	buffer := make([]byte, lump.Length)
+	n, err := r.ReadAt(buffer, int64(lump.Offset))
+	if err == nil && n < len(buffer) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && !(err == io.EOF && n == len(buffer)) {
+		return nil, truncated(err, "%s lump extends past the end of the file", lumpType)
+	}
+	if bspFile.order() == binary.BigEndian {
+		buffer = swapLump(bspFile.BspHeader.Version, lumpType, buffer, binary.BigEndian)
+	}
+	return buffer, nil
+}
+
+// readLumpArray decodes a lump of fixed size records into the slice returned
+// by alloc for the number of records found.
+func readLumpArray(bspFile *BspFile, r io.ReaderAt, lumpType LumpType, recordSize int, alloc func(n int) interface{}) error {
+	lump := bspFile.BspHeader.Lumps[lumpType]
+	if int(lump.Length)%recordSize != 0 {
+		return formatErrorf("%s lump size %d is not a multiple of %d", lumpType, lump.Length, recordSize)
+	}
+	out := alloc(int(lump.Length) / recordSize)
+	err := binary.Read(io.NewSectionReader(r, int64(lump.Offset), int64(lump.Length)), bspFile.order(), out)
+	return truncated(err, "%s lump extends past the end of the file", lumpType)
+}
+
+// ReadModels decodes the models lump.
+func ReadModels(bspFile *BspFile, r io.ReaderAt) ([]Model, error) {
+	var models []Model
+	err := readLumpArray(bspFile, r, LumpModels, binary.Size(Model{}), func(n int) interface{} {
+		models = make([]Model, n)
+		return models
+	})
+	return models, err
+}
+
+// Contents is the contents value of a leaf or clipping hull leaf.
+type Contents int32
+
+const (
+	ContentsEmpty Contents = -1
+	ContentsSolid Contents = -2
+	ContentsWater Contents = -3
+	ContentsSlime Contents = -4
+	ContentsLava  Contents = -5
+	ContentsSky   Contents = -6
+)
+
+func (c Contents) String() string {
+	switch c {
+	case ContentsEmpty:
+		return "Empty"
+	case ContentsSolid:
+		return "Solid"
+	case ContentsWater:
+		return "Water"
+	case ContentsSlime:
+		return "Slime"
+	case ContentsLava:
+		return "Lava"
+	case ContentsSky:
+		return "Sky"
+	default:
+		return fmt.Sprintf("Unknown contents (%d)", int(c))
+	}
+}
+
+// ParseContents accepts the names printed by Contents.String, case
+// insensitively.
+func ParseContents(s string) (Contents, error) {
+	for c := ContentsSky; c <= ContentsEmpty; c++ {
+		if strings.EqualFold(s, c.String()) {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown contents %q, expected empty, solid, water, slime, lava or sky", s)
+}
+
+// Plane is a record of the planes lump, the same in all versions.
+type Plane struct {
+	Normal Vec3
+	Dist   float32
+	Type   int32
+}
+
+// Node, Leaf and ClipNode are the version independent in-memory forms of the
+// BSP29, 2PSB and BSP2 records.
+type Node struct {
+	PlaneId   int32
+	Children  [2]int32
+	Mins      Vec3
+	Maxs      Vec3
+	FirstFace uint32
+	NumFaces  uint32
+}
+
+// Leaf is a leaf of the hull 0 tree, decoded to the BSP2 layout.
+type Leaf struct {
+	Contents         Contents
+	VisOfs           int32
+	Mins             Vec3
+	Maxs             Vec3
+	FirstMarkSurface uint32
+	NumMarkSurfaces  uint32
+	Ambient          [4]uint8
+}
+
+// ClipNode is a node of the clipping hulls, decoded to the BSP2 layout.
+type ClipNode struct {
+	PlaneId  int32
+	Children [2]int32
+}
+
+type node29 struct {
+	PlaneId   int32
+	Children  [2]int16
+	Mins      [3]int16
+	Maxs      [3]int16
+	FirstFace uint16
+	NumFaces  uint16
+}
+
+type node2PSB struct {
+	PlaneId   int32
+	Children  [2]int32
+	Mins      [3]int16
+	Maxs      [3]int16
+	FirstFace uint32
+	NumFaces  uint32
+}
+
+type nodeV2 struct {
+	PlaneId   int32
+	Children  [2]int32
+	Mins      Vec3
+	Maxs      Vec3
+	FirstFace uint32
+	NumFaces  uint32
+}
+
+type leaf29 struct {
+	Contents         int32
+	VisOfs           int32
+	Mins             [3]int16
+	Maxs             [3]int16
+	FirstMarkSurface uint16
+	NumMarkSurfaces  uint16
+	Ambient          [4]uint8
+}
+
+type leaf2PSB struct {
+	Contents         int32
+	VisOfs           int32
+	Mins             [3]int16
+	Maxs             [3]int16
+	FirstMarkSurface uint32
+	NumMarkSurfaces  uint32
+	Ambient          [4]uint8
+}
+
+type leafV2 struct {
+	Contents         int32
+	VisOfs           int32
+	Mins             Vec3
+	Maxs             Vec3
+	FirstMarkSurface uint32
+	NumMarkSurfaces  uint32
+	Ambient          [4]uint8
+}
+
+type clipNode29 struct {
+	PlaneId  int32
+	Children [2]uint16
+}
+
+type clipNodeV2 struct {
+	PlaneId  int32
+	Children [2]int32
+}
+
+// IsLongFormat reports whether the version uses 32 bit indices for faces,
+// edges, marksurfaces and clipnodes.
+func (b BspVersion) IsLongFormat() bool {
+	return b == BspVersionBSP2 || b == BspVersion2PSB
+}
+
+func shortsToVec3(s [3]int16) Vec3 {
+	return Vec3{float32(s[0]), float32(s[1]), float32(s[2])}
+}
+
+// clipChild widens a BSP29 clipnode child. Values above 0xfff0 are contents,
+// anything else is an unsigned index so maps with more than 32k clipnodes
+// still resolve.
+func clipChild(c uint16) int32 {
+	if c > 0xfff0 {
+		return int32(int16(c))
+	}
+	return int32(c)
+}
+
+// ReadPlanes decodes the planes lump.
+func ReadPlanes(bspFile *BspFile, r io.ReaderAt) ([]Plane, error) {
+	var planes []Plane
+	err := readLumpArray(bspFile, r, LumpPlanes, binary.Size(Plane{}), func(n int) interface{} {
+		planes = make([]Plane, n)
+		return planes
+	})
+	return planes, err
+}
+
+// ReadNodes decodes the nodes lump of any version.
+func ReadNodes(bspFile *BspFile, r io.ReaderAt) ([]Node, error) {
+	var nodes []Node
+	var err error
+	switch bspFile.BspHeader.Version {
+	case BspVersionBSP2:
+		var raw []nodeV2
+		err = readLumpArray(bspFile, r, LumpNodes, binary.Size(nodeV2{}), func(n int) interface{} {
+			raw = make([]nodeV2, n)
+			return raw
+		})
+		for _, r := range raw {
+			nodes = append(nodes, Node(r))
+		}
+	case BspVersion2PSB:
+		var raw []node2PSB
+		err = readLumpArray(bspFile, r, LumpNodes, binary.Size(node2PSB{}), func(n int) interface{} {
+			raw = make([]node2PSB, n)
+			return raw
+		})
+		for _, r := range raw {
+			nodes = append(nodes, Node{r.PlaneId, r.Children, shortsToVec3(r.Mins), shortsToVec3(r.Maxs), r.FirstFace, r.NumFaces})
+		}
+	default:
+		var raw []node29
+		err = readLumpArray(bspFile, r, LumpNodes, binary.Size(node29{}), func(n int) interface{} {
+			raw = make([]node29, n)
+			return raw
+		})
+		for _, r := range raw {
+			children := [2]int32{int32(r.Children[0]), int32(r.Children[1])}
+			nodes = append(nodes, Node{r.PlaneId, children, shortsToVec3(r.Mins), shortsToVec3(r.Maxs), uint32(r.FirstFace), uint32(r.NumFaces)})
+		}
+	}
+	return nodes, err
+}
+
+// ReadLeafs decodes the leafs lump of any version.
+func ReadLeafs(bspFile *BspFile, r io.ReaderAt) ([]Leaf, error) {
+	var leafs []Leaf
+	var err error
+	switch bspFile.BspHeader.Version {
+	case BspVersionBSP2:
+		var raw []leafV2
+		err = readLumpArray(bspFile, r, LumpLeafs, binary.Size(leafV2{}), func(n int) interface{} {
+			raw = make([]leafV2, n)
+			return raw
+		})
+		for _, r := range raw {
+			leafs = append(leafs, Leaf{Contents(r.Contents), r.VisOfs, r.Mins, r.Maxs, r.FirstMarkSurface, r.NumMarkSurfaces, r.Ambient})
+		}
+	case BspVersion2PSB:
+		var raw []leaf2PSB
+		err = readLumpArray(bspFile, r, LumpLeafs, binary.Size(leaf2PSB{}), func(n int) interface{} {
+			raw = make([]leaf2PSB, n)
+			return raw
+		})
+		for _, r := range raw {
+			leafs = append(leafs, Leaf{Contents(r.Contents), r.VisOfs, shortsToVec3(r.Mins), shortsToVec3(r.Maxs), r.FirstMarkSurface, r.NumMarkSurfaces, r.Ambient})
+		}
+	default:
+		var raw []leaf29
+		err = readLumpArray(bspFile, r, LumpLeafs, binary.Size(leaf29{}), func(n int) interface{} {
+			raw = make([]leaf29, n)
+			return raw
+		})
+		for _, r := range raw {
+			leafs = append(leafs, Leaf{Contents(r.Contents), r.VisOfs, shortsToVec3(r.Mins), shortsToVec3(r.Maxs), uint32(r.FirstMarkSurface), uint32(r.NumMarkSurfaces), r.Ambient})
+		}
+	}
+	return leafs, err
+}
+
+// ReadClipNodes decodes the clipnodes lump of any version.
+func ReadClipNodes(bspFile *BspFile, r io.ReaderAt) ([]ClipNode, error) {
+	var clipNodes []ClipNode
+	var err error
+	if bspFile.BspHeader.Version.IsLongFormat() {
+		var raw []clipNodeV2
+		err = readLumpArray(bspFile, r, LumpClipnodes, binary.Size(clipNodeV2{}), func(n int) interface{} {
+			raw = make([]clipNodeV2, n)
+			return raw
+		})
+		for _, r := range raw {
+			clipNodes = append(clipNodes, ClipNode(r))
+		}
+	} else {
+		var raw []clipNode29
+		err = readLumpArray(bspFile, r, LumpClipnodes, binary.Size(clipNode29{}), func(n int) interface{} {
+			raw = make([]clipNode29, n)
+			return raw
+		})
+		for _, r := range raw {
+			clipNodes = append(clipNodes, ClipNode{r.PlaneId, [2]int32{clipChild(r.Children[0]), clipChild(r.Children[1])}})
+		}
+	}
+	return clipNodes, err
+}
+
+// LumpRecordSize returns the on-disk size of a single record of the given
+// lump, or 0 for lumps without fixed size records.
+func LumpRecordSize(version BspVersion, lumpType LumpType) int {
+	long := version.IsLongFormat()
+	switch lumpType {
+	case LumpPlanes:
+		return binary.Size(Plane{})
+	case LumpVertexes:
+		return binary.Size(Vec3{})
+	case LumpNodes:
+		switch version {
+		case BspVersionBSP2:
+			return binary.Size(nodeV2{})
+		case BspVersion2PSB:
+			return binary.Size(node2PSB{})
+		}
+		return binary.Size(node29{})
+	case LumpTexinfo:
+		return binary.Size(Texinfo{})
+	case LumpFaces:
+		if long {
+			return binary.Size(FaceV2{})
+		}
+		return binary.Size(Face{})
+	case LumpClipnodes:
+		if long {
+			return binary.Size(clipNodeV2{})
+		}
+		return binary.Size(clipNode29{})
+	case LumpLeafs:
+		switch version {
+		case BspVersionBSP2:
+			return binary.Size(leafV2{})
+		case BspVersion2PSB:
+			return binary.Size(leaf2PSB{})
+		}
+		return binary.Size(leaf29{})
+	case LumpMarksurfaces:
+		if long {
+			return 4
+		}
+		return 2
+	case LumpEdges:
+		if long {
+			return 8
+		}
+		return 4
+	case LumpSurfedges:
+		return 4
+	case LumpModels:
+		return binary.Size(Model{})
+	}
+	return 0
+}
+
+// StructureProblem is a lump of a map that can't be read as it is.
+type StructureProblem struct {
+	// Check is "bounds" for lumps extending past the end of the file and
+	// "records" for lumps not holding whole records.
+	Check   string
+	Message string
+}
+
+// CheckStructure returns the lumps, BSPX lumps and BSPX directory of a file
+// of fileSize bytes extending past its end, and the standard lumps whose
+// length is not a multiple of their record size.
+func CheckStructure(bspFile *BspFile, fileSize int64) []StructureProblem {
+	var problems []StructureProblem
+	for i, lump := range bspFile.BspHeader.Lumps {
+		lumpType := LumpType(i)
+		if int64(lump.Offset)+int64(lump.Length) > fileSize {
+			problems = append(problems, StructureProblem{"bounds", fmt.Sprintf("%s lump extends past end of file", lumpType)})
+			continue
+		}
+		size := LumpRecordSize(bspFile.BspHeader.Version, lumpType)
+		if size > 0 && int(lump.Length)%size != 0 {
+			problems = append(problems, StructureProblem{"records", fmt.Sprintf("%s lump size %d is not a multiple of %d", lumpType, lump.Length, size)})
+		}
+	}
+	if n := len(bspFile.BspXLumps); n > 0 && bspFile.BspXOffset+int64(8+BspXLumpHeaderSize*n) > fileSize {
+		problems = append(problems, StructureProblem{"bounds", "BSPX directory extends past end of file"})
+	}
+	for _, xlump := range bspFile.BspXLumps {
+		if int64(xlump.Offset)+int64(xlump.Length) > fileSize {
+			problems = append(problems, StructureProblem{"bounds", fmt.Sprintf("BSPX lump %s extends past end of file", BytesToString(xlump.LumpName[:]))})
+		}
+	}
+	return problems
+}
+
+// PointLeaf walks the hull 0 node tree from headNode and returns the index of
+// the leaf containing p.
+func PointLeaf(nodes []Node, planes []Plane, headNode int32, p Vec3) int {
+	num := headNode
+	for num >= 0 {
+		if int(num) >= len(nodes) {
+			return 0
+		}
+		node := &nodes[num]
+		if node.PlaneId < 0 || int(node.PlaneId) >= len(planes) {
+			return 0
+		}
+		if planes[node.PlaneId].Distance(p) < 0 {
+			num = node.Children[1]
+		} else {
+			num = node.Children[0]
+		}
+	}
+	return int(-1 - num)
+}
+
+// HullPointContents walks a clipping hull (hull 1 and up) and returns the
+// contents at p.
+func HullPointContents(clipNodes []ClipNode, planes []Plane, headNode int32, p Vec3) Contents {
+	num := headNode
+	for num >= 0 {
+		if int(num) >= len(clipNodes) {
+			return ContentsSolid
+		}
+		node := &clipNodes[num]
+		if node.PlaneId < 0 || int(node.PlaneId) >= len(planes) {
+			return ContentsSolid
+		}
+		if planes[node.PlaneId].Distance(p) < 0 {
+			num = node.Children[1]
+		} else {
+			num = node.Children[0]
+		}
+	}
+	return Contents(num)
+}
+
+// Distance returns the signed distance of v from the plane.
+func (p Plane) Distance(v Vec3) float32 {
+	return p.Normal.Dot(v) - p.Dist
+}
+
+// ReadVertexes decodes the vertexes lump.
+func ReadVertexes(bspFile *BspFile, r io.ReaderAt) ([]Vec3, error) {
+	var vertexes []Vec3
+	err := readLumpArray(bspFile, r, LumpVertexes, binary.Size(Vec3{}), func(n int) interface{} {
+		vertexes = make([]Vec3, n)
+		return vertexes
+	})
+	return vertexes, err
+}
+
+// ReadEdges returns the vertex index pairs of the edges lump widened to 32
+// bits.
+func ReadEdges(bspFile *BspFile, r io.ReaderAt) ([][2]uint32, error) {
+	var edges [][2]uint32
+	if bspFile.BspHeader.Version.IsLongFormat() {
+		err := readLumpArray(bspFile, r, LumpEdges, 8, func(n int) interface{} {
+			edges = make([][2]uint32, n)
+			return edges
+		})
+		return edges, err
+	}
+
+	var raw [][2]uint16
+	err := readLumpArray(bspFile, r, LumpEdges, 4, func(n int) interface{} {
+		raw = make([][2]uint16, n)
+		return raw
+	})
+	for _, r := range raw {
+		edges = append(edges, [2]uint32{uint32(r[0]), uint32(r[1])})
+	}
+	return edges, err
+}
+
+// ReadSurfedges decodes the surfedges lump.
+func ReadSurfedges(bspFile *BspFile, r io.ReaderAt) ([]int32, error) {
+	var surfedges []int32
+	err := readLumpArray(bspFile, r, LumpSurfedges, 4, func(n int) interface{} {
+		surfedges = make([]int32, n)
+		return surfedges
+	})
+	return surfedges, err
+}
+
+// ReadFaces returns the faces lump, widening BSP29 faces to the BSP2 layout.
+func ReadFaces(bspFile *BspFile, r io.ReaderAt) ([]FaceV2, error) {
+	var faces []FaceV2
+	if bspFile.BspHeader.Version.IsLongFormat() {
+		err := readLumpArray(bspFile, r, LumpFaces, binary.Size(FaceV2{}), func(n int) interface{} {
+			faces = make([]FaceV2, n)
+			return faces
+		})
+		return faces, err
+	}
+
+	var raw []Face
+	err := readLumpArray(bspFile, r, LumpFaces, binary.Size(Face{}), func(n int) interface{} {
+		raw = make([]Face, n)
+		return raw
+	})
+	for _, r := range raw {
+		faces = append(faces, FaceV2{
+			PlaneId:   uint32(r.PlaneId),
+			Side:      uint32(r.Side),
+			LedgeId:   r.LedgeId,
+			LedgeNum:  uint32(r.LedgeNum),
+			TexinfoId: uint32(r.TexinfoId),
+			TypeLight: r.TypeLight,
+			BaseLight: r.BaseLight,
+			Light:     r.Light,
+			Lightmap:  r.Lightmap,
+		})
+	}
+	return faces, err
+}
+
+// SurfedgeEdge returns the index of the edge a surfedge refers to, negative
+// surfedges walking it from its second vertex, and false if the edge is not
+// one of numEdges. -2147483648 has no positive counterpart and is never valid.
+func SurfedgeEdge(surfedge int32, numEdges int) (int, bool) {
+	if surfedge == math.MinInt32 {
+		return 0, false
+	}
+	edge := int(surfedge)
+	if edge < 0 {
+		edge = -edge
+	}
+	if edge >= numEdges {
+		return 0, false
+	}
+	return edge, true
+}
+
+// FaceWinding resolves the surfedges of a face into its vertex positions.
+func FaceWinding(face *FaceV2, edges [][2]uint32, surfedges []int32, vertexes []Vec3) []Vec3 {
+	var winding []Vec3
+	for i := uint32(0); i < face.LedgeNum; i++ {
+		index := int(face.LedgeId + i)
+		if index >= len(surfedges) {
+			break
+		}
+		edge, ok := SurfedgeEdge(surfedges[index], len(edges))
+		if !ok {
+			break
+		}
+		vertex := edges[edge][0]
+		if surfedges[index] < 0 {
+			vertex = edges[edge][1]
+		}
+		if int(vertex) >= len(vertexes) {
+			break
+		}
+		winding = append(winding, vertexes[vertex])
+	}
+	return winding
+}
+
+// Texinfo is a texture projection record.
+type Texinfo struct {
+	Vecs   [2]Vec4
+	MipTex int32
+	Flags  int32
+}
+
+// ReadTexinfo decodes the texinfo lump.
+func ReadTexinfo(bspFile *BspFile, r io.ReaderAt) ([]Texinfo, error) {
+	var texinfo []Texinfo
+	err := readLumpArray(bspFile, r, LumpTexinfo, binary.Size(Texinfo{}), func(n int) interface{} {
+		texinfo = make([]Texinfo, n)
+		return texinfo
+	})
+	return texinfo, err
+}
+
+// ReadMarksurfaces returns the marksurfaces lump widened to 32 bits.
+func ReadMarksurfaces(bspFile *BspFile, r io.ReaderAt) ([]uint32, error) {
+	var marksurfaces []uint32
+	if bspFile.BspHeader.Version.IsLongFormat() {
+		err := readLumpArray(bspFile, r, LumpMarksurfaces, 4, func(n int) interface{} {
+			marksurfaces = make([]uint32, n)
+			return marksurfaces
+		})
+		return marksurfaces, err
+	}
+
+	var raw []uint16
+	err := readLumpArray(bspFile, r, LumpMarksurfaces, 2, func(n int) interface{} {
+		raw = make([]uint16, n)
+		return raw
+	})
+	for _, r := range raw {
+		marksurfaces = append(marksurfaces, uint32(r))
+	}
+	return marksurfaces, err
+}
+
+// EncodeRecords serializes a slice of fixed size records in little endian.
+// It panics if records can't be encoded by binary.Write.
+//
+// Deprecated: Use the encoder of the lump, such as EncodePlanes or
+// EncodeDecoupledLM, which handle the format differences between versions.
+func EncodeRecords(records interface{}) []byte {
+	return encodeRecords(records)
+}
+
+// encodeRecords serializes a slice of fixed size records in little endian.
+// It is only called with the record types of this package, which
+// binary.Write always encodes into a buffer.
+func encodeRecords(records interface{}) []byte {
+	var buffer bytes.Buffer
+	err := binary.Write(&buffer, binary.LittleEndian, records)
+	if err != nil {
+		panic(err)
+	}
+	return buffer.Bytes()
+}
+
+// vec3ToShorts converts a bounding box to the 16 bit form used by BSP29 and
+// 2PSB, rounding outwards so the box never shrinks.
+func vec3ToShorts(mins, maxs Vec3) ([3]int16, [3]int16) {
+	var smins, smaxs [3]int16
+	for i := 0; i < 3; i++ {
+		smins[i] = int16(math.Max(math.Floor(float64(mins[i])), math.MinInt16))
+		smaxs[i] = int16(math.Min(math.Ceil(float64(maxs[i])), math.MaxInt16))
+	}
+	return smins, smaxs
+}
+
+func EncodeModels(models []Model) []byte {
+	return encodeRecords(models)
+}
+
+func EncodePlanes(planes []Plane) []byte {
+	return encodeRecords(planes)
+}
+
+func EncodeVertexes(vertexes []Vec3) []byte {
+	return encodeRecords(vertexes)
+}
+
+func EncodeTexinfo(texinfo []Texinfo) []byte {
+	return encodeRecords(texinfo)
+}
+
+func EncodeSurfedges(surfedges []int32) []byte {
+	return encodeRecords(surfedges)
+}
+
+func EncodeNodes(version BspVersion, nodes []Node) []byte {
+	switch version {
+	case BspVersionBSP2:
+		raw := make([]nodeV2, len(nodes))
+		for i, n := range nodes {
+			raw[i] = nodeV2(n)
+		}
+		return encodeRecords(raw)
+	case BspVersion2PSB:
+		raw := make([]node2PSB, len(nodes))
+		for i, n := range nodes {
+			mins, maxs := vec3ToShorts(n.Mins, n.Maxs)
+			raw[i] = node2PSB{n.PlaneId, n.Children, mins, maxs, n.FirstFace, n.NumFaces}
+		}
+		return encodeRecords(raw)
+	default:
+		raw := make([]node29, len(nodes))
+		for i, n := range nodes {
+			mins, maxs := vec3ToShorts(n.Mins, n.Maxs)
+			children := [2]int16{int16(n.Children[0]), int16(n.Children[1])}
+			raw[i] = node29{n.PlaneId, children, mins, maxs, uint16(n.FirstFace), uint16(n.NumFaces)}
+		}
+		return encodeRecords(raw)
+	}
+}
+
+func EncodeLeafs(version BspVersion, leafs []Leaf) []byte {
+	switch version {
+	case BspVersionBSP2:
+		raw := make([]leafV2, len(leafs))
+		for i, l := range leafs {
+			raw[i] = leafV2{int32(l.Contents), l.VisOfs, l.Mins, l.Maxs, l.FirstMarkSurface, l.NumMarkSurfaces, l.Ambient}
+		}
+		return encodeRecords(raw)
+	case BspVersion2PSB:
+		raw := make([]leaf2PSB, len(leafs))
+		for i, l := range leafs {
+			mins, maxs := vec3ToShorts(l.Mins, l.Maxs)
+			raw[i] = leaf2PSB{int32(l.Contents), l.VisOfs, mins, maxs, l.FirstMarkSurface, l.NumMarkSurfaces, l.Ambient}
+		}
+		return encodeRecords(raw)
+	default:
+		raw := make([]leaf29, len(leafs))
+		for i, l := range leafs {
+			mins, maxs := vec3ToShorts(l.Mins, l.Maxs)
+			raw[i] = leaf29{int32(l.Contents), l.VisOfs, mins, maxs, uint16(l.FirstMarkSurface), uint16(l.NumMarkSurfaces), l.Ambient}
+		}
+		return encodeRecords(raw)
+	}
+}
+
+func EncodeClipNodes(version BspVersion, clipNodes []ClipNode) []byte {
+	if version.IsLongFormat() {
+		raw := make([]clipNodeV2, len(clipNodes))
+		for i, c := range clipNodes {
+			raw[i] = clipNodeV2(c)
+		}
+		return encodeRecords(raw)
+	}
+	raw := make([]clipNode29, len(clipNodes))
+	for i, c := range clipNodes {
+		raw[i] = clipNode29{c.PlaneId, [2]uint16{uint16(c.Children[0]), uint16(c.Children[1])}}
+	}
+	return encodeRecords(raw)
+}
+
+func EncodeEdges(version BspVersion, edges [][2]uint32) []byte {
+	if version.IsLongFormat() {
+		return encodeRecords(edges)
+	}
+	raw := make([][2]uint16, len(edges))
+	for i, e := range edges {
+		raw[i] = [2]uint16{uint16(e[0]), uint16(e[1])}
+	}
+	return encodeRecords(raw)
+}
+
+func EncodeMarksurfaces(version BspVersion, marksurfaces []uint32) []byte {
+	if version.IsLongFormat() {
+		return encodeRecords(marksurfaces)
+	}
+	raw := make([]uint16, len(marksurfaces))
+	for i, m := range marksurfaces {
+		raw[i] = uint16(m)
+	}
+	return encodeRecords(raw)
+}
+
+func EncodeFaces(version BspVersion, faces []FaceV2) []byte {
+	if version.IsLongFormat() {
+		return encodeRecords(faces)
+	}
+	raw := make([]Face, len(faces))
+	for i, f := range faces {
+		raw[i] = Face{
+			PlaneId:   uint16(f.PlaneId),
+			Side:      uint16(f.Side),
+			LedgeId:   f.LedgeId,
+			LedgeNum:  uint16(f.LedgeNum),
+			TexinfoId: uint16(f.TexinfoId),
+			TypeLight: f.TypeLight,
+			BaseLight: f.BaseLight,
+			Light:     f.Light,
+			Lightmap:  f.Lightmap,
+		}
+	}
+	return encodeRecords(raw)
+}
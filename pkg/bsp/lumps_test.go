@@ -0,0 +1,78 @@
+package bsp
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestCheckStructure(t *testing.T) {
+	data := testMap(t)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := CheckStructure(&bspFile, int64(len(data))); len(problems) != 0 {
+		t.Errorf("valid map has problems: %v", problems)
+	}
+
+	problems := CheckStructure(&bspFile, int64(len(data)-1))
+	if len(problems) != 1 || problems[0].Check != "bounds" {
+		t.Errorf("truncated entities lump reported as %v", problems)
+	}
+
+	bspFile.BspHeader.Lumps[LumpPlanes].Length = 7
+	problems = CheckStructure(&bspFile, int64(len(data)))
+	if len(problems) != 1 || problems[0].Check != "records" {
+		t.Errorf("partial plane reported as %v", problems)
+	}
+}
+
+func TestSurfedgeEdge(t *testing.T) {
+	for _, test := range []struct {
+		surfedge int32
+		edge     int
+		ok       bool
+	}{
+		{0, 0, true},
+		{3, 3, true},
+		{-3, 3, true},
+		{4, 0, false},
+		{-4, 0, false},
+		{math.MinInt32, 0, false},
+	} {
+		edge, ok := SurfedgeEdge(test.surfedge, 4)
+		if edge != test.edge || ok != test.ok {
+			t.Errorf("SurfedgeEdge(%d, 4) = %d, %v, expected %d, %v", test.surfedge, edge, ok, test.edge, test.ok)
+		}
+	}
+}
+
+func TestFaceWindingInvalidSurfedge(t *testing.T) {
+	vertexes := []Vec3{{0, 0, 0}, {1, 0, 0}, {1, 1, 0}}
+	edges := [][2]uint32{{0, 0}, {0, 1}, {1, 2}, {2, 0}}
+	face := FaceV2{LedgeNum: 3}
+	if winding := FaceWinding(&face, edges, []int32{1, 2, 3}, vertexes); len(winding) != 3 {
+		t.Errorf("winding has %d vertexes, expected 3", len(winding))
+	}
+	if winding := FaceWinding(&face, edges, []int32{1, math.MinInt32, 3}, vertexes); len(winding) != 1 {
+		t.Errorf("winding has %d vertexes, expected 1 before the invalid surfedge", len(winding))
+	}
+}
+
+func TestReadLumpTruncated(t *testing.T) {
+	data := testMap(t)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadLump(&bspFile, bytes.NewReader(data), LumpEntities); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadLump(&bspFile, bytes.NewReader(data[:len(data)-1]), LumpEntities)
+	var formatErr *FormatError
+	if !errors.As(err, &formatErr) {
+		t.Errorf("truncated lump read with error %v, expected a FormatError", err)
+	}
+}
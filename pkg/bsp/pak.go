@@ -0,0 +1,154 @@
+package bsp
+
+import (
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pakHeader starts a Quake .pak archive.
+type pakHeader struct {
+	Id        [4]byte
+	DirOffset int32
+	DirLength int32
+}
+
+// pakEntry is an entry of the .pak directory.
+type pakEntry struct {
+	Name   [56]byte
+	Offset int32
+	Length int32
+}
+
+// Pak is a Quake .pak archive opened with OpenPak. It implements fs.FS, so
+// maps inside it can be read with ReadBspFileFS.
+type Pak struct {
+	r     io.ReaderAt
+	files map[string]pakEntry
+	dirs  map[string][]fs.DirEntry
+}
+
+// OpenPak reads the directory of the .pak archive in r.
+func OpenPak(r io.ReaderAt) (*Pak, error) {
+	var header pakHeader
+	err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(header))), binary.LittleEndian, &header)
+	if err != nil {
+		return nil, truncated(err, "pak header truncated")
+	}
+	if string(header.Id[:]) != "PACK" {
+		return nil, formatErrorf("not a pak file")
+	}
+	entrySize := binary.Size(pakEntry{})
+	if header.DirOffset < 0 || header.DirLength < 0 || int(header.DirLength)%entrySize != 0 {
+		return nil, formatErrorf("invalid pak directory")
+	}
+
+	entries := make([]pakEntry, int(header.DirLength)/entrySize)
+	err = binary.Read(io.NewSectionReader(r, int64(header.DirOffset), int64(header.DirLength)), binary.LittleEndian, entries)
+	if err != nil {
+		return nil, truncated(err, "pak directory truncated")
+	}
+
+	pak := &Pak{r: r, files: map[string]pakEntry{}, dirs: map[string][]fs.DirEntry{".": nil}}
+	for _, entry := range entries {
+		name := path.Clean(strings.TrimLeft(strings.ReplaceAll(BytesToString(entry.Name[:]), "\\", "/"), "/"))
+		if !fs.ValidPath(name) || name == "." || entry.Offset < 0 || entry.Length < 0 {
+			continue
+		}
+		if _, found := pak.files[name]; found {
+			continue
+		}
+		pak.files[name] = entry
+		pak.addDirEntry(name, pakFileInfo{name: path.Base(name), size: int64(entry.Length)})
+	}
+	for _, children := range pak.dirs {
+		sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	}
+	return pak, nil
+}
+
+// addDirEntry adds name to its parent directory, creating the parents as
+// needed.
+func (p *Pak) addDirEntry(name string, info pakFileInfo) {
+	dir := path.Dir(name)
+	if _, found := p.dirs[dir]; !found {
+		p.addDirEntry(dir, pakFileInfo{name: path.Base(dir), dir: true})
+	}
+	p.dirs[dir] = append(p.dirs[dir], fs.FileInfoToDirEntry(info))
+}
+
+// Open opens a file or directory of the archive.
+func (p *Pak) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if entry, found := p.files[name]; found {
+		return &pakFile{
+			SectionReader: io.NewSectionReader(p.r, int64(entry.Offset), int64(entry.Length)),
+			info:          pakFileInfo{name: path.Base(name), size: int64(entry.Length)},
+		}, nil
+	}
+	if children, found := p.dirs[name]; found {
+		return &pakDir{info: pakFileInfo{name: path.Base(name), dir: true}, entries: children}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+type pakFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i pakFileInfo) Name() string       { return i.name }
+func (i pakFileInfo) Size() int64        { return i.size }
+func (i pakFileInfo) ModTime() time.Time { return time.Time{} }
+func (i pakFileInfo) IsDir() bool        { return i.dir }
+func (i pakFileInfo) Sys() interface{}   { return nil }
+
+func (i pakFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// pakFile is a file inside a pak, it implements io.ReaderAt and io.Seeker.
+type pakFile struct {
+	*io.SectionReader
+	info pakFileInfo
+}
+
+func (f *pakFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *pakFile) Close() error               { return nil }
+
+type pakDir struct {
+	info    pakFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *pakDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *pakDir) Close() error               { return nil }
+
+func (d *pakDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: fs.ErrInvalid}
+}
+
+func (d *pakDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	entries := d.entries[d.offset:]
+	if n > 0 {
+		if len(entries) == 0 {
+			return nil, io.EOF
+		}
+		if n < len(entries) {
+			entries = entries[:n]
+		}
+	}
+	d.offset += len(entries)
+	return entries, nil
+}
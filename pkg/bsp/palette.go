@@ -0,0 +1,176 @@
+package bsp
+
+import (
+	"image"
+	"image/color"
+)
+
+// FullbrightStart is the first palette index engines draw at full
+// brightness regardless of lighting.
+const FullbrightStart = 224
+
+// TransparentIndex is the palette index alpha masked ({) textures leave
+// see-through.
+const TransparentIndex = 255
+
+// quakePalette is the palette.lmp of Quake, 256 RGB triples.
+var quakePalette = [256 * 3]byte{
+	0, 0, 0, 15, 15, 15, 31, 31, 31, 47, 47, 47, 63, 63, 63, 75, 75, 75, 91, 91, 91, 107, 107, 107,
+	123, 123, 123, 139, 139, 139, 155, 155, 155, 171, 171, 171, 187, 187, 187, 203, 203, 203, 219, 219, 219, 235, 235, 235,
+	15, 11, 7, 23, 15, 11, 31, 23, 11, 39, 27, 15, 47, 35, 19, 55, 43, 23, 63, 47, 23, 75, 55, 27,
+	83, 59, 27, 91, 67, 31, 99, 75, 31, 107, 83, 31, 115, 87, 31, 123, 95, 35, 131, 103, 35, 143, 111, 35,
+	11, 11, 15, 19, 19, 27, 27, 27, 39, 39, 39, 51, 47, 47, 63, 55, 55, 75, 63, 63, 87, 71, 71, 103,
+	79, 79, 115, 91, 91, 127, 99, 99, 139, 107, 107, 151, 115, 115, 163, 123, 123, 175, 131, 131, 187, 139, 139, 203,
+	0, 0, 0, 7, 7, 0, 11, 11, 0, 19, 19, 0, 27, 27, 0, 35, 35, 0, 43, 43, 7, 47, 47, 7,
+	55, 55, 7, 63, 63, 7, 71, 71, 7, 75, 75, 11, 83, 83, 11, 91, 91, 11, 99, 99, 11, 107, 107, 15,
+	7, 0, 0, 15, 0, 0, 23, 0, 0, 31, 0, 0, 39, 0, 0, 47, 0, 0, 55, 0, 0, 63, 0, 0,
+	71, 0, 0, 79, 0, 0, 87, 0, 0, 95, 0, 0, 103, 0, 0, 111, 0, 0, 119, 0, 0, 127, 0, 0,
+	19, 19, 0, 27, 27, 0, 35, 35, 0, 47, 43, 0, 55, 47, 0, 67, 55, 0, 75, 59, 7, 87, 67, 7,
+	95, 71, 7, 107, 75, 11, 119, 83, 15, 131, 87, 19, 139, 91, 19, 151, 95, 27, 163, 99, 31, 175, 103, 35,
+	35, 19, 7, 47, 23, 11, 59, 31, 15, 75, 35, 19, 87, 43, 23, 99, 47, 31, 115, 55, 35, 127, 59, 43,
+	143, 67, 51, 159, 79, 51, 175, 99, 47, 191, 119, 47, 207, 143, 43, 223, 171, 39, 239, 203, 31, 255, 243, 27,
+	11, 7, 0, 27, 19, 0, 43, 35, 15, 55, 43, 19, 71, 51, 27, 83, 55, 35, 99, 63, 43, 111, 71, 51,
+	127, 83, 63, 139, 95, 71, 155, 107, 83, 167, 123, 95, 183, 135, 107, 195, 147, 123, 211, 163, 139, 227, 179, 151,
+	171, 139, 163, 159, 127, 151, 147, 115, 135, 139, 103, 123, 127, 91, 111, 119, 83, 99, 107, 75, 87, 95, 63, 75,
+	87, 55, 67, 75, 47, 55, 67, 39, 47, 55, 31, 35, 43, 23, 27, 35, 19, 19, 23, 11, 11, 15, 7, 7,
+	187, 115, 159, 175, 107, 143, 163, 95, 131, 151, 87, 119, 139, 79, 107, 127, 75, 95, 115, 67, 83, 107, 59, 75,
+	95, 51, 63, 83, 43, 55, 71, 35, 43, 59, 31, 35, 47, 23, 27, 35, 19, 19, 23, 11, 11, 15, 7, 7,
+	219, 195, 187, 203, 179, 167, 191, 163, 155, 175, 151, 139, 163, 135, 123, 151, 123, 111, 135, 111, 95, 123, 99, 83,
+	107, 87, 71, 95, 75, 59, 83, 63, 51, 67, 51, 39, 55, 43, 31, 39, 31, 23, 27, 19, 15, 15, 11, 7,
+	111, 131, 123, 103, 123, 111, 95, 115, 103, 87, 107, 95, 79, 99, 87, 71, 91, 79, 63, 83, 71, 55, 75, 63,
+	47, 67, 55, 43, 59, 47, 35, 51, 39, 31, 43, 31, 23, 35, 23, 15, 27, 19, 11, 19, 11, 7, 11, 7,
+	255, 243, 27, 239, 223, 23, 219, 203, 19, 203, 183, 15, 187, 167, 15, 171, 151, 11, 155, 131, 7, 139, 115, 7,
+	123, 99, 7, 107, 83, 0, 91, 71, 0, 75, 55, 0, 59, 43, 0, 43, 31, 0, 27, 15, 0, 11, 7, 0,
+	0, 0, 255, 11, 11, 239, 19, 19, 223, 27, 27, 207, 35, 35, 191, 43, 43, 175, 47, 47, 159, 47, 47, 143,
+	47, 47, 127, 47, 47, 111, 47, 47, 95, 43, 43, 79, 35, 35, 63, 27, 27, 47, 19, 19, 31, 11, 11, 15,
+	43, 0, 0, 59, 0, 0, 75, 7, 0, 95, 7, 0, 111, 15, 0, 127, 23, 7, 147, 31, 7, 163, 39, 11,
+	183, 51, 15, 195, 75, 27, 207, 99, 43, 219, 127, 59, 227, 151, 79, 231, 171, 95, 239, 191, 119, 247, 211, 139,
+	167, 123, 59, 183, 155, 55, 199, 195, 55, 231, 227, 87, 127, 191, 255, 171, 231, 255, 215, 255, 255, 103, 0, 0,
+	139, 0, 0, 179, 0, 0, 215, 0, 0, 255, 0, 0, 255, 243, 147, 255, 247, 199, 255, 255, 255, 159, 91, 83,
+}
+
+// QuakePalette returns the palette of Quake.
+func QuakePalette() color.Palette {
+	palette, _ := ParsePalette(quakePalette[:])
+	return palette
+}
+
+// ParsePalette decodes a palette.lmp, 256 RGB triples.
+func ParsePalette(data []byte) (color.Palette, error) {
+	if len(data) != 256*3 {
+		return nil, formatErrorf("palette has %d bytes, expected 768", len(data))
+	}
+	palette := make(color.Palette, 256)
+	for i := range palette {
+		palette[i] = color.RGBA{data[3*i], data[3*i+1], data[3*i+2], 255}
+	}
+	return palette, nil
+}
+
+// MipLevel returns the pixels of one mip level of an embedded texture, level
+// 0 being the full size, together with the width and height of that level.
+func (t *TextureEntry) MipLevel(level int) ([]byte, int, int) {
+	if level < 0 || level > 3 || len(t.Pixels) == 0 {
+		return nil, 0, 0
+	}
+	width, height := int(t.MipTex.Width), int(t.MipTex.Height)
+	start := 0
+	for i := 0; i < level; i++ {
+		start += (width >> i) * (height >> i)
+	}
+	w, h := width>>level, height>>level
+	if start+w*h > len(t.Pixels) {
+		return nil, 0, 0
+	}
+	return t.Pixels[start : start+w*h], w, h
+}
+
+// TextureImage returns a mip level of an embedded texture as an image using
+// palette. The transparent index of alpha masked textures has alpha 0.
+func TextureImage(t *TextureEntry, level int, palette color.Palette) *image.Paletted {
+	pixels, w, h := t.MipLevel(level)
+	if pixels == nil {
+		return nil
+	}
+	if TextureClass(t.Name()) == "{" {
+		palette = append(color.Palette(nil), palette...)
+		palette[TransparentIndex] = color.RGBA{}
+	}
+	img := image.NewPaletted(image.Rect(0, 0, w, h), palette)
+	copy(img.Pix, pixels)
+	return img
+}
+
+// HasFullbrights reports whether a mip level of a texture uses a fullbright
+// palette index.
+func HasFullbrights(t *TextureEntry, level int) bool {
+	pixels, _, _ := t.MipLevel(level)
+	transparent := TextureClass(t.Name()) == "{"
+	for _, index := range pixels {
+		if index >= FullbrightStart && !(transparent && index == TransparentIndex) {
+			return true
+		}
+	}
+	return false
+}
+
+// nearestColor returns the index of the colour among the first colors
+// entries of palette closest to c.
+func nearestColor(palette color.Palette, colors int, c color.RGBA) byte {
+	best, bestDistance := 0, -1
+	for i := 0; i < colors && i < len(palette); i++ {
+		r, g, b, _ := palette[i].RGBA()
+		dr, dg, db := int(r>>8)-int(c.R), int(g>>8)-int(c.G), int(b>>8)-int(c.B)
+		distance := dr*dr + dg*dg + db*db
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = i, distance
+		}
+	}
+	return byte(best)
+}
+
+// QuantizeTexture converts img to the four mip levels of a texture, each
+// pixel the nearest of the first colors entries of palette. The smaller
+// levels average blocks of the image before quantizing. With masked, for
+// alpha masked ({) textures, pixels and blocks that are mostly see-through
+// become the transparent index. The width and height of img must be
+// multiples of 8.
+func QuantizeTexture(img image.Image, palette color.Palette, colors int, masked bool) []byte {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	pixels := make([]byte, 0, MipDataSize(uint32(width), uint32(height)))
+	if masked && colors > TransparentIndex {
+		colors = TransparentIndex
+	}
+	nearest := map[color.RGBA]byte{}
+	for level := 0; level < 4; level++ {
+		step := 1 << level
+		for y := 0; y+step <= height; y += step {
+			for x := 0; x+step <= width; x += step {
+				var r, g, b, opaque int
+				for dy := 0; dy < step; dy++ {
+					for dx := 0; dx < step; dx++ {
+						c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x+dx, bounds.Min.Y+y+dy)).(color.NRGBA)
+						if masked && c.A < 128 {
+							continue
+						}
+						r, g, b = r+int(c.R), g+int(c.G), b+int(c.B)
+						opaque++
+					}
+				}
+				if masked && 2*opaque <= step*step {
+					pixels = append(pixels, TransparentIndex)
+					continue
+				}
+				c := color.RGBA{uint8(r / opaque), uint8(g / opaque), uint8(b / opaque), 255}
+				index, found := nearest[c]
+				if !found {
+					index = nearestColor(palette, colors, c)
+					nearest[c] = index
+				}
+				pixels = append(pixels, index)
+			}
+		}
+	}
+	return pixels
+}
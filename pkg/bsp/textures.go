@@ -0,0 +1,157 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+)
+
+type MipTex struct {
+	Name    [16]byte
+	Width   uint32
+	Height  uint32
+	Offsets [4]uint32
+}
+
+const MipTexHeaderSize = 16 + 4 + 4 + 4*4
+
+// TextureEntry is one slot of the textures lump offset table. Offset is
+// relative to the lump start and -1 for missing textures. Pixels holds all
+// four mip levels when the texture is embedded, and is empty otherwise.
+type TextureEntry struct {
+	Offset int32
+	MipTex MipTex
+	Pixels []byte
+}
+
+func (t *TextureEntry) Name() string {
+	return BytesToString(t.MipTex.Name[:])
+}
+
+func (t *TextureEntry) Missing() bool {
+	return t.Offset < 0
+}
+
+// MipDataSize returns the size of all four mip levels of a w x h texture.
+func MipDataSize(width, height uint32) int {
+	return int(width*height + (width/2)*(height/2) + (width/4)*(height/4) + (width/8)*(height/8))
+}
+
+// ParseTextureLump decodes the miptex directory and headers of a textures
+// lump.
+func ParseTextureLump(data []byte) ([]TextureEntry, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < 4 {
+		return nil, formatErrorf("textures lump too short")
+	}
+
+	count := binary.LittleEndian.Uint32(data)
+	if 4+int64(count)*4 > int64(len(data)) {
+		return nil, formatErrorf("textures lump offset table exceeds lump size")
+	}
+
+	entries := make([]TextureEntry, count)
+	for i := range entries {
+		offset := binary.LittleEndian.Uint32(data[4+4*i:])
+		if offset == math.MaxUint32 {
+			entries[i].Offset = -1
+			continue
+		}
+		if int64(offset)+MipTexHeaderSize > int64(len(data)) {
+			return nil, formatErrorf("texture %d at offset %d exceeds lump size", i, offset)
+		}
+		entries[i].Offset = int32(offset)
+
+		err := binary.Read(bytes.NewReader(data[offset:offset+MipTexHeaderSize]), binary.LittleEndian, &entries[i].MipTex)
+		if err != nil {
+			return nil, err
+		}
+
+		mipTex := &entries[i].MipTex
+		if mipTex.Offsets[0] == 0 {
+			continue
+		}
+		start := int64(offset) + int64(mipTex.Offsets[0])
+		end := start + int64(MipDataSize(mipTex.Width, mipTex.Height))
+		if end > int64(len(data)) {
+			return nil, formatErrorf("texture %q pixel data exceeds lump size", entries[i].Name())
+		}
+		entries[i].Pixels = data[start:end]
+	}
+	return entries, nil
+}
+
+// TextureClass returns the name prefix engines attach behaviour to: animation
+// frames (+0..+9, +a..+j), warping liquids (*), sky and alpha masked ({)
+// textures. Plain textures return "".
+func TextureClass(name string) string {
+	switch {
+	case strings.HasPrefix(name, "+") && len(name) > 1:
+		return name[:2]
+	case strings.HasPrefix(name, "*"):
+		return "*"
+	case strings.HasPrefix(name, "sky"):
+		return "sky"
+	case strings.HasPrefix(name, "{"):
+		return "{"
+	}
+	return ""
+}
+
+// EncodeTextureLump builds a textures lump from entries, laying out each
+// embedded texture as header followed by its four mip levels.
+func EncodeTextureLump(entries []TextureEntry) []byte {
+	return EncodeSharedTextureLump(entries, nil)
+}
+
+// EncodeSharedTextureLump builds a textures lump like EncodeTextureLump,
+// except that a slot i with shared[i] != i points at the miptex written for
+// the earlier slot shared[i] instead of a copy of its own. A nil shared
+// shares nothing.
+func EncodeSharedTextureLump(entries []TextureEntry, shared []int) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, uint32(len(entries)))
+
+	offsets := make([]int, len(entries))
+	offset := 4 + 4*len(entries)
+	for i := range entries {
+		if entries[i].Missing() {
+			binary.Write(&buffer, binary.LittleEndian, uint32(math.MaxUint32))
+			continue
+		}
+		if shared != nil && shared[i] < i {
+			offsets[i] = offsets[shared[i]]
+		} else {
+			offsets[i] = offset
+			offset += MipTexHeaderSize + len(entries[i].Pixels)
+		}
+		binary.Write(&buffer, binary.LittleEndian, uint32(offsets[i]))
+	}
+
+	for i := range entries {
+		if !entries[i].Missing() && (shared == nil || shared[i] >= i) {
+			writeMipTex(&buffer, &entries[i])
+		}
+	}
+	return buffer.Bytes()
+}
+
+// writeMipTex writes the header of a texture followed by its four mip
+// levels, with the mip offsets pointing right behind the header, or 0 if the
+// texture has no pixels.
+func writeMipTex(buffer *bytes.Buffer, entry *TextureEntry) {
+	mipTex := entry.MipTex
+	mipTex.Offsets = [4]uint32{}
+	if len(entry.Pixels) > 0 {
+		w, h := mipTex.Width, mipTex.Height
+		mipTex.Offsets[0] = MipTexHeaderSize
+		mipTex.Offsets[1] = mipTex.Offsets[0] + w*h
+		mipTex.Offsets[2] = mipTex.Offsets[1] + (w/2)*(h/2)
+		mipTex.Offsets[3] = mipTex.Offsets[2] + (w/4)*(h/4)
+	}
+	binary.Write(buffer, binary.LittleEndian, mipTex)
+	buffer.Write(entry.Pixels)
+}
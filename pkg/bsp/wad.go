@@ -0,0 +1,120 @@
+package bsp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// WadTypeMipTex is the lump type of miptex textures in WAD2 files.
+const WadTypeMipTex = 'D'
+
+// wadHeader starts a WAD2 file.
+type wadHeader struct {
+	Id              [4]byte
+	NumLumps        int32
+	InfoTableOffset int32
+}
+
+// wadEntry is an entry of the WAD2 directory.
+type wadEntry struct {
+	FilePos     int32
+	DiskSize    int32
+	Size        int32
+	Type        byte
+	Compression byte
+	Pad         [2]byte
+	Name        [16]byte
+}
+
+// ReadWadTextures reads the miptex lumps of the WAD2 file in r, in directory
+// order. Lumps of other types, such as the palette and status bar pictures of
+// gfx.wad, are skipped.
+func ReadWadTextures(r io.ReaderAt) ([]TextureEntry, error) {
+	var header wadHeader
+	err := binary.Read(io.NewSectionReader(r, 0, int64(binary.Size(header))), binary.LittleEndian, &header)
+	if err != nil {
+		return nil, truncated(err, "wad header truncated")
+	}
+	if string(header.Id[:]) != "WAD2" {
+		return nil, formatErrorf("not a WAD2 file")
+	}
+	if header.NumLumps < 0 || header.InfoTableOffset < 0 {
+		return nil, formatErrorf("invalid wad directory")
+	}
+
+	entries := make([]wadEntry, header.NumLumps)
+	entrySize := int64(binary.Size(wadEntry{}))
+	err = binary.Read(io.NewSectionReader(r, int64(header.InfoTableOffset), int64(header.NumLumps)*entrySize), binary.LittleEndian, entries)
+	if err != nil {
+		return nil, truncated(err, "wad directory truncated")
+	}
+
+	var textures []TextureEntry
+	for _, entry := range entries {
+		if entry.Type != WadTypeMipTex {
+			continue
+		}
+		name := BytesToString(entry.Name[:])
+		if entry.Compression != 0 {
+			return nil, formatErrorf("wad lump %s is compressed", name)
+		}
+		if entry.FilePos < 0 || entry.DiskSize < MipTexHeaderSize {
+			return nil, formatErrorf("wad lump %s is invalid", name)
+		}
+		data := make([]byte, entry.DiskSize)
+		n, err := r.ReadAt(data, int64(entry.FilePos))
+		if n < len(data) {
+			return nil, truncated(err, "wad lump %s truncated", name)
+		}
+
+		var texture TextureEntry
+		err = binary.Read(bytes.NewReader(data), binary.LittleEndian, &texture.MipTex)
+		if err != nil {
+			return nil, err
+		}
+		if texture.MipTex.Offsets[0] != 0 {
+			start := int64(texture.MipTex.Offsets[0])
+			end := start + int64(MipDataSize(texture.MipTex.Width, texture.MipTex.Height))
+			if end > int64(len(data)) {
+				return nil, formatErrorf("wad lump %s pixel data exceeds lump size", name)
+			}
+			texture.Pixels = data[start:end]
+		}
+		textures = append(textures, texture)
+	}
+	return textures, nil
+}
+
+// WriteWad writes textures as a WAD2 file of miptex lumps, the format map
+// editors and compilers read textures from.
+func WriteWad(w io.Writer, textures []TextureEntry) error {
+	var data bytes.Buffer
+	entries := make([]wadEntry, 0, len(textures))
+	headerSize := binary.Size(wadHeader{})
+	for i := range textures {
+		start := data.Len()
+		writeMipTex(&data, &textures[i])
+		entry := wadEntry{
+			FilePos:  int32(headerSize + start),
+			DiskSize: int32(data.Len() - start),
+			Size:     int32(data.Len() - start),
+			Type:     WadTypeMipTex,
+		}
+		entry.Name = textures[i].MipTex.Name
+		entries = append(entries, entry)
+	}
+
+	header := wadHeader{
+		Id:              [4]byte{'W', 'A', 'D', '2'},
+		NumLumps:        int32(len(entries)),
+		InfoTableOffset: int32(headerSize + data.Len()),
+	}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data.Bytes()); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, entries)
+}
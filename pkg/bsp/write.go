@@ -0,0 +1,323 @@
+package bsp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// readBspXLumps returns the contents of all BSPX lumps in the order of the
+// map.
+func readBspXLumps(bspFile *BspFile, r io.ReaderAt) (*BspXLumps, error) {
+	bspx := &BspXLumps{}
+	for _, xlump := range bspFile.BspXLumps {
+		var buffer = make([]byte, xlump.Length)
+		_, err := r.ReadAt(buffer, int64(xlump.Offset))
+		if err != nil {
+			return nil, truncated(err, "BSPX lump %s extends past the end of the file", BytesToString(xlump.LumpName[:]))
+		}
+		bspx.set(xlump.LumpName, buffer)
+	}
+	return bspx, nil
+}
+
+// WriteBSPXTo writes the map read from r to w, copying the standard lumps as
+// they are and adding the BSPX lumps handler leaves in the lumps passed to it,
+// in their order.
+// An error returned by handler is passed on and nothing is written after it.
+func WriteBSPXTo(w io.Writer, bspFile *BspFile, r io.ReaderAt, handler func(lumps *BspXLumps) error) error {
+	err := copyRange(w, r, 0, bspFile.BspXOffset, "standard lumps")
+	if err != nil {
+		return err
+	}
+
+	bspx, err := readBspXLumps(bspFile, r)
+	if err != nil {
+		return err
+	}
+
+	err = handler(bspx)
+	if err != nil {
+		return err
+	}
+
+	return writeBspXPayloads(w, bspFile.BspXOffset, bspFile.order(), 0, nil, bspx.payloads())
+}
+
+// WriteBSPX writes the map to destName like WriteBSPXTo. The file is only
+// created once the new map is complete.
+func WriteBSPX(bspFile *BspFile, r io.ReaderAt, destName string, handler func(lumps *BspXLumps) error) error {
+	return WriteBSPXContext(context.Background(), bspFile, r, destName, handler)
+}
+
+// WriteBSPXContext is WriteBSPX stopping with ctx.Err() once ctx is done,
+// in which case destName is left untouched.
+func WriteBSPXContext(ctx context.Context, bspFile *BspFile, r io.ReaderAt, destName string, handler func(lumps *BspXLumps) error) error {
+	return writeFile(ctx, destName, func(w io.Writer) error {
+		return WriteBSPXTo(w, bspFile, r, handler)
+	})
+}
+
+// StreamBSPXTo writes the map read from r to w like WriteBSPXTo, without
+// reading every BSPX lump into memory. handler edits a lazily opened
+// document, only the lumps it reads or sets are held in memory and all others
+// are copied from r. The BSPX lumps keep their order, new ones are appended.
+// Standard lumps are copied as they are, use RewriteBsp to change them.
+func StreamBSPXTo(w io.Writer, bspFile *BspFile, r io.ReaderAt, handler func(doc *Document) error) error {
+	source := *bspFile
+	source.r = r
+	doc := openDocument(&source)
+	err := handler(doc)
+	if err != nil {
+		return err
+	}
+	for i, changed := range doc.changed {
+		if changed {
+			return fmt.Errorf("%s lump changed while streaming BSPX lumps", LumpType(i))
+		}
+	}
+
+	err = copyRange(w, r, 0, bspFile.BspXOffset, "standard lumps")
+	if err != nil {
+		return err
+	}
+	return writeBspXPayloads(w, bspFile.BspXOffset, bspFile.order(), doc.BspXAlignment, r, doc.bspxPayloads())
+}
+
+// StreamBSPX writes the map to destName like StreamBSPXTo. The file is only
+// created once the new map is complete.
+func StreamBSPX(bspFile *BspFile, r io.ReaderAt, destName string, handler func(doc *Document) error) error {
+	return StreamBSPXContext(context.Background(), bspFile, r, destName, handler)
+}
+
+// StreamBSPXContext is StreamBSPX stopping with ctx.Err() once ctx is done,
+// in which case destName is left untouched.
+func StreamBSPXContext(ctx context.Context, bspFile *BspFile, r io.ReaderAt, destName string, handler func(doc *Document) error) error {
+	return writeFile(ctx, destName, func(w io.Writer) error {
+		return StreamBSPXTo(w, bspFile, r, handler)
+	})
+}
+
+// RenameBspXLumpTo writes the map read from r to w with every BSPX lump named
+// from renamed to to. Only the directory entries change, all other bytes are
+// copied as they are.
+func RenameBspXLumpTo(w io.Writer, bspFile *BspFile, r io.ReaderAt, from string, to string) error {
+	if to == "" || len(to) > len(BspXLump{}.LumpName) {
+		return fmt.Errorf("BSPX lump name %q must be 1 to %d bytes long", to, len(BspXLump{}.LumpName))
+	}
+	if FindBspXLump(bspFile, from) == nil {
+		return fmt.Errorf("no BSPX lump %s", from)
+	}
+	if from != to && FindBspXLump(bspFile, to) != nil {
+		return fmt.Errorf("BSPX lump %s exists already", to)
+	}
+
+	offset := int64(0)
+	for i, xlump := range bspFile.BspXLumps {
+		if BytesToString(xlump.LumpName[:]) != from {
+			continue
+		}
+		entry := bspFile.BspXOffset + 8 + int64(i*BspXLumpHeaderSize)
+		if err := copyRange(w, r, offset, entry-offset, "lumps"); err != nil {
+			return err
+		}
+		lumpName := LumpName(to)
+		if _, err := w.Write(lumpName[:]); err != nil {
+			return err
+		}
+		offset = entry + int64(len(lumpName))
+	}
+	_, err := io.Copy(w, io.NewSectionReader(r, offset, math.MaxInt64-offset))
+	return err
+}
+
+// RenameBspXLumpContext writes the map to destName like RenameBspXLumpTo,
+// stopping with ctx.Err() once ctx is done, in which case destName is left
+// untouched.
+func RenameBspXLumpContext(ctx context.Context, bspFile *BspFile, r io.ReaderAt, destName string, from string, to string) error {
+	return writeFile(ctx, destName, func(w io.Writer) error {
+		return RenameBspXLumpTo(w, bspFile, r, from, to)
+	})
+}
+
+// TruncateContext writes the first length bytes of the map read from r to
+// destName, stopping with ctx.Err() once ctx is done, in which case destName
+// is left untouched.
+func TruncateContext(ctx context.Context, r io.ReaderAt, length int64, destName string) error {
+	return writeFile(ctx, destName, func(w io.Writer) error {
+		return copyRange(w, r, 0, length, "map")
+	})
+}
+
+// copyRange copies length bytes at offset in r to w.
+func copyRange(w io.Writer, r io.ReaderAt, offset int64, length int64, what string) error {
+	written, err := io.CopyN(w, io.NewSectionReader(r, offset, length), length)
+	if err == io.EOF {
+		return formatErrorf("could not copy %s, %d of %d bytes", what, written, length)
+	}
+	return err
+}
+
+// contextWriter fails writes once ctx is done.
+type contextWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (c contextWriter) Write(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.w.Write(p)
+}
+
+// writeFile writes a new file through write to a temporary file next to
+// destName and renames it into place, so destName is never left half
+// written. The temporary file is removed again on errors and when ctx is
+// done.
+func writeFile(ctx context.Context, destName string, write func(w io.Writer) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tmpName := destName + ".tmp"
+	out, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	buffered := bufio.NewWriter(out)
+	err = write(contextWriter{ctx, buffered})
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(tmpName, destName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// bspxPayload is a BSPX lump to write, held in memory or copied from source.
+type bspxPayload struct {
+	name   [24]byte
+	data   []byte
+	source *BspXLump
+}
+
+func (p bspxPayload) length() uint32 {
+	if p.source != nil {
+		return p.source.Length
+	}
+	return uint32(len(p.data))
+}
+
+// writeBspXPayloads appends a BSPX header, directory and lump data to w,
+// which offset bytes have been written to already, padding to 4 bytes first.
+// The header and directory are encoded with order, each payload starts at a
+// multiple of alignment if above 1 and lumps with a source are copied from r.
+// Nothing is written when there are no lumps.
+func writeBspXPayloads(w io.Writer, offset int64, order binary.ByteOrder, alignment int, r io.ReaderAt, payloads []bspxPayload) error {
+	if len(payloads) == 0 {
+		return nil
+	}
+
+	if padding := (4 - offset%4) % 4; padding != 0 {
+		if _, err := w.Write(make([]byte, padding)); err != nil {
+			return err
+		}
+		offset += padding
+	}
+
+	header := BspXHeader{Id: [4]byte{'B', 'S', 'P', 'X'}, NumLumps: int32(len(payloads))}
+	if err := binary.Write(w, order, header); err != nil {
+		return err
+	}
+
+	offset += int64(8 + BspXLumpHeaderSize*len(payloads))
+	start := offset
+
+	xlumps := make([]BspXLump, len(payloads))
+	for i, payload := range payloads {
+		if alignment > 1 {
+			offset += (int64(alignment) - offset%int64(alignment)) % int64(alignment)
+		}
+		xlumps[i] = BspXLump{
+			LumpName: payload.name,
+			Offset:   uint32(offset),
+			Length:   payload.length(),
+		}
+		offset += int64(xlumps[i].Length)
+	}
+	if err := binary.Write(w, order, xlumps); err != nil {
+		return err
+	}
+
+	offset = start
+	for i, payload := range payloads {
+		if padding := int64(xlumps[i].Offset) - offset; padding != 0 {
+			if _, err := w.Write(make([]byte, padding)); err != nil {
+				return err
+			}
+		}
+		offset = int64(xlumps[i].Offset) + int64(xlumps[i].Length)
+
+		var err error
+		if payload.source != nil {
+			err = copyRange(w, r, int64(payload.source.Offset), int64(payload.source.Length), "BSPX lump "+BytesToString(payload.name[:]))
+		} else {
+			_, err = w.Write(payload.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RewriteBspTo writes a copy of the map read from r to w with a recomputed
+// lump directory. handler may replace any of the standard lumps and edit the
+// BSPX lumps, or return an error to abort. See Document for editing a map
+// without a handler.
+func RewriteBspTo(w io.Writer, bspFile *BspFile, r io.ReaderAt, handler func(lumps *[LumpTotal][]byte, bspx *BspXLumps) error) error {
+	doc, err := loadDocument(bspFile, r)
+	if err != nil {
+		return err
+	}
+
+	err = handler(&doc.Lumps, &doc.BspX)
+	if err != nil {
+		return err
+	}
+
+	_, err = doc.WriteTo(w)
+	return err
+}
+
+// RewriteBsp writes the rewritten map to destName like RewriteBspTo. The file
+// is only created once the new map is complete.
+func RewriteBsp(bspFile *BspFile, r io.ReaderAt, destName string, handler func(lumps *[LumpTotal][]byte, bspx *BspXLumps) error) error {
+	return RewriteBspContext(context.Background(), bspFile, r, destName, handler)
+}
+
+// RewriteBspContext is RewriteBsp stopping with ctx.Err() once ctx is done,
+// in which case destName is left untouched.
+func RewriteBspContext(ctx context.Context, bspFile *BspFile, r io.ReaderAt, destName string, handler func(lumps *[LumpTotal][]byte, bspx *BspXLumps) error) error {
+	return writeFile(ctx, destName, func(w io.Writer) error {
+		return RewriteBspTo(w, bspFile, r, handler)
+	})
+}
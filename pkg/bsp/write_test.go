@@ -0,0 +1,90 @@
+package bsp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStreamBSPXTo(t *testing.T) {
+	data := testMap(t)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = StreamBSPXTo(&out, &bspFile, bytes.NewReader(data), func(doc *Document) error {
+		doc.SetBspXLump("LMSHIFT", []byte{4})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(out.Bytes(), data) {
+		t.Error("standard lumps not copied as they are")
+	}
+
+	streamed, err := ReadBspFile(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lump, err := ReadBspXLump(&streamed, bytes.NewReader(out.Bytes()), "LMSHIFT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(lump, []byte{4}) {
+		t.Errorf("LMSHIFT read back as %v", lump)
+	}
+}
+
+func TestStreamBSPXToRejectsStandardLumps(t *testing.T) {
+	data := testMap(t)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = StreamBSPXTo(&bytes.Buffer{}, &bspFile, bytes.NewReader(data), func(doc *Document) error {
+		doc.SetLump(LumpEntities, []byte("{\n}\n\x00"))
+		return nil
+	})
+	if err == nil {
+		t.Error("changing a standard lump while streaming succeeded")
+	}
+}
+
+func TestRewriteBspTo(t *testing.T) {
+	data := testMap(t)
+	bspFile, err := ReadBspFile(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entities := []byte("{\n\"classname\" \"worldspawn\"\n\"message\" \"rewritten\"\n}\n\x00")
+	var out bytes.Buffer
+	err = RewriteBspTo(&out, &bspFile, bytes.NewReader(data), func(lumps *[LumpTotal][]byte, bspx *BspXLumps) error {
+		lumps[LumpEntities] = entities
+		bspx.Set("RGBLIGHTING", []byte("rgb"))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := LoadDocument(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(doc.Lumps[LumpEntities], entities) {
+		t.Errorf("entities read back as %q", doc.Lumps[LumpEntities])
+	}
+	if lump, _ := doc.BspX.Get("RGBLIGHTING"); string(lump) != "rgb" {
+		t.Errorf("RGBLIGHTING read back as %q", lump)
+	}
+	rewritten, err := ReadBspFile(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := CheckStructure(&rewritten, int64(out.Len())); len(problems) != 0 {
+		t.Errorf("rewritten map has problems: %v", problems)
+	}
+}
@@ -0,0 +1,155 @@
+// Package bspxmgr provides the commands of the bspxmgr tool as functions
+// taking option structs, for build tools driving them from Go. The command
+// line tool is a thin wrapper around them.
+//
+// The module is versioned with vX.Y.Z tags. From v1.0.0 on, exported names of
+// this package and of package bsp are only added within a major version,
+// never removed or changed, so tools built against v1.x keep compiling with
+// every later v1.x. Names marked deprecated stay until the next major version.
+package bspxmgr
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// DefaultOutput returns the name new maps are written to when no output is
+// given, <map>.new.bsp next to the map.
+func DefaultOutput(mapPath string) string {
+	basename := strings.TrimSuffix(mapPath, filepath.Ext(mapPath))
+	return fmt.Sprintf("%s.new.bsp", basename)
+}
+
+// SetLumpOptions configures SetLump.
+type SetLumpOptions struct {
+	Map    string
+	Lump   string
+	Data   []byte
+	Output string // DefaultOutput(Map) if empty
+}
+
+// SetLump writes a copy of the map with the BSPX lump added or replaced and
+// returns the name of the new map.
+func SetLump(ctx context.Context, opts SetLumpOptions, options ...Option) (string, error) {
+	return streamBSPX(ctx, opts.Map, opts.Output, newSettings(options), func(doc *bsp.Document) error {
+		doc.SetBspXLump(opts.Lump, opts.Data)
+		return nil
+	})
+}
+
+// UnsetLumpOptions configures UnsetLump.
+type UnsetLumpOptions struct {
+	Map    string
+	Lump   string
+	Output string // DefaultOutput(Map) if empty
+}
+
+// UnsetLump writes a copy of the map without the BSPX lump and returns the
+// name of the new map.
+func UnsetLump(ctx context.Context, opts UnsetLumpOptions, options ...Option) (string, error) {
+	return streamBSPX(ctx, opts.Map, opts.Output, newSettings(options), func(doc *bsp.Document) error {
+		doc.DeleteBspXLump(opts.Lump)
+		return nil
+	})
+}
+
+// LumpEdit adds or replaces the BSPX lump Lump with Data, or removes it if
+// Unset is set.
+type LumpEdit struct {
+	Lump  string
+	Data  []byte
+	Unset bool
+}
+
+// EditLumpsOptions configures EditLumps.
+type EditLumpsOptions struct {
+	Map    string
+	Edits  []LumpEdit
+	Output string // DefaultOutput(Map) if empty
+}
+
+// EditLumps writes a copy of the map with the edits applied in order and
+// returns the name of the new map, rewriting the map once for any number of
+// lumps.
+func EditLumps(ctx context.Context, opts EditLumpsOptions, options ...Option) (string, error) {
+	return streamBSPX(ctx, opts.Map, opts.Output, newSettings(options), func(doc *bsp.Document) error {
+		for _, edit := range opts.Edits {
+			if edit.Unset {
+				doc.DeleteBspXLump(edit.Lump)
+			} else {
+				doc.SetBspXLump(edit.Lump, edit.Data)
+			}
+		}
+		return nil
+	})
+}
+
+func streamBSPX(ctx context.Context, mapPath string, output string, s settings, handler func(doc *bsp.Document) error) (string, error) {
+	f, bspFile, err := openMap(mapPath, s)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if output == "" {
+		output = DefaultOutput(mapPath)
+	}
+	return output, bsp.StreamBSPXContext(ctx, bspFile, f, output, func(doc *bsp.Document) error {
+		doc.BspXAlignment = s.alignment
+		return handler(doc)
+	})
+}
+
+// PrintOptions configures Print.
+type PrintOptions struct {
+	Map string
+}
+
+// Print writes the version and the standard and BSPX lump directories of a
+// map to w.
+func Print(w io.Writer, opts PrintOptions) error {
+	f, err := os.Open(opts.Map)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", opts.Map, err)
+	}
+	return PrintListing(w, opts.Map, &bspFile)
+}
+
+// PrintListing writes the listing Print shows for a map already read.
+func PrintListing(w io.Writer, name string, bspFile *bsp.BspFile) error {
+	fmt.Fprintln(w, "Filename:", path.Base(name))
+	fmt.Fprintln(w, " Version:", bspFile.BspHeader.Version)
+	if bspFile.ByteOrder == binary.BigEndian {
+		fmt.Fprintln(w, "  Endian: big")
+	}
+	fmt.Fprintln(w, "   Lumps:")
+
+	for i, lump := range bspFile.BspHeader.Lumps {
+		fmt.Fprintf(w, "     %-24s %8.1f kB @ %8d ofs\n", bsp.LumpType(i), float64(lump.Length)/1024.0, lump.Offset)
+	}
+
+	if len(bspFile.BspXLumps) > 0 {
+		fmt.Fprintf(w, "  XLumps:                                 @ %8d ofs\n", bspFile.BspXOffset)
+
+		for _, xlump := range bspFile.BspXLumps {
+			fmt.Fprintf(w, "     %-24s %8.1f kB @ %8d ofs\n", bsp.BytesToString(xlump.LumpName[:]), float64(xlump.Length)/1024, xlump.Offset)
+		}
+	}
+
+	_, err := fmt.Fprintln(w, "")
+	return err
+}
@@ -0,0 +1,225 @@
+package bspxmgr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest lists the operations Apply performs on a map, in order.
+type Manifest struct {
+	Operations []ManifestOperation `json:"operations" yaml:"operations"`
+}
+
+// ManifestOperation is one step of a manifest, Op selects the fields used:
+//
+//	set     Lump, Path  add or replace a BSPX lump with the file at Path
+//	unset   Lump        remove a BSPX lump if present
+//	rename  Lump, To    rename a BSPX lump
+//	entity  Match, Set, Delete
+//	                    set and delete keys of every entity whose values
+//	                    equal all of Match, at least one must match
+type ManifestOperation struct {
+	Op     string            `json:"op" yaml:"op"`
+	Lump   string            `json:"lump,omitempty" yaml:"lump,omitempty"`
+	Path   string            `json:"path,omitempty" yaml:"path,omitempty"`
+	To     string            `json:"to,omitempty" yaml:"to,omitempty"`
+	Match  map[string]string `json:"match,omitempty" yaml:"match,omitempty"`
+	Set    map[string]string `json:"set,omitempty" yaml:"set,omitempty"`
+	Delete []string          `json:"delete,omitempty" yaml:"delete,omitempty"`
+}
+
+// check returns what is missing for the operation to be applied.
+func (o *ManifestOperation) check() error {
+	switch o.Op {
+	case "set":
+		if o.Lump == "" || o.Path == "" {
+			return fmt.Errorf("set needs lump and path")
+		}
+	case "unset":
+		if o.Lump == "" {
+			return fmt.Errorf("unset needs lump")
+		}
+	case "rename":
+		if o.Lump == "" || o.To == "" {
+			return fmt.Errorf("rename needs lump and to")
+		}
+	case "entity":
+		if len(o.Match) == 0 {
+			return fmt.Errorf("entity needs match")
+		}
+		if len(o.Set) == 0 && len(o.Delete) == 0 {
+			return fmt.Errorf("entity needs set or delete")
+		}
+		keys := make([]string, 0, len(o.Set))
+		for key := range o.Set {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if err := bsp.CheckKeyValue(key, o.Set[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown op %q", o.Op)
+	}
+	return nil
+}
+
+// matches reports whether the entity has all key/value pairs of Match.
+func (o *ManifestOperation) matches(entity *bsp.Entity) bool {
+	for key, value := range o.Match {
+		if !entity.Has(key) || entity.Get(key) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadManifest reads a manifest and checks its operations, as YAML if the
+// file name ends in .yaml or .yml and as JSON otherwise. Relative paths of set
+// operations are resolved against the directory of the manifest.
+func ReadManifest(manifestPath string) (*Manifest, error) {
+	f, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var manifest Manifest
+	switch strings.ToLower(filepath.Ext(manifestPath)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		err = decoder.Decode(&manifest)
+	default:
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&manifest)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", manifestPath, err)
+	}
+	for i := range manifest.Operations {
+		operation := &manifest.Operations[i]
+		if err := operation.check(); err != nil {
+			return nil, fmt.Errorf("%s: operation %d: %w", manifestPath, i+1, err)
+		}
+		if operation.Path != "" && !filepath.IsAbs(operation.Path) {
+			operation.Path = filepath.Join(filepath.Dir(manifestPath), operation.Path)
+		}
+	}
+	return &manifest, nil
+}
+
+// ApplyOptions configures Apply.
+type ApplyOptions struct {
+	Map      string
+	Manifest *Manifest
+	Output   string // DefaultOutput(Map) if empty
+}
+
+// Apply writes a copy of the map with all operations of the manifest applied
+// and returns the name of the new map. If any operation fails nothing is
+// written.
+func Apply(ctx context.Context, opts ApplyOptions, options ...Option) (string, error) {
+	operations := opts.Manifest.Operations
+	data := make([][]byte, len(operations))
+	for i, operation := range operations {
+		if err := operation.check(); err != nil {
+			return "", fmt.Errorf("operation %d: %w", i+1, err)
+		}
+		if operation.Op != "set" {
+			continue
+		}
+		buffer, err := os.ReadFile(operation.Path)
+		if err != nil {
+			return "", fmt.Errorf("operation %d: %w", i+1, err)
+		}
+		data[i] = buffer
+	}
+
+	s := newSettings(options)
+	f, _, err := openMap(opts.Map, s)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	doc, err := bsp.OpenDocument(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", opts.Map, err)
+	}
+	doc.BspXAlignment = s.alignment
+
+	var entities []bsp.Entity
+	for i, operation := range operations {
+		var err error
+		switch operation.Op {
+		case "set":
+			doc.SetBspXLump(operation.Lump, data[i])
+		case "unset":
+			doc.DeleteBspXLump(operation.Lump)
+		case "rename":
+			err = doc.RenameBspXLump(operation.Lump, operation.To)
+		case "entity":
+			if entities == nil {
+				entities, err = doc.Entities()
+				if err != nil {
+					break
+				}
+			}
+			err = applyEntityOperation(entities, &operation)
+		}
+		if err != nil {
+			return "", fmt.Errorf("operation %d: %w", i+1, err)
+		}
+	}
+	if entities != nil {
+		err := doc.SetEntities(entities)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	output := opts.Output
+	if output == "" {
+		output = DefaultOutput(opts.Map)
+	}
+	return output, doc.WriteFileContext(ctx, output)
+}
+
+// applyEntityOperation edits the entities matching the operation. Keys are
+// set in sorted order so the written entities lump is the same on every run.
+func applyEntityOperation(entities []bsp.Entity, operation *ManifestOperation) error {
+	keys := make([]string, 0, len(operation.Set))
+	for key := range operation.Set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	matched := 0
+	for i := range entities {
+		if !operation.matches(&entities[i]) {
+			continue
+		}
+		matched++
+		for _, key := range keys {
+			entities[i].Set(key, operation.Set[key])
+		}
+		for _, key := range operation.Delete {
+			entities[i].Delete(key)
+		}
+	}
+	if matched == 0 {
+		return fmt.Errorf("no entity matches %v", operation.Match)
+	}
+	return nil
+}
@@ -0,0 +1,335 @@
+package bspxmgr
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// ObfuscationMarkerLump is written by Obfuscate and records the seed and a
+// hash of the name mapping, so already scrambled maps are not scrambled again.
+const ObfuscationMarkerLump = "BSPXMGR_OBFUSCATED"
+
+// ObfuscationPolicy is what Obfuscate changes in a map.
+type ObfuscationPolicy struct {
+	Textures       bool
+	ScramblePixels bool
+	Targetnames    bool
+	Seed           int64
+	Exclude        []string // lower case glob patterns of textures to keep
+	Mapping        string   // file the name mapping is written to, if set
+}
+
+// Excluded reports whether a texture is left untouched by the policy.
+func (p *ObfuscationPolicy) Excluded(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range p.Exclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ResolveSeed turns a seed source into a seed: "time", "map" for a seed
+// derived from the map contents, or a number.
+func ResolveSeed(source string, mapPath string) (int64, error) {
+	switch source {
+	case "", "time":
+		return time.Now().UnixNano(), nil
+	case "map":
+		f, err := os.Open(mapPath)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return 0, err
+		}
+		return int64(binary.LittleEndian.Uint64(hash.Sum(nil))), nil
+	}
+	seed, err := strconv.ParseInt(source, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid seed source %q, expected time, map or a number", source)
+	}
+	return seed, nil
+}
+
+// AlreadyObfuscatedError is returned by Obfuscate for maps carrying an
+// obfuscation marker.
+type AlreadyObfuscatedError struct {
+	Map    string
+	Marker string
+}
+
+func (e *AlreadyObfuscatedError) Error() string {
+	return "refusing to obfuscate an already obfuscated map"
+}
+
+// ObfuscateOptions configures Obfuscate.
+type ObfuscateOptions struct {
+	Map    string
+	Output string // DefaultOutput(Map) if empty
+	Policy ObfuscationPolicy
+	// Log receives every texture rename, nil to discard them.
+	Log func(format string, a ...interface{})
+}
+
+// Obfuscate writes a copy of the map with textures and entity names
+// scrambled according to the policy and returns the name of the new map.
+// Maps obfuscated before are refused with an AlreadyObfuscatedError.
+func Obfuscate(ctx context.Context, opts ObfuscateOptions, options ...Option) (string, error) {
+	s := newSettings(options)
+	f, bspFile, err := openMap(opts.Map, s)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	marker, err := bspFile.BspXLump(ObfuscationMarkerLump)
+	if err != nil {
+		return "", err
+	}
+	if marker != nil {
+		return "", &AlreadyObfuscatedError{opts.Map, string(marker)}
+	}
+
+	o := &obfuscator{
+		policy:       &opts.Policy,
+		rng:          rand.New(rand.NewSource(opts.Policy.Seed)),
+		animSuffixes: map[string]string{},
+		log:          opts.Log,
+	}
+	if o.log == nil {
+		o.log = func(string, ...interface{}) {}
+	}
+
+	mapping := sha256.New()
+	o.mapping = mapping
+	if opts.Policy.Mapping != "" {
+		mappingFile, err := os.Create(opts.Policy.Mapping)
+		if err != nil {
+			return "", err
+		}
+		defer mappingFile.Close()
+		o.mapping = io.MultiWriter(mapping, mappingFile)
+	}
+
+	output := opts.Output
+	if output == "" {
+		output = DefaultOutput(opts.Map)
+	}
+	doc, err := bsp.LoadDocument(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", opts.Map, err)
+	}
+	doc.BspXAlignment = s.alignment
+
+	err = o.textureLump(doc.Lumps[bsp.LumpTextures])
+	if err != nil {
+		return "", err
+	}
+	if opts.Policy.Targetnames {
+		entities, err := doc.Entities()
+		if err != nil {
+			return "", err
+		}
+		o.targetnames(entities)
+		err = doc.SetEntities(entities)
+		if err != nil {
+			return "", err
+		}
+	}
+	marker = []byte(fmt.Sprintf("seed=%d\nmapping=%x\n", opts.Policy.Seed, mapping.Sum(nil)))
+	doc.SetBspXLump(ObfuscationMarkerLump, marker)
+	return output, doc.WriteFileContext(ctx, output)
+}
+
+// obfuscator holds the state of one Obfuscate run.
+type obfuscator struct {
+	policy       *ObfuscationPolicy
+	rng          *rand.Rand
+	animSuffixes map[string]string
+	mapping      io.Writer
+	log          func(format string, a ...interface{})
+}
+
+// scramblePixels nudges a few texels of every mip level to the neighbouring
+// shade of the same palette ramp, so texture data no longer matches known
+// hashes while looking the same in game. Fullbright colours and the
+// transparent index are left alone.
+func (o *obfuscator) scramblePixels(lump []byte, offset uint32) {
+	if int(offset)+40 > len(lump) {
+		return
+	}
+	width := binary.LittleEndian.Uint32(lump[offset+16:])
+	height := binary.LittleEndian.Uint32(lump[offset+20:])
+	for level := uint32(0); level < 4; level++ {
+		mipOffset := binary.LittleEndian.Uint32(lump[offset+24+4*level:])
+		size := uint64(width>>level) * uint64(height>>level)
+		start := uint64(offset) + uint64(mipOffset)
+		if mipOffset == 0 || start+size > uint64(len(lump)) {
+			continue
+		}
+		for i := start; i < start+size; i++ {
+			if lump[i] < 224 && o.rng.Intn(32) == 0 {
+				lump[i] ^= 1
+			}
+		}
+	}
+}
+
+// textureLump renames and scrambles the textures of a texture lump in place,
+// writing "old => new" lines to the mapping.
+func (o *obfuscator) textureLump(lump []byte) error {
+	if len(lump) < 4 {
+		return nil
+	}
+	numMips := binary.LittleEndian.Uint32(lump)
+	if uint64(numMips)*4+4 > uint64(len(lump)) {
+		return fmt.Errorf("texture lump too short for %d textures", numMips)
+	}
+
+	for i := uint32(0); i < numMips; i++ {
+		offset := binary.LittleEndian.Uint32(lump[4+4*i:])
+		if offset == math.MaxUint32 {
+			continue
+		}
+		if uint64(offset)+16 > uint64(len(lump)) {
+			return fmt.Errorf("texture %d at %d outside of lump", i, offset)
+		}
+		rawName := lump[offset : offset+16]
+		name := bsp.BytesToString(rawName)
+		if o.policy.Excluded(name) {
+			continue
+		}
+
+		if o.policy.Textures {
+			obf := o.textureName(string(rawName))
+			o.log("%s => %s", name, obf)
+			fmt.Fprintf(o.mapping, "%s => %s\n", name, obf)
+
+			var name16 [15]byte
+			copy(name16[:], obf) // copies up to 15 bytes
+			copy(rawName, name16[:])
+		}
+		if o.policy.ScramblePixels {
+			o.scramblePixels(lump, offset)
+		}
+	}
+	return nil
+}
+
+// targetnameKeys are the entity keys linking entities by name.
+var targetnameKeys = []string{"target", "targetname", "killtarget"}
+
+// targetnames replaces every entity name with a random one, consistently
+// across all keys linking entities, and writes the mapping.
+func (o *obfuscator) targetnames(entities []bsp.Entity) {
+	renamed := map[string]string{}
+	used := map[string]bool{}
+	for i := range entities {
+		for _, key := range targetnameKeys {
+			name := entities[i].Get(key)
+			if name == "" {
+				continue
+			}
+			obf, found := renamed[name]
+			if !found {
+				for obf == "" || used[obf] {
+					obf = o.randomLetters(12)
+				}
+				renamed[name], used[obf] = obf, true
+				fmt.Fprintf(o.mapping, "targetname %s => %s\n", name, obf)
+			}
+			entities[i].Set(key, obf)
+		}
+	}
+}
+
+func (o *obfuscator) randomLetters(n int) string {
+	const letters = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[o.rng.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// textureName returns a random name of the maximum length keeping the
+// prefixes engines attach behaviour to.
+func (o *obfuscator) textureName(original string) string {
+	trimmed := strings.TrimRight(original, "\x00 ")
+
+	const totalLen = 15
+
+	//----------------------------------------------------------------
+	// 1) Animated textures: +0foo, +1foo, +2foo, +afoo, etc.
+	//----------------------------------------------------------------
+	if strings.HasPrefix(trimmed, "+") && len(trimmed) > 1 {
+		prefix := trimmed[:2]
+		suffix := trimmed[2:]
+
+		prefixLen := len(prefix)
+		suffixLen := totalLen - prefixLen
+
+		if suffixLen < 0 {
+			return prefix[:totalLen]
+		}
+
+		scrambledSuffix, found := o.animSuffixes[suffix]
+		if !found {
+			scrambledSuffix = o.randomLetters(suffixLen)
+			o.animSuffixes[suffix] = scrambledSuffix
+		} else {
+			if len(scrambledSuffix) != suffixLen {
+				scrambledSuffix = o.randomLetters(suffixLen)
+				o.animSuffixes[suffix] = scrambledSuffix
+			}
+		}
+
+		return prefix + scrambledSuffix
+	}
+
+	liquidPrefixes := []string{"*water", "*lava", "*slime", "*tele"}
+	for _, lp := range liquidPrefixes {
+		if strings.HasPrefix(trimmed, lp) {
+			return o.preserveAndScrambleFixed(lp, trimmed, totalLen)
+		}
+	}
+
+	if strings.HasPrefix(trimmed, "*") {
+		return o.preserveAndScrambleFixed("*", trimmed, totalLen)
+	}
+
+	if strings.HasPrefix(trimmed, "{") {
+		return o.preserveAndScrambleFixed("{", trimmed, totalLen)
+	}
+
+	if strings.HasPrefix(trimmed, "sky") {
+		return o.preserveAndScrambleFixed("sky", trimmed, totalLen)
+	}
+
+	return o.randomLetters(totalLen)
+}
+
+func (o *obfuscator) preserveAndScrambleFixed(prefix, original string, totalLen int) string {
+	prefixLen := len(prefix)
+	if prefixLen >= totalLen {
+		return prefix[:totalLen]
+	}
+	scrambleLen := totalLen - prefixLen
+	return prefix + o.randomLetters(scrambleLen)
+}
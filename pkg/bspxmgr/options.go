@@ -0,0 +1,95 @@
+package bspxmgr
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+)
+
+// Option changes how the functions writing maps read and write them. Options
+// apply on top of the per command options structs.
+type Option func(*settings)
+
+type settings struct {
+	alignment int
+	strict    bool
+}
+
+func newSettings(options []Option) settings {
+	var s settings
+	for _, option := range options {
+		option(&s)
+	}
+	return s
+}
+
+// WithAlignment starts every BSPX lump of the written map at a multiple of n
+// bytes, for engines reading lumps in place. By default lumps are written back
+// to back.
+func WithAlignment(n int) Option {
+	return func(s *settings) {
+		s.alignment = n
+	}
+}
+
+// WithStrictValidation refuses maps whose lump directories don't describe
+// whole records within the file with a ValidationError, instead of copying
+// whatever they hold.
+func WithStrictValidation() Option {
+	return func(s *settings) {
+		s.strict = true
+	}
+}
+
+// ValidationError lists the structural problems WithStrictValidation found.
+type ValidationError struct {
+	Map      string
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Map, strings.Join(e.Problems, ", "))
+}
+
+// openMap opens and reads the map at mapPath, checking its structure when
+// strict validation is enabled.
+func openMap(mapPath string, s settings) (*os.File, *bsp.BspFile, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w", mapPath, err)
+	}
+	if s.strict {
+		err = validateStructure(mapPath, &bspFile, f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+	}
+	return f, &bspFile, nil
+}
+
+// validateStructure checks that all lumps lie within the file and standard
+// lumps hold whole records.
+func validateStructure(mapPath string, bspFile *bsp.BspFile, f *os.File) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var problems []string
+	for _, problem := range bsp.CheckStructure(bspFile, stat.Size()) {
+		problems = append(problems, problem.Message)
+	}
+	if len(problems) > 0 {
+		return &ValidationError{mapPath, problems}
+	}
+	return nil
+}
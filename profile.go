@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// UploadConfig describes where finished maps are delivered. Either or both of
+// URL and SFTP may be set.
+type UploadConfig struct {
+	// URL receives an HTTP POST of the output map, or of its manifest when
+	// Manifest is set.
+	URL      string            `json:"url,omitempty"`
+	Manifest bool              `json:"manifest,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+
+	// SFTP is a user@host:path destination the output map is copied to
+	// using the system sftp client.
+	SFTP     string   `json:"sftp,omitempty"`
+	SFTPArgs []string `json:"sftpArgs,omitempty"`
+}
+
+// ObfuscationConfig is the obfuscation policy of a profile. Flags given to
+// obfuscate override the individual settings.
+type ObfuscationConfig struct {
+	// Textures defaults to true when unset.
+	Textures       *bool `json:"textures,omitempty"`
+	ScramblePixels bool  `json:"scramblePixels,omitempty"`
+	Targetnames    bool  `json:"targetnames,omitempty"`
+	// Seed is "time", "map" or a fixed number.
+	Seed    string   `json:"seed,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+	// Mapping is the path the name mapping is written to, with {map}
+	// replaced by the map name.
+	Mapping string `json:"mapping,omitempty"`
+}
+
+type Profile struct {
+	Upload      *UploadConfig      `json:"upload,omitempty"`
+	Obfuscation *ObfuscationConfig `json:"obfuscation,omitempty"`
+}
+
+type Config struct {
+	Profiles map[string]Profile `json:"profiles"`
+}
+
+var profileName string
+var configPath string
+
+func DefaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "bspxmgr.json"
+	}
+	return filepath.Join(dir, "bspxmgr", "config.json")
+}
+
+func LoadConfig(path string) (*Config, error) {
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	err = json.Unmarshal(buffer, &config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// ActiveProfile returns the profile selected with --profile, or nil when no
+// profile was requested.
+func ActiveProfile() (*Profile, error) {
+	if profileName == "" {
+		return nil, nil
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	profile, found := config.Profiles[profileName]
+	if !found {
+		return nil, fmt.Errorf("profile %q not found in %s", profileName, configPath)
+	}
+	return &profile, nil
+}
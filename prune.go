@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// ModelRef returns the model index of a "*N" model key.
+func ModelRef(value string) (int, bool) {
+	if !strings.HasPrefix(value, "*") {
+		return 0, false
+	}
+	index, err := strconv.Atoi(value[1:])
+	if err != nil || index < 0 {
+		return 0, false
+	}
+	return index, true
+}
+
+// ReferencedModels returns which models are used by the world or an entity.
+func ReferencedModels(entities []bsp.Entity, numModels int) []bool {
+	referenced := make([]bool, numModels)
+	if numModels > 0 {
+		referenced[0] = true
+	}
+	for i := range entities {
+		if index, ok := ModelRef(entities[i].Get("model")); ok && index < numModels {
+			referenced[index] = true
+		}
+	}
+	return referenced
+}
+
+// markClipNodes marks every clipnode reachable from num.
+func markClipNodes(clipNodes []bsp.ClipNode, num int32, used []bool) {
+	for num >= 0 && int(num) < len(clipNodes) && !used[num] {
+		used[num] = true
+		markClipNodes(clipNodes, clipNodes[num].Children[0], used)
+		num = clipNodes[num].Children[1]
+	}
+}
+
+// markNodes marks every node and leaf reachable from num.
+func markNodes(nodes []bsp.Node, num int32, usedNodes []bool, usedLeafs []bool) {
+	for num >= 0 && int(num) < len(nodes) && !usedNodes[num] {
+		usedNodes[num] = true
+		markNodes(nodes, nodes[num].Children[0], usedNodes, usedLeafs)
+		num = nodes[num].Children[1]
+	}
+	if leaf := -1 - num; num < 0 && int(leaf) < len(usedLeafs) {
+		usedLeafs[leaf] = true
+	}
+}
+
+// compactIndex returns the new index of every kept element, or -1.
+func compactIndex(keep []bool) []int32 {
+	mapping := make([]int32, len(keep))
+	next := int32(0)
+	for i := range keep {
+		if keep[i] {
+			mapping[i] = next
+			next++
+		} else {
+			mapping[i] = -1
+		}
+	}
+	return mapping
+}
+
+// PruneModels removes the models not flagged in keep along with their faces,
+// nodes, leafs and clipnodes. Kept data keeps its relative order so the world
+// leafs still line up with the visibility data. Entity model references are
+// renumbered to match.
+func PruneModels(data *mapData, bspx *bsp.BspXLumps, keep []bool) []string {
+	var warnings []string
+
+	keepFaces := make([]bool, len(data.faces))
+	for i := range keepFaces {
+		keepFaces[i] = true
+	}
+	keepNodes := make([]bool, len(data.nodes))
+	keepLeafs := make([]bool, len(data.leafs))
+	keepClipNodes := make([]bool, len(data.clipNodes))
+	if len(keepLeafs) > 0 {
+		keepLeafs[0] = true
+	}
+	for i, model := range data.models {
+		if !keep[i] {
+			for face := model.FirstFace; face < model.FirstFace+model.NumFaces && int(face) < len(keepFaces); face++ {
+				keepFaces[face] = false
+			}
+			continue
+		}
+		markNodes(data.nodes, model.HeadNode[0], keepNodes, keepLeafs)
+		for hull := 1; hull < len(model.HeadNode); hull++ {
+			markClipNodes(data.clipNodes, model.HeadNode[hull], keepClipNodes)
+		}
+	}
+	// Leafs covered by the visibility data are kept even if unreachable, the
+	// visibility rows are indexed by leaf number.
+	if len(data.models) > 0 {
+		for i := 1; i <= int(data.models[0].VisLeafs) && i < len(keepLeafs); i++ {
+			keepLeafs[i] = true
+		}
+	}
+
+	warnings = append(warnings, RemoveFaces(data, bspx, keepFaces)...)
+
+	nodeMap := compactIndex(keepNodes)
+	leafMap := compactIndex(keepLeafs)
+	clipNodeMap := compactIndex(keepClipNodes)
+	modelMap := compactIndex(keep)
+
+	var nodes []bsp.Node
+	for i := range data.nodes {
+		if !keepNodes[i] {
+			continue
+		}
+		node := data.nodes[i]
+		for j, child := range node.Children {
+			if child >= 0 && int(child) < len(nodeMap) {
+				node.Children[j] = nodeMap[child]
+			} else if leaf := -1 - child; child < 0 && int(leaf) < len(leafMap) {
+				node.Children[j] = -1 - leafMap[leaf]
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	var leafs []bsp.Leaf
+	var marksurfs []uint32
+	for i := range data.leafs {
+		if !keepLeafs[i] {
+			continue
+		}
+		leaf := data.leafs[i]
+		first := uint32(len(marksurfs))
+		for j := leaf.FirstMarkSurface; j < leaf.FirstMarkSurface+leaf.NumMarkSurfaces && int(j) < len(data.marksurfs); j++ {
+			marksurfs = append(marksurfs, data.marksurfs[j])
+		}
+		leaf.FirstMarkSurface = first
+		leafs = append(leafs, leaf)
+	}
+
+	var clipNodes []bsp.ClipNode
+	for i := range data.clipNodes {
+		if !keepClipNodes[i] {
+			continue
+		}
+		clipNode := data.clipNodes[i]
+		for j, child := range clipNode.Children {
+			if child >= 0 && int(child) < len(clipNodeMap) {
+				clipNode.Children[j] = clipNodeMap[child]
+			}
+		}
+		clipNodes = append(clipNodes, clipNode)
+	}
+
+	var models []bsp.Model
+	for i, model := range data.models {
+		if !keep[i] {
+			continue
+		}
+		// A model of a single leaf has the leaf as its head node.
+		if head := model.HeadNode[0]; head >= 0 && int(head) < len(nodeMap) {
+			model.HeadNode[0] = nodeMap[head]
+		} else if leaf := -1 - head; head < 0 && int(leaf) < len(leafMap) {
+			model.HeadNode[0] = -1 - leafMap[leaf]
+		}
+		for hull := 1; hull < len(model.HeadNode); hull++ {
+			if head := model.HeadNode[hull]; head >= 0 && int(head) < len(clipNodeMap) && clipNodeMap[head] >= 0 {
+				model.HeadNode[hull] = clipNodeMap[head]
+			}
+		}
+		models = append(models, model)
+	}
+
+	for i := range data.entities {
+		entity := &data.entities[i]
+		if index, ok := ModelRef(entity.Get("model")); ok && index < len(modelMap) && modelMap[index] >= 0 {
+			entity.Set("model", fmt.Sprintf("*%d", modelMap[index]))
+		}
+	}
+
+	data.nodes, data.leafs, data.marksurfs = nodes, leafs, marksurfs
+	data.clipNodes, data.models = clipNodes, models
+
+	return warnings
+}
+
+var pruneModelsCmd = &cobra.Command{
+	Use:   "prune-models <map>",
+	Short: "Remove brush models no entity references",
+	Long: `Remove the *N brush models no entity uses any more, e.g. after deleting
+doors or triggers from the entity lump, together with their faces, nodes,
+leafs and clipnodes. Remaining model references are renumbered.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+
+		keep := ReferencedModels(data.entities, len(data.models))
+		var unused []string
+		for i := range keep {
+			if !keep[i] {
+				unused = append(unused, fmt.Sprintf("*%d", i))
+			}
+		}
+		if len(unused) == 0 {
+			fmt.Println("No unused models")
+			return nil
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			warnings := PruneModels(data, bspx, keep)
+			for _, warning := range warnings {
+				Warnf("%s", warning)
+			}
+			data.encodeGeometry(lumps)
+			var err error
+			lumps[bsp.LumpEntities], err = bsp.FormatEntities(data.entities)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Removed %s, wrote %s\n", strings.Join(unused, " "), destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
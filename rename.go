@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// copyFile copies src to dst, refusing to overwrite an existing file.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// RenamedSidecars returns the new path of every existing sidecar of mapPath
+// when the map is renamed to name, keyed by the current path.
+func RenamedSidecars(mapPath string, name string) map[string]string {
+	renamed := map[string]string{}
+	for _, sidecar := range FindSidecars(mapPath) {
+		renamed[sidecar] = filepath.Join(filepath.Dir(sidecar), name+filepath.Ext(sidecar))
+	}
+	return renamed
+}
+
+// setEntFileMessage replaces the worldspawn message in a .ent file, which
+// overrides the entities lump in engines that load it.
+func setEntFileMessage(path string, message string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	entities, err := bsp.ParseEntities(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(entities) == 0 || entities[0].Classname() != "worldspawn" {
+		return fmt.Errorf("%s: first entity is not worldspawn", path)
+	}
+	entities[0].Set("message", message)
+	data, err = bsp.FormatEntities(entities)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, bytes.TrimRight(data, "\x00"), 0644)
+}
+
+var renameMessage string
+var renameKeep bool
+
+// writeMapWithMessage writes a copy of the map to destName with the
+// worldspawn message replaced.
+func writeMapWithMessage(cmd *cobra.Command, mapPath string, destName string, message string) error {
+	f, err := OpenMapFile(mapPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", mapPath, err)
+	}
+	entities, err := bsp.ReadEntities(&bspFile, f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", mapPath, err)
+	}
+	if len(entities) == 0 || entities[0].Classname() != "worldspawn" {
+		return fmt.Errorf("%s: first entity is not worldspawn", mapPath)
+	}
+	entities[0].Set("message", message)
+	lump, err := bsp.FormatEntities(entities)
+	if err != nil {
+		return err
+	}
+	return bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+		lumps[bsp.LumpEntities] = lump
+		return nil
+	})
+}
+
+var renameMapCmd = &cobra.Command{
+	Use:   "rename-map <old.bsp> <newname>",
+	Short: "Rename a map together with its sidecar files",
+	Long: `Write the map as <newname>.bsp next to the original and rename its .lit,
+.lux, .ent, .loc and .way files to match, including a .loc in the gamedir's
+locs directory. With --message the worldspawn message is replaced as well,
+in the map and in its .ent file.
+Nothing is written if any of the new files already exists, and if a step
+fails the new files are removed and the sidecars renamed back.
+
+The CRC32 of every new file is printed, for updating download manifests and
+server configs.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := strings.TrimSuffix(args[1], ".bsp")
+		if name == "" || filepath.Base(name) != name {
+			return fmt.Errorf("new name %q must be a map name without directory", args[1])
+		}
+		destName := filepath.Join(filepath.Dir(args[0]), name+".bsp")
+		sidecars := RenamedSidecars(args[0], name)
+
+		if _, err := os.Stat(destName); err == nil {
+			return fmt.Errorf("%s already exists", destName)
+		}
+		for _, path := range sidecars {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists", path)
+			}
+		}
+
+		if renameMessage != "" {
+			if err := writeMapWithMessage(cmd, args[0], destName, renameMessage); err != nil {
+				return err
+			}
+		} else if err := copyFile(args[0], destName); err != nil {
+			return err
+		}
+
+		// undo holds the steps reverting what has been written so far, run
+		// in reverse when a later step fails.
+		undo := []func(){func() { os.Remove(destName) }}
+		rollback := func(err error) error {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+			return err
+		}
+
+		renamed := []string{destName}
+		// Sidecars that are edited are copied, their originals are removed
+		// along with the map once everything else succeeded.
+		var copied []string
+		for _, old := range FindSidecars(args[0]) {
+			old, path := old, sidecars[old]
+			edit := renameMessage != "" && filepath.Ext(old) == ".ent"
+			if renameKeep || edit {
+				if err := copyFile(old, path); err != nil {
+					return rollback(err)
+				}
+				undo = append(undo, func() { os.Remove(path) })
+				copied = append(copied, old)
+			} else {
+				if err := os.Rename(old, path); err != nil {
+					return rollback(err)
+				}
+				undo = append(undo, func() { os.Rename(path, old) })
+			}
+			if edit {
+				if err := setEntFileMessage(path, renameMessage); err != nil {
+					return rollback(err)
+				}
+			}
+			renamed = append(renamed, path)
+		}
+		if !renameKeep {
+			if err := os.Remove(args[0]); err != nil {
+				return rollback(err)
+			}
+			for _, old := range copied {
+				if err := os.Remove(old); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, path := range renamed {
+			entry, err := NewDownloadEntry(path, filepath.Dir(args[0]))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s %d %08x\n", entry.Path, entry.Size, entry.CRC32)
+		}
+
+		err := RunUploadHooks(cmd.Context(), destName, cmd.Name())
+		if err != nil {
+			return err
+		}
+		return nil
+	},
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var renameLumpCmd = &cobra.Command{
+	Use:   "rename <map> <old-lump-name> <new-lump-name>",
+	Short: "Rename a BSPX lump",
+	Long: `Write a copy of the map with a BSPX lump renamed, e.g. to fix a lump name
+misspelled by another tool. Only the BSPX directory entry changes, the lump
+payload and everything else are copied byte for byte.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RenameBspXLumpContext(cmd.Context(), &bspFile, f, destName, args[1], args[2])
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		fmt.Printf("Renamed %s to %s, wrote %s\n", args[1], args[2], destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
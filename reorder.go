@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var reorderOrder []string
+
+var reorderCmd = &cobra.Command{
+	Use:   "reorder <map>",
+	Short: "Sort the BSPX lumps or put them in a given order",
+	Long: `Write a copy of the map with the BSPX lumps sorted by name, or with the lumps
+given by --order first in that order followed by the others, for engines
+expecting lumps in a certain order. Lump payloads are copied as they are.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		order := reorderOrder
+		if len(order) == 0 {
+			for _, xlump := range bspFile.BspXLumps {
+				order = append(order, bsp.BytesToString(xlump.LumpName[:]))
+			}
+			sort.Strings(order)
+		}
+		for _, name := range order {
+			if bsp.FindBspXLump(&bspFile, name) == nil {
+				return fmt.Errorf("%s has no BSPX lump %s", args[0], name)
+			}
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.StreamBSPXContext(cmd.Context(), &bspFile, f, destName, func(doc *bsp.Document) error {
+			doc.ReorderBspX(order)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Reordered %d BSPX lumps, wrote %s\n", len(bspFile.BspXLumps), destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var repackAlignment int
+
+// UnusedBytes returns the number of bytes of a file of the given size that
+// lie outside of all regions, such as padding, stale data between lumps and
+// BSPX payloads no directory entry refers to.
+func UnusedBytes(regions []FileRegion, size int64) int64 {
+	sorted := append([]FileRegion(nil), regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+
+	unused, covered := int64(0), int64(0)
+	for _, region := range sorted {
+		if region.Offset > covered {
+			unused += region.Offset - covered
+		}
+		if end := region.Offset + region.Length; end > covered {
+			covered = end
+		}
+	}
+	if size > covered {
+		unused += size - covered
+	}
+	return unused
+}
+
+var repackCmd = &cobra.Command{
+	Use:   "repack <map>",
+	Short: "Rewrite the map with all lumps back to back",
+	Long: `Write a copy of the map with the standard lumps following the header back to
+back, each padded to 4 bytes, followed by the BSPX directory and the BSPX
+lumps, each starting at a multiple of --align bytes. Stale data between lumps
+and BSPX payloads no directory entry refers to are dropped. Lump contents are
+copied as they are.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		unused := UnusedBytes(MapRegions(&bspFile), info.Size())
+
+		doc, err := bsp.OpenDocument(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		doc.BspXAlignment = repackAlignment
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = doc.WriteFileContext(cmd.Context(), destName)
+		if err != nil {
+			return err
+		}
+		newInfo, err := os.Stat(destName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Repacked %s from %d to %d bytes, %d bytes were unused, wrote %s\n", args[0], info.Size(), newInfo.Size(), unused, destName)
+		if reclaimed := info.Size() - newInfo.Size(); reclaimed > 0 {
+			fmt.Printf("Reclaimed %d bytes\n", reclaimed)
+		} else if reclaimed < 0 {
+			fmt.Printf("Alignment added %d bytes\n", -reclaimed)
+		}
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func ParseSeverity(s string) (Severity, error) {
+	switch s {
+	case "info":
+		return SeverityInfo, nil
+	case "warning":
+		return SeverityWarning, nil
+	case "error":
+		return SeverityError, nil
+	default:
+		return 0, fmt.Errorf("unknown severity %q (want info, warning or error)", s)
+	}
+}
+
+// FailsAt reports whether any finding is at or above the given severity.
+func FailsAt(findings []Finding, threshold Severity) bool {
+	for _, finding := range findings {
+		if finding.Severity >= threshold {
+			return true
+		}
+	}
+	return false
+}
+
+type jsonFinding struct {
+	Severity Severity `json:"severity"`
+	Check    string   `json:"check"`
+	Message  string   `json:"message"`
+	Entity   *int     `json:"entity,omitempty"`
+}
+
+type jsonReport struct {
+	Map      string        `json:"map"`
+	Findings []jsonFinding `json:"findings"`
+}
+
+func writeJSONReport(w io.Writer, mapPath string, findings []Finding) error {
+	report := jsonReport{Map: mapPath, Findings: []jsonFinding{}}
+	for _, finding := range findings {
+		jf := jsonFinding{Severity: finding.Severity, Check: finding.Check, Message: finding.Message}
+		if finding.Entity >= 0 {
+			entity := finding.Entity
+			jf.Entity = &entity
+		}
+		report.Findings = append(report.Findings, jf)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+// writeJUnitReport emits one test case per finding; findings at or above the
+// threshold are failures, the rest are reported as passing with output.
+func writeJUnitReport(w io.Writer, mapPath string, findings []Finding, threshold Severity) error {
+	suite := junitTestSuite{Name: mapPath}
+	for _, finding := range findings {
+		tc := junitTestCase{Name: finding.Check, Classname: mapPath}
+		if finding.Severity >= threshold {
+			tc.Failure = &junitFailure{Message: finding.Message, Type: finding.Severity.String(), Text: finding.String()}
+			suite.Failures++
+		} else {
+			tc.SystemOut = finding.String()
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+	if len(suite.TestCases) == 0 {
+		suite.TestCases = append(suite.TestCases, junitTestCase{Name: "validate", Classname: mapPath})
+	}
+	suite.Tests = len(suite.TestCases)
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	err = encoder.Encode(suite)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifRule struct {
+	Id string `json:"id"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+}
+
+type sarifResult struct {
+	RuleId    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name  string      `json:"name"`
+			Rules []sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+func sarifLevel(s Severity) string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "note"
+	}
+}
+
+func writeSARIFReport(w io.Writer, mapPath string, findings []Finding) error {
+	var run sarifRun
+	run.Tool.Driver.Name = "bspxmgr"
+	run.Tool.Driver.Rules = []sarifRule{}
+	run.Results = []sarifResult{}
+
+	rules := map[string]bool{}
+	for _, finding := range findings {
+		if !rules[finding.Check] {
+			rules[finding.Check] = true
+			run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{Id: finding.Check})
+		}
+		var location sarifLocation
+		location.PhysicalLocation.ArtifactLocation.URI = mapPath
+		run.Results = append(run.Results, sarifResult{
+			RuleId:    finding.Check,
+			Level:     sarifLevel(finding.Severity),
+			Message:   sarifMessage{Text: finding.Message},
+			Locations: []sarifLocation{location},
+		})
+	}
+
+	log := sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(log)
+}
+
+// reportFormats are the formats WriteReport accepts.
+var reportFormats = []string{"json", "junit", "sarif"}
+
+// CheckReportFormat returns an error for formats WriteReport doesn't accept,
+// so commands can reject them before doing any work.
+func CheckReportFormat(format string) error {
+	for _, known := range reportFormats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown report format %q (want json, junit or sarif)", format)
+}
+
+// WriteReport writes findings in one of the machine readable formats: json,
+// junit or sarif.
+func WriteReport(w io.Writer, format string, mapPath string, findings []Finding, threshold Severity) error {
+	switch format {
+	case "json":
+		return writeJSONReport(w, mapPath, findings)
+	case "junit":
+		return writeJUnitReport(w, mapPath, findings, threshold)
+	case "sarif":
+		return writeSARIFReport(w, mapPath, findings)
+	default:
+		return CheckReportFormat(format)
+	}
+}
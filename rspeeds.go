@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// DecompressVis expands the run length encoded visibility row at offset into
+// one flag per leaf, where index i is leaf i+1. Leafs without visibility data
+// see everything.
+func DecompressVis(vis []byte, offset int32, numLeafs int) []bool {
+	visible := make([]bool, numLeafs)
+	if offset < 0 || int(offset) >= len(vis) {
+		for i := range visible {
+			visible[i] = true
+		}
+		return visible
+	}
+
+	leaf := 0
+	for i := int(offset); leaf < numLeafs && i < len(vis); i++ {
+		if vis[i] == 0 {
+			// A zero byte is followed by the number of zero bytes it stands for.
+			if i+1 < len(vis) {
+				i++
+				leaf += 8 * int(vis[i])
+			}
+			continue
+		}
+		for bit := 0; bit < 8 && leaf < numLeafs; bit, leaf = bit+1, leaf+1 {
+			visible[leaf] = vis[i]&(1<<bit) != 0
+		}
+	}
+	return visible
+}
+
+type Viewpoint struct {
+	Name   string
+	Origin bsp.Vec3
+}
+
+// SpawnViewpoints returns the eye positions of all player spawn points.
+func SpawnViewpoints(entities []bsp.Entity) []Viewpoint {
+	var viewpoints []Viewpoint
+	for i := range entities {
+		classname := entities[i].Classname()
+		if !strings.HasPrefix(classname, "info_player_") {
+			continue
+		}
+		origin, ok := entities[i].Origin()
+		if !ok {
+			continue
+		}
+		// Players spawn with the view 22 units above their origin.
+		origin[2] += 22
+		viewpoints = append(viewpoints, Viewpoint{entityRef(entities, i), origin})
+	}
+	return viewpoints
+}
+
+type RSpeedsEstimate struct {
+	Viewpoint
+	Leaf         int
+	Leafs        int
+	WPolys       int
+	Outside      bool
+	NoVisibility bool
+}
+
+func (e RSpeedsEstimate) String() string {
+	switch {
+	case e.Outside:
+		return fmt.Sprintf("%-40s %s: in solid or outside the map", e.Name, e.Origin)
+	case e.NoVisibility:
+		return fmt.Sprintf("%6d wpoly %5d leafs  %-40s %s (no vis data)", e.WPolys, e.Leafs, e.Name, e.Origin)
+	}
+	return fmt.Sprintf("%6d wpoly %5d leafs  %-40s %s", e.WPolys, e.Leafs, e.Name, e.Origin)
+}
+
+// EstimateRSpeeds counts the world faces in all leafs potentially visible
+// from each viewpoint. It ignores the view frustum, so the result is the upper
+// bound of what r_speeds reports when turning around on the spot.
+func EstimateRSpeeds(data *mapData, vis []byte, viewpoints []Viewpoint) []RSpeedsEstimate {
+	world := data.models[0]
+	numLeafs := int(world.VisLeafs)
+	if numLeafs > len(data.leafs)-1 {
+		numLeafs = len(data.leafs) - 1
+	}
+
+	var estimates []RSpeedsEstimate
+	for _, viewpoint := range viewpoints {
+		estimate := RSpeedsEstimate{Viewpoint: viewpoint}
+		leaf := bsp.PointLeaf(data.nodes, data.planes, world.HeadNode[0], viewpoint.Origin)
+		estimate.Leaf = leaf
+		if leaf == 0 || leaf >= len(data.leafs) || data.leafs[leaf].Contents == bsp.ContentsSolid {
+			estimate.Outside = true
+			estimates = append(estimates, estimate)
+			continue
+		}
+
+		estimate.NoVisibility = len(vis) == 0 || data.leafs[leaf].VisOfs < 0
+		visible := DecompressVis(vis, data.leafs[leaf].VisOfs, numLeafs)
+		if leaf-1 < len(visible) {
+			visible[leaf-1] = true
+		}
+
+		seen := make([]bool, len(data.faces))
+		for i, v := range visible {
+			if !v {
+				continue
+			}
+			estimate.Leafs++
+			l := &data.leafs[i+1]
+			for j := l.FirstMarkSurface; j < l.FirstMarkSurface+l.NumMarkSurfaces && int(j) < len(data.marksurfs); j++ {
+				face := data.marksurfs[j]
+				if int(face) < len(seen) && !seen[face] {
+					seen[face] = true
+					estimate.WPolys++
+				}
+			}
+		}
+		estimates = append(estimates, estimate)
+	}
+	return estimates
+}
+
+var rspeedsPoints []string
+var rspeedsTop int
+
+var rspeedsCmd = &cobra.Command{
+	Use:   "rspeeds <map>",
+	Short: "Estimate wpoly counts from spawn points or given viewpoints",
+	Long: `Walk the PVS from each viewpoint and count the world polygons in all
+potentially visible leafs, listing the worst viewpoints first. Without
+--point, the eye positions of all player spawn points are used.
+
+The count ignores the view direction, it is the worst case r_speeds shows
+when looking around from that position, not including brush models.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		if len(data.models) == 0 {
+			return fmt.Errorf("map has no world model")
+		}
+		vis, err := bsp.ReadLump(&bspFile, f, bsp.LumpVisibility)
+		if err != nil {
+			return err
+		}
+
+		var viewpoints []Viewpoint
+		for _, point := range rspeedsPoints {
+			v, err := parseVectorFlag(point)
+			if err != nil {
+				return err
+			}
+			viewpoints = append(viewpoints, Viewpoint{point, bsp.Vec3{float32(v[0]), float32(v[1]), float32(v[2])}})
+		}
+		if len(viewpoints) == 0 {
+			viewpoints = SpawnViewpoints(data.entities)
+		}
+		if len(viewpoints) == 0 {
+			return fmt.Errorf("map has no spawn points, pass viewpoints with --point")
+		}
+
+		estimates := EstimateRSpeeds(data, vis, viewpoints)
+		sort.SliceStable(estimates, func(i, j int) bool {
+			return estimates[i].WPolys > estimates[j].WPolys
+		})
+		if rspeedsTop > 0 && len(estimates) > rspeedsTop {
+			estimates = estimates[:rspeedsTop]
+		}
+		for _, estimate := range estimates {
+			fmt.Println(estimate)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// Coordinates sent with the standard QuakeWorld protocol are 16 bit fixed
+// point with 3 fractional bits, so anything beyond +-4096 needs float coords.
+const StandardCoordLimit = 4096
+
+type SpawnCounts struct {
+	Deathmatch int
+	Team1      int
+	Team2      int
+	Start      int
+}
+
+func CountSpawns(entities []bsp.Entity) SpawnCounts {
+	var counts SpawnCounts
+	for i := range entities {
+		switch entities[i].Classname() {
+		case "info_player_deathmatch":
+			counts.Deathmatch++
+		case "info_player_team1":
+			counts.Team1++
+		case "info_player_team2":
+			counts.Team2++
+		case "info_player_start":
+			counts.Start++
+		}
+	}
+	return counts
+}
+
+// RecommendedMaxClients derives a player limit from the available spawn
+// points, preferring team spawns when the map provides them.
+func (s SpawnCounts) RecommendedMaxClients() int {
+	n := s.Deathmatch
+	if s.Team1 > 0 && s.Team2 > 0 {
+		team := s.Team1
+		if s.Team2 < team {
+			team = s.Team2
+		}
+		if 2*team > n {
+			n = 2 * team
+		}
+	}
+	if n < 2 {
+		n = 2
+	}
+	if n > 32 {
+		n = 32
+	}
+	return n
+}
+
+func NeedsFloatCoords(world bsp.Model) bool {
+	for i := 0; i < 3; i++ {
+		if world.Mins[i] < -StandardCoordLimit || world.Maxs[i] > StandardCoordLimit {
+			return true
+		}
+	}
+	return false
+}
+
+type serverMapInfo struct {
+	Name        string
+	Version     bsp.BspVersion
+	Spawns      SpawnCounts
+	World       bsp.Model
+	FloatCoords bool
+}
+
+func readServerMapInfo(filename string) (serverMapInfo, error) {
+	f, err := OpenMapFile(filename)
+	if err != nil {
+		return serverMapInfo{}, err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return serverMapInfo{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	entities, err := bsp.ReadEntities(&bspFile, f)
+	if err != nil {
+		return serverMapInfo{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	models, err := bsp.ReadModels(&bspFile, f)
+	if err != nil {
+		return serverMapInfo{}, fmt.Errorf("%s: %w", filename, err)
+	}
+	if len(models) == 0 {
+		return serverMapInfo{}, fmt.Errorf("%s: map has no world model", filename)
+	}
+
+	return serverMapInfo{
+		Name:        strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)),
+		Version:     bspFile.BspHeader.Version,
+		Spawns:      CountSpawns(entities),
+		World:       models[0],
+		FloatCoords: NeedsFloatCoords(models[0]),
+	}, nil
+}
+
+var serverConfigCmd = &cobra.Command{
+	Use:   "serverconfig <map>...",
+	Short: "Generate server config snippets",
+	Long: `Emit ready-to-paste server config entries for the given maps: a localinfo
+map rotation in argument order, recommended maxclients from spawn counts and
+the protocol features required by the map bounds and format.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var infos []serverMapInfo
+		for _, arg := range args {
+			if err := cmd.Context().Err(); err != nil {
+				return err
+			}
+			info, err := readServerMapInfo(arg)
+			if err != nil {
+				return err
+			}
+			infos = append(infos, info)
+		}
+
+		maxClients := 0
+		floatCoords := false
+		for i, info := range infos {
+			next := infos[(i+1)%len(infos)].Name
+			recommended := info.Spawns.RecommendedMaxClients()
+
+			fmt.Printf("// %s: version %s, bounds %s .. %s\n", info.Name, info.Version, info.World.Mins, info.World.Maxs)
+			fmt.Printf("// spawns: %d deathmatch, %d team1, %d team2, %d start; recommended maxclients %d\n",
+				info.Spawns.Deathmatch, info.Spawns.Team1, info.Spawns.Team2, info.Spawns.Start, recommended)
+			if info.FloatCoords {
+				fmt.Printf("// requires float coords (bounds exceed +-%d)\n", StandardCoordLimit)
+			}
+			if info.Version == bsp.BspVersionBSP2 || info.Version == bsp.BspVersion2PSB {
+				fmt.Printf("// requires clients with %s support\n", info.Version)
+			}
+			fmt.Printf("localinfo %s %s\n", info.Name, next)
+			fmt.Println("")
+
+			if maxClients == 0 || recommended < maxClients {
+				maxClients = recommended
+			}
+			floatCoords = floatCoords || info.FloatCoords
+		}
+
+		fmt.Println("// rotation-wide settings")
+		fmt.Printf("maxclients %d\n", maxClients)
+		if floatCoords {
+			fmt.Println("sv_bigcoords 1")
+		}
+		return nil
+	},
+}
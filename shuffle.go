@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// shuffleExcluded are item classnames whose position is part of the game
+// mode rather than the item layout.
+var shuffleExcluded = map[string]bool{
+	"item_flag_team1": true,
+	"item_flag_team2": true,
+}
+
+// ShuffleItems permutes the origins of all entities whose classname starts
+// with one of prefixes, so every item ends up on a spot another item used to
+// occupy. It returns the indexes of the shuffled entities.
+func ShuffleItems(entities []bsp.Entity, prefixes []string, rng *rand.Rand) []int {
+	var indexes []int
+	var origins []string
+	for i := range entities {
+		classname := entities[i].Classname()
+		if shuffleExcluded[classname] || !entities[i].Has("origin") {
+			continue
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(classname, prefix) {
+				indexes = append(indexes, i)
+				origins = append(origins, entities[i].Get("origin"))
+				break
+			}
+		}
+	}
+
+	rng.Shuffle(len(origins), func(i, j int) {
+		origins[i], origins[j] = origins[j], origins[i]
+	})
+	for i, index := range indexes {
+		entities[index].Set("origin", origins[i])
+	}
+	return indexes
+}
+
+var shuffleSeed int64
+var shufflePrefixes []string
+
+var shuffleCmd = &cobra.Command{
+	Use:   "shuffle <map>",
+	Short: "Randomly swap item and weapon positions",
+	Long: `Permute the positions of items and weapons among the spots they originally
+occupy, producing shuffled variants of a map. The same --seed always gives
+the same layout. CTF flags are never moved.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		entities, err := bsp.ReadEntities(&bspFile, f)
+		if err != nil {
+			return err
+		}
+
+		seed := shuffleSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		shuffled := ShuffleItems(entities, shufflePrefixes, rand.New(rand.NewSource(seed)))
+		if len(shuffled) < 2 {
+			fmt.Printf("%s: fewer than two items to shuffle\n", args[0])
+			return nil
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			var err error
+			lumps[bsp.LumpEntities], err = bsp.FormatEntities(entities)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, index := range shuffled {
+			fmt.Printf("%-24s -> %s\n", entities[index].Classname(), entities[index].Get("origin"))
+		}
+		fmt.Printf("Shuffled %d items with seed %d, wrote %s\n", len(shuffled), seed, destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
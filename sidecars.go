@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// SidecarExtensions lists the companion files engines and mods load next to
+// a map.
+var SidecarExtensions = []string{".lit", ".lux", ".ent", ".loc", ".way"}
+
+// SidecarCandidates returns every path a sidecar of the given map may live
+// at, whether or not it exists. Besides the map directory, .loc files are
+// also looked up in the gamedir's locs directory as ezQuake does.
+func SidecarCandidates(mapPath string) []string {
+	dir := filepath.Dir(mapPath)
+	name := strings.TrimSuffix(filepath.Base(mapPath), filepath.Ext(mapPath))
+
+	var candidates []string
+	for _, ext := range SidecarExtensions {
+		candidates = append(candidates, filepath.Join(dir, name+ext))
+	}
+	if filepath.Base(dir) == "maps" {
+		candidates = append(candidates, filepath.Join(filepath.Dir(dir), "locs", name+".loc"))
+	}
+	return candidates
+}
+
+// FindSidecars returns the sidecar files of a map that exist on disk.
+func FindSidecars(mapPath string) []string {
+	var found []string
+	for _, candidate := range SidecarCandidates(mapPath) {
+		stat, err := os.Stat(candidate)
+		if err == nil && stat.Mode().IsRegular() {
+			found = append(found, candidate)
+		}
+	}
+	return found
+}
+
+// SidecarLumps maps sidecar extensions to the BSPX lump holding the same data
+// inside the map. .ent files replace the standard entities lump instead.
+var SidecarLumps = map[string]string{
+	".lit": "RGBLIGHTING",
+	".lux": "LIGHTINGDIR",
+	".loc": LocationsLump,
+	".way": WaypointsLump,
+}
+
+// SidecarPayload returns the part of a sidecar file that is stored in the
+// map: .lit and .lux files lose their "QLIT" header, .ent files are NUL
+// terminated like the entities lump.
+func SidecarPayload(ext string, data []byte) ([]byte, error) {
+	switch ext {
+	case ".lit", ".lux":
+		if len(data) < 8 || string(data[:4]) != "QLIT" {
+			return nil, fmt.Errorf("missing QLIT header")
+		}
+		if version := binary.LittleEndian.Uint32(data[4:]); version != 1 {
+			return nil, fmt.Errorf("unsupported QLIT version %d", version)
+		}
+		return data[8:], nil
+	case ".ent":
+		if len(data) == 0 || data[len(data)-1] != 0 {
+			data = append(append([]byte{}, data...), 0)
+		}
+		return data, nil
+	}
+	return data, nil
+}
+
+type SidecarStatus struct {
+	Ext      string
+	Path     string
+	Lump     string
+	OnDisk   bool
+	Embedded bool
+	Differs  bool
+	Problem  string
+}
+
+func (s SidecarStatus) State() string {
+	switch {
+	case s.Problem != "":
+		return s.Problem
+	case s.OnDisk && s.Embedded && s.Differs:
+		return "on disk and embedded, contents differ"
+	case s.OnDisk && s.Embedded:
+		return "on disk and embedded, identical"
+	case s.OnDisk:
+		return "on disk only"
+	case s.Embedded:
+		return "embedded only"
+	}
+	return "missing"
+}
+
+// CheckSidecars compares the sidecar files of a map with the data embedded in
+// it. Every sidecar extension gets one entry, found or not.
+func CheckSidecars(mapPath string, bspFile *bsp.BspFile, r io.ReaderAt) ([]SidecarStatus, error) {
+	var statuses []SidecarStatus
+	found := FindSidecars(mapPath)
+	for _, ext := range SidecarExtensions {
+		status := SidecarStatus{Ext: ext, Lump: SidecarLumps[ext]}
+
+		var embedded []byte
+		var err error
+		if ext == ".ent" {
+			status.Lump = bsp.LumpType(bsp.LumpEntities).String()
+			// Every map has entities, they only count as embedded data to
+			// compare against when a .ent file exists.
+			embedded, err = bsp.ReadLump(bspFile, r, bsp.LumpEntities)
+		} else {
+			embedded, err = bsp.ReadBspXLump(bspFile, r, status.Lump)
+			status.Embedded = embedded != nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, path := range found {
+			if filepath.Ext(path) != ext {
+				continue
+			}
+			status.Path = path
+			status.OnDisk = true
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			payload, err := SidecarPayload(ext, data)
+			if err != nil {
+				status.Problem = fmt.Sprintf("invalid: %s", err)
+				break
+			}
+			if ext == ".ent" {
+				status.Embedded = true
+				status.Differs = strings.TrimRight(string(payload), "\x00\r\n\t ") != strings.TrimRight(string(embedded), "\x00\r\n\t ")
+			} else {
+				status.Differs = status.Embedded && !bytes.Equal(payload, embedded)
+			}
+			break
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+var sidecarsCmd = &cobra.Command{
+	Use:   "sidecars <map>",
+	Short: "Report companion files on disk and embedded in the map",
+	Long: `List which of the .lit, .lux, .ent, .loc and .way companion files exist next
+to the map, which of them are embedded, and where the file on disk and the
+embedded data disagree.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		statuses, err := CheckSidecars(args[0], &bspFile, f)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "EXT\tLUMP\tFILE\tSTATE")
+		for _, status := range statuses {
+			path := status.Path
+			if path == "" {
+				path = "-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", status.Ext, status.Lump, path, status.State())
+		}
+		w.Flush()
+		return nil
+	},
+}
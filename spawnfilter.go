@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// Spawnflags the game code checks before spawning an entity.
+const (
+	SpawnflagNotEasy       = 256
+	SpawnflagNotMedium     = 512
+	SpawnflagNotHard       = 1024
+	SpawnflagNotDeathmatch = 2048
+)
+
+var spawnFilterDeathmatch bool
+var spawnFilterSkill int
+
+// skillSpawnflags returns the spawnflag excluding entities from a skill
+// level, nightmare using the flag of hard.
+func skillSpawnflags(skill int) (int, error) {
+	switch skill {
+	case 0:
+		return SpawnflagNotEasy, nil
+	case 1:
+		return SpawnflagNotMedium, nil
+	case 2, 3:
+		return SpawnflagNotHard, nil
+	}
+	return 0, fmt.Errorf("invalid skill %d, expected 0 to 3", skill)
+}
+
+// entitySpawnflags returns the spawnflags of an entity, 0 if unset or not a
+// number. Compilers sometimes write them as floats.
+func entitySpawnflags(e *bsp.Entity) int {
+	value := strings.TrimSpace(e.Get("spawnflags"))
+	if flags, err := strconv.Atoi(value); err == nil {
+		return flags
+	}
+	if flags, err := strconv.ParseFloat(value, 64); err == nil {
+		return int(flags)
+	}
+	return 0
+}
+
+// FilterSpawnflags removes the entities with any of the spawnflags in mask
+// set and returns the rest together with the removed ones. worldspawn is
+// always kept.
+func FilterSpawnflags(entities []bsp.Entity, mask int) ([]bsp.Entity, []bsp.Entity) {
+	var kept, removed []bsp.Entity
+	for i := range entities {
+		if entitySpawnflags(&entities[i])&mask != 0 && entities[i].Classname() != "worldspawn" {
+			removed = append(removed, entities[i])
+		} else {
+			kept = append(kept, entities[i])
+		}
+	}
+	return kept, removed
+}
+
+var entitiesSpawnFilterCmd = &cobra.Command{
+	Use:   "spawnfilter <map>",
+	Short: "Remove entities that don't spawn in deathmatch or at a skill level",
+	Long: `Write a copy of the map without the entities the game code removes anyway:
+with --deathmatch those flagged not in deathmatch (2048), with --skill those
+flagged not in easy (256) for skill 0, not in medium (512) for skill 1 or not
+in hard (1024) for skills 2 and 3. The result is a smaller entities lump
+tailored for multiplayer servers.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mask := 0
+		if spawnFilterDeathmatch {
+			mask |= SpawnflagNotDeathmatch
+		}
+		if cmd.Flags().Changed("skill") {
+			flag, err := skillSpawnflags(spawnFilterSkill)
+			if err != nil {
+				return err
+			}
+			mask |= flag
+		}
+		if mask == 0 {
+			return fmt.Errorf("nothing to do, give --deathmatch or --skill")
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		entities, removed := FilterSpawnflags(entities, mask)
+		if len(removed) == 0 {
+			fmt.Printf("%s: no entity has spawnflags %d\n", args[0], mask)
+			return nil
+		}
+		for i := range removed {
+			Infof("removed %s", removed[i].Classname())
+		}
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d entities, wrote %s\n", len(removed), destName)
+		return nil
+	},
+}
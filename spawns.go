@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var spawnsMin int
+var spawnsTolerance int
+
+// spawnClassnames are the player spawn points reported by entities spawns.
+var spawnClassnames = []string{"info_player_start", "info_player_deathmatch", "info_player_team1", "info_player_team2"}
+
+// spawnYaw returns the direction a player spawns facing, from angle or the
+// yaw of angles, or "" if the entity has neither.
+func spawnYaw(e *bsp.Entity) string {
+	if e.Has("angle") {
+		return strings.TrimSpace(e.Get("angle"))
+	}
+	if fields := strings.Fields(e.Get("angles")); len(fields) == 3 {
+		return fields[1]
+	}
+	return ""
+}
+
+// SpawnProblems returns what is wrong with the spawn counts: fewer
+// deathmatch spawns than min, or, on maps with team spawns, fewer than min
+// for either team or counts differing by more than tolerance.
+func SpawnProblems(counts SpawnCounts, min int, tolerance int) []string {
+	var problems []string
+	if counts.Deathmatch < min {
+		problems = append(problems, fmt.Sprintf("%d deathmatch spawns, at least %d wanted", counts.Deathmatch, min))
+	}
+	if counts.Team1 == 0 && counts.Team2 == 0 {
+		return problems
+	}
+	for team, count := range []int{counts.Team1, counts.Team2} {
+		if count < min {
+			problems = append(problems, fmt.Sprintf("%d team%d spawns, at least %d wanted", count, team+1, min))
+		}
+	}
+	diff := counts.Team1 - counts.Team2
+	if diff < 0 {
+		diff = -diff
+	}
+	if diff > tolerance {
+		problems = append(problems, fmt.Sprintf("unbalanced team spawns: %d team1, %d team2", counts.Team1, counts.Team2))
+	}
+	return problems
+}
+
+var entitiesSpawnsCmd = &cobra.Command{
+	Use:   "spawns <map>",
+	Short: "List the player spawn points and check their balance",
+	Long: `List the start, deathmatch and team spawn points of a map with their origin
+and the angle players face, followed by the count of each. Exits with status
+4 when there are fewer deathmatch spawns than --min, or, on maps with team
+spawns, fewer than --min for either team or team counts differing by more
+than --tolerance.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ENTITY\tCLASSNAME\tORIGIN\tANGLE")
+		for _, classname := range spawnClassnames {
+			for i := range entities {
+				e := &entities[i]
+				if e.Classname() != classname {
+					continue
+				}
+				origin := e.Get("origin")
+				if origin == "" {
+					origin = "-"
+				}
+				yaw := spawnYaw(e)
+				if yaw == "" {
+					yaw = "-"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", i, classname, origin, yaw)
+			}
+		}
+		w.Flush()
+
+		counts := CountSpawns(entities)
+		fmt.Println()
+		fmt.Printf("  %-24s %8d\n", "Start", counts.Start)
+		fmt.Printf("  %-24s %8d\n", "Deathmatch", counts.Deathmatch)
+		fmt.Printf("  %-24s %8d\n", "Team1", counts.Team1)
+		fmt.Printf("  %-24s %8d\n", "Team2", counts.Team2)
+
+		problems := SpawnProblems(counts, spawnsMin, spawnsTolerance)
+		for _, problem := range problems {
+			Warnf("%s: %s", args[0], problem)
+		}
+		if len(problems) > 0 {
+			return ErrCheckFailed
+		}
+		return nil
+	},
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// splitHeaderFile is the name of the header written by split and read by
+// build.
+const splitHeaderFile = "header.json"
+
+// ReadSplitHeader reads the header of a directory written by split.
+func ReadSplitHeader(dir string) (*ExtractManifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, splitHeaderFile))
+	if err != nil {
+		return nil, err
+	}
+	var header ExtractManifest
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, splitHeaderFile), err)
+	}
+	return &header, nil
+}
+
+// removeSplitFiles removes the lump files listed in the header of an earlier
+// split of dir, so lumps the map no longer has don't linger.
+func removeSplitFiles(dir string) error {
+	header, err := ReadSplitHeader(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, lump := range header.Lumps {
+		err := os.Remove(filepath.Join(dir, filepath.Base(lump.File)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+var splitCmd = &cobra.Command{
+	Use:   "split <map> <dir>",
+	Short: "Split a map into a header and one file per lump for version control",
+	Long: `Write the header of the map as header.json and each standard and BSPX lump
+to its own file in dir, so maps can be tracked and diffed in git lump by
+lump. The entities are written as text to 00-entities.ent. Files of an
+earlier split of the same directory are replaced. build reassembles the map.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		err = removeSplitFiles(args[1])
+		if err != nil {
+			return err
+		}
+		header, err := extractLumps(cmd.Context(), args[0], &bspFile, f, args[1], true)
+		if err != nil {
+			return err
+		}
+		err = writeJSONFile(filepath.Join(args[1], splitHeaderFile), header)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Split %s into %d lumps in %s\n", args[0], len(header.Lumps), args[1])
+		return nil
+	},
+}
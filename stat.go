@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var statJSON bool
+var statFormat string
+var statReport string
+var statFailOn string
+
+// ClassnameCount is the number of entities with one classname.
+type ClassnameCount struct {
+	Classname string `json:"classname"`
+	Count     int    `json:"count"`
+}
+
+// MapStats holds the record counts of the decoded lumps of a map.
+type MapStats struct {
+	Filename        string           `json:"filename"`
+	Version         string           `json:"version"`
+	Models          int              `json:"models"`
+	Faces           int              `json:"faces"`
+	Vertexes        int              `json:"vertexes"`
+	Edges           int              `json:"edges"`
+	Surfedges       int              `json:"surfedges"`
+	Planes          int              `json:"planes"`
+	Nodes           int              `json:"nodes"`
+	Leafs           int              `json:"leafs"`
+	Clipnodes       int              `json:"clipnodes"`
+	Marksurfaces    int              `json:"marksurfaces"`
+	Texinfo         int              `json:"texinfo"`
+	Textures        int              `json:"textures"`
+	MissingTextures int              `json:"missingTextures"`
+	LightingBytes   int              `json:"lightingBytes"`
+	VisBytes        int              `json:"visBytes"`
+	Entities        int              `json:"entities"`
+	Classnames      []ClassnameCount `json:"classnames"`
+}
+
+// NewMapStats decodes the lumps of a map and counts their records. Entity
+// classnames are sorted by count, most frequent first.
+func NewMapStats(name string, bspFile *bsp.BspFile, r io.ReaderAt) (*MapStats, error) {
+	data, err := readMapData(bspFile, r)
+	if err != nil {
+		return nil, err
+	}
+	textureLump, err := bsp.ReadLump(bspFile, r, bsp.LumpTextures)
+	if err != nil {
+		return nil, err
+	}
+	textures, err := bsp.ParseTextureLump(textureLump)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &MapStats{
+		Filename:      path.Base(name),
+		Version:       bspFile.BspHeader.Version.String(),
+		Models:        len(data.models),
+		Faces:         len(data.faces),
+		Vertexes:      len(data.vertexes),
+		Edges:         len(data.edges),
+		Surfedges:     len(data.surfedges),
+		Planes:        len(data.planes),
+		Nodes:         len(data.nodes),
+		Leafs:         len(data.leafs),
+		Clipnodes:     len(data.clipNodes),
+		Marksurfaces:  len(data.marksurfs),
+		Texinfo:       len(data.texinfo),
+		Textures:      len(textures),
+		LightingBytes: int(bspFile.BspHeader.Lumps[bsp.LumpLighting].Length),
+		VisBytes:      int(bspFile.BspHeader.Lumps[bsp.LumpVisibility].Length),
+		Entities:      len(data.entities),
+	}
+	for i := range textures {
+		if textures[i].Missing() {
+			stats.MissingTextures++
+		}
+	}
+
+	counts := map[string]int{}
+	for _, entity := range data.entities {
+		counts[entity.Classname()]++
+	}
+	for classname, count := range counts {
+		stats.Classnames = append(stats.Classnames, ClassnameCount{classname, count})
+	}
+	sort.Slice(stats.Classnames, func(i, j int) bool {
+		if stats.Classnames[i].Count != stats.Classnames[j].Count {
+			return stats.Classnames[i].Count > stats.Classnames[j].Count
+		}
+		return stats.Classnames[i].Classname < stats.Classnames[j].Classname
+	})
+	return stats, nil
+}
+
+// StatFindings reports the counts of a map as info findings, one per count
+// with the check named after it, for CI pipelines tracking them, and warns
+// about missing textures.
+func StatFindings(stats *MapStats) []Finding {
+	findings := []Finding{}
+	for _, row := range stats.rows() {
+		check := "stat." + strings.ReplaceAll(strings.ToLower(row.name), " ", "_")
+		findings = append(findings, Finding{SeverityInfo, check, fmt.Sprintf("%d %s", row.count, strings.ToLower(row.name)), -1})
+	}
+	if stats.MissingTextures > 0 {
+		findings = append(findings, Finding{SeverityWarning, "stat.missing_textures", fmt.Sprintf("%d of %d texture slots are empty", stats.MissingTextures, stats.Textures), -1})
+	}
+	return findings
+}
+
+// statRow is one count of the stat table.
+type statRow struct {
+	name  string
+	count int
+}
+
+func (stats *MapStats) rows() []statRow {
+	return []statRow{
+		{"Models", stats.Models},
+		{"Faces", stats.Faces},
+		{"Vertexes", stats.Vertexes},
+		{"Edges", stats.Edges},
+		{"Surfedges", stats.Surfedges},
+		{"Planes", stats.Planes},
+		{"Nodes", stats.Nodes},
+		{"Leafs", stats.Leafs},
+		{"Clipnodes", stats.Clipnodes},
+		{"Marksurfaces", stats.Marksurfaces},
+		{"Texinfo", stats.Texinfo},
+		{"Textures", stats.Textures},
+		{"Missing textures", stats.MissingTextures},
+		{"Lighting bytes", stats.LightingBytes},
+		{"Vis bytes", stats.VisBytes},
+		{"Entities", stats.Entities},
+	}
+}
+
+var statCmd = &cobra.Command{
+	Use:   "stat <map>",
+	Short: "Print face, leaf, model, texture and entity counts",
+	Long: `Decode the lumps of a map and print the number of faces, vertexes, leafs,
+nodes, clipnodes, models and textures, and the entities by classname.
+--format executes a Go template with the counts instead, e.g.
+'{{.Version}} {{.Faces}} {{.Entities}}'; the fields are those of --json,
+capitalized.
+
+--report writes the counts as info findings in json, junit or sarif for CI
+pipelines, with a warning for missing textures, and exits non-zero when any
+finding is at or above the --fail-on severity.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		threshold, err := ParseSeverity(statFailOn)
+		if err != nil {
+			return err
+		}
+		if statReport != "" {
+			if err := CheckReportFormat(statReport); err != nil {
+				return err
+			}
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		stats, err := NewMapStats(args[0], &bspFile, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		if statReport != "" {
+			findings := StatFindings(stats)
+			err = WriteReport(os.Stdout, statReport, args[0], findings, threshold)
+			if err != nil {
+				return err
+			}
+			if FailsAt(findings, threshold) {
+				return ErrCheckFailed
+			}
+			return nil
+		}
+		if statFormat != "" {
+			return RenderFormat(os.Stdout, statFormat, stats)
+		}
+		if statJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(stats)
+		}
+
+		fmt.Printf("Filename: %s\n", stats.Filename)
+		fmt.Printf(" Version: %s\n", stats.Version)
+		for _, row := range stats.rows() {
+			fmt.Printf("  %-24s %8d\n", row.name, row.count)
+		}
+
+		fmt.Println("Classnames:")
+		for _, c := range stats.Classnames {
+			fmt.Printf("  %-24s %8d\n", c.Classname, c.Count)
+		}
+		return nil
+	},
+}
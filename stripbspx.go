@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var stripBspXCmd = &cobra.Command{
+	Use:   "strip-bspx <map>",
+	Short: "Remove all BSPX lumps",
+	Long: `Write a copy of the map cut off after the standard lumps, without the BSPX
+directory and its lumps, for engines that fail to load a map because of a
+BSPX lump.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.StreamBSPXContext(cmd.Context(), &bspFile, f, destName, func(doc *bsp.Document) error {
+			for _, xlump := range bspFile.BspXLumps {
+				doc.DeleteBspXLump(bsp.BytesToString(xlump.LumpName[:]))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d BSPX lumps, wrote %s\n", len(bspFile.BspXLumps), destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
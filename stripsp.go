@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var stripSPKeep []string
+
+// singlePlayerClassnames are the classname patterns of entities that only
+// matter in single player: monsters, level changes and skill selection,
+// episode gates, keys and sigils.
+var singlePlayerClassnames = []string{
+	"monster_*",
+	"trigger_changelevel",
+	"trigger_setskill",
+	"trigger_monsterjump",
+	"func_episodegate",
+	"func_bossgate",
+	"item_key1",
+	"item_key2",
+	"item_sigil",
+	"info_player_coop",
+}
+
+// StripSinglePlayer removes the entities whose classname matches a pattern
+// of singlePlayerClassnames but none of keep, and returns the rest with the
+// number removed per classname.
+func StripSinglePlayer(entities []bsp.Entity, keep []string) ([]bsp.Entity, map[string]int) {
+	matchAny := func(patterns []string, classname string) bool {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, classname); matched {
+				return true
+			}
+		}
+		return false
+	}
+
+	removed := map[string]int{}
+	kept := entities[:0]
+	for i := range entities {
+		classname := entities[i].Classname()
+		if matchAny(singlePlayerClassnames, classname) && !matchAny(keep, classname) {
+			removed[classname]++
+			continue
+		}
+		kept = append(kept, entities[i])
+	}
+	return kept, removed
+}
+
+var entitiesStripSPCmd = &cobra.Command{
+	Use:   "strip-sp <map>",
+	Short: "Remove single player entities for deathmatch servers",
+	Long: `Write a copy of the map without the entities only single player needs, so
+classic single player maps can be run on deathmatch servers: monsters,
+trigger_changelevel, trigger_setskill, trigger_monsterjump, the episode and
+boss gates, keys, sigils and coop spawns. --keep keeps classnames matching a
+glob pattern, e.g. --keep item_key* for maps with key doors. The removed
+entities are listed per classname.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, pattern := range stripSPKeep {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid classname pattern %q: %w", pattern, err)
+			}
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		entities, removed := StripSinglePlayer(entities, stripSPKeep)
+		if len(removed) == 0 {
+			fmt.Printf("%s: no single player entities\n", args[0])
+			return nil
+		}
+		classnames := make([]string, 0, len(removed))
+		total := 0
+		for classname, count := range removed {
+			classnames = append(classnames, classname)
+			total += count
+		}
+		sort.Strings(classnames)
+		for _, classname := range classnames {
+			fmt.Printf("  %-24s %8d\n", classname, removed[classname])
+		}
+		fmt.Printf("  %-24s %8d\n", "Total", total)
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %d entities, wrote %s\n", total, destName)
+		return nil
+	},
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// FaceLightmapSize returns the number of lightmap samples per style of a face
+// lit at the standard 16 units per sample.
+func FaceLightmapSize(winding []bsp.Vec3, texinfo *bsp.Texinfo) int {
+	if len(winding) == 0 {
+		return 0
+	}
+	size := 1
+	for axis := 0; axis < 2; axis++ {
+		vec := texinfo.Vecs[axis]
+		min, max := math.Inf(1), math.Inf(-1)
+		for _, v := range winding {
+			val := float64(v[0])*float64(vec[0]) + float64(v[1])*float64(vec[1]) + float64(v[2])*float64(vec[2]) + float64(vec[3])
+			min = math.Min(min, val)
+			max = math.Max(max, val)
+		}
+		extent := int(math.Ceil(max/16)) - int(math.Floor(min/16))
+		size *= extent + 1
+	}
+	return size
+}
+
+// FaceStyles returns the number of lightstyles a face has lightmaps for.
+func FaceStyles(face *bsp.FaceV2) int {
+	styles := 0
+	for _, style := range [4]uint8{face.TypeLight, face.BaseLight, face.Light[0], face.Light[1]} {
+		if style != 255 {
+			styles++
+		}
+	}
+	return styles
+}
+
+// modelExtractor copies everything one model references into a new, densely
+// numbered mapData.
+type modelExtractor struct {
+	src      *mapData
+	out      mapData
+	planes   map[int32]int32
+	vertexes map[uint32]uint32
+	edges    map[uint32]uint32
+	texinfo  map[int32]int32
+	leafs    map[int32]int32
+}
+
+func (x *modelExtractor) plane(id int32) int32 {
+	if mapped, found := x.planes[id]; found {
+		return mapped
+	}
+	mapped := int32(len(x.out.planes))
+	x.planes[id] = mapped
+	x.out.planes = append(x.out.planes, x.src.planes[id])
+	return mapped
+}
+
+func (x *modelExtractor) vertex(id uint32) uint32 {
+	if mapped, found := x.vertexes[id]; found {
+		return mapped
+	}
+	mapped := uint32(len(x.out.vertexes))
+	x.vertexes[id] = mapped
+	x.out.vertexes = append(x.out.vertexes, x.src.vertexes[id])
+	return mapped
+}
+
+func (x *modelExtractor) edge(id uint32) uint32 {
+	if mapped, found := x.edges[id]; found {
+		return mapped
+	}
+	edge := x.src.edges[id]
+	mapped := uint32(len(x.out.edges))
+	x.edges[id] = mapped
+	x.out.edges = append(x.out.edges, [2]uint32{x.vertex(edge[0]), x.vertex(edge[1])})
+	return mapped
+}
+
+func (x *modelExtractor) texinfoId(id int32) int32 {
+	if mapped, found := x.texinfo[id]; found {
+		return mapped
+	}
+	mapped := int32(len(x.out.texinfo))
+	x.texinfo[id] = mapped
+	x.out.texinfo = append(x.out.texinfo, x.src.texinfo[id])
+	return mapped
+}
+
+// node copies a hull 0 subtree and returns the new child number.
+func (x *modelExtractor) node(num int32, firstFace int32, numFaces int32) (int32, error) {
+	if num < 0 {
+		return x.leaf(-1-num, firstFace, numFaces)
+	}
+	if int(num) >= len(x.src.nodes) {
+		return 0, fmt.Errorf("node %d out of range", num)
+	}
+	node := x.src.nodes[num]
+	mapped := int32(len(x.out.nodes))
+	x.out.nodes = append(x.out.nodes, bsp.Node{})
+
+	if int(node.PlaneId) >= len(x.src.planes) {
+		return 0, fmt.Errorf("node %d references plane %d out of range", num, node.PlaneId)
+	}
+	node.PlaneId = x.plane(node.PlaneId)
+	if int32(node.FirstFace) >= firstFace && int32(node.FirstFace+node.NumFaces) <= firstFace+numFaces {
+		node.FirstFace -= uint32(firstFace)
+	} else {
+		node.FirstFace, node.NumFaces = 0, 0
+	}
+	for i := range node.Children {
+		child, err := x.node(node.Children[i], firstFace, numFaces)
+		if err != nil {
+			return 0, err
+		}
+		node.Children[i] = child
+	}
+	x.out.nodes[mapped] = node
+	return mapped, nil
+}
+
+func (x *modelExtractor) leaf(id int32, firstFace int32, numFaces int32) (int32, error) {
+	if mapped, found := x.leafs[id]; found {
+		return -1 - mapped, nil
+	}
+	if int(id) >= len(x.src.leafs) {
+		return 0, fmt.Errorf("leaf %d out of range", id)
+	}
+	leaf := x.src.leafs[id]
+	leaf.VisOfs = -1
+
+	first := uint32(len(x.out.marksurfs))
+	for i := leaf.FirstMarkSurface; i < leaf.FirstMarkSurface+leaf.NumMarkSurfaces && int(i) < len(x.src.marksurfs); i++ {
+		face := int32(x.src.marksurfs[i])
+		if face >= firstFace && face < firstFace+numFaces {
+			x.out.marksurfs = append(x.out.marksurfs, uint32(face-firstFace))
+		}
+	}
+	leaf.FirstMarkSurface = first
+	leaf.NumMarkSurfaces = uint32(len(x.out.marksurfs)) - first
+
+	mapped := int32(len(x.out.leafs))
+	x.leafs[id] = mapped
+	x.out.leafs = append(x.out.leafs, leaf)
+	return -1 - mapped, nil
+}
+
+// clipNode copies a clipping hull subtree and returns the new child number.
+func (x *modelExtractor) clipNode(num int32) (int32, error) {
+	if num < 0 {
+		return num, nil
+	}
+	if int(num) >= len(x.src.clipNodes) {
+		return 0, fmt.Errorf("clipnode %d out of range", num)
+	}
+	clipNode := x.src.clipNodes[num]
+	mapped := int32(len(x.out.clipNodes))
+	x.out.clipNodes = append(x.out.clipNodes, bsp.ClipNode{})
+
+	if int(clipNode.PlaneId) >= len(x.src.planes) {
+		return 0, fmt.Errorf("clipnode %d references plane %d out of range", num, clipNode.PlaneId)
+	}
+	clipNode.PlaneId = x.plane(clipNode.PlaneId)
+	for i := range clipNode.Children {
+		child, err := x.clipNode(clipNode.Children[i])
+		if err != nil {
+			return 0, err
+		}
+		clipNode.Children[i] = child
+	}
+	x.out.clipNodes[mapped] = clipNode
+	return mapped, nil
+}
+
+// ExtractModel copies model index of data, with its faces, nodes, leafs,
+// clipnodes and everything they reference, into a new map where it is the
+// world model. Lightmaps are copied when lighting is given, textures are
+// renumbered in the returned textures lump.
+func ExtractModel(data *mapData, index int, lighting []byte, textures []bsp.TextureEntry) (*mapData, []byte, []bsp.TextureEntry, error) {
+	if index < 0 || index >= len(data.models) {
+		return nil, nil, nil, fmt.Errorf("model %d out of range, map has %d models", index, len(data.models))
+	}
+	model := data.models[index]
+	if model.FirstFace < 0 || int(model.FirstFace+model.NumFaces) > len(data.faces) {
+		return nil, nil, nil, fmt.Errorf("model %d face range out of bounds", index)
+	}
+
+	x := &modelExtractor{
+		src:      data,
+		out:      mapData{bspFile: data.bspFile},
+		planes:   map[int32]int32{},
+		vertexes: map[uint32]uint32{},
+		edges:    map[uint32]uint32{},
+		texinfo:  map[int32]int32{},
+		leafs:    map[int32]int32{},
+	}
+	// Edge 0 is never used by faces since its negation is ambiguous, and leaf
+	// 0 is the shared solid leaf.
+	x.edges[0] = 0
+	x.out.edges = append(x.out.edges, [2]uint32{0, 0})
+	if len(data.leafs) > 0 {
+		x.leafs[0] = 0
+		x.out.leafs = append(x.out.leafs, data.leafs[0])
+		x.out.leafs[0].VisOfs = -1
+		x.out.leafs[0].NumMarkSurfaces = 0
+	}
+
+	var newLighting []byte
+	for i := model.FirstFace; i < model.FirstFace+model.NumFaces; i++ {
+		face := data.faces[i]
+		if int(face.TexinfoId) >= len(data.texinfo) {
+			return nil, nil, nil, fmt.Errorf("face %d references texinfo %d out of range", i, face.TexinfoId)
+		}
+		winding := bsp.FaceWinding(&face, data.edges, data.surfedges, data.vertexes)
+
+		if face.Lightmap >= 0 && lighting != nil {
+			size := FaceLightmapSize(winding, &data.texinfo[face.TexinfoId]) * FaceStyles(&face)
+			if int(face.Lightmap)+size <= len(lighting) {
+				offset := len(newLighting)
+				newLighting = append(newLighting, lighting[face.Lightmap:int(face.Lightmap)+size]...)
+				face.Lightmap = int32(offset)
+			} else {
+				face.Lightmap = -1
+			}
+		} else {
+			face.Lightmap = -1
+		}
+
+		first := uint32(len(x.out.surfedges))
+		for j := face.LedgeId; j < face.LedgeId+face.LedgeNum && int(j) < len(data.surfedges); j++ {
+			edge, ok := bsp.SurfedgeEdge(data.surfedges[j], len(data.edges))
+			if !ok {
+				return nil, nil, nil, fmt.Errorf("face %d references edge %d out of range", i, data.surfedges[j])
+			}
+			sign := int32(1)
+			if data.surfedges[j] < 0 {
+				sign = -1
+			}
+			for _, vertex := range data.edges[edge] {
+				if int(vertex) >= len(data.vertexes) {
+					return nil, nil, nil, fmt.Errorf("edge %d references vertex %d out of range", edge, vertex)
+				}
+			}
+			x.out.surfedges = append(x.out.surfedges, sign*int32(x.edge(uint32(edge))))
+		}
+		face.LedgeId = first
+		face.LedgeNum = uint32(len(x.out.surfedges)) - first
+
+		if int(face.PlaneId) >= len(data.planes) {
+			return nil, nil, nil, fmt.Errorf("face %d references plane %d out of range", i, face.PlaneId)
+		}
+		face.PlaneId = uint32(x.plane(int32(face.PlaneId)))
+		face.TexinfoId = uint32(x.texinfoId(int32(face.TexinfoId)))
+		x.out.faces = append(x.out.faces, face)
+	}
+
+	newModel := model
+	newModel.FirstFace = 0
+	headNode, err := x.node(model.HeadNode[0], model.FirstFace, model.NumFaces)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	newModel.HeadNode[0] = headNode
+	for hull := 1; hull < len(model.HeadNode); hull++ {
+		// Quake only builds three hulls, the unused fourth head node is 0.
+		if hull == 3 && data.bspFile.BspHeader.Version != bsp.BspVersionHalfLife {
+			newModel.HeadNode[hull] = 0
+			continue
+		}
+		if headNode, err = x.clipNode(model.HeadNode[hull]); err != nil {
+			return nil, nil, nil, err
+		}
+		newModel.HeadNode[hull] = headNode
+	}
+	newModel.VisLeafs = int32(len(x.out.leafs) - 1)
+	x.out.models = []bsp.Model{newModel}
+
+	// Renumber the textures the copied texinfo use.
+	var newTextures []bsp.TextureEntry
+	textureMap := map[int32]int32{}
+	for i := range x.out.texinfo {
+		miptex := x.out.texinfo[i].MipTex
+		if miptex < 0 || int(miptex) >= len(textures) {
+			continue
+		}
+		mapped, found := textureMap[miptex]
+		if !found {
+			mapped = int32(len(newTextures))
+			textureMap[miptex] = mapped
+			newTextures = append(newTextures, textures[miptex])
+		}
+		x.out.texinfo[i].MipTex = mapped
+	}
+
+	return &x.out, newLighting, newTextures, nil
+}
+
+var extractModelCmd = &cobra.Command{
+	Use:   "extract-model <map> <model> <out.bsp>",
+	Short: "Extract a brush model into a standalone map",
+	Long: `Copy one brush model, e.g. *1 or 1, with its faces, nodes, clipnodes,
+vertexes, edges, texinfo, textures and lightmaps into a minimal map where it
+is the world model. Visibility and BSPX lumps are not copied.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		index, err := strconv.Atoi(strings.TrimPrefix(args[1], "*"))
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+
+		lighting, err := bsp.ReadLump(&bspFile, f, bsp.LumpLighting)
+		if err != nil {
+			return err
+		}
+		// Lightmaps sized by LMSHIFT or DECOUPLED_LM can't be cut out with the
+		// standard 16 unit sample size.
+		if bsp.FindBspXLump(&bspFile, "LMSHIFT") != nil || bsp.FindBspXLump(&bspFile, "DECOUPLED_LM") != nil {
+			Warnf("map uses custom lightmap scales, lightmaps are not copied")
+			lighting = nil
+		}
+
+		buffer, err := bsp.ReadLump(&bspFile, f, bsp.LumpTextures)
+		if err != nil {
+			return err
+		}
+		textures, err := bsp.ParseTextureLump(buffer)
+		if err != nil {
+			return err
+		}
+
+		extracted, newLighting, newTextures, err := ExtractModel(data, index, lighting, textures)
+		if err != nil {
+			return err
+		}
+
+		worldspawn := bsp.Entity{}
+		worldspawn.Set("classname", "worldspawn")
+		for _, entity := range data.entities {
+			if entity.Classname() == "worldspawn" && entity.Has("wad") {
+				worldspawn.Set("wad", entity.Get("wad"))
+			}
+		}
+		description := fmt.Sprintf("*%d of %s", index, filepath.Base(args[0]))
+		for _, entity := range data.entities {
+			if entity.Get("model") == fmt.Sprintf("*%d", index) {
+				description = fmt.Sprintf("%s (%s)", description, entity.Classname())
+				break
+			}
+		}
+		worldspawn.Set("message", description)
+		extracted.entities = []bsp.Entity{worldspawn}
+
+		entitiesLump, err := bsp.FormatEntities(extracted.entities)
+		if err != nil {
+			return err
+		}
+		err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, args[2], func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+			extracted.encodeGeometry(lumps)
+			lumps[bsp.LumpEntities] = entitiesLump
+			lumps[bsp.LumpTextures] = bsp.EncodeTextureLump(newTextures)
+			lumps[bsp.LumpLighting] = newLighting
+			lumps[bsp.LumpVisibility] = nil
+			bspx.Clear()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Wrote %s: %d faces, %d nodes, %d clipnodes, %d textures\n", args[2], len(extracted.faces), len(extracted.nodes), len(extracted.clipNodes), len(newTextures))
+		return nil
+	},
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var targetsDot string
+
+// firingKeys are the keys naming the targetname of the entities an entity
+// fires, with the style of their edges in DOT output.
+var firingKeys = []struct {
+	Key   string
+	Style string
+}{
+	{"target", "solid"},
+	{"killtarget", "dashed"},
+}
+
+// TargetLink is an edge of the target graph: entity From names To in Key.
+// To is -1 if no entity has the targetname.
+type TargetLink struct {
+	From       int
+	To         int
+	Key        string
+	Targetname string
+}
+
+// TargetGraph is the graph of entities firing each other through target and
+// killtarget.
+type TargetGraph struct {
+	Links []TargetLink
+	// Targeted is set for the entities some other entity names.
+	Targeted map[int]bool
+}
+
+// BuildTargetGraph links every target and killtarget to the entities with a
+// matching targetname.
+func BuildTargetGraph(entities []bsp.Entity) *TargetGraph {
+	byName := map[string][]int{}
+	for i := range entities {
+		if name := entities[i].Get("targetname"); name != "" {
+			byName[name] = append(byName[name], i)
+		}
+	}
+
+	graph := &TargetGraph{Targeted: map[int]bool{}}
+	for i := range entities {
+		for _, firingKey := range firingKeys {
+			name := entities[i].Get(firingKey.Key)
+			if name == "" {
+				continue
+			}
+			targets := byName[name]
+			if len(targets) == 0 {
+				graph.Links = append(graph.Links, TargetLink{i, -1, firingKey.Key, name})
+			}
+			for _, target := range targets {
+				graph.Links = append(graph.Links, TargetLink{i, target, firingKey.Key, name})
+				graph.Targeted[target] = true
+			}
+		}
+	}
+	return graph
+}
+
+// Findings reports links to missing targetnames as errors and entities with a
+// targetname nothing names as warnings: a door or trigger waiting to be fired
+// that never is.
+func (g *TargetGraph) Findings(entities []bsp.Entity) []Finding {
+	var findings []Finding
+	for _, link := range g.Links {
+		if link.To < 0 {
+			findings = append(findings, Finding{SeverityError, "entities.target", fmt.Sprintf("%s %s \"%s\" matches no targetname", entityRef(entities, link.From), link.Key, link.Targetname), link.From})
+		}
+	}
+	for i := range entities {
+		if entities[i].Has("targetname") && !g.Targeted[i] {
+			findings = append(findings, Finding{SeverityWarning, "entities.targetname", fmt.Sprintf("%s targetname \"%s\" is never targeted", entityRef(entities, i), entities[i].Get("targetname")), i})
+		}
+	}
+	return findings
+}
+
+// dotQuote quotes lines of text as a DOT string.
+func dotQuote(lines ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	for i, line := range lines {
+		lines[i] = escaper.Replace(line)
+	}
+	return `"` + strings.Join(lines, `\n`) + `"`
+}
+
+// WriteDot writes the graph in Graphviz DOT format. Entities are labelled
+// with their index, classname and targetname; missing targetnames are drawn
+// as red nodes.
+func (g *TargetGraph) WriteDot(w io.Writer, entities []bsp.Entity) error {
+	nodes := map[int]bool{}
+	var missing []string
+	seenMissing := map[string]bool{}
+	for _, link := range g.Links {
+		nodes[link.From] = true
+		if link.To >= 0 {
+			nodes[link.To] = true
+		} else if !seenMissing[link.Targetname] {
+			seenMissing[link.Targetname] = true
+			missing = append(missing, link.Targetname)
+		}
+	}
+	for i := range entities {
+		if entities[i].Has("targetname") {
+			nodes[i] = true
+		}
+	}
+	indexes := make([]int, 0, len(nodes))
+	for i := range nodes {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "digraph targets {")
+	fmt.Fprintln(b, "  node [shape=box];")
+	for _, i := range indexes {
+		label := []string{fmt.Sprintf("#%d %s", i, entities[i].Classname())}
+		if name := entities[i].Get("targetname"); name != "" {
+			label = append(label, name)
+		}
+		fmt.Fprintf(b, "  e%d [label=%s];\n", i, dotQuote(label...))
+	}
+	for _, name := range missing {
+		fmt.Fprintf(b, "  %s [color=red, fontcolor=red];\n", dotQuote("missing: "+name))
+	}
+	for _, link := range g.Links {
+		style := "solid"
+		for _, firingKey := range firingKeys {
+			if firingKey.Key == link.Key {
+				style = firingKey.Style
+			}
+		}
+		to := fmt.Sprintf("e%d", link.To)
+		if link.To < 0 {
+			to = dotQuote("missing: " + link.Targetname)
+		}
+		fmt.Fprintf(b, "  e%d -> %s [style=%s];\n", link.From, to, style)
+	}
+	fmt.Fprintln(b, "}")
+	return b.Flush()
+}
+
+var entitiesTargetsCmd = &cobra.Command{
+	Use:   "targets <map>",
+	Short: "Check the target/targetname links between entities",
+	Long: `Build the graph of entities firing each other through target and killtarget
+and report broken links: targets no entity has as targetname are errors,
+targetnames nothing targets, such as doors no trigger opens, are warnings.
+Exits with status 3 if there are errors.
+
+--dot writes the graph in Graphviz DOT format to a file, or with - to stdout
+instead of the report:
+
+  bspxmgr entities targets --dot - dm4.bsp | dot -Tsvg -o dm4-targets.svg`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		graph := BuildTargetGraph(entities)
+		if targetsDot == "-" {
+			return graph.WriteDot(os.Stdout, entities)
+		}
+		if targetsDot != "" {
+			out, err := os.Create(targetsDot)
+			if err != nil {
+				return err
+			}
+			err = graph.WriteDot(out, entities)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		findings := graph.Findings(entities)
+		if len(findings) == 0 {
+			fmt.Printf("%s: %d links, no problems found\n", args[0], len(graph.Links))
+		}
+		for _, finding := range findings {
+			fmt.Println(finding)
+		}
+		if FailsAt(findings, SeverityError) {
+			return ErrCheckFailed
+		}
+		return nil
+	},
+}
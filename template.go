@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var templateParams []string
+var templateInstances string
+
+// ExpandTemplate replaces ${name} in an entity template with the parameter of
+// that name and parses the result. Every parameter used must be given.
+func ExpandTemplate(template string, params map[string]string) ([]bsp.Entity, error) {
+	unset := map[string]bool{}
+	expanded := os.Expand(template, func(name string) string {
+		value, ok := params[name]
+		if !ok {
+			unset[name] = true
+		}
+		return value
+	})
+	if len(unset) > 0 {
+		missing := make([]string, 0, len(unset))
+		for name := range unset {
+			missing = append(missing, name)
+		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("no value for %s", strings.Join(missing, ", "))
+	}
+	return bsp.ParseEntities([]byte(expanded))
+}
+
+// readTemplateInstances reads a JSON array of parameter objects, one per
+// expansion of the template.
+func readTemplateInstances(path string) ([]map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var instances []map[string]string
+	if err := json.Unmarshal(data, &instances); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return instances, nil
+}
+
+var entitiesTemplateCmd = &cobra.Command{
+	Use:   "template <map> <template.ent>",
+	Short: "Append entities expanded from a template with parameters",
+	Long: `Write a copy of the map with the entities of a template appended, for
+per-event additions such as sponsor logos or announcement triggers. The
+template is a .ent file in which ${name} is replaced with the value of
+--param name=value; ${map} is the name of the map. Parameters without a
+value are an error.
+
+--instances expands the template once for every object of a JSON array,
+e.g. [{"origin": "0 0 64", "model": "progs/logo1.mdl"}, ...], with --param
+giving the values all instances share.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := filepath.Base(filepath.FromSlash(args[0]))
+		shared := map[string]string{"map": strings.TrimSuffix(name, filepath.Ext(name))}
+		for _, param := range templateParams {
+			key, value, found := strings.Cut(param, "=")
+			if !found || key == "" {
+				return fmt.Errorf("invalid --param %q, expected name=value", param)
+			}
+			shared[key] = value
+		}
+		instances := []map[string]string{{}}
+		if templateInstances != "" {
+			var err error
+			instances, err = readTemplateInstances(templateInstances)
+			if err != nil {
+				return err
+			}
+			if len(instances) == 0 {
+				return fmt.Errorf("%s: no instances", templateInstances)
+			}
+		}
+
+		template, err := os.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		var added []bsp.Entity
+		for i, instance := range instances {
+			params := map[string]string{}
+			for key, value := range shared {
+				params[key] = value
+			}
+			for key, value := range instance {
+				params[key] = value
+			}
+			entities, err := ExpandTemplate(string(template), params)
+			if err != nil {
+				if templateInstances != "" {
+					return fmt.Errorf("%s: instance %d: %w", args[1], i+1, err)
+				}
+				return fmt.Errorf("%s: %w", args[1], err)
+			}
+			added = append(added, entities...)
+		}
+		if len(added) == 0 {
+			return fmt.Errorf("%s: no entities", args[1])
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		entities = append(entities, added...)
+
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %d entities from %d instances of %s, wrote %s\n", len(added), len(instances), args[1], destName)
+		return nil
+	},
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// textureColor derives a stable, reasonably bright colour from a name.
+func textureColor(name string) color.RGBA {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	sum := hash.Sum32()
+	return color.RGBA{uint8(64 + sum%192), uint8(64 + (sum>>8)%192), uint8(64 + (sum>>16)%192), 255}
+}
+
+// lmshiftColors shade faces by lightmap scale, from 1 unit (shift 0) to 16
+// units (shift 4) and beyond.
+var lmshiftColors = []color.RGBA{
+	{230, 40, 40, 255},
+	{240, 140, 30, 255},
+	{240, 220, 40, 255},
+	{80, 200, 80, 255},
+	{60, 120, 230, 255},
+	{160, 80, 220, 255},
+}
+
+// RenderTextureMap draws the world faces from above, lower faces first, each
+// filled with the colour colorOf returns for it. Faces colorOf skips are not
+// drawn. It returns the number of faces drawn per legend label.
+func RenderTextureMap(data *mapData, size int, colorOf func(face int) (string, color.RGBA, bool)) (*image.RGBA, map[string]color.RGBA, map[string]int) {
+	world := data.models[0]
+	canvas := newLayoutCanvas(world, size)
+
+	type coloredFace struct {
+		winding []bsp.Vec3
+		z       float32
+		label   string
+		color   color.RGBA
+	}
+	var faces []coloredFace
+	for i := world.FirstFace; i < world.FirstFace+world.NumFaces && int(i) < len(data.faces); i++ {
+		label, col, ok := colorOf(int(i))
+		if !ok {
+			continue
+		}
+		winding := bsp.FaceWinding(&data.faces[i], data.edges, data.surfedges, data.vertexes)
+		if len(winding) < 3 {
+			continue
+		}
+		var z float32
+		for _, v := range winding {
+			z += v[2]
+		}
+		faces = append(faces, coloredFace{winding, z / float32(len(winding)), label, col})
+	}
+	sort.SliceStable(faces, func(i, j int) bool { return faces[i].z < faces[j].z })
+
+	legend := map[string]color.RGBA{}
+	counts := map[string]int{}
+	outline := color.RGBA{16, 16, 16, 255}
+	for _, face := range faces {
+		canvas.polygon(face.winding, face.color)
+		for i := range face.winding {
+			x0, y0 := canvas.project(face.winding[i])
+			x1, y1 := canvas.project(face.winding[(i+1)%len(face.winding)])
+			canvas.line(x0, y0, x1, y1, outline)
+		}
+		legend[face.label] = face.color
+		counts[face.label]++
+	}
+	return canvas.img, legend, counts
+}
+
+var texmapSize int
+var texmapBy string
+var texmapHighlight string
+
+var texmapCmd = &cobra.Command{
+	Use:   "texmap <map> <out.png>",
+	Short: "Render a top-down image coloured by texture",
+	Long: `Render a top-down PNG of the world with every face filled in a colour per
+texture, or per lightmap scale with --by lmshift. With --highlight, faces
+whose texture matches the glob pattern are drawn in red and all others in
+grey, to find where a texture is used before renaming or replacing it.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		if len(data.models) == 0 {
+			return fmt.Errorf("map has no world model")
+		}
+		buffer, err := bsp.ReadLump(&bspFile, f, bsp.LumpTextures)
+		if err != nil {
+			return err
+		}
+		textures, err := bsp.ParseTextureLump(buffer)
+		if err != nil {
+			return err
+		}
+
+		var colorOf func(face int) (string, color.RGBA, bool)
+		switch {
+		case texmapHighlight != "":
+			pattern := strings.ToLower(texmapHighlight)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return err
+			}
+			colorOf = func(face int) (string, color.RGBA, bool) {
+				name := FaceTextureName(data, textures, &data.faces[face])
+				if matched, _ := path.Match(pattern, strings.ToLower(name)); matched {
+					return name, color.RGBA{230, 40, 40, 255}, true
+				}
+				return "other", color.RGBA{90, 90, 90, 255}, true
+			}
+		case texmapBy == "texture":
+			colorOf = func(face int) (string, color.RGBA, bool) {
+				name := FaceTextureName(data, textures, &data.faces[face])
+				return name, textureColor(name), true
+			}
+		case texmapBy == "lmshift":
+			shifts, err := bsp.ReadBspXLump(&bspFile, f, "LMSHIFT")
+			if err != nil {
+				return err
+			}
+			if len(shifts) != len(data.faces) {
+				Warnf("no per face LMSHIFT lump, all faces use the default scale")
+			}
+			colorOf = func(face int) (string, color.RGBA, bool) {
+				shift := 4
+				if face < len(shifts) {
+					shift = int(shifts[face])
+				}
+				index := shift
+				if index >= len(lmshiftColors) {
+					index = len(lmshiftColors) - 1
+				}
+				return fmt.Sprintf("%d units per sample", 1<<shift), lmshiftColors[index], true
+			}
+		default:
+			return fmt.Errorf("unknown attribute %q, expected texture or lmshift", texmapBy)
+		}
+
+		img, legend, counts := RenderTextureMap(data, texmapSize, colorOf)
+
+		out, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		err = png.Encode(out, img)
+		if err != nil {
+			return err
+		}
+
+		var labels []string
+		for label := range legend {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		fmt.Println("Legend:")
+		for _, label := range labels {
+			col := legend[label]
+			fmt.Printf("  #%02x%02x%02x  %5d faces  %s\n", col.R, col.G, col.B, counts[label], label)
+		}
+		return nil
+	},
+}
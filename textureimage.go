@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var texturesExportFormat string
+var texturesExportPalette string
+var texturesExportLuma bool
+
+// loadPalette reads a palette.lmp, or returns the Quake palette if path is
+// empty.
+func loadPalette(path string) (color.Palette, error) {
+	if path == "" {
+		return bsp.QuakePalette(), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	palette, err := bsp.ParsePalette(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return palette, nil
+}
+
+// lumaPalette returns palette with every colour that is not fullbright
+// black, for the _luma images engines add on top of the lit texture.
+func lumaPalette(palette color.Palette) color.Palette {
+	luma := append(color.Palette(nil), palette...)
+	for i := 0; i < bsp.FullbrightStart; i++ {
+		luma[i] = color.RGBA{0, 0, 0, 255}
+	}
+	return luma
+}
+
+// textureFileName returns the file name texture packs use for a texture,
+// with the * of liquids, not allowed on every file system, written as #.
+func textureFileName(name string) string {
+	return strings.ReplaceAll(name, "*", "#")
+}
+
+// writeTGA writes img as an uncompressed 32 bit TGA image.
+func writeTGA(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	header := []byte{
+		0, 0, 2, // no image id, no colour map, uncompressed true colour
+		0, 0, 0, 0, 0,
+		0, 0, 0, 0,
+		byte(width), byte(width >> 8), byte(height), byte(height >> 8),
+		32, 0x28, // 8 alpha bits, rows top to bottom
+	}
+	buffer := bufio.NewWriter(w)
+	buffer.Write(header)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			buffer.Write([]byte{c.B, c.G, c.R, c.A})
+		}
+	}
+	return buffer.Flush()
+}
+
+// writeTextureImage writes img to name in the given format, png or tga.
+func writeTextureImage(name string, img image.Image, format string) error {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if format == "tga" {
+		err = writeTGA(out, img)
+	} else {
+		err = png.Encode(out, img)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+var texturesExportCmd = &cobra.Command{
+	Use:   "export <map> <dir> [pattern]...",
+	Short: "Write the embedded textures as PNG or TGA images",
+	Long: `Write every embedded texture, or those whose name matches a glob pattern, to
+an image named after the texture in dir, translated with the Quake palette
+or the palette.lmp given with --palette. The * of liquid textures is written
+as # in file names, as texture packs do. Alpha masked ({) textures are
+written with the transparent colour see-through.
+
+Colours from index 224 on are drawn fullbright by engines. With --luma
+textures using them get an additional <name>_luma image with every other
+colour black, the glow layer texture packs use.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format := strings.ToLower(texturesExportFormat)
+		if format != "png" && format != "tga" {
+			return fmt.Errorf("invalid format %q, expected png or tga", texturesExportFormat)
+		}
+		patterns := args[2:]
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid texture pattern %q: %w", pattern, err)
+			}
+		}
+		palette, err := loadPalette(texturesExportPalette)
+		if err != nil {
+			return err
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		textures, err := readTextures(&bspFile, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		err = os.MkdirAll(args[1], 0755)
+		if err != nil {
+			return err
+		}
+
+		written := 0
+		for i := range textures {
+			texture := &textures[i]
+			if texture.Missing() || !matchesAny(patterns, strings.ToLower(texture.Name())) {
+				continue
+			}
+			img := bsp.TextureImage(texture, 0, palette)
+			if img == nil {
+				Infof("skipping external texture %s", texture.Name())
+				continue
+			}
+			base := filepath.Join(args[1], textureFileName(texture.Name()))
+			err = writeTextureImage(base+"."+format, img, format)
+			if err != nil {
+				return err
+			}
+			Debugf("wrote %s.%s", base, format)
+			written++
+
+			if texturesExportLuma && bsp.HasFullbrights(texture, 0) {
+				luma := bsp.TextureImage(texture, 0, lumaPalette(palette))
+				err = writeTextureImage(base+"_luma."+format, luma, format)
+				if err != nil {
+					return err
+				}
+				Debugf("wrote %s_luma.%s", base, format)
+			}
+		}
+		if written == 0 && len(patterns) > 0 {
+			return fmt.Errorf("%s: no embedded textures match %s", args[0], strings.Join(patterns, ", "))
+		}
+		if written == 0 {
+			return fmt.Errorf("%s: no embedded textures to export", args[0])
+		}
+		fmt.Printf("Wrote %d textures to %s\n", written, args[1])
+		return nil
+	},
+}
+
+// matchesAny reports whether the lower case name matches one of the glob
+// patterns, compared case-insensitively, or whether there are no patterns.
+func matchesAny(patterns []string, name string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+var texturesReplacePalette string
+var texturesReplaceFullbrights bool
+
+var texturesReplaceCmd = &cobra.Command{
+	Use:   "replace <map> <name> <image.png>",
+	Short: "Replace the pixels of a texture with a PNG image",
+	Long: `Write a copy of the map with the texture of the given name, matched
+case-insensitively, replaced by a PNG image, for texture hotfixes on compiled
+maps. The image is quantized to the Quake palette or the palette.lmp given
+with --palette and the four mip levels are regenerated. Fullbright colours
+are only used with --fullbrights, since they glow in the dark. For alpha
+masked ({) textures mostly transparent pixels become the transparent colour.
+
+The width and height of the image must be multiples of 16. An image of a
+different size than the texture is embedded with its own size, with a
+warning since it no longer lines up the same. External textures of that name
+become embedded.`,
+	Args: cobra.ExactArgs(3),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		palette, err := loadPalette(texturesReplacePalette)
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(args[2])
+		if err != nil {
+			return err
+		}
+		img, err := png.Decode(in)
+		in.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[2], err)
+		}
+		width, height := img.Bounds().Dx(), img.Bounds().Dy()
+		if width == 0 || height == 0 || width%16 != 0 || height%16 != 0 {
+			return fmt.Errorf("%s: image is %dx%d, width and height must be multiples of 16", args[2], width, height)
+		}
+
+		textures, err := readMapTextures(args[0])
+		if err != nil {
+			return err
+		}
+		colors := bsp.FullbrightStart
+		if texturesReplaceFullbrights {
+			colors = len(palette)
+		}
+		replaced := 0
+		for i := range textures {
+			texture := &textures[i]
+			if texture.Missing() || !strings.EqualFold(texture.Name(), args[1]) {
+				continue
+			}
+			if int(texture.MipTex.Width) != width || int(texture.MipTex.Height) != height {
+				Warnf("%s: texture %s is %dx%d in the map and %dx%d in %s", args[0], texture.Name(),
+					texture.MipTex.Width, texture.MipTex.Height, width, height, args[2])
+			}
+			texture.MipTex.Width, texture.MipTex.Height = uint32(width), uint32(height)
+			texture.Pixels = bsp.QuantizeTexture(img, palette, colors, bsp.TextureClass(texture.Name()) == "{")
+			replaced++
+		}
+		if replaced == 0 {
+			return fmt.Errorf("%s: no texture %s", args[0], args[1])
+		}
+
+		destName, err := writeTexturesLump(cmd, args[0], bsp.EncodeTextureLump(textures))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Replaced %s with %s, wrote %s\n", args[1], args[2], destName)
+		return nil
+	},
+}
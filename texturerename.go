@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// maxTextureName is the longest texture name fitting the miptex header
+// with its terminating NUL.
+const maxTextureName = len(bsp.MipTex{}.Name) - 1
+
+// TextureRename is one old,new pair of a texture mapping file.
+type TextureRename struct {
+	Old string
+	New string
+}
+
+// ReadTextureMapping reads a CSV file of old,new texture name pairs. Lines
+// starting with # are comments.
+func ReadTextureMapping(path string) ([]TextureRename, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comment = '#'
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	renames := make([]TextureRename, 0, len(records))
+	seen := map[string]bool{}
+	for _, record := range records {
+		rename := TextureRename{strings.TrimSpace(record[0]), strings.TrimSpace(record[1])}
+		if rename.Old == "" || rename.New == "" {
+			return nil, fmt.Errorf("%s: empty name in %s,%s", path, record[0], record[1])
+		}
+		if seen[strings.ToLower(rename.Old)] {
+			return nil, fmt.Errorf("%s: %s is renamed twice", path, rename.Old)
+		}
+		seen[strings.ToLower(rename.Old)] = true
+		renames = append(renames, rename)
+	}
+	return renames, nil
+}
+
+// animationSuffix returns the name of an animated texture without its +N
+// frame prefix, "" for other textures.
+func animationSuffix(name string) string {
+	if !strings.HasPrefix(name, "+") || len(name) < 2 {
+		return ""
+	}
+	return strings.ToLower(name[2:])
+}
+
+// TextureRenameProblems describes the renames breaking engine rules: names
+// longer than the miptex header holds, which can't be applied, names moving
+// a texture to or from the animated, liquid, sky or alpha masked class, the
+// frames of one animation renamed apart, and names clashing with another
+// texture of the map or with the new name of another texture.
+func TextureRenameProblems(renames []TextureRename, names []string) (problems []string, fatal map[string]bool) {
+	fatal = map[string]bool{}
+	newName := map[string]string{}
+	for _, rename := range renames {
+		newName[strings.ToLower(rename.Old)] = rename.New
+	}
+	for _, rename := range renames {
+		if len(rename.New) > maxTextureName {
+			problems = append(problems, fmt.Sprintf("%s: new name %s is longer than %d characters", rename.Old, rename.New, maxTextureName))
+			fatal[strings.ToLower(rename.Old)] = true
+			continue
+		}
+		if before, after := bsp.TextureClass(strings.ToLower(rename.Old)), bsp.TextureClass(strings.ToLower(rename.New)); before != after {
+			describe := func(class string) string {
+				if class == "" {
+					return "no prefix"
+				}
+				return "prefix " + class
+			}
+			problems = append(problems, fmt.Sprintf("%s: %s changes %s to %s", rename.Old, rename.New, describe(before), describe(after)))
+		}
+	}
+
+	// Frames of an animation must keep sharing a name after the prefix.
+	animations := map[string]map[string]bool{}
+	for _, name := range names {
+		suffix := animationSuffix(name)
+		if suffix == "" {
+			continue
+		}
+		renamed, found := newName[strings.ToLower(name)]
+		if !found || fatal[strings.ToLower(name)] {
+			renamed = name
+		}
+		if animations[suffix] == nil {
+			animations[suffix] = map[string]bool{}
+		}
+		animations[suffix][animationSuffix(renamed)] = true
+	}
+	for suffix, renamed := range animations {
+		if len(renamed) > 1 {
+			problems = append(problems, fmt.Sprintf("frames of animation +?%s are renamed apart", suffix))
+		}
+	}
+
+	// Renamed textures must not take the name of a texture left as it is.
+	kept := map[string]bool{}
+	for _, name := range names {
+		if _, found := newName[strings.ToLower(name)]; !found {
+			kept[strings.ToLower(name)] = true
+		}
+	}
+	for _, rename := range renames {
+		if kept[strings.ToLower(rename.New)] && !fatal[strings.ToLower(rename.Old)] {
+			problems = append(problems, fmt.Sprintf("%s: new name %s is used by another texture", rename.Old, rename.New))
+		}
+	}
+
+	// Nor may two textures of the map be renamed to the same name.
+	present := map[string]bool{}
+	for _, name := range names {
+		present[strings.ToLower(name)] = true
+	}
+	targets := map[string][]string{}
+	for _, rename := range renames {
+		if present[strings.ToLower(rename.Old)] && !fatal[strings.ToLower(rename.Old)] {
+			targets[strings.ToLower(rename.New)] = append(targets[strings.ToLower(rename.New)], rename.Old)
+		}
+	}
+	for _, rename := range renames {
+		olds := targets[strings.ToLower(rename.New)]
+		if len(olds) > 1 && olds[0] == rename.Old {
+			problems = append(problems, fmt.Sprintf("%s are renamed to the same name %s", strings.Join(olds, ", "), rename.New))
+		}
+	}
+	sort.Strings(problems)
+	return problems, fatal
+}
+
+var texturesRenameCmd = &cobra.Command{
+	Use:   "rename <map> <mapping.csv>",
+	Short: "Rename textures from a mapping file",
+	Long: `Write a copy of the map with the textures renamed as listed in a CSV file of
+old,new name pairs, for controlled re-skins with external texture packs.
+Old names are matched case-insensitively; lines starting with # are
+comments.
+
+Renames breaking engine rules are warned about: names longer than 15
+characters are skipped, as the miptex header can't hold them, while names
+changing the +N, *, sky or { prefix, splitting the frames of an animation,
+clashing with another texture of the map or giving two textures the same
+name are applied as given. Mapping lines
+matching no texture of the map are warned about too.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		renames, err := ReadTextureMapping(args[1])
+		if err != nil {
+			return err
+		}
+		textures, err := readMapTextures(args[0])
+		if err != nil {
+			return err
+		}
+
+		var names []string
+		for i := range textures {
+			if !textures[i].Missing() {
+				names = append(names, textures[i].Name())
+			}
+		}
+		problems, fatal := TextureRenameProblems(renames, names)
+		for _, problem := range problems {
+			Warnf("%s: %s", args[1], problem)
+		}
+
+		newName := map[string]string{}
+		for _, rename := range renames {
+			if !fatal[strings.ToLower(rename.Old)] {
+				newName[strings.ToLower(rename.Old)] = rename.New
+			}
+		}
+		used := map[string]bool{}
+		for i := range textures {
+			texture := &textures[i]
+			if texture.Missing() {
+				continue
+			}
+			name, found := newName[strings.ToLower(texture.Name())]
+			if !found {
+				continue
+			}
+			used[strings.ToLower(texture.Name())] = true
+			Infof("%s => %s", texture.Name(), name)
+			texture.MipTex.Name = [16]byte{}
+			copy(texture.MipTex.Name[:], name)
+		}
+		renamed := 0
+		for _, rename := range renames {
+			if used[strings.ToLower(rename.Old)] {
+				renamed++
+			} else if !fatal[strings.ToLower(rename.Old)] {
+				Warnf("%s: no texture %s in %s", args[1], rename.Old, args[0])
+			}
+		}
+		if renamed == 0 {
+			return fmt.Errorf("%s: no texture of %s to rename", args[0], args[1])
+		}
+
+		destName, err := writeTexturesLump(cmd, args[0], bsp.EncodeTextureLump(textures))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d of %d renames, wrote %s\n", renamed, len(renames), destName)
+		return nil
+	},
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// textureStorage describes where the pixels of a texture are: embedded in
+// the map, external for textures whose mip offsets are 0 and which engines
+// load from wads or texture packs, or missing for empty offset table slots.
+func textureStorage(texture *bsp.TextureEntry) string {
+	switch {
+	case texture.Missing():
+		return "missing"
+	case texture.MipTex.Offsets[0] == 0:
+		return "external"
+	}
+	return "embedded"
+}
+
+// textureBytes returns the bytes a texture takes in the textures lump,
+// header and pixel data, not counting its offset table slot.
+func textureBytes(texture *bsp.TextureEntry) int {
+	if texture.Missing() {
+		return 0
+	}
+	return bsp.MipTexHeaderSize + len(texture.Pixels)
+}
+
+// TextureUse counts the faces of each texture, indexed like the textures
+// lump.
+func TextureUse(texinfo []bsp.Texinfo, faces []bsp.FaceV2, count int) []int {
+	use := make([]int, count)
+	for i := range faces {
+		if int(faces[i].TexinfoId) >= len(texinfo) {
+			continue
+		}
+		miptex := texinfo[faces[i].TexinfoId].MipTex
+		if miptex >= 0 && int(miptex) < count {
+			use[miptex]++
+		}
+	}
+	return use
+}
+
+// readTextures reads and parses the textures lump of a map.
+func readTextures(bspFile *bsp.BspFile, f MapFile) ([]bsp.TextureEntry, error) {
+	buffer, err := bsp.ReadLump(bspFile, f, bsp.LumpTextures)
+	if err != nil {
+		return nil, err
+	}
+	return bsp.ParseTextureLump(buffer)
+}
+
+var texturesCmd = &cobra.Command{
+	Use:   "textures",
+	Short: "Operate on the textures of a map",
+}
+
+var texturesListCmd = &cobra.Command{
+	Use:   "list <map>",
+	Short: "List the textures with their size, storage and byte usage",
+	Long: `List every slot of the textures lump: the miptex name, its width and height,
+whether the pixels are embedded in the map, external (mip offsets of 0, for
+textures loaded from wads or texture packs) or missing, the bytes it takes
+in the lump and the number of faces using it.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		textures, err := readTextures(&bspFile, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		texinfo, err := bsp.ReadTexinfo(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		faces, err := bsp.ReadFaces(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		use := TextureUse(texinfo, faces, len(textures))
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "INDEX\tNAME\tSIZE\tDATA\tBYTES\tFACES")
+		total := 4 + 4*len(textures)
+		counted := map[int32]bool{}
+		for i := range textures {
+			texture := &textures[i]
+			if texture.Missing() {
+				fmt.Fprintf(w, "%d\t-\t-\t%s\t%d\t%d\n", i, textureStorage(texture), 0, use[i])
+				continue
+			}
+			// Slots sharing a miptex point at the same offset.
+			if !counted[texture.Offset] {
+				total += textureBytes(texture)
+				counted[texture.Offset] = true
+			}
+			fmt.Fprintf(w, "%d\t%s\t%dx%d\t%s\t%d\t%d\n", i, texture.Name(), texture.MipTex.Width, texture.MipTex.Height, textureStorage(texture), textureBytes(texture), use[i])
+		}
+		w.Flush()
+		fmt.Printf("%d textures, %d bytes of %d in the textures lump\n", len(textures), total, bspFile.BspHeader.Lumps[bsp.LumpTextures].Length)
+		return nil
+	},
+}
+
+var texturesExportWadCmd = &cobra.Command{
+	Use:   "export-wad <map> <out.wad>",
+	Short: "Write the embedded textures to a WAD2 file",
+	Long: `Write every texture with embedded pixels to a WAD2 file, so textures can be
+recovered from a compiled map and edited in the usual tools. External and
+missing textures are skipped, as are later textures with a name already
+written.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		textures, err := readTextures(&bspFile, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		var embedded []bsp.TextureEntry
+		written := map[string]bool{}
+		for i := range textures {
+			texture := &textures[i]
+			switch {
+			case texture.Missing():
+				continue
+			case len(texture.Pixels) == 0:
+				Infof("skipping external texture %s", texture.Name())
+				continue
+			case written[strings.ToLower(texture.Name())]:
+				Warnf("%s: skipping texture %d, %s is written already", args[0], i, texture.Name())
+				continue
+			}
+			written[strings.ToLower(texture.Name())] = true
+			embedded = append(embedded, *texture)
+		}
+		if len(embedded) == 0 {
+			return fmt.Errorf("%s has no embedded textures", args[0])
+		}
+
+		out, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		err = bsp.WriteWad(out, embedded)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Wrote %d of %d textures to %s\n", len(embedded), len(textures), args[1])
+		return nil
+	},
+}
+
+// writeTexturesLump writes a copy of the map with a new textures lump,
+// moving the lumps after it as needed.
+func writeTexturesLump(cmd *cobra.Command, mapPath string, data []byte) (string, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	doc, err := bsp.OpenDocument(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", mapPath, err)
+	}
+	doc.SetLump(bsp.LumpTextures, data)
+
+	basename := strings.TrimSuffix(mapPath, filepath.Ext(mapPath))
+	destName := fmt.Sprintf("%s.new.bsp", basename)
+	err = doc.WriteFileContext(cmd.Context(), destName)
+	if err != nil {
+		return "", err
+	}
+	return destName, RunUploadHooks(cmd.Context(), destName, cmd.Name())
+}
+
+// readMapTextures reads the textures lump of a map to be rewritten.
+func readMapTextures(mapPath string) ([]bsp.TextureEntry, error) {
+	f, err := os.Open(mapPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapPath, err)
+	}
+	textures, err := readTextures(&bspFile, f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", mapPath, err)
+	}
+	return textures, nil
+}
+
+var texturesEmbedReplace bool
+
+var texturesEmbedCmd = &cobra.Command{
+	Use:   "embed <map> <file.wad>",
+	Short: "Fill in the pixels of external textures from a WAD2 file",
+	Long: `Write a copy of the map with the pixels of external textures, those without
+embedded pixel data, taken from the textures of the same name in a WAD2
+file. With --replace textures already embedded are replaced as well, for
+maps carrying stale versions. The textures lump is rebuilt and the lumps
+after it moved. A texture of a different size than in the map is embedded
+with its own size, with a warning since it no longer lines up the same.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		wad, err := os.Open(args[1])
+		if err != nil {
+			return err
+		}
+		wadTextures, err := bsp.ReadWadTextures(wad)
+		wad.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[1], err)
+		}
+		byName := map[string]*bsp.TextureEntry{}
+		for i := range wadTextures {
+			name := strings.ToLower(wadTextures[i].Name())
+			if _, found := byName[name]; !found && len(wadTextures[i].Pixels) > 0 {
+				byName[name] = &wadTextures[i]
+			}
+		}
+
+		textures, err := readMapTextures(args[0])
+		if err != nil {
+			return err
+		}
+		embedded := 0
+		for i := range textures {
+			texture := &textures[i]
+			if texture.Missing() || len(texture.Pixels) > 0 && !texturesEmbedReplace {
+				continue
+			}
+			source, found := byName[strings.ToLower(texture.Name())]
+			if !found {
+				if len(texture.Pixels) == 0 {
+					Warnf("%s: texture %s is not in %s", args[0], texture.Name(), args[1])
+				}
+				continue
+			}
+			if source.MipTex.Width != texture.MipTex.Width || source.MipTex.Height != texture.MipTex.Height {
+				Warnf("%s: texture %s is %dx%d in the map and %dx%d in %s", args[0], texture.Name(),
+					texture.MipTex.Width, texture.MipTex.Height, source.MipTex.Width, source.MipTex.Height, args[1])
+			}
+			texture.MipTex.Width, texture.MipTex.Height = source.MipTex.Width, source.MipTex.Height
+			texture.Pixels = source.Pixels
+			embedded++
+		}
+		if embedded == 0 {
+			fmt.Printf("%s: no textures to embed from %s\n", args[0], args[1])
+			return nil
+		}
+
+		destName, err := writeTexturesLump(cmd, args[0], bsp.EncodeTextureLump(textures))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Embedded %d textures from %s, wrote %s\n", embedded, args[1], destName)
+		return nil
+	},
+}
+
+var texturesStripZero bool
+var texturesStripKeep []string
+
+var texturesStripCmd = &cobra.Command{
+	Use:   "strip <map>",
+	Short: "Remove the embedded pixel data, keeping the texture names",
+	Long: `Write a copy of the map without the pixel data of its embedded textures, for
+maps distributed alongside external texture packs. The names and sizes are
+kept so engines still find the textures by name. By default the pixels are
+removed and the textures lump compacted, leaving external textures (mip
+offsets of 0); with --zero they are set to 0 instead, keeping the lump layout
+for tools that expect embedded textures while still compressing to nearly
+nothing. --keep keeps textures whose name matches a glob pattern, e.g.
+--keep 'sky*' for engines without external skies.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		for _, pattern := range texturesStripKeep {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid texture pattern %q: %w", pattern, err)
+			}
+		}
+
+		textures, err := readMapTextures(args[0])
+		if err != nil {
+			return err
+		}
+		stripped := 0
+		for i := range textures {
+			texture := &textures[i]
+			if len(texture.Pixels) == 0 {
+				continue
+			}
+			if len(texturesStripKeep) > 0 && matchesAny(texturesStripKeep, strings.ToLower(texture.Name())) {
+				Infof("keeping texture %s", texture.Name())
+				continue
+			}
+			if texturesStripZero {
+				texture.Pixels = make([]byte, len(texture.Pixels))
+			} else {
+				texture.Pixels = nil
+			}
+			stripped++
+		}
+		if stripped == 0 {
+			fmt.Printf("%s: no embedded textures to strip\n", args[0])
+			return nil
+		}
+
+		destName, err := writeTexturesLump(cmd, args[0], bsp.EncodeTextureLump(textures))
+		if err != nil {
+			return err
+		}
+		before, err := os.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		after, err := os.Stat(destName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Stripped %d textures, wrote %s, %d -> %d bytes\n", stripped, destName, before.Size(), after.Size())
+		return nil
+	},
+}
+
+// DuplicateTextures returns for every texture slot the first slot with the
+// same size and byte-identical pixels, or the slot itself. Slots taking
+// another slot's miptex take its name too, so only textures of the same
+// prefix class are collapsed, and animation frames only with the same name;
+// with sameName only textures of the same name are.
+func DuplicateTextures(textures []bsp.TextureEntry, sameName bool) []int {
+	shared := make([]int, len(textures))
+	first := map[string]int{}
+	for i := range textures {
+		shared[i] = i
+		texture := &textures[i]
+		if len(texture.Pixels) == 0 {
+			continue
+		}
+		name := strings.ToLower(texture.Name())
+		class := bsp.TextureClass(name)
+		key := fmt.Sprintf("%s %dx%d %s", class, texture.MipTex.Width, texture.MipTex.Height, texture.Pixels)
+		if sameName || strings.HasPrefix(class, "+") {
+			key = name + " " + key
+		}
+		if j, found := first[key]; found {
+			shared[i] = j
+		} else {
+			first[key] = i
+		}
+	}
+	return shared
+}
+
+var texturesDedupeSameName bool
+
+var texturesDedupeCmd = &cobra.Command{
+	Use:   "dedupe <map>",
+	Short: "Store textures with identical pixels only once",
+	Long: `Write a copy of the map in which textures with byte-identical pixel data
+share a single miptex in the textures lump, the offset table pointing their
+slots at the same copy, as is common in maps assembled from several wads.
+The bytes saved are reported.
+
+A slot sharing another's miptex shares its name too, so a duplicate under a
+different name takes the name of the first copy, which matters for external
+texture packs. Only textures with the same +N, *, sky or { prefix class are
+collapsed, animation frames only with the same name; --same-name restricts
+this to textures of the same name.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		textures, err := readMapTextures(args[0])
+		if err != nil {
+			return err
+		}
+		shared := DuplicateTextures(textures, texturesDedupeSameName)
+		collapsed := 0
+		for i, j := range shared {
+			if j == i {
+				continue
+			}
+			if !strings.EqualFold(textures[i].Name(), textures[j].Name()) {
+				Infof("texture %d: %s => %s", i, textures[i].Name(), textures[j].Name())
+			} else {
+				Debugf("texture %d: %s shares texture %d", i, textures[i].Name(), j)
+			}
+			collapsed++
+		}
+
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		bspFile, err := bsp.ReadBspFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data := bsp.EncodeSharedTextureLump(textures, shared)
+		before := int(bspFile.BspHeader.Lumps[bsp.LumpTextures].Length)
+		if collapsed == 0 || len(data) >= before {
+			fmt.Printf("%s: no duplicate textures\n", args[0])
+			return nil
+		}
+
+		destName, err := writeTexturesLump(cmd, args[0], data)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Collapsed %d duplicate textures, saved %d bytes, wrote %s\n", collapsed, before-len(data), destName)
+		return nil
+	},
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// TJunction is an edge of a face with vertexes of other faces lying on it,
+// which leaves hairline cracks ("sparklies") between the faces.
+type TJunction struct {
+	Model    int
+	Face     int
+	Edge     [2]bsp.Vec3
+	Vertexes []bsp.Vec3
+}
+
+func (t TJunction) String() string {
+	return fmt.Sprintf("model %d face %d edge %s - %s: %d vertexes on edge", t.Model, t.Face, t.Edge[0], t.Edge[1], len(t.Vertexes))
+}
+
+// NearVertexes are two vertexes of a model closer than the weld epsilon
+// without being identical.
+type NearVertexes struct {
+	Model    int
+	Vertexes [2]bsp.Vec3
+	Distance float64
+}
+
+func (n NearVertexes) String() string {
+	return fmt.Sprintf("model %d: %s and %s are %.4f apart", n.Model, n.Vertexes[0], n.Vertexes[1], n.Distance)
+}
+
+func vertexDistance(a, b bsp.Vec3) float64 {
+	dx, dy, dz := float64(a[0]-b[0]), float64(a[1]-b[1]), float64(a[2]-b[2])
+	return math.Sqrt(dx*dx + dy*dy + dz*dz)
+}
+
+// vertexGrid buckets vertexes into cubes so nearby ones are found quickly.
+type vertexGrid struct {
+	size  float64
+	cells map[[3]int][]bsp.Vec3
+}
+
+func (g *vertexGrid) cell(v bsp.Vec3) [3]int {
+	return [3]int{int(math.Floor(float64(v[0]) / g.size)), int(math.Floor(float64(v[1]) / g.size)), int(math.Floor(float64(v[2]) / g.size))}
+}
+
+func (g *vertexGrid) add(v bsp.Vec3) {
+	c := g.cell(v)
+	for _, existing := range g.cells[c] {
+		if existing == v {
+			return
+		}
+	}
+	g.cells[c] = append(g.cells[c], v)
+}
+
+// near calls fn for every vertex in the cells overlapping the box between
+// mins and maxs.
+func (g *vertexGrid) near(mins, maxs bsp.Vec3, fn func(v bsp.Vec3)) {
+	lo, hi := g.cell(mins), g.cell(maxs)
+	for x := lo[0]; x <= hi[0]; x++ {
+		for y := lo[1]; y <= hi[1]; y++ {
+			for z := lo[2]; z <= hi[2]; z++ {
+				for _, v := range g.cells[[3]int{x, y, z}] {
+					fn(v)
+				}
+			}
+		}
+	}
+}
+
+// FindTJunctions checks the faces of every model for vertexes of other faces
+// of the same model lying inside an edge, and for distinct vertexes closer
+// than epsilon to each other.
+func FindTJunctions(data *mapData, epsilon float64) ([]TJunction, []NearVertexes) {
+	var junctions []TJunction
+	var near []NearVertexes
+
+	for m, model := range data.models {
+		grid := &vertexGrid{size: 64, cells: map[[3]int][]bsp.Vec3{}}
+		var windings [][]bsp.Vec3
+		var faces []int
+		for i := model.FirstFace; i < model.FirstFace+model.NumFaces && int(i) < len(data.faces); i++ {
+			winding := bsp.FaceWinding(&data.faces[i], data.edges, data.surfedges, data.vertexes)
+			if len(winding) < 3 {
+				continue
+			}
+			windings = append(windings, winding)
+			faces = append(faces, int(i))
+			for _, v := range winding {
+				grid.add(v)
+			}
+		}
+
+		for w, winding := range windings {
+			for i := range winding {
+				a, b := winding[i], winding[(i+1)%len(winding)]
+				length := vertexDistance(a, b)
+				if length <= epsilon {
+					continue
+				}
+				var mins, maxs bsp.Vec3
+				for axis := 0; axis < 3; axis++ {
+					mins[axis] = float32(math.Min(float64(a[axis]), float64(b[axis])) - epsilon)
+					maxs[axis] = float32(math.Max(float64(a[axis]), float64(b[axis])) + epsilon)
+				}
+
+				var on []bsp.Vec3
+				grid.near(mins, maxs, func(v bsp.Vec3) {
+					// Project v onto the edge, vertexes near the ends are
+					// reported as near vertexes instead.
+					var t float64
+					for axis := 0; axis < 3; axis++ {
+						t += float64(v[axis]-a[axis]) * float64(b[axis]-a[axis])
+					}
+					t /= length * length
+					if t*length <= epsilon || (1-t)*length <= epsilon {
+						return
+					}
+					var closest bsp.Vec3
+					for axis := 0; axis < 3; axis++ {
+						closest[axis] = a[axis] + float32(t)*(b[axis]-a[axis])
+					}
+					if vertexDistance(v, closest) <= epsilon {
+						on = append(on, v)
+					}
+				})
+				if len(on) > 0 {
+					junctions = append(junctions, TJunction{m, faces[w], [2]bsp.Vec3{a, b}, on})
+				}
+			}
+		}
+
+		for _, vertexes := range grid.cells {
+			for _, v := range vertexes {
+				offset := bsp.Vec3{float32(epsilon), float32(epsilon), float32(epsilon)}
+				mins := bsp.Vec3{v[0] - offset[0], v[1] - offset[1], v[2] - offset[2]}
+				maxs := bsp.Vec3{v[0] + offset[0], v[1] + offset[1], v[2] + offset[2]}
+				grid.near(mins, maxs, func(other bsp.Vec3) {
+					// Report every pair once.
+					if other == v || !vertexLess(v, other) {
+						return
+					}
+					if d := vertexDistance(v, other); d <= epsilon {
+						near = append(near, NearVertexes{m, [2]bsp.Vec3{v, other}, d})
+					}
+				})
+			}
+		}
+	}
+
+	sort.SliceStable(junctions, func(i, j int) bool {
+		return len(junctions[i].Vertexes) > len(junctions[j].Vertexes)
+	})
+	sort.SliceStable(near, func(i, j int) bool {
+		if near[i].Distance != near[j].Distance {
+			return near[i].Distance > near[j].Distance
+		}
+		return vertexLess(near[i].Vertexes[0], near[j].Vertexes[0])
+	})
+	return junctions, near
+}
+
+func vertexLess(a, b bsp.Vec3) bool {
+	for axis := 0; axis < 3; axis++ {
+		if a[axis] != b[axis] {
+			return a[axis] < b[axis]
+		}
+	}
+	return false
+}
+
+var tjuncEpsilon float64
+var tjuncTop int
+
+var tjuncCmd = &cobra.Command{
+	Use:   "tjunc <map>",
+	Short: "Report t-junctions and near-coincident vertexes",
+	Long: `Check the faces of each model for vertexes of other faces lying inside one of
+their edges, and for vertexes closer than --epsilon without being identical.
+Both leave hairline cracks ("sparklies") between faces. Counts are printed
+along with the worst offenders; a map with many of them should be recompiled
+with t-junction fixing enabled.
+
+Exits with status 3 when t-junctions are found.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+
+		junctions, near := FindTJunctions(data, tjuncEpsilon)
+		vertexes := 0
+		for _, junction := range junctions {
+			vertexes += len(junction.Vertexes)
+		}
+		fmt.Printf("%s: %d t-junctions on %d edges, %d near-coincident vertex pairs\n", args[0], vertexes, len(junctions), len(near))
+
+		if tjuncTop > 0 && len(junctions) > tjuncTop {
+			junctions = junctions[:tjuncTop]
+		}
+		for _, junction := range junctions {
+			fmt.Println(junction)
+		}
+		if tjuncTop > 0 && len(near) > tjuncTop {
+			near = near[:tjuncTop]
+		}
+		for _, pair := range near {
+			fmt.Println(pair)
+		}
+
+		if vertexes > 0 {
+			return ErrCheckFailed
+		}
+		return nil
+	},
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// Transform maps world positions p to Scale * Rotation * p + Translation.
+// Rotation is orthonormal and may contain a reflection.
+type Transform struct {
+	Rotation    [3][3]float64
+	Scale       float64
+	Translation [3]float64
+}
+
+func IdentityTransform() Transform {
+	return Transform{
+		Rotation: [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+		Scale:    1,
+	}
+}
+
+// RotationZ returns a rotation around the z axis by a multiple of 90
+// degrees. Other angles are rejected since the clipping hulls are expanded
+// by axis aligned player boxes and would no longer match the geometry.
+func RotationZ(degrees float64) ([3][3]float64, error) {
+	if math.Mod(degrees, 90) != 0 {
+		return [3][3]float64{}, fmt.Errorf("rotation of %g degrees is not a multiple of 90", degrees)
+	}
+	var c, s float64
+	switch ((int(degrees)/90)%4 + 4) % 4 {
+	case 0:
+		c, s = 1, 0
+	case 1:
+		c, s = 0, 1
+	case 2:
+		c, s = -1, 0
+	case 3:
+		c, s = 0, -1
+	}
+	return [3][3]float64{{c, -s, 0}, {s, c, 0}, {0, 0, 1}}, nil
+}
+
+func (t *Transform) direction(v [3]float64) [3]float64 {
+	var out [3]float64
+	for i := 0; i < 3; i++ {
+		out[i] = t.Rotation[i][0]*v[0] + t.Rotation[i][1]*v[1] + t.Rotation[i][2]*v[2]
+	}
+	return out
+}
+
+func (t *Transform) Point(v bsp.Vec3) bsp.Vec3 {
+	d := t.direction([3]float64{float64(v[0]), float64(v[1]), float64(v[2])})
+	return bsp.Vec3{
+		float32(t.Scale*d[0] + t.Translation[0]),
+		float32(t.Scale*d[1] + t.Translation[1]),
+		float32(t.Scale*d[2] + t.Translation[2]),
+	}
+}
+
+func (t *Transform) Mirrored() bool {
+	r := t.Rotation
+	det := r[0][0]*(r[1][1]*r[2][2]-r[1][2]*r[2][1]) -
+		r[0][1]*(r[1][0]*r[2][2]-r[1][2]*r[2][0]) +
+		r[0][2]*(r[1][0]*r[2][1]-r[1][1]*r[2][0])
+	return det < 0
+}
+
+// Bounds transforms an axis aligned box and returns the box enclosing the
+// result.
+func (t *Transform) Bounds(mins, maxs bsp.Vec3) (bsp.Vec3, bsp.Vec3) {
+	var outMins, outMaxs bsp.Vec3
+	for i := 0; i < 8; i++ {
+		corner := mins
+		for axis := 0; axis < 3; axis++ {
+			if i&(1<<axis) != 0 {
+				corner[axis] = maxs[axis]
+			}
+		}
+		p := t.Point(corner)
+		for axis := 0; axis < 3; axis++ {
+			if i == 0 || p[axis] < outMins[axis] {
+				outMins[axis] = p[axis]
+			}
+			if i == 0 || p[axis] > outMaxs[axis] {
+				outMaxs[axis] = p[axis]
+			}
+		}
+	}
+	return outMins, outMaxs
+}
+
+// TexVec transforms a texture or lightmap projection vector so that every
+// transformed point projects to the same texel as before.
+func (t *Transform) TexVec(v bsp.Vec4) bsp.Vec4 {
+	d := t.direction([3]float64{float64(v[0]), float64(v[1]), float64(v[2])})
+	var out bsp.Vec4
+	w := float64(v[3])
+	for i := 0; i < 3; i++ {
+		out[i] = float32(d[i] / t.Scale)
+		w -= d[i] / t.Scale * t.Translation[i]
+	}
+	out[3] = float32(w)
+	return out
+}
+
+// Yaw transforms a yaw angle in degrees.
+func (t *Transform) Yaw(yaw float64) float64 {
+	rad := yaw * math.Pi / 180
+	d := t.direction([3]float64{math.Cos(rad), math.Sin(rad), 0})
+	out := math.Atan2(d[1], d[0]) * 180 / math.Pi
+	out = math.Round(out*1000) / 1000
+	if out < 0 {
+		out += 360
+	}
+	return out
+}
+
+func planeType(normal bsp.Vec3) int32 {
+	major := 0
+	for axis := 1; axis < 3; axis++ {
+		if math.Abs(float64(normal[axis])) > math.Abs(float64(normal[major])) {
+			major = axis
+		}
+	}
+	if normal[major] == 1 {
+		return int32(major)
+	}
+	return int32(3 + major)
+}
+
+// transformPlanes moves the planes and flips those whose major axis ended up
+// negative, as qbsp would have written them. It returns which planes were
+// flipped so node children and face sides can be swapped to match.
+func (t *Transform) transformPlanes(planes []bsp.Plane) []bool {
+	flipped := make([]bool, len(planes))
+	for i := range planes {
+		p := &planes[i]
+		d := t.direction([3]float64{float64(p.Normal[0]), float64(p.Normal[1]), float64(p.Normal[2])})
+		dist := t.Scale*float64(p.Dist) + d[0]*t.Translation[0] + d[1]*t.Translation[1] + d[2]*t.Translation[2]
+		normal := bsp.Vec3{float32(d[0]), float32(d[1]), float32(d[2])}
+
+		major := 0
+		for axis := 1; axis < 3; axis++ {
+			if math.Abs(d[axis]) > math.Abs(d[major]) {
+				major = axis
+			}
+		}
+		if normal[major] < 0 {
+			normal = bsp.Vec3{-normal[0], -normal[1], -normal[2]}
+			dist = -dist
+			flipped[i] = true
+		}
+
+		p.Normal = normal
+		p.Dist = float32(dist)
+		p.Type = planeType(normal)
+	}
+	return flipped
+}
+
+func formatAngle(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// transformEntity moves origins and turns yaw angles. Light values are
+// scaled along with the map so the falloff still reaches the same surfaces.
+func (t *Transform) transformEntity(e *bsp.Entity) {
+	isLight := strings.HasPrefix(e.Classname(), "light")
+	for i := range e.Pairs {
+		kv := &e.Pairs[i]
+		switch kv.Key {
+		case "origin":
+			if origin, ok := bsp.ParseVec3(kv.Value); ok {
+				kv.Value = bsp.FormatVec3(t.Point(origin))
+			}
+		case "angle":
+			yaw, err := strconv.ParseFloat(strings.TrimSpace(kv.Value), 64)
+			// -1 and -2 mean up and down for doors and plats.
+			if err == nil && yaw != -1 && yaw != -2 {
+				kv.Value = formatAngle(t.Yaw(yaw))
+			}
+		case "angles", "mangle":
+			fields := strings.Fields(kv.Value)
+			if len(fields) != 3 {
+				continue
+			}
+			// Spotlights store yaw first, everything else pitch yaw roll.
+			index := 1
+			if kv.Key == "mangle" && isLight {
+				index = 0
+			}
+			yaw, err := strconv.ParseFloat(fields[index], 64)
+			if err != nil {
+				continue
+			}
+			fields[index] = formatAngle(t.Yaw(yaw))
+			kv.Value = strings.Join(fields, " ")
+		case "light", "_light":
+			fields := strings.Fields(kv.Value)
+			if !isLight || t.Scale == 1 || len(fields) == 0 {
+				continue
+			}
+			// Only the intensity is scaled, _light may carry a colour after it.
+			value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+			if err != nil {
+				continue
+			}
+			fields[len(fields)-1] = formatAngle(math.Round(value * t.Scale))
+			kv.Value = strings.Join(fields, " ")
+		}
+	}
+}
+
+// positionalBspXLumps hold world space data that is not rewritten by
+// transforms and has to be regenerated.
+var positionalBspXLumps = []string{"LIGHTGRID_OCTREE", "ENVMAP", "BRUSHLIST", "FACENORMALS", "VERTEXNORMALS", "MVDSV_PHYSICSNORMALS"}
+
+// ApplyTransform transforms all geometry, entities and DECOUPLED_LM
+// projections of a map in place, and returns warnings about data that could
+// not be transformed.
+func ApplyTransform(data *mapData, bspx *bsp.BspXLumps, t Transform) ([]string, error) {
+	var warnings []string
+
+	for i := range data.vertexes {
+		data.vertexes[i] = t.Point(data.vertexes[i])
+	}
+
+	flipped := t.transformPlanes(data.planes)
+	for i := range data.nodes {
+		n := &data.nodes[i]
+		n.Mins, n.Maxs = t.Bounds(n.Mins, n.Maxs)
+		if n.PlaneId >= 0 && int(n.PlaneId) < len(flipped) && flipped[n.PlaneId] {
+			n.Children[0], n.Children[1] = n.Children[1], n.Children[0]
+		}
+	}
+	for i := range data.clipNodes {
+		c := &data.clipNodes[i]
+		if c.PlaneId >= 0 && int(c.PlaneId) < len(flipped) && flipped[c.PlaneId] {
+			c.Children[0], c.Children[1] = c.Children[1], c.Children[0]
+		}
+	}
+	for i := range data.faces {
+		f := &data.faces[i]
+		if int(f.PlaneId) < len(flipped) && flipped[f.PlaneId] {
+			f.Side ^= 1
+		}
+		// A reflection turns clockwise windings counter clockwise, walk the
+		// edges backwards to restore them.
+		if t.Mirrored() {
+			start, end := int(f.LedgeId), int(f.LedgeId+f.LedgeNum)
+			if end > len(data.surfedges) {
+				continue
+			}
+			edges := data.surfedges[start:end]
+			for a, b := 0, len(edges)-1; a < b; a, b = a+1, b-1 {
+				edges[a], edges[b] = edges[b], edges[a]
+			}
+			for j := range edges {
+				edges[j] = -edges[j]
+			}
+		}
+	}
+	for i := range data.leafs {
+		l := &data.leafs[i]
+		l.Mins, l.Maxs = t.Bounds(l.Mins, l.Maxs)
+	}
+	for i := range data.models {
+		m := &data.models[i]
+		m.Mins, m.Maxs = t.Bounds(m.Mins, m.Maxs)
+		origin := t.direction([3]float64{float64(m.Origin[0]), float64(m.Origin[1]), float64(m.Origin[2])})
+		m.Origin = bsp.Vec3{float32(t.Scale * origin[0]), float32(t.Scale * origin[1]), float32(t.Scale * origin[2])}
+	}
+	for i := range data.texinfo {
+		data.texinfo[i].Vecs[0] = t.TexVec(data.texinfo[i].Vecs[0])
+		data.texinfo[i].Vecs[1] = t.TexVec(data.texinfo[i].Vecs[1])
+	}
+	for i := range data.entities {
+		t.transformEntity(&data.entities[i])
+	}
+
+	if buffer, found := bspx.Get("DECOUPLED_LM"); found {
+		lightmaps, err := bsp.ParseDecoupledLM(buffer)
+		if err != nil {
+			return nil, err
+		}
+		for i := range lightmaps {
+			lightmaps[i].WorldToLmSpace[0] = t.TexVec(lightmaps[i].WorldToLmSpace[0])
+			lightmaps[i].WorldToLmSpace[1] = t.TexVec(lightmaps[i].WorldToLmSpace[1])
+		}
+		bspx.Set("DECOUPLED_LM", bsp.EncodeDecoupledLM(lightmaps))
+	}
+	for _, name := range positionalBspXLumps {
+		if bspx.Has(name) {
+			warnings = append(warnings, fmt.Sprintf("BSPX lump %s holds world space data that was not transformed, regenerate it", name))
+		}
+	}
+
+	return warnings, nil
+}
+
+// CheckProtocolBounds reports transformed maps whose world no longer fits the
+// standard QuakeWorld coordinate range, or whose node and leaf bounds no
+// longer fit the 16 bit fields of BSP29 and 2PSB.
+func CheckProtocolBounds(data *mapData, allowBigCoords bool) error {
+	if len(data.models) == 0 {
+		return fmt.Errorf("map has no world model")
+	}
+	world := data.models[0]
+	if NeedsFloatCoords(world) && !allowBigCoords {
+		return fmt.Errorf("world bounds %s .. %s exceed +-%d, pass --allow-bigcoords for servers with float coords", world.Mins, world.Maxs, StandardCoordLimit)
+	}
+	if data.bspFile.BspHeader.Version != bsp.BspVersionBSP2 {
+		for axis := 0; axis < 3; axis++ {
+			if world.Mins[axis] < math.MinInt16 || world.Maxs[axis] > math.MaxInt16 {
+				return fmt.Errorf("world bounds %s .. %s do not fit %s node bounds", world.Mins, world.Maxs, data.bspFile.BspHeader.Version)
+			}
+		}
+	}
+	return nil
+}
+
+var transformAllowBigCoords bool
+
+// writeTransformedMap applies t to the map at path and writes the result to
+// <map>.new.bsp.
+func writeTransformedMap(path string, t Transform, cmd *cobra.Command) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bspFile, err := bsp.ReadBspFile(f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	data, err := readMapData(&bspFile, f)
+	if err != nil {
+		return err
+	}
+
+	basename := strings.TrimSuffix(path, filepath.Ext(path))
+	destName := fmt.Sprintf("%s.new.bsp", basename)
+	err = bsp.RewriteBspContext(cmd.Context(), &bspFile, f, destName, func(lumps *[bsp.LumpTotal][]byte, bspx *bsp.BspXLumps) error {
+		warnings, err := ApplyTransform(data, bspx, t)
+		if err != nil {
+			return err
+		}
+		for _, warning := range warnings {
+			Warnf("%s", warning)
+		}
+		err = CheckProtocolBounds(data, transformAllowBigCoords)
+		if err != nil {
+			return err
+		}
+		data.encodeGeometry(lumps)
+		lumps[bsp.LumpEntities], err = bsp.FormatEntities(data.entities)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s, world bounds %s .. %s\n", destName, data.models[0].Mins, data.models[0].Maxs)
+
+	return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+}
+
+func parseVectorFlag(s string) ([3]float64, error) {
+	var v [3]float64
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+	if len(fields) != 3 {
+		return v, fmt.Errorf("expected x,y,z, got %q", s)
+	}
+	for i, field := range fields {
+		f, err := strconv.ParseFloat(field, 64)
+		if err != nil {
+			return v, err
+		}
+		v[i] = f
+	}
+	return v, nil
+}
+
+var transformTranslate string
+var transformRotate float64
+
+var transformCmd = &cobra.Command{
+	Use:   "transform <map>",
+	Short: "Translate and rotate the whole map",
+	Long: `Rotate the map around the z axis by a multiple of 90 degrees, then translate
+it. Vertexes, planes, nodes, leafs, models, texture and DECOUPLED_LM
+projections and entity origins and angles are rewritten, and the result is
+checked to stay within protocol bounds.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t := IdentityTransform()
+
+		rotation, err := RotationZ(transformRotate)
+		if err != nil {
+			return err
+		}
+		t.Rotation = rotation
+
+		if transformTranslate != "" {
+			t.Translation, err = parseVectorFlag(transformTranslate)
+			if err != nil {
+				return err
+			}
+		}
+
+		return writeTransformedMap(args[0], t, cmd)
+	},
+}
+
+var scaleCmd = &cobra.Command{
+	Use:   "scale <map> <factor>",
+	Short: "Scale the whole map uniformly",
+	Long: `Scale vertexes, plane distances, node, leaf and model bounds, entity origins
+and light values by factor. Texture and DECOUPLED_LM projections are scaled
+with the geometry so the existing lightmaps still fit their faces.
+
+The clipping hulls are scaled as well, including the player size they were
+expanded by, so scaled maps should be recompiled before being played.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		factor, err := strconv.ParseFloat(args[1], 64)
+		if err != nil {
+			return err
+		}
+		if factor <= 0 || math.IsInf(factor, 0) || math.IsNaN(factor) {
+			return fmt.Errorf("invalid scale factor %s", args[1])
+		}
+
+		t := IdentityTransform()
+		t.Scale = factor
+
+		if factor != 1 {
+			Warnf("clipping hulls are scaled with the map and no longer match the player size")
+		}
+		return writeTransformedMap(args[0], t, cmd)
+	},
+}
+
+var mirrorAxis string
+
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror <map>",
+	Short: "Mirror the whole map along the x or y axis",
+	Long: `Mirror the map through the plane where the given axis is 0. Face windings
+are reversed so faces keep pointing outwards, planes are flipped back to
+positive major axes with node and clipnode children swapped to match, and
+entity origins and angles are mirrored.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		t := IdentityTransform()
+		switch mirrorAxis {
+		case "x":
+			t.Rotation[0][0] = -1
+		case "y":
+			t.Rotation[1][1] = -1
+		default:
+			return fmt.Errorf("unknown axis %q, expected x or y", mirrorAxis)
+		}
+
+		return writeTransformedMap(args[0], t, cmd)
+	},
+}
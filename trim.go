@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+var trimCheck bool
+
+// ReferencedEnd returns the offset after the last byte of any region.
+func ReferencedEnd(regions []FileRegion) int64 {
+	end := int64(0)
+	for _, region := range regions {
+		if region.Offset+region.Length > end {
+			end = region.Offset + region.Length
+		}
+	}
+	return end
+}
+
+var trimCmd = &cobra.Command{
+	Use:   "trim <map>",
+	Short: "Cut off bytes after the last lump",
+	Long: `Write a copy of the map cut off after the last byte the header, the lumps
+or the BSPX directory refer to, dropping junk some compilers leave at the
+end. Unused bytes between lumps are only reported, repack drops those as
+well. With --check nothing is written.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		regions := MapRegions(&bspFile)
+		end := ReferencedEnd(regions)
+		if end > info.Size() {
+			return fmt.Errorf("%s: lumps extend %d bytes past the end of the file", args[0], end-info.Size())
+		}
+		trailing := info.Size() - end
+		if between := UnusedBytes(regions, info.Size()) - trailing; between > 0 {
+			fmt.Printf("%s: %d bytes unused between lumps\n", args[0], between)
+		}
+		if trailing == 0 {
+			fmt.Printf("%s: no bytes after the last lump\n", args[0])
+			return nil
+		}
+		if trimCheck {
+			fmt.Printf("%s: %d bytes after the last lump at %d\n", args[0], trailing, end)
+			return nil
+		}
+
+		basename := strings.TrimSuffix(args[0], filepath.Ext(args[0]))
+		destName := fmt.Sprintf("%s.new.bsp", basename)
+		err = bsp.TruncateContext(cmd.Context(), f, end, destName)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Trimmed %d bytes after the last lump at %d, wrote %s\n", trailing, end, destName)
+
+		return RunUploadHooks(cmd.Context(), destName, cmd.Name())
+	},
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// uploadTimeout bounds HTTP uploads without a --timeout of their own, so a
+// stalled server doesn't hang a build forever.
+const uploadTimeout = 5 * time.Minute
+
+var uploadClient = &http.Client{Timeout: uploadTimeout}
+
+type UploadManifest struct {
+	File    string `json:"file"`
+	Size    int64  `json:"size"`
+	SHA256  string `json:"sha256"`
+	Command string `json:"command"`
+}
+
+func NewUploadManifest(filename string, command string) (*UploadManifest, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadManifest{
+		File:    filepath.Base(filename),
+		Size:    size,
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+		Command: command,
+	}, nil
+}
+
+func uploadHTTP(ctx context.Context, config *UploadConfig, filename string, manifest *UploadManifest) error {
+	var body io.Reader
+	contentType := "application/octet-stream"
+	if config.Manifest {
+		buffer, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(buffer)
+		contentType = "application/json"
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		body = f
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.URL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Bspxmgr-Filename", manifest.File)
+	req.Header.Set("X-Bspxmgr-Sha256", manifest.SHA256)
+	for key, value := range config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := uploadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("upload to %s failed: %s", config.URL, resp.Status)
+	}
+	return nil
+}
+
+// sftpQuote quotes a path for an sftp batch command. Within double quotes
+// sftp takes backslashes and quotes escaped and glob characters literally.
+// Paths can't hold line breaks, which end the command.
+func sftpQuote(path string) (string, error) {
+	if strings.ContainsAny(path, "\r\n") {
+		return "", fmt.Errorf("%q: sftp paths can't contain line breaks", path)
+	}
+	path = strings.ReplaceAll(path, `\`, `\\`)
+	path = strings.ReplaceAll(path, `"`, `\"`)
+	return `"` + path + `"`, nil
+}
+
+func uploadSFTP(ctx context.Context, config *UploadConfig, filename string) error {
+	host, remote, found := strings.Cut(config.SFTP, ":")
+	if !found || remote == "" {
+		remote = "."
+	}
+	local, err := sftpQuote(filename)
+	if err != nil {
+		return err
+	}
+	remote, err = sftpQuote(remote)
+	if err != nil {
+		return err
+	}
+
+	args := append([]string{"-b", "-"}, config.SFTPArgs...)
+	args = append(args, host)
+	cmd := exec.CommandContext(ctx, "sftp", args...)
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("put %s %s\n", local, remote))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("sftp to %s failed: %w", config.SFTP, err)
+	}
+	return nil
+}
+
+// RunUploadHooks delivers a freshly written map according to the active
+// profile. It does nothing when no profile or no upload target is configured.
+// Uploads are aborted when ctx is done.
+func RunUploadHooks(ctx context.Context, filename string, command string) error {
+	profile, err := ActiveProfile()
+	if err != nil {
+		return err
+	}
+	if profile == nil || profile.Upload == nil {
+		return nil
+	}
+
+	manifest, err := NewUploadManifest(filename, command)
+	if err != nil {
+		return err
+	}
+
+	if profile.Upload.URL != "" {
+		err = uploadHTTP(ctx, profile.Upload, filename, manifest)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Uploaded %s to %s\n", manifest.File, profile.Upload.URL)
+	}
+
+	if profile.Upload.SFTP != "" {
+		err = uploadSFTP(ctx, profile.Upload, filename)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Copied %s to %s\n", manifest.File, profile.Upload.SFTP)
+	}
+
+	return nil
+}
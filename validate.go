@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityInfo:
+		return "info"
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("Unknown severity (%d)", int(s))
+	}
+}
+
+// Finding is a single validation result. Entity is the index into the entity
+// lump the finding refers to, or -1.
+type Finding struct {
+	Severity Severity
+	Check    string
+	Message  string
+	Entity   int
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%-7s %-20s %s", f.Severity, f.Check, f.Message)
+}
+
+type ValidateOptions struct {
+	CTF                bool
+	TeamSpawnTolerance int
+	Classes            EntityClasses // BuiltinEntityClasses() if nil
+}
+
+func entityRef(entities []bsp.Entity, i int) string {
+	e := &entities[i]
+	if origin, ok := e.Origin(); ok {
+		return fmt.Sprintf("entity #%d (%s @ %s)", i, e.Classname(), origin)
+	}
+	if model := e.Get("model"); model != "" {
+		return fmt.Sprintf("entity #%d (%s, model %s)", i, e.Classname(), model)
+	}
+	return fmt.Sprintf("entity #%d (%s)", i, e.Classname())
+}
+
+func ValidateMap(bspFile *bsp.BspFile, f MapFile, opts ValidateOptions) ([]Finding, error) {
+	var findings []Finding
+	add := func(severity Severity, check string, entity int, format string, a ...interface{}) {
+		findings = append(findings, Finding{severity, check, fmt.Sprintf(format, a...), entity})
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := bsp.CheckStructure(bspFile, stat.Size())
+	for _, problem := range problems {
+		add(SeverityError, "structure."+problem.Check, -1, "%s", problem.Message)
+	}
+	if len(problems) > 0 {
+		return findings, nil
+	}
+
+	data := mapData{bspFile: bspFile}
+	data.entities, err = bsp.ReadEntities(bspFile, f)
+	if err != nil {
+		add(SeverityError, "entities.parse", -1, "%s", err)
+		return findings, nil
+	}
+	if err = readMapGeometry(bspFile, f, &data); err != nil {
+		return nil, err
+	}
+	badSurfedges, firstBad := 0, -1
+	for i, surfedge := range data.surfedges {
+		if _, ok := bsp.SurfedgeEdge(surfedge, len(data.edges)); !ok {
+			if firstBad < 0 {
+				firstBad = i
+			}
+			badSurfedges++
+		}
+	}
+	if badSurfedges > 0 {
+		add(SeverityError, "structure.surfedges", -1, "%d surfedges reference edges out of range, e.g. surfedge %d is %d with %d edges",
+			badSurfedges, firstBad, data.surfedges[firstBad], len(data.edges))
+		return findings, nil
+	}
+
+	if len(data.models) == 0 {
+		add(SeverityError, "structure.models", -1, "map has no world model")
+		return findings, nil
+	}
+	if len(data.entities) == 0 || data.entities[0].Classname() != "worldspawn" {
+		add(SeverityError, "entities.worldspawn", -1, "first entity is not worldspawn")
+	}
+
+	classes := opts.Classes
+	if classes == nil {
+		classes = BuiltinEntityClasses()
+	}
+	findings = append(findings, LintEntities(data.entities, classes)...)
+
+	spawns := CountSpawns(data.entities)
+	if spawns.Deathmatch == 0 && spawns.Start == 0 && spawns.Team1 == 0 && spawns.Team2 == 0 {
+		add(SeverityError, "entities.spawns", -1, "map has no player spawn points")
+	}
+
+	for _, xlump := range bspFile.BspXLumps {
+		name := bsp.BytesToString(xlump.LumpName[:])
+		handler := BspXHandlerFor(name)
+		if handler == nil {
+			continue
+		}
+		lump, err := bsp.ReadBspXLump(bspFile, f, name)
+		if err != nil {
+			add(SeverityError, "bspx.bounds", -1, "%s", err)
+			continue
+		}
+		for _, problem := range ValidateBspXLump(handler, bspFile, lump) {
+			add(SeverityError, "bspx.contents", -1, "%s: %s", name, problem)
+		}
+	}
+
+	if opts.CTF {
+		findings = append(findings, validateCTF(&data, spawns, opts)...)
+	}
+
+	return findings, nil
+}
+
+func validateCTF(data *mapData, spawns SpawnCounts, opts ValidateOptions) []Finding {
+	var findings []Finding
+	add := func(severity Severity, check string, entity int, format string, a ...interface{}) {
+		findings = append(findings, Finding{severity, check, fmt.Sprintf(format, a...), entity})
+	}
+
+	var graph *NavGraph
+	for _, flag := range []string{"item_flag_team1", "item_flag_team2"} {
+		var found []int
+		for i := range data.entities {
+			if data.entities[i].Classname() == flag {
+				found = append(found, i)
+			}
+		}
+		if len(found) == 0 {
+			add(SeverityError, "ctf.flags", -1, "%s missing", flag)
+			continue
+		}
+		if len(found) > 1 {
+			for _, i := range found[1:] {
+				add(SeverityWarning, "ctf.flags", i, "duplicate %s: %s", flag, entityRef(data.entities, i))
+			}
+		}
+		for _, i := range found {
+			checkFlagReachable(data, i, &graph, add)
+		}
+	}
+
+	if spawns.Team1 == 0 || spawns.Team2 == 0 {
+		add(SeverityError, "ctf.spawns", -1, "team spawns missing: %d team1, %d team2", spawns.Team1, spawns.Team2)
+	} else {
+		diff := spawns.Team1 - spawns.Team2
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > opts.TeamSpawnTolerance {
+			add(SeverityError, "ctf.spawns", -1, "unbalanced team spawns: %d team1, %d team2", spawns.Team1, spawns.Team2)
+		}
+	}
+
+	// Team restricted entities (doors, walls, triggers) carry a "team" key and
+	// should exist in matching numbers for both sides.
+	perTeam := map[string][3]int{}
+	var classnames []string
+	for i := range data.entities {
+		e := &data.entities[i]
+		if !e.Has("team") {
+			continue
+		}
+		team := e.Get("team")
+		if team != "1" && team != "2" {
+			add(SeverityError, "ctf.teamkeys", i, "invalid team %q on %s", team, entityRef(data.entities, i))
+			continue
+		}
+		counts, found := perTeam[e.Classname()]
+		if !found {
+			classnames = append(classnames, e.Classname())
+		}
+		counts[team[0]-'0']++
+		perTeam[e.Classname()] = counts
+	}
+	for _, classname := range classnames {
+		counts := perTeam[classname]
+		if counts[1] != counts[2] {
+			add(SeverityWarning, "ctf.teamkeys", -1, "%s: %d for team1, %d for team2", classname, counts[1], counts[2])
+		}
+	}
+
+	return findings
+}
+
+// validateNavGrid is the sample spacing of the walkable area graph flags
+// are checked to be reachable in.
+const validateNavGrid = 32
+
+// checkFlagReachable checks that a flag is inside the world, not in solid
+// and can be walked to from a spawn point in the walkable area graph of nav,
+// built on first use.
+func checkFlagReachable(data *mapData, i int, graph **NavGraph, add func(Severity, string, int, string, ...interface{})) {
+	origin, ok := data.entities[i].Origin()
+	if !ok {
+		add(SeverityError, "ctf.flags", i, "flag without origin: %s", entityRef(data.entities, i))
+		return
+	}
+
+	world := data.models[0]
+	for axis := 0; axis < 3; axis++ {
+		if origin[axis] < world.Mins[axis] || origin[axis] > world.Maxs[axis] {
+			add(SeverityError, "ctf.flags", i, "flag outside world bounds: %s", entityRef(data.entities, i))
+			return
+		}
+	}
+
+	leaf := bsp.PointLeaf(data.nodes, data.planes, world.HeadNode[0], origin)
+	if leaf < len(data.leafs) && data.leafs[leaf].Contents == bsp.ContentsSolid {
+		add(SeverityError, "ctf.flags", i, "flag inside solid: %s", entityRef(data.entities, i))
+		return
+	}
+
+	if *graph == nil {
+		var err error
+		*graph, err = BuildNavGraph(data, validateNavGrid)
+		if err != nil {
+			add(SeverityError, "ctf.flags", i, "can't check flag reachability: %s", err)
+			return
+		}
+	}
+	for _, item := range (*graph).Items {
+		if item.Entity == i && !item.Reachable {
+			add(SeverityError, "ctf.flags", i, "flag not reachable from any spawn: %s", entityRef(data.entities, i))
+		}
+	}
+}
+
+var validateOpts ValidateOptions
+var validateReport string
+var validateFailOn string
+var validateClasses []string
+
+var validateCmd = &cobra.Command{
+	Use:   "validate <map>",
+	Short: "Check a map for structural and gameplay problems",
+	Long: `Check lump layout, entity data and spawn points of a map. Entities are
+linted as by entities lint, --classes adds classnames to the known ones.
+With --ctf, also check both flags are present and can be walked to from a
+spawn point, as nav computes it, team spawn counts are balanced and team
+restricted entities are consistent. Jumps, lifts and teleporters are not
+followed, so flags only reachable that way fail the check as well.
+
+Exits non-zero when any finding is at or above the --fail-on severity. With
+--report, findings are written as json, junit or sarif for CI pipelines.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		threshold, err := ParseSeverity(validateFailOn)
+		if err != nil {
+			return err
+		}
+		if validateReport != "" {
+			if err := CheckReportFormat(validateReport); err != nil {
+				return err
+			}
+		}
+
+		if len(validateClasses) > 0 {
+			validateOpts.Classes, err = loadEntityClasses(validateClasses)
+			if err != nil {
+				return err
+			}
+		}
+
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		findings, err := ValidateMap(&bspFile, f, validateOpts)
+		if err != nil {
+			return err
+		}
+
+		if validateReport != "" {
+			err = WriteReport(os.Stdout, validateReport, args[0], findings, threshold)
+			if err != nil {
+				return err
+			}
+		} else {
+			if len(findings) == 0 {
+				fmt.Printf("%s: no problems found\n", args[0])
+			}
+			for _, finding := range findings {
+				fmt.Println(finding)
+			}
+		}
+
+		if FailsAt(findings, threshold) {
+			return ErrCheckFailed
+		}
+		return nil
+	},
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// ParseDownloadManifest reads a manifest written by download-manifest in the
+// json or list format.
+func ParseDownloadManifest(data []byte) ([]DownloadEntry, error) {
+	var entries []DownloadEntry
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err := json.Unmarshal(trimmed, &entries)
+		return entries, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected path, size and crc", line)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		crc, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, DownloadEntry{Path: fields[0], Size: size, CRC32: uint32(crc)})
+	}
+	return entries, scanner.Err()
+}
+
+type ManifestMismatch struct {
+	Path    string
+	Problem string
+}
+
+func (m ManifestMismatch) String() string {
+	return fmt.Sprintf("%s: %s", m.Path, m.Problem)
+}
+
+// VerifyManifest checks the files below dir against the entries of a
+// manifest. With strict set, maps and sidecars not listed are reported too.
+func VerifyManifest(entries []DownloadEntry, dir string, strict bool) ([]ManifestMismatch, error) {
+	var mismatches []ManifestMismatch
+	listed := map[string]bool{}
+	for _, expected := range entries {
+		listed[filepath.ToSlash(filepath.Clean(expected.Path))] = true
+
+		path := filepath.Join(dir, filepath.FromSlash(expected.Path))
+		actual, err := NewDownloadEntry(path, dir)
+		switch {
+		case os.IsNotExist(err):
+			mismatches = append(mismatches, ManifestMismatch{expected.Path, "missing"})
+		case err != nil:
+			return nil, err
+		case actual.Size != expected.Size:
+			mismatches = append(mismatches, ManifestMismatch{expected.Path, fmt.Sprintf("size %d, expected %d", actual.Size, expected.Size)})
+		case actual.CRC32 != expected.CRC32:
+			mismatches = append(mismatches, ManifestMismatch{expected.Path, fmt.Sprintf("crc %08x, expected %08x", actual.CRC32, expected.CRC32)})
+		}
+	}
+	if !strict {
+		return mismatches, nil
+	}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		tracked := ext == ".bsp"
+		for _, sidecar := range SidecarExtensions {
+			tracked = tracked || ext == sidecar
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if tracked && !listed[filepath.ToSlash(rel)] {
+			mismatches = append(mismatches, ManifestMismatch{filepath.ToSlash(rel), "not in manifest"})
+		}
+		return nil
+	})
+	return mismatches, err
+}
+
+var verifyManifestStrict bool
+
+var verifyManifestCmd = &cobra.Command{
+	Use:   "verify-manifest <manifest> <dir>",
+	Short: "Check maps and sidecars against a download manifest",
+	Long: `Check every file listed in a manifest written by download-manifest (json or
+list format) against the files below dir, reporting missing files and size
+or CRC32 mismatches. With --strict, maps and sidecars in dir that are not
+listed are reported as well.
+
+Exits with status 3 when anything does not match, for server startup
+integrity checks and mirror validation.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		data, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		entries, err := ParseDownloadManifest(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+
+		mismatches, err := VerifyManifest(entries, args[1], verifyManifestStrict)
+		if err != nil {
+			return err
+		}
+		for _, mismatch := range mismatches {
+			fmt.Println(mismatch)
+		}
+		fmt.Printf("%d files listed, %d problems\n", len(entries), len(mismatches))
+		if len(mismatches) > 0 {
+			return ErrCheckFailed
+		}
+		return nil
+	},
+}
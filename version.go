@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/qw-ctf/bspxmgr/pkg/bspxmgr"
+	"github.com/spf13/cobra"
+)
+
+// Version is set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
+var SupportedVersions = []bsp.BspVersion{bsp.BspVersionStd, bsp.BspVersionHalfLife, bsp.BspVersion2PSB, bsp.BspVersionBSP2}
+
+type Capability struct {
+	Name     string           `json:"name"`
+	Commands []string         `json:"commands"`
+	Versions []bsp.BspVersion `json:"-"`
+}
+
+// Capabilities lists what the tool can do per BSP version. Operations only
+// touching the lump directory work on every version, decoding lump contents
+// depends on the record layouts implemented in lumps.go.
+var Capabilities = []Capability{
+	{"lump directory", []string{"print", "set", "unset", "browse", "grep", "list", "download-manifest", "waypoints", "locs", "meta", "get-lump", "extract-all", "copy-lump", "diff", "hexdump", "checksum", "rename", "reorder", "strip-bspx", "repack", "apply", "merge-bspx", "trim", "split", "build", "entities"}, SupportedVersions},
+	{"texture names", []string{"obfuscate", "equivalent", "textures"}, SupportedVersions},
+	{"decoded geometry", []string{"validate", "layout", "texmap", "optimize", "tjunc", "leak", "serverconfig", "stat"}, SupportedVersions},
+	{"BSPX lump detail", []string{"print <bspx-lump>"}, SupportedVersions},
+	{"byte order", []string{"convert"}, SupportedVersions},
+}
+
+type KnownBspXLump struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Decoded     bool   `json:"decoded"`
+}
+
+var KnownBspXLumps = []KnownBspXLump{
+	{"RGBLIGHTING", "coloured lightmap data (.lit)", true},
+	{"LIGHTINGDIR", "deluxemap light directions (.lux)", true},
+	{"LMSHIFT", "per face lightmap scale", true},
+	{"LMOFFSET", "per face lightmap offsets", true},
+	{"LMSTYLE", "per face lightstyles", true},
+	{"DECOUPLED_LM", "per face lightmap projection", true},
+	{"BRUSHLIST", "brush data for collision", true},
+	{"FACENORMALS", "per vertex normals", false},
+	{"ENVMAP", "environment map probes", false},
+	{"LIGHTGRID_OCTREE", "light grid for models", false},
+	{"VERTEXNORMALS", "per vertex normals", false},
+	{"MVDSV_PHYSICSNORMALS", "mvdsv ramp physics normals", false},
+	{bspxmgr.ObfuscationMarkerLump, "obfuscation seed and mapping hash", false},
+	{WaypointsLump, "embedded frogbot waypoints (.way)", false},
+	{LocationsLump, "embedded team locations (.loc)", false},
+	{MetaLump, "distribution metadata (key=value lines)", true},
+}
+
+func buildInfo() (string, string) {
+	revision := "unknown"
+	goVersion := runtime.Version()
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	return revision, goVersion
+}
+
+var versionJSON bool
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print build info and the format support matrix",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		revision, goVersion := buildInfo()
+
+		if versionJSON {
+			type capability struct {
+				Capability
+				Versions []string `json:"versions"`
+			}
+			out := struct {
+				Version      string          `json:"version"`
+				Revision     string          `json:"revision"`
+				Go           string          `json:"go"`
+				Capabilities []capability    `json:"capabilities"`
+				BspXLumps    []KnownBspXLump `json:"bspxLumps"`
+			}{Version: Version, Revision: revision, Go: goVersion, BspXLumps: KnownBspXLumps}
+			for _, c := range Capabilities {
+				var versions []string
+				for _, v := range c.Versions {
+					versions = append(versions, v.String())
+				}
+				out.Capabilities = append(out.Capabilities, capability{c, versions})
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err := encoder.Encode(out)
+			if err != nil {
+				return err
+			}
+			return nil
+		}
+
+		fmt.Printf("bspxmgr %s (revision %s, %s %s/%s)\n", Version, revision, goVersion, runtime.GOOS, runtime.GOARCH)
+		fmt.Println("")
+
+		fmt.Printf("  %-22s", "")
+		for _, v := range SupportedVersions {
+			fmt.Printf(" %-9s", v)
+		}
+		fmt.Println("")
+		for _, c := range Capabilities {
+			fmt.Printf("  %-22s", c.Name)
+			for _, v := range SupportedVersions {
+				mark := "-"
+				for _, supported := range c.Versions {
+					if supported == v {
+						mark = "yes"
+					}
+				}
+				fmt.Printf(" %-9s", mark)
+			}
+			fmt.Printf(" (%s)\n", strings.Join(c.Commands, ", "))
+		}
+		fmt.Println("")
+
+		fmt.Println("  Known BSPX lumps:")
+		for _, lump := range KnownBspXLumps {
+			decoded := ""
+			if lump.Decoded {
+				decoded = " [decoded]"
+			}
+			fmt.Printf("     %-24s %s%s\n", lump.Name, lump.Description, decoded)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// fileStamp tells versions of a file apart by size and modification time.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// stampFiles returns the stamps of the files, the zero stamp for files that
+// don't exist.
+func stampFiles(paths []string) []fileStamp {
+	stamps := make([]fileStamp, len(paths))
+	for i, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			stamps[i] = fileStamp{info.Size(), info.ModTime()}
+		}
+	}
+	return stamps
+}
+
+func sameStamps(a, b []fileStamp) bool {
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// WatchFiles calls fn once and again whenever one of the files changed,
+// polling every interval. A change is only acted on once the files stayed the
+// same for a whole interval, so tools still writing them aren't raced.
+// Errors from fn are logged and watching goes on until ctx is done.
+func WatchFiles(ctx context.Context, paths []string, interval time.Duration, fn func() error) error {
+	applied := stampFiles(paths)
+	if err := fn(); err != nil {
+		Warnf("%s", err)
+	}
+
+	last := applied
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		stamps := stampFiles(paths)
+		if sameStamps(stamps, last) && !sameStamps(stamps, applied) {
+			applied = stamps
+			if err := fn(); err != nil {
+				Warnf("%s", err)
+			}
+		}
+		last = stamps
+	}
+}
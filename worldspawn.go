@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// worldspawnKeys are the worldspawn keys entities worldspawn has a flag for,
+// in the order they are printed.
+var worldspawnKeys = []string{"message", "wad", "sky", "fog", "worldtype"}
+
+var worldspawnMessage string
+var worldspawnWad string
+var worldspawnSky string
+var worldspawnFog string
+var worldspawnWorldtype string
+
+// worldtypeNames are the names worldtype accepts besides its numbers.
+var worldtypeNames = []string{"medieval", "metal", "base"}
+
+// checkWorldspawnValue returns the value to store for a worldspawn key, a
+// worldtype given by name is stored as its number.
+func checkWorldspawnValue(key string, value string) (string, error) {
+	if err := bsp.CheckKeyValue(key, value); err != nil {
+		return "", err
+	}
+	switch key {
+	case "worldtype":
+		for i, name := range worldtypeNames {
+			if strings.EqualFold(value, name) || value == strconv.Itoa(i) {
+				return strconv.Itoa(i), nil
+			}
+		}
+		return "", fmt.Errorf("invalid worldtype %q, expected 0 (medieval), 1 (metal) or 2 (base)", value)
+	case "fog":
+		fields := strings.Fields(value)
+		if len(fields) != 1 && len(fields) != 4 {
+			return "", fmt.Errorf("invalid fog %q, expected a density optionally followed by red, green and blue", value)
+		}
+		for _, field := range fields {
+			if _, err := strconv.ParseFloat(field, 32); err != nil {
+				return "", fmt.Errorf("invalid fog %q: %s is not a number", value, field)
+			}
+		}
+	}
+	return value, nil
+}
+
+var entitiesWorldspawnCmd = &cobra.Command{
+	Use:   "worldspawn <map>",
+	Short: "Print or change the message, wad, sky, fog and worldtype of a map",
+	Long: `Print the message, wad, sky, fog and worldtype keys of the worldspawn
+entity, or with any of their flags write a copy of the map with them
+changed, e.g.
+
+  bspxmgr entities worldspawn --message 'Night CTF' --wad gfx/base.wad ctf1.bsp
+
+An empty value removes the key. worldtype is 0 or medieval, 1 or metal, 2 or
+base; fog is a density optionally followed by red, green and blue. Values
+can't contain quotes or newlines.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		values := map[string]string{
+			"message":   worldspawnMessage,
+			"wad":       worldspawnWad,
+			"sky":       worldspawnSky,
+			"fog":       worldspawnFog,
+			"worldtype": worldspawnWorldtype,
+		}
+		changed := map[string]string{}
+		for _, key := range worldspawnKeys {
+			if !cmd.Flags().Changed(key) {
+				continue
+			}
+			value := values[key]
+			if value != "" {
+				var err error
+				value, err = checkWorldspawnValue(key, value)
+				if err != nil {
+					return err
+				}
+			}
+			changed[key] = value
+		}
+
+		data, err := readEntitiesLump(args[0])
+		if err != nil {
+			return err
+		}
+		entities, err := bsp.ParseEntities(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		if len(entities) == 0 || entities[0].Classname() != "worldspawn" {
+			return fmt.Errorf("%s: first entity is not worldspawn", args[0])
+		}
+		worldspawn := &entities[0]
+
+		if len(changed) == 0 {
+			for _, key := range worldspawnKeys {
+				if worldspawn.Has(key) {
+					fmt.Printf("%-10s \"%s\"\n", key, worldspawn.Get(key))
+				} else {
+					fmt.Printf("%-10s -\n", key)
+				}
+			}
+			return nil
+		}
+
+		for _, key := range worldspawnKeys {
+			value, ok := changed[key]
+			if !ok {
+				continue
+			}
+			if value == "" {
+				worldspawn.Delete(key)
+			} else {
+				worldspawn.Set(key, value)
+			}
+		}
+		lump, err := bsp.FormatEntities(entities)
+		if err != nil {
+			return err
+		}
+		destName, err := writeEntitiesLump(cmd, args[0], lump)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Changed %d worldspawn keys, wrote %s\n", len(changed), destName)
+		return nil
+	},
+}
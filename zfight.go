@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/qw-ctf/bspxmgr/pkg/bsp"
+	"github.com/spf13/cobra"
+)
+
+// projectWinding drops the major axis of normal so coplanar windings can be
+// compared in 2D.
+func projectWinding(winding []bsp.Vec3, normal bsp.Vec3) [][2]float64 {
+	major := 0
+	for axis := 1; axis < 3; axis++ {
+		if math.Abs(float64(normal[axis])) > math.Abs(float64(normal[major])) {
+			major = axis
+		}
+	}
+	u, v := (major+1)%3, (major+2)%3
+	points := make([][2]float64, len(winding))
+	for i, p := range winding {
+		points[i] = [2]float64{float64(p[u]), float64(p[v])}
+	}
+	return points
+}
+
+// convexOverlap reports whether two convex polygons overlap by more than
+// epsilon, i.e. share an area rather than just an edge or corner.
+func convexOverlap(a, b [][2]float64, epsilon float64) bool {
+	for _, polygon := range [][][2]float64{a, b} {
+		for i := range polygon {
+			p, q := polygon[i], polygon[(i+1)%len(polygon)]
+			axis := [2]float64{q[1] - p[1], p[0] - q[0]}
+			length := math.Hypot(axis[0], axis[1])
+			if length == 0 {
+				continue
+			}
+			axis[0] /= length
+			axis[1] /= length
+
+			minA, maxA := projectRange(a, axis)
+			minB, maxB := projectRange(b, axis)
+			if maxA-epsilon <= minB || maxB-epsilon <= minA {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func projectRange(polygon [][2]float64, axis [2]float64) (float64, float64) {
+	min, max := math.Inf(1), math.Inf(-1)
+	for _, p := range polygon {
+		d := p[0]*axis[0] + p[1]*axis[1]
+		min = math.Min(min, d)
+		max = math.Max(max, d)
+	}
+	return min, max
+}
+
+func windingCenter(winding []bsp.Vec3) bsp.Vec3 {
+	var center bsp.Vec3
+	for _, p := range winding {
+		for axis := 0; axis < 3; axis++ {
+			center[axis] += p[axis] / float32(len(winding))
+		}
+	}
+	return center
+}
+
+type ZFight struct {
+	Faces    [2]int
+	Textures [2]string
+	Center   bsp.Vec3
+}
+
+func (z ZFight) String() string {
+	return fmt.Sprintf("faces %d (%s) and %d (%s) overlap near %s", z.Faces[0], z.Textures[0], z.Faces[1], z.Textures[1], z.Center)
+}
+
+// FindZFighting returns pairs of faces on the same plane and side whose
+// windings overlap but use different texinfo.
+func FindZFighting(data *mapData, textures []bsp.TextureEntry) []ZFight {
+	type key struct {
+		plane uint32
+		side  uint32
+	}
+	groups := map[key][]int{}
+	var order []key
+	for i := range data.faces {
+		k := key{data.faces[i].PlaneId, data.faces[i].Side}
+		if _, found := groups[k]; !found {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], i)
+	}
+
+	var fights []ZFight
+	for _, k := range order {
+		faces := groups[k]
+		if len(faces) < 2 || int(k.plane) >= len(data.planes) {
+			continue
+		}
+		normal := data.planes[k.plane].Normal
+		windings := make([][]bsp.Vec3, len(faces))
+		projected := make([][][2]float64, len(faces))
+		for i, face := range faces {
+			windings[i] = bsp.FaceWinding(&data.faces[face], data.edges, data.surfedges, data.vertexes)
+			projected[i] = projectWinding(windings[i], normal)
+		}
+
+		for i := range faces {
+			for j := i + 1; j < len(faces); j++ {
+				a, b := &data.faces[faces[i]], &data.faces[faces[j]]
+				if a.TexinfoId == b.TexinfoId || len(projected[i]) < 3 || len(projected[j]) < 3 {
+					continue
+				}
+				if !convexOverlap(projected[i], projected[j], 0.1) {
+					continue
+				}
+				centerA, centerB := windingCenter(windings[i]), windingCenter(windings[j])
+				fights = append(fights, ZFight{
+					Faces:    [2]int{faces[i], faces[j]},
+					Textures: [2]string{FaceTextureName(data, textures, a), FaceTextureName(data, textures, b)},
+					Center:   bsp.Vec3{(centerA[0] + centerB[0]) / 2, (centerA[1] + centerB[1]) / 2, (centerA[2] + centerB[2]) / 2},
+				})
+			}
+		}
+	}
+	return fights
+}
+
+var zfightCmd = &cobra.Command{
+	Use:   "zfight <map>",
+	Short: "Find overlapping coplanar faces with different textures",
+	Long: `Report pairs of faces on the same plane and side whose windings overlap but
+use different texinfo, which flicker in game as they are drawn over each
+other.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f, err := OpenMapFile(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		bspFile, err := bsp.ReadBspFile(f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", args[0], err)
+		}
+		data, err := readMapData(&bspFile, f)
+		if err != nil {
+			return err
+		}
+		buffer, err := bsp.ReadLump(&bspFile, f, bsp.LumpTextures)
+		if err != nil {
+			return err
+		}
+		textures, err := bsp.ParseTextureLump(buffer)
+		if err != nil {
+			return err
+		}
+
+		fights := FindZFighting(data, textures)
+		if len(fights) == 0 {
+			fmt.Printf("%s: no overlapping faces found\n", args[0])
+			return nil
+		}
+		for _, fight := range fights {
+			fmt.Println(fight)
+		}
+		return ErrCheckFailed
+	},
+}